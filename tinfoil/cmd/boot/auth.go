@@ -47,6 +47,36 @@ func setupRegistryAuth(ext *shimconfig.ExternalConfig) error {
 		}
 	}
 
+	auths, gcloudKey := resolveRegistryAuths(ext)
+	for host, auth := range auths {
+		cfg.Auths[host] = auth
+		log.Printf("Auth configured: %s", host)
+	}
+	if gcloudKey != "" {
+		// Write key file for containers that mount it directly (e.g., Pollux)
+		if err := os.WriteFile(boot.GCloudKeyPath, []byte(gcloudKey), 0600); err != nil {
+			log.Printf("Warning: failed to write GCloud key file: %v", err)
+		}
+	}
+
+	// Write config
+	if len(cfg.Auths) > 0 {
+		if err := os.MkdirAll(boot.DockerConfigDir, 0700); err != nil {
+			return fmt.Errorf("creating docker config dir: %w", err)
+		}
+		data, _ := json.MarshalIndent(cfg, "", "  ")
+		if err := os.WriteFile(boot.DockerConfigPath, data, 0600); err != nil {
+			return fmt.Errorf("writing docker config: %w", err)
+		}
+	}
+	return nil
+}
+
+// resolveRegistryAuths returns the registry credentials the external-config
+// secrets define, keyed by host, and the GCP service account key if any.
+func resolveRegistryAuths(ext *shimconfig.ExternalConfig) (map[string]DockerAuth, string) {
+	auths := make(map[string]DockerAuth)
+
 	// Generic registry auth: REGISTRY_<HOST>_TOKEN (user optional)
 	// Host format: underscores become dots (GHCR_IO -> ghcr.io)
 	for key, token := range ext.Secrets {
@@ -63,8 +93,7 @@ func setupRegistryAuth(ext *shimconfig.ExternalConfig) error {
 		if user == "" {
 			user = "token"
 		}
-		cfg.Auths[host] = DockerAuth{Auth: base64.StdEncoding.EncodeToString([]byte(user + ":" + token))}
-		log.Printf("Auth configured: %s", host)
+		auths[host] = DockerAuth{Auth: base64.StdEncoding.EncodeToString([]byte(user + ":" + token))}
 	}
 
 	// GCP Artifact Registry auth via service account JSON key
@@ -76,34 +105,16 @@ func setupRegistryAuth(ext *shimconfig.ExternalConfig) error {
 	if gcloudRegistry == "" {
 		gcloudRegistry = ext.GetSecret("gcloud-registry")
 	}
-	if gcloudKey != "" {
-		// Write key file for containers that mount it directly (e.g., Pollux)
-		if err := os.WriteFile(boot.GCloudKeyPath, []byte(gcloudKey), 0600); err != nil {
-			log.Printf("Warning: failed to write GCloud key file: %v", err)
-		}
-	}
 	if gcloudKey != "" && gcloudRegistry != "" {
 		registries := strings.Split(gcloudRegistry, ",")
 		for _, reg := range registries {
 			reg = strings.TrimSpace(reg)
 			if reg != "" && registryPattern.MatchString(reg) {
-				cfg.Auths[reg] = DockerAuth{
+				auths[reg] = DockerAuth{
 					Auth: base64.StdEncoding.EncodeToString([]byte("_json_key_base64:" + base64.StdEncoding.EncodeToString([]byte(gcloudKey)))),
 				}
-				log.Printf("Auth configured: %s (GCP service account)", reg)
 			}
 		}
 	}
-
-	// Write config
-	if len(cfg.Auths) > 0 {
-		if err := os.MkdirAll(boot.DockerConfigDir, 0700); err != nil {
-			return fmt.Errorf("creating docker config dir: %w", err)
-		}
-		data, _ := json.MarshalIndent(cfg, "", "  ")
-		if err := os.WriteFile(boot.DockerConfigPath, data, 0600); err != nil {
-			return fmt.Errorf("writing docker config: %w", err)
-		}
-	}
-	return nil
+	return auths, gcloudKey
 }
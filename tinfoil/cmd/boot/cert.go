@@ -9,8 +9,11 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"slices"
+	"strings"
 	"time"
 
+	"github.com/go-acme/lego/v4/challenge"
 	"github.com/go-acme/lego/v4/lego"
 	verifier "tinfoil/internal/legacy"
 	"golang.org/x/net/publicsuffix"
@@ -19,6 +22,7 @@ import (
 	shimconfig "tinfoil/internal/config"
 	"tinfoil/internal/dcode"
 	"tinfoil/internal/firewall"
+	"tinfoil/internal/runtimeconfig"
 	tlsutil "tinfoil/internal/tls"
 )
 
@@ -27,67 +31,60 @@ const (
 	secretCloudflareZoneToken = "CLOUDFLARE_ZONE_TOKEN"
 	secretCertAuthToken       = "CERT_AUTH_TOKEN"
 
-	maxCertRetries     = 10
+	secretRFC2136Nameserver    = "RFC2136_NAMESERVER"
+	secretRFC2136Zone          = "RFC2136_ZONE"
+	secretRFC2136TSIGKey       = "RFC2136_TSIG_KEY"
+	secretRFC2136TSIGSecret    = "RFC2136_TSIG_SECRET"
+	secretRFC2136TSIGAlgorithm = "RFC2136_TSIG_ALGORITHM"
+	secretDNSWebhookURL        = "ACME_DNS_WEBHOOK_URL"
+	secretDNSWebhookUsername   = "ACME_DNS_WEBHOOK_USERNAME"
+	secretDNSWebhookPassword   = "ACME_DNS_WEBHOOK_PASSWORD"
+	secretACMEEABKeyID         = "ACME_EAB_KEY_ID"
+	secretACMEEABHMAC          = "ACME_EAB_HMAC_KEY"
+
+	certRetryAttempts  = 10
 	maxCertificateSANs = 100
 
 	certProxyRetryInterval = 5 * time.Minute
 	acmeRetryInterval      = 18 * time.Minute
 )
 
-func obtainCertificate(id *NodeIdentity, att *verifier.Document, shimCfg *shimconfig.Config, externalConfig *shimconfig.ExternalConfig) error {
-	encodedSANDomain := "tinfoil.sh"
-	if shimCfg.TLSOwnSANDomain {
-		encodedSANDomain = id.Domain
-		if d, err := publicsuffix.EffectiveTLDPlusOne(id.Domain); err == nil {
-			encodedSANDomain = d
-		}
-	}
-
-	var encodedDomains []string
-	hpkeKeyDomains, err := dcode.Encode(id.HPKEKeyBytes, "hpke."+encodedSANDomain)
-	if err != nil {
-		return fmt.Errorf("encoding HPKE key: %w", err)
-	}
-	encodedDomains = append(encodedDomains, hpkeKeyDomains...)
-
-	reservedSANs := 1
+func obtainCertificate(id *NodeIdentity, att *verifier.Document, shimCfg *shimconfig.Config, externalConfig *shimconfig.ExternalConfig, acme *runtimeconfig.ACME) error {
+	reservedSANs := len(id.Domains())
 	if shimCfg.TLSWildcard {
-		reservedSANs = 2
+		reservedSANs++
 	}
 
-	if shimCfg.PublishAttestation {
-		attHashDomains, err := dcode.Encode([]byte(att.Hash()), "hatt."+encodedSANDomain)
+	// The attestation-binding SANs are issued below every domain's
+	// registrable zone, so clients can find them whichever name they use.
+	var encodedDomains []string
+	for _, base := range attestationSANDomains(id, shimCfg) {
+		hpkeKeyDomains, err := dcode.Encode(id.HPKEKeyBytes, "hpke."+base)
 		if err != nil {
-			return fmt.Errorf("encoding attestation hash: %w", err)
+			return fmt.Errorf("encoding HPKE key: %w", err)
 		}
-		if len(attHashDomains)+len(encodedDomains)+reservedSANs <= maxCertificateSANs {
+		encodedDomains = append(encodedDomains, hpkeKeyDomains...)
+
+		if shimCfg.PublishAttestation {
+			attHashDomains, err := dcode.Encode([]byte(att.Hash()), "hatt."+base)
+			if err != nil {
+				return fmt.Errorf("encoding attestation hash: %w", err)
+			}
 			encodedDomains = append(encodedDomains, attHashDomains...)
-		} else {
-			return fmt.Errorf("attestation hash too large for certificate SANs")
 		}
 	}
-
-	var domains []string
-	switch {
-	case shimCfg.TLSMode == "cert-proxy" && shimCfg.TLSChallengeMode == "http":
-		domains = append([]string{id.Domain}, encodedDomains...)
-	case shimCfg.TLSMode != "cert-proxy" && (shimCfg.TLSChallengeMode == "tls" || shimCfg.TLSChallengeMode == "http"):
-		domains = []string{id.Domain}
-	default:
-		if shimCfg.TLSWildcard {
-			domains = append([]string{id.Domain, "*." + id.Domain}, encodedDomains...)
-		} else {
-			domains = append([]string{id.Domain}, encodedDomains...)
-		}
+	if len(encodedDomains)+reservedSANs > maxCertificateSANs {
+		return fmt.Errorf("attestation SANs for %d domain(s) do not fit in the certificate", len(id.Domains()))
 	}
+	domains := certificateDomains(id, shimCfg, encodedDomains)
+	aliasModes := aliasChallengeModes(id, shimCfg)
 
 	log.Printf("Obtaining TLS certificate for %d domains (mode=%s)", len(domains), shimCfg.TLSMode)
 
-	cfDNS := externalConfig.GetSecret(secretCloudflareDNSToken)
-	cfZone := externalConfig.GetSecret(secretCloudflareZoneToken)
 	certAuthToken := externalConfig.GetSecret(secretCertAuthToken)
 
 	var cert *tls.Certificate
+	var err error
 	if id.Domain == "localhost" || shimCfg.TLSMode == "self-signed" {
 		cert, err = tlsutil.Certificate(id.TLSKey, domains...)
 		if err != nil {
@@ -97,10 +94,20 @@ func obtainCertificate(id *NodeIdentity, att *verifier.Document, shimCfg *shimco
 		if shimCfg.ControlPlane == "" {
 			return fmt.Errorf("cert-proxy requires control-plane URL")
 		}
+		// The control plane solves DNS-01 for every name not served over
+		// HTTP-01 here.
 		var httpChallengeDomains []string
 		var listenPort int
 		if shimCfg.TLSChallengeMode == "http" {
 			httpChallengeDomains = []string{id.Domain}
+		}
+		for name, mode := range aliasModes {
+			if mode == tlsutil.ChallengeModeHTTP01 {
+				httpChallengeDomains = append(httpChallengeDomains, name)
+			}
+		}
+		slices.Sort(httpChallengeDomains)
+		if len(httpChallengeDomains) > 0 {
 			listenPort = boot.HTTPChallengePort
 		}
 		requestCertificate := func() (*tls.Certificate, error) {
@@ -111,9 +118,9 @@ func obtainCertificate(id *NodeIdentity, att *verifier.Document, shimCfg *shimco
 			if err != nil {
 				return nil, fmt.Errorf("creating cert proxy manager: %w", err)
 			}
-			return retryCertificate(mgr.Certificate, certProxyRetryInterval)
+			return mgr.Certificate()
 		}
-		if shimCfg.TLSChallengeMode == "http" {
+		if len(httpChallengeDomains) > 0 {
 			cert, err = withHTTP01Firewall(requestCertificate)
 		} else {
 			cert, err = requestCertificate()
@@ -122,20 +129,16 @@ func obtainCertificate(id *NodeIdentity, att *verifier.Document, shimCfg *shimco
 			return fmt.Errorf("obtaining cert via cert-proxy: %w", err)
 		}
 	} else {
-		dir := lego.LEDirectoryProduction
-		if shimCfg.TLSEnv == "staging" {
-			dir = lego.LEDirectoryStaging
-		}
-		mgr, err := tlsutil.NewCertManager(
-			domains, shimCfg.Email, boot.CacheDir, dir,
-			tlsutil.ChallengeMode(shimCfg.TLSChallengeMode),
-			boot.ShimListenPort, id.TLSKey,
-			cfDNS, cfZone,
-		)
+		acmeCfg, err := acmeConfig(id, shimCfg, externalConfig, acme)
+		if err != nil {
+			return err
+		}
+		acmeCfg.DomainModes = aliasModes
+		mgr, err := tlsutil.NewCertManager(domains, boot.CacheDir, id.TLSKey, acmeCfg)
 		if err != nil {
 			return fmt.Errorf("creating ACME cert manager: %w", err)
 		}
-		cert, err = retryCertificate(mgr.Certificate, acmeRetryInterval)
+		cert, err = mgr.Certificate()
 		if err != nil {
 			return fmt.Errorf("obtaining cert via ACME: %w", err)
 		}
@@ -144,16 +147,184 @@ func obtainCertificate(id *NodeIdentity, att *verifier.Document, shimCfg *shimco
 	return writeTLSArtifacts(cert, id.TLSKey)
 }
 
-func retryCertificate(fn func() (*tls.Certificate, error), interval time.Duration) (*tls.Certificate, error) {
-	for attempt := range maxCertRetries {
-		cert, err := fn()
-		if err == nil {
-			return cert, nil
+// certificateDomains lists the names to certify. The wildcard and the
+// attestation-binding SANs can only be proven over DNS-01, so ACME leaves
+// them out when the node's domain is proven over HTTP-01 or TLS-ALPN-01.
+// The cert proxy solves DNS-01 for the attestation SANs itself, but not for
+// a wildcard when the node serves HTTP-01.
+func certificateDomains(id *NodeIdentity, shimCfg *shimconfig.Config, encodedDomains []string) []string {
+	certProxy := shimCfg.TLSMode == "cert-proxy"
+	httpRelay := certProxy && shimCfg.TLSChallengeMode == "http"
+	directChallenge := !certProxy && (shimCfg.TLSChallengeMode == "tls" || shimCfg.TLSChallengeMode == "http")
+
+	domains := []string{id.Domain}
+	if shimCfg.TLSWildcard && !httpRelay && !directChallenge {
+		domains = append(domains, "*."+id.Domain)
+	}
+	for _, alias := range id.Aliases {
+		domains = append(domains, alias.Name)
+	}
+	if !directChallenge {
+		domains = append(domains, encodedDomains...)
+	}
+	return domains
+}
+
+// attestationSANDomains returns the zones the attestation-binding SANs are
+// issued below: tinfoil.sh, or with tls-own-san-domain the registrable
+// domain of each of the node's domains.
+func attestationSANDomains(id *NodeIdentity, shimCfg *shimconfig.Config) []string {
+	if !shimCfg.TLSOwnSANDomain {
+		return []string{"tinfoil.sh"}
+	}
+	var bases []string
+	for _, domain := range id.Domains() {
+		domain = strings.TrimPrefix(domain, "*.")
+		base := domain
+		if d, err := publicsuffix.EffectiveTLDPlusOne(domain); err == nil {
+			base = d
+		}
+		if !slices.Contains(bases, base) {
+			bases = append(bases, base)
+		}
+	}
+	return bases
+}
+
+// aliasChallengeModes maps each alias to the ACME challenge proving it.
+func aliasChallengeModes(id *NodeIdentity, shimCfg *shimconfig.Config) map[string]tlsutil.ChallengeMode {
+	modes := make(map[string]tlsutil.ChallengeMode, len(id.Aliases))
+	for _, alias := range id.Aliases {
+		modes[alias.Name] = tlsutil.ChallengeMode(alias.Challenge(shimCfg.TLSChallengeMode))
+	}
+	return modes
+}
+
+// acmeDirectory returns the ACME directory URL: the one in the boot
+// extensions, or Let's Encrypt.
+func acmeDirectory(shimCfg *shimconfig.Config, acme *runtimeconfig.ACME) string {
+	switch {
+	case acme != nil:
+		return acme.DirectoryURL
+	case shimCfg.TLSEnv == "staging":
+		return lego.LEDirectoryStaging
+	default:
+		return lego.LEDirectoryProduction
+	}
+}
+
+// acmeConfig assembles the ACME directory, account binding and challenge
+// solvers from the verified config and the external config secrets.
+func acmeConfig(id *NodeIdentity, shimCfg *shimconfig.Config, externalConfig *shimconfig.ExternalConfig, acme *runtimeconfig.ACME) (tlsutil.ACMEConfig, error) {
+	cfg := tlsutil.ACMEConfig{
+		DirectoryURL:  acmeDirectory(shimCfg, acme),
+		Email:         shimCfg.Email,
+		ChallengeMode: tlsutil.ChallengeMode(shimCfg.TLSChallengeMode),
+		Port:          boot.ShimListenPort,
+	}
+	if acme != nil {
+		roots, err := acme.RootCAs()
+		if err != nil {
+			return cfg, fmt.Errorf("acme: %w", err)
+		}
+		cfg.RootCAs = roots
+	}
+	var err error
+	if cfg.EABKeyID, cfg.EABHMAC, err = acmeAccountBinding(externalConfig); err != nil {
+		return cfg, err
+	}
+	if usesDNSChallenge(id, shimCfg) {
+		if cfg.DNSProvider, err = acmeDNSProvider(externalConfig); err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, nil
+}
+
+// acmeAccountBinding returns the external account binding key ID and
+// HMAC key, which are set together or not at all.
+func acmeAccountBinding(externalConfig *shimconfig.ExternalConfig) (string, string, error) {
+	keyID := externalConfig.GetSecret(secretACMEEABKeyID)
+	hmac := externalConfig.GetSecret(secretACMEEABHMAC)
+	if (keyID == "") != (hmac == "") {
+		return "", "", fmt.Errorf("%s and %s must be set together", secretACMEEABKeyID, secretACMEEABHMAC)
+	}
+	return keyID, hmac, nil
+}
+
+// usesDNSChallenge reports whether any certified name is proven over
+// DNS-01.
+func usesDNSChallenge(id *NodeIdentity, shimCfg *shimconfig.Config) bool {
+	if tlsutil.ChallengeMode(shimCfg.TLSChallengeMode) == tlsutil.ChallengeModeDNS01 {
+		return true
+	}
+	for _, mode := range aliasChallengeModes(id, shimCfg) {
+		if mode == tlsutil.ChallengeModeDNS01 {
+			return true
 		}
-		log.Printf("Certificate request failed (attempt %d/%d), retrying in %s: %v", attempt+1, maxCertRetries, interval, err)
-		time.Sleep(interval)
 	}
-	return nil, fmt.Errorf("certificate request failed after %d attempts", maxCertRetries)
+	return false
+}
+
+// acmeDNSProviderName names the DNS-01 provider the external config
+// secrets configure: rfc2136, webhook, or cloudflare.
+func acmeDNSProviderName(externalConfig *shimconfig.ExternalConfig) (string, error) {
+	var names []string
+	if externalConfig.GetSecret(secretRFC2136Nameserver) != "" {
+		names = append(names, "rfc2136")
+	}
+	if externalConfig.GetSecret(secretDNSWebhookURL) != "" {
+		names = append(names, "webhook")
+	}
+	if externalConfig.GetSecret(secretCloudflareDNSToken) != "" {
+		names = append(names, "cloudflare")
+	}
+	switch len(names) {
+	case 0:
+		return "", fmt.Errorf("dns challenge requires %s, %s, or %s", secretRFC2136Nameserver, secretDNSWebhookURL, secretCloudflareDNSToken)
+	case 1:
+		return names[0], nil
+	default:
+		return "", fmt.Errorf("more than one DNS provider is configured: %s", strings.Join(names, ", "))
+	}
+}
+
+func acmeDNSProvider(externalConfig *shimconfig.ExternalConfig) (challenge.Provider, error) {
+	name, err := acmeDNSProviderName(externalConfig)
+	if err != nil {
+		return nil, err
+	}
+	switch name {
+	case "rfc2136":
+		return tlsutil.NewRFC2136DNSProvider(tlsutil.RFC2136Config{
+			Nameserver:    externalConfig.GetSecret(secretRFC2136Nameserver),
+			Zone:          externalConfig.GetSecret(secretRFC2136Zone),
+			TSIGKey:       externalConfig.GetSecret(secretRFC2136TSIGKey),
+			TSIGSecret:    externalConfig.GetSecret(secretRFC2136TSIGSecret),
+			TSIGAlgorithm: externalConfig.GetSecret(secretRFC2136TSIGAlgorithm),
+		})
+	case "webhook":
+		return tlsutil.NewWebhookDNSProvider(
+			externalConfig.GetSecret(secretDNSWebhookURL),
+			externalConfig.GetSecret(secretDNSWebhookUsername),
+			externalConfig.GetSecret(secretDNSWebhookPassword),
+		)
+	default:
+		return tlsutil.NewCloudflareDNSProvider(
+			externalConfig.GetSecret(secretCloudflareDNSToken),
+			externalConfig.GetSecret(secretCloudflareZoneToken),
+		)
+	}
+}
+
+// certificateRetry spaces certificate requests to stay inside the issuer's
+// rate limits; ACME allows fewer failed orders than the cert proxy.
+func certificateRetry(shimCfg *shimconfig.Config) retryPolicy {
+	interval := acmeRetryInterval
+	if shimCfg.TLSMode == "cert-proxy" {
+		interval = certProxyRetryInterval
+	}
+	return retryPolicy{attempts: certRetryAttempts, backoff: interval}
 }
 
 func writeTLSArtifacts(cert *tls.Certificate, key *ecdsa.PrivateKey) error {
@@ -8,6 +8,12 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+
+	"github.com/go-acme/lego/v4/lego"
+
+	shimconfig "tinfoil/internal/config"
+	"tinfoil/internal/runtimeconfig"
+	tlsutil "tinfoil/internal/tls"
 )
 
 func TestWithHTTP01FirewallUsesFixedMeasuredChain(t *testing.T) {
@@ -132,3 +138,96 @@ func TestMeasuredFirewallDefinesHTTP01Chain(t *testing.T) {
 		}
 	}
 }
+
+func TestCertificateDomainsIncludeAliases(t *testing.T) {
+	id := &NodeIdentity{Domain: "node.example.com", Aliases: []shimconfig.DomainAlias{
+		{Name: "api.customer.com", ChallengeMode: "http"},
+		{Name: "*.customer.org", ChallengeMode: "dns"},
+	}}
+	encoded := []string{"x.hpke.tinfoil.sh"}
+	for _, test := range []struct {
+		name string
+		cfg  shimconfig.Config
+		want []string
+	}{
+		{"dns", shimconfig.Config{TLSChallengeMode: "dns", TLSWildcard: true}, []string{"node.example.com", "*.node.example.com", "api.customer.com", "*.customer.org", "x.hpke.tinfoil.sh"}},
+		{"acme http", shimconfig.Config{TLSChallengeMode: "http", TLSWildcard: true}, []string{"node.example.com", "api.customer.com", "*.customer.org"}},
+		{"cert-proxy http", shimconfig.Config{TLSMode: "cert-proxy", TLSChallengeMode: "http", TLSWildcard: true}, []string{"node.example.com", "api.customer.com", "*.customer.org", "x.hpke.tinfoil.sh"}},
+	} {
+		if got := certificateDomains(id, &test.cfg, encoded); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: certificateDomains = %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	modes := aliasChallengeModes(&NodeIdentity{Aliases: []shimconfig.DomainAlias{{Name: "a.example.com"}, {Name: "b.example.com", ChallengeMode: "http"}}}, &shimconfig.Config{TLSChallengeMode: "tls"})
+	if modes["a.example.com"] != tlsutil.ChallengeModeTLSALPN01 || modes["b.example.com"] != tlsutil.ChallengeModeHTTP01 {
+		t.Fatalf("aliasChallengeModes = %v", modes)
+	}
+}
+
+func TestAttestationSANDomainsPerRegistrableDomain(t *testing.T) {
+	id := &NodeIdentity{Domain: "node.example.com", Aliases: []shimconfig.DomainAlias{
+		{Name: "api.example.com"},
+		{Name: "*.chat.customer.co.uk", ChallengeMode: "dns"},
+	}}
+	if got := attestationSANDomains(id, &shimconfig.Config{}); !reflect.DeepEqual(got, []string{"tinfoil.sh"}) {
+		t.Fatalf("shared SAN domain = %v", got)
+	}
+	got := attestationSANDomains(id, &shimconfig.Config{TLSOwnSANDomain: true})
+	if want := []string{"example.com", "customer.co.uk"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("own SAN domains = %v, want %v", got, want)
+	}
+}
+
+func TestACMEConfigSelectsDNSProvider(t *testing.T) {
+	dnsAlias := &NodeIdentity{Domain: "node.example.com", Aliases: []shimconfig.DomainAlias{{Name: "*.customer.org", ChallengeMode: "dns"}}}
+	httpOnly := &NodeIdentity{Domain: "node.example.com"}
+	httpCfg := &shimconfig.Config{TLSChallengeMode: "http"}
+	for _, test := range []struct {
+		name    string
+		id      *NodeIdentity
+		secrets map[string]string
+		want    string
+	}{
+		{"rfc2136", dnsAlias, map[string]string{secretRFC2136Nameserver: "ns1.example.com", secretRFC2136TSIGKey: "acme", secretRFC2136TSIGSecret: "c2VjcmV0"}, "rfc2136"},
+		{"webhook", dnsAlias, map[string]string{secretDNSWebhookURL: "https://dns.example.com/hook"}, "webhook"},
+		{"cloudflare", dnsAlias, map[string]string{secretCloudflareDNSToken: "token"}, "cloudflare"},
+		{"no dns challenge", httpOnly, map[string]string{secretDNSWebhookURL: "https://dns.example.com/hook", secretCloudflareDNSToken: "token"}, ""},
+		{"none configured", dnsAlias, map[string]string{}, "dns challenge requires"},
+		{"two configured", dnsAlias, map[string]string{secretDNSWebhookURL: "https://dns.example.com/hook", secretCloudflareDNSToken: "token"}, "more than one DNS provider is configured: webhook, cloudflare"},
+		{"half an account binding", httpOnly, map[string]string{secretACMEEABKeyID: "kid"}, "must be set together"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			external := &shimconfig.ExternalConfig{Secrets: test.secrets}
+			cfg, err := acmeConfig(test.id, httpCfg, external, nil)
+			name, nameErr := acmeDNSProviderName(external)
+			switch {
+			case test.want == "":
+				if err != nil || cfg.DNSProvider != nil {
+					t.Fatalf("acmeConfig = %v, %v; want no DNS provider", cfg.DNSProvider, err)
+				}
+			case err != nil:
+				if !strings.Contains(err.Error(), test.want) {
+					t.Fatalf("acmeConfig error = %v, want %q", err, test.want)
+				}
+			case cfg.DNSProvider == nil || nameErr != nil || name != test.want:
+				t.Fatalf("acmeConfig provider = %T, acmeDNSProviderName = %q, %v; want %s", cfg.DNSProvider, name, nameErr, test.want)
+			}
+		})
+	}
+}
+
+func TestACMEConfigUsesCustomDirectory(t *testing.T) {
+	external := &shimconfig.ExternalConfig{Secrets: map[string]string{secretACMEEABKeyID: "kid", secretACMEEABHMAC: "aG1hYw"}}
+	acme := &runtimeconfig.ACME{DirectoryURL: "https://acme.corp.example/directory"}
+	cfg, err := acmeConfig(&NodeIdentity{Domain: "node.example.com"}, &shimconfig.Config{TLSChallengeMode: "tls", TLSEnv: "staging"}, external, acme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DirectoryURL != acme.DirectoryURL || cfg.EABKeyID != "kid" || cfg.EABHMAC != "aG1hYw" || cfg.RootCAs != nil {
+		t.Fatalf("acmeConfig = %+v", cfg)
+	}
+	if got := acmeDirectory(&shimconfig.Config{TLSEnv: "staging"}, nil); got != lego.LEDirectoryStaging {
+		t.Fatalf("acmeDirectory = %s, want staging", got)
+	}
+}
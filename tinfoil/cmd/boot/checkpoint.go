@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"tinfoil/internal/boot"
+)
+
+// checkpointStore persists the outcome and outputs of boot stages in the
+// private ramdisk so a re-run of tinfoil-boot resumes instead of starting
+// over. Checkpoints are bound to the verified config hash. A nil store
+// checkpoints nothing.
+type checkpointStore struct {
+	dir        string
+	configHash string
+}
+
+// stageCheckpoint is one stage's checkpoint file. Status stays pending
+// from the moment the stage starts until it succeeds, so a resumed boot can
+// tell an interrupted stage from one that never ran.
+type stageCheckpoint struct {
+	ConfigHash string          `json:"config_hash"`
+	Status     string          `json:"status"`
+	Duration   time.Duration   `json:"duration_ns,omitempty"`
+	Detail     string          `json:"detail,omitempty"`
+	Output     json.RawMessage `json:"output,omitempty"`
+}
+
+func (c *checkpointStore) path(name string) string {
+	return filepath.Join(c.dir, name+".json")
+}
+
+func (c *checkpointStore) begin(name string) error {
+	if c == nil {
+		return nil
+	}
+	return c.write(name, stageCheckpoint{ConfigHash: c.configHash, Status: boot.StatusPending})
+}
+
+func (c *checkpointStore) finish(stage bootStage, result stageResult, duration time.Duration) error {
+	if c == nil {
+		return nil
+	}
+	checkpoint := stageCheckpoint{
+		ConfigHash: c.configHash,
+		Status:     result.status,
+		Duration:   duration,
+		Detail:     result.detail,
+	}
+	if stage.output != nil {
+		output, err := json.Marshal(stage.output)
+		if err != nil {
+			return fmt.Errorf("encoding output: %w", err)
+		}
+		checkpoint.Output = output
+	}
+	return c.write(stage.name, checkpoint)
+}
+
+func (c *checkpointStore) write(name string, checkpoint stageCheckpoint) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.path(name), data, 0o600)
+}
+
+// load returns the checkpoint of the named stage, reporting false when the
+// stage never started under this config.
+func (c *checkpointStore) load(name string) (stageCheckpoint, bool, error) {
+	if c == nil {
+		return stageCheckpoint{}, false, nil
+	}
+	data, err := os.ReadFile(c.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return stageCheckpoint{}, false, nil
+	}
+	if err != nil {
+		return stageCheckpoint{}, false, err
+	}
+	var checkpoint stageCheckpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return stageCheckpoint{}, false, fmt.Errorf("parsing checkpoint: %w", err)
+	}
+	if checkpoint.ConfigHash != c.configHash {
+		return stageCheckpoint{}, false, fmt.Errorf("checkpoint belongs to config %q", checkpoint.ConfigHash)
+	}
+	return checkpoint, true, nil
+}
+
+// resumeStages restores the stages a previous run of tinfoil-boot
+// completed and returns the ones still to run along with every stage that
+// counts as done. A stage is only restored when all of its dependencies
+// were, so everything downstream of a stage that runs again sees fresh
+// inputs. A completed rerun stage runs again without holding its
+// dependents back. A stage that was interrupted and is not idempotent
+// cannot be resumed.
+func resumeStages(checkpoints *checkpointStore, recorder stageRecorder, stages []bootStage, completed ...string) ([]bootStage, []string, error) {
+	done := make(map[string]bool, len(completed)+len(stages))
+	for _, name := range completed {
+		done[name] = true
+	}
+	var remaining []bootStage
+	for _, stage := range stages {
+		checkpoint, found, err := checkpoints.load(stage.name)
+		if err != nil {
+			log.Printf("Warning: ignoring checkpoint for boot stage %s: %v", stage.name, err)
+		}
+		if found && checkpoint.Status == boot.StatusPending && !stage.idempotent {
+			return nil, nil, fmt.Errorf("boot stage %q was interrupted and is not safe to run again", stage.name)
+		}
+		if found && checkpoint.Status != boot.StatusPending && allDone(done, stage.deps) && stage.rerun {
+			log.Printf("Running boot stage %s again; later stages may still resume", stage.name)
+			done[stage.name] = true
+			remaining = append(remaining, stage)
+			continue
+		}
+		if !found || checkpoint.Status == boot.StatusPending || !allDone(done, stage.deps) || !restoreOutput(stage, checkpoint) {
+			remaining = append(remaining, stage)
+			continue
+		}
+		log.Printf("Resuming past boot stage %s from its checkpoint", stage.name)
+		recorder.Record(stage.name, checkpoint.Status, checkpoint.Duration, checkpoint.Detail)
+		done[stage.name] = true
+		completed = append(completed, stage.name)
+	}
+	return remaining, completed, nil
+}
+
+func allDone(done map[string]bool, names []string) bool {
+	for _, name := range names {
+		if !done[name] {
+			return false
+		}
+	}
+	return true
+}
+
+func restoreOutput(stage bootStage, checkpoint stageCheckpoint) bool {
+	if stage.output == nil {
+		return true
+	}
+	if len(checkpoint.Output) == 0 {
+		return false
+	}
+	if err := json.Unmarshal(checkpoint.Output, stage.output); err != nil {
+		log.Printf("Warning: ignoring checkpoint for boot stage %s: %v", stage.name, err)
+		return false
+	}
+	return true
+}
+
+// writeFileAtomic writes data to path with mode perm via a temp file and
+// rename so a crash never leaves a partial file behind. A missing parent
+// directory is created private.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, path)
+}
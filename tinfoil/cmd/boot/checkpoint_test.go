@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"tinfoil/internal/boot"
+	shimconfig "tinfoil/internal/config"
+)
+
+// checkpointedGraph is a -> b -> c, where a and b pass a value along.
+type checkpointedGraph struct {
+	runs   []string
+	fromA  string
+	fromB  string
+	failB  bool
+	stages []bootStage
+}
+
+func newCheckpointedGraph() *checkpointedGraph {
+	g := &checkpointedGraph{}
+	g.stages = []bootStage{
+		{name: "a", idempotent: true, output: &g.fromA, run: func(context.Context) (stageResult, error) {
+			g.runs = append(g.runs, "a")
+			g.fromA = "from-a"
+			return stageOK("a done"), nil
+		}},
+		{name: "b", deps: []string{"a"}, idempotent: true, output: &g.fromB, run: func(context.Context) (stageResult, error) {
+			g.runs = append(g.runs, "b")
+			if g.failB {
+				return stageResult{}, context.DeadlineExceeded
+			}
+			g.fromB = g.fromA + "+b"
+			return stageOK(""), nil
+		}},
+		{name: "c", deps: []string{"b"}, run: func(context.Context) (stageResult, error) {
+			g.runs = append(g.runs, "c")
+			return stageSkipped("nothing to mount"), nil
+		}},
+	}
+	return g
+}
+
+func (g *checkpointedGraph) boot(t *testing.T, checkpoints *checkpointStore) error {
+	t.Helper()
+	recorder := newFakeRecorder()
+	stages, completed, err := resumeStages(checkpoints, recorder, g.stages)
+	if err != nil {
+		return err
+	}
+	return runStages(context.Background(), recorder, checkpoints, stages, completed...)
+}
+
+func TestResumeSkipsCheckpointedStages(t *testing.T) {
+	checkpoints := &checkpointStore{dir: t.TempDir(), configHash: "abc"}
+	first := newCheckpointedGraph()
+	first.failB = true
+	if err := first.boot(t, checkpoints); err == nil {
+		t.Fatal("first boot succeeded")
+	}
+
+	second := newCheckpointedGraph()
+	if err := second.boot(t, checkpoints); err != nil {
+		t.Fatalf("resumed boot: %v", err)
+	}
+	if !slices.Equal(second.runs, []string{"b", "c"}) {
+		t.Fatalf("resumed boot ran %v, want b and c", second.runs)
+	}
+	if second.fromB != "from-a+b" {
+		t.Fatalf("b saw %q, want the restored output of a", second.fromB)
+	}
+
+	third := newCheckpointedGraph()
+	if err := third.boot(t, checkpoints); err != nil {
+		t.Fatalf("completed boot: %v", err)
+	}
+	if len(third.runs) != 0 || third.fromB != "from-a+b" {
+		t.Fatalf("completed boot ran %v with b output %q", third.runs, third.fromB)
+	}
+
+	other := newCheckpointedGraph()
+	if err := other.boot(t, &checkpointStore{dir: checkpoints.dir, configHash: "def"}); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(other.runs, []string{"a", "b", "c"}) {
+		t.Fatalf("boot under another config ran %v", other.runs)
+	}
+}
+
+func TestResumeReRunsDependentsOfMissingCheckpoints(t *testing.T) {
+	checkpoints := &checkpointStore{dir: t.TempDir(), configHash: "abc"}
+	if err := newCheckpointedGraph().boot(t, checkpoints); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(checkpoints.path("a")); err != nil {
+		t.Fatal(err)
+	}
+	g := newCheckpointedGraph()
+	if err := g.boot(t, checkpoints); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(g.runs, []string{"a", "b", "c"}) {
+		t.Fatalf("ran %v, want every stage downstream of a", g.runs)
+	}
+}
+
+func TestResumeRunsRerunStagesAgain(t *testing.T) {
+	checkpoints := &checkpointStore{dir: t.TempDir(), configHash: "abc"}
+	first := newCheckpointedGraph()
+	first.stages[1].output = nil
+	first.stages[1].rerun = true
+	if err := first.boot(t, checkpoints); err != nil {
+		t.Fatal(err)
+	}
+
+	g := newCheckpointedGraph()
+	g.stages[1].output = nil
+	g.stages[1].rerun = true
+	if err := g.boot(t, checkpoints); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(g.runs, []string{"b"}) {
+		t.Fatalf("resumed boot ran %v, want only the rerun stage", g.runs)
+	}
+	if g.fromB != "from-a+b" {
+		t.Fatalf("rerun stage saw %q, want the restored output of a", g.fromB)
+	}
+}
+
+func TestRerunStagesCannotCheckpointOutput(t *testing.T) {
+	g := newCheckpointedGraph()
+	g.stages[1].rerun = true
+	if err := validateStageGraph(g.stages, nil); err == nil {
+		t.Fatal("rerun stage with output accepted")
+	}
+}
+
+func TestResumeRefusesInterruptedNonIdempotentStage(t *testing.T) {
+	checkpoints := &checkpointStore{dir: t.TempDir(), configHash: "abc"}
+	if err := newCheckpointedGraph().boot(t, checkpoints); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"b", "c"} {
+		if err := checkpoints.begin(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := newCheckpointedGraph().boot(t, checkpoints); err == nil {
+		t.Fatal("resumed past an interrupted non-idempotent stage")
+	}
+}
+
+func TestNodeIdentityCheckpointRoundTrip(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &NodeIdentity{TLSKey: key, HPKEKeyBytes: []byte{1, 2}, Domain: "node.example.com",
+		Aliases: []shimconfig.DomainAlias{{Name: "api.example.com", ChallengeMode: "http"}}}
+	data, err := json.Marshal(&want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got *NodeIdentity
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !got.TLSKey.Equal(key) || got.Domain != want.Domain || !slices.Equal(got.HPKEKeyBytes, want.HPKEKeyBytes) ||
+		!slices.Equal(got.Aliases, want.Aliases) {
+		t.Fatalf("round trip = %+v", got)
+	}
+}
+
+func TestCheckpointFilesArePrivate(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "checkpoints")
+	checkpoints := &checkpointStore{dir: dir, configHash: "abc"}
+	if err := checkpoints.finish(bootStage{name: boot.StageIdentity, output: map[string]string{"K": "v"}}, stageOK(""), 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{dir, checkpoints.path(boot.StageIdentity)} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm()&0o077 != 0 {
+			t.Fatalf("%s mode = %s", path, info.Mode())
+		}
+	}
+}
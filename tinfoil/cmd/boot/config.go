@@ -81,6 +81,31 @@ func ipv4Broadcast(prefix netip.Prefix) netip.Addr {
 
 // loadAndVerifyConfig reads the config from disk and verifies its hash
 func loadAndVerifyConfig(expectedHash string, debug bool) (*Config, error) {
+	configData, err := readVerifiedConfig(expectedHash)
+	if err != nil {
+		return nil, err
+	}
+
+	// Write verified config to ramdisk
+	if err := os.WriteFile(boot.ConfigPath, configData, 0644); err != nil {
+		return nil, fmt.Errorf("writing config to ramdisk: %w", err)
+	}
+
+	config, err := decodeVerifiedConfig(configData, debug)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := loadExternalConfig(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// readVerifiedConfig reads the config disk and checks it against the hash
+// from the kernel command line.
+func readVerifiedConfig(expectedHash string) ([]byte, error) {
 	configDiskPath, err := device.ConfigDisk()
 	if err != nil {
 		return nil, fmt.Errorf("finding config disk: %w", err)
@@ -104,12 +129,10 @@ func loadAndVerifyConfig(expectedHash string, debug bool) (*Config, error) {
 		return nil, fmt.Errorf("config hash mismatch: expected %s, got %s", expectedHash, actualHash)
 	}
 	log.Printf("Config hash verified: %s", actualHash)
+	return configData, nil
+}
 
-	// Write verified config to ramdisk
-	if err := os.WriteFile(boot.ConfigPath, configData, 0644); err != nil {
-		return nil, fmt.Errorf("writing config to ramdisk: %w", err)
-	}
-
+func decodeVerifiedConfig(configData []byte, debug bool) (*Config, error) {
 	config, err := runtimeconfig.Decode(configData, debug)
 	if err != nil {
 		return nil, err
@@ -121,25 +144,22 @@ func loadAndVerifyConfig(expectedHash string, debug bool) (*Config, error) {
 	if err := validateModelCount(len(config.Models)); err != nil {
 		return nil, err
 	}
-
-	if err := loadExternalConfig(); err != nil {
-		return nil, err
-	}
-
 	return config, nil
 }
 
-func loadExternalConfig() error {
-	externalDiskPath, err := device.ExternalConfigDisk()
+// loadVerifiedExtensions decodes the extensions section of the config that
+// loadAndVerifyConfig verified and copied to the ramdisk.
+func loadVerifiedExtensions() (*runtimeconfig.Extensions, error) {
+	data, err := os.ReadFile(boot.ConfigPath)
 	if err != nil {
-		return fmt.Errorf("finding external config disk: %w", err)
+		return nil, fmt.Errorf("reading verified config: %w", err)
 	}
+	return runtimeconfig.DecodeExtensions(data)
+}
 
-	data, err := readDiskPayload(externalDiskPath, maxDiskPayloadBytes)
+func loadExternalConfig() error {
+	data, _, err := readExternalConfigDisk()
 	if err != nil {
-		return fmt.Errorf("reading external config disk: %w", err)
-	}
-	if _, err := decodeExternalConfig(data); err != nil {
 		return err
 	}
 
@@ -150,6 +170,24 @@ func loadExternalConfig() error {
 	return nil
 }
 
+// readExternalConfigDisk reads and validates the external config disk.
+func readExternalConfigDisk() ([]byte, *shimconfig.ExternalConfig, error) {
+	externalDiskPath, err := device.ExternalConfigDisk()
+	if err != nil {
+		return nil, nil, fmt.Errorf("finding external config disk: %w", err)
+	}
+
+	data, err := readDiskPayload(externalDiskPath, maxDiskPayloadBytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading external config disk: %w", err)
+	}
+	config, err := decodeExternalConfig(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, config, nil
+}
+
 // externalConfigOrEmpty loads the external config, or returns an empty one
 // when the disk is absent (bare dev launches without tinfoild metadata).
 func externalConfigOrEmpty() *shimconfig.ExternalConfig {
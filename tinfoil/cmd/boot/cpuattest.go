@@ -15,6 +15,7 @@ import (
 	"tinfoil/internal/attestation"
 	"tinfoil/internal/boot"
 	shimconfig "tinfoil/internal/config"
+	"tinfoil/internal/runtimeconfig"
 	tlsutil "tinfoil/internal/tls"
 )
 
@@ -22,15 +23,21 @@ type CPUAttestation struct {
 	RawReport []byte
 	Platform  string
 	V2Doc     *verifier.Document
+	// TCB is unset for dummy reports and reports whose TCB could not be
+	// read without a policy requiring it.
+	TCB *attestation.TCB
 }
 
-func fetchCPUAttestation(id *NodeIdentity, shimCfg *shimconfig.Config) (*CPUAttestation, error) {
+func fetchCPUAttestation(id *NodeIdentity, shimCfg *shimconfig.Config, minimumTCB *runtimeconfig.MinimumTCB) (*CPUAttestation, error) {
 	aBody := id.attestationBody()
 	log.Printf("Attestation body: tls_fp=%x hpke=%x", aBody.TLSKeyFP, aBody.HPKEKey)
 	userData := aBody.Marshal()
 
 	if id.Domain == "localhost" || shimCfg.DummyAttestation {
 		log.Println("Using dummy attestation report")
+		if minimumTCB != nil {
+			log.Println("Warning: minimum TCB policy is not enforced with dummy attestation")
+		}
 		doc := attestation.DummyReport(userData)
 		if err := writeAttestationDoc(doc); err != nil {
 			return nil, err
@@ -47,6 +54,10 @@ func fetchCPUAttestation(id *NodeIdentity, shimCfg *shimconfig.Config) (*CPUAtte
 	if err != nil {
 		return nil, fmt.Errorf("fetching attestation report: %w", err)
 	}
+	tcb, err := hostTCB(rawReport, platform, minimumTCB)
+	if err != nil {
+		return nil, err
+	}
 
 	v2Doc, err := attestation.V2Document(rawReport, platform)
 	if err != nil {
@@ -61,9 +72,28 @@ func fetchCPUAttestation(id *NodeIdentity, shimCfg *shimconfig.Config) (*CPUAtte
 		RawReport: rawReport,
 		Platform:  platform,
 		V2Doc:     v2Doc,
+		TCB:       tcb,
 	}, nil
 }
 
+// hostTCB reads the TCB from the report and enforces the minimum. A TCB
+// that cannot be read only fails boot when a minimum is configured.
+func hostTCB(rawReport []byte, platform string, minimum *runtimeconfig.MinimumTCB) (*attestation.TCB, error) {
+	tcb, err := attestation.ParseTCB(rawReport, platform)
+	if err != nil {
+		if minimum != nil {
+			return nil, fmt.Errorf("reading host TCB: %w", err)
+		}
+		log.Printf("Warning: failed to read host TCB: %v", err)
+		return nil, nil
+	}
+	log.Printf("Host TCB: %s", tcb)
+	if err := checkMinimumTCB(minimum, tcb); err != nil {
+		return nil, err
+	}
+	return &tcb, nil
+}
+
 func (id *NodeIdentity) attestationBody() attestation.BodyV2 {
 	var hpkeKey [32]byte
 	copy(hpkeKey[:], id.HPKEKeyBytes)
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"tinfoil/internal/boot"
+	shimconfig "tinfoil/internal/config"
+	"tinfoil/internal/device"
+	"tinfoil/internal/nvidia"
+)
+
+const (
+	diagnosticsLogLines    = 200
+	diagnosticsKernelLines = 200
+	diagnosticsLineLimit   = 1024
+	// Secrets shorter than this are not redacted; replacing every
+	// occurrence of a few characters would destroy the bundle.
+	minRedactedSecretLength = 4
+)
+
+var kmsgPath = "/dev/kmsg"
+
+// diagnosticsBundle is what tinfoil-boot publishes when it fails, so a
+// failed production boot can be diagnosed without a debug image. Every
+// section that could not be collected is named in Unavailable.
+type diagnosticsBundle struct {
+	GeneratedAt time.Time `json:"generated_at"`
+	Error       string    `json:"error"`
+	// Boot is the stage graph with timings as recorded in boot-state.json.
+	Boot *boot.State `json:"boot,omitempty"`
+	// Log is the tail of tinfoil-boot's own log.
+	Log []string `json:"log,omitempty"`
+	// ServiceLog holds the kernel log lines tinfoil services wrote, such
+	// as pid1's supervision messages; KernelLog holds everything else.
+	ServiceLog      []string            `json:"service_log,omitempty"`
+	KernelLog       []string            `json:"kernel_log,omitempty"`
+	Devices         []device.Controller `json:"devices"`
+	Network         []networkInterface  `json:"network,omitempty"`
+	NVIDIABootstrap string              `json:"nvidia_bootstrap,omitempty"`
+	Unavailable     map[string]string   `json:"unavailable,omitempty"`
+}
+
+// writeDiagnostics collects a bundle for the boot failure and writes it to
+// path, readable only by root. Secrets in externalConfig, the config boot
+// held in memory, are redacted.
+func writeDiagnostics(path string, failure error, tail *logTail, externalConfig *shimconfig.ExternalConfig) error {
+	bundle := collectDiagnostics(failure, tail)
+	newRedactor(diagnosticsSecrets(externalConfig)).bundle(&bundle)
+	data, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0o600)
+}
+
+func collectDiagnostics(failure error, tail *logTail) diagnosticsBundle {
+	bundle := diagnosticsBundle{
+		GeneratedAt: time.Now().UTC(),
+		Error:       failure.Error(),
+		Log:         tail.lines(),
+		Devices:     device.Inventory(),
+		Unavailable: make(map[string]string),
+	}
+	var err error
+	if bundle.Boot, err = boot.Load(); err != nil {
+		bundle.Unavailable["boot"] = err.Error()
+	}
+	if bundle.ServiceLog, bundle.KernelLog, err = readKernelLog(kmsgPath, diagnosticsKernelLines); err != nil {
+		bundle.Unavailable["kernel_log"] = err.Error()
+	}
+	if bundle.Network, err = networkState(); err != nil {
+		bundle.Unavailable["network"] = err.Error()
+	}
+	if bundle.NVIDIABootstrap, err = nvidiaBootstrapState(boot.NVIDIABootstrapStatusPath); err != nil {
+		bundle.Unavailable["nvidia_bootstrap"] = err.Error()
+	}
+	return bundle
+}
+
+// logTail keeps the last lines written to it. tinfoil-boot tees its log
+// into one so the diagnostics bundle can carry it.
+type logTail struct {
+	mu    sync.Mutex
+	limit int
+	ring  []string
+	next  int
+}
+
+func newLogTail(limit int) *logTail {
+	return &logTail{limit: limit}
+}
+
+func (t *logTail) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for line := range strings.Lines(string(p)) {
+		line = truncateLine(strings.TrimRight(line, "\n"))
+		if len(t.ring) < t.limit {
+			t.ring = append(t.ring, line)
+			continue
+		}
+		t.ring[t.next] = line
+		t.next = (t.next + 1) % t.limit
+	}
+	return len(p), nil
+}
+
+func (t *logTail) lines() []string {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append(slices.Clone(t.ring[t.next:]), t.ring[:t.next]...)
+}
+
+// readKernelLog returns the last limit records of the kernel log written by
+// tinfoil services and the last limit of the rest. The log is read without
+// blocking, so records logged while it is read may be missed.
+func readKernelLog(path string, limit int) ([]string, []string, error) {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	defer unix.Close(fd)
+
+	services, kernel := newLogTail(limit), newLogTail(limit)
+	var pending []byte
+	// Each read of /dev/kmsg returns exactly one record.
+	buf := make([]byte, 8192)
+	for {
+		n, err := unix.Read(fd, buf)
+		if errors.Is(err, unix.EPIPE) {
+			// Records were overwritten while reading; continue from the
+			// oldest one left.
+			continue
+		}
+		if errors.Is(err, unix.EAGAIN) || (err == nil && n == 0) {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+		pending = append(pending, buf[:n]...)
+		for {
+			end := bytes.IndexByte(pending, '\n')
+			if end < 0 {
+				break
+			}
+			if line, service, ok := parseKernelRecord(string(pending[:end])); ok {
+				if service {
+					services.Write([]byte(line + "\n"))
+				} else {
+					kernel.Write([]byte(line + "\n"))
+				}
+			}
+			pending = pending[end+1:]
+		}
+	}
+	return services.lines(), kernel.lines(), nil
+}
+
+// parseKernelRecord formats a "priority,sequence,microseconds,flags;message"
+// kmsg record like dmesg does and reports whether a tinfoil service wrote
+// it. Continuation lines carrying device metadata are dropped.
+func parseKernelRecord(record string) (string, bool, bool) {
+	header, message, ok := strings.Cut(record, ";")
+	if !ok || strings.HasPrefix(record, " ") {
+		return "", false, false
+	}
+	fields := strings.Split(header, ",")
+	if len(fields) < 3 {
+		return "", false, false
+	}
+	micros, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return "", false, false
+	}
+	name, _, _ := strings.Cut(message, ": ")
+	service := strings.HasPrefix(name, "tinfoil-") && !strings.ContainsAny(name, " \t")
+	return fmt.Sprintf("[%5d.%06d] %s", micros/1e6, micros%1e6, message), service, true
+}
+
+func nvidiaBootstrapState(path string) (string, error) {
+	status, err := nvidia.ReadBootstrapStatus(path)
+	if err != nil {
+		return "", err
+	}
+	switch status.State {
+	case nvidia.BootstrapStateNoGPU:
+		return "no-gpu", nil
+	case nvidia.BootstrapStateReady:
+		return fmt.Sprintf("ready: %d GPU(s)", status.GPUCount), nil
+	case nvidia.BootstrapStateFailed:
+		return "failed", nil
+	default:
+		return "", fmt.Errorf("unknown NVIDIA bootstrap state %d", status.State)
+	}
+}
+
+// diagnosticsSecrets returns every secret value tinfoil-boot may have seen:
+// those in externalConfig, including the ones vault released, or in the
+// external config on disk when boot failed before loading it.
+func diagnosticsSecrets(externalConfig *shimconfig.ExternalConfig) []string {
+	if externalConfig == nil {
+		var err error
+		if externalConfig, err = getExternalConfig(); err != nil {
+			return nil
+		}
+	}
+	var secrets []string
+	for _, value := range externalConfig.Secrets {
+		secrets = append(secrets, value)
+	}
+	return secrets
+}
+
+var bearerTokenPattern = regexp.MustCompile(`(?i)(bearer\s+)[^\s"']+`)
+
+// redactor removes secret values and bearer tokens from diagnostics text.
+type redactor struct {
+	secrets *strings.Replacer
+}
+
+func newRedactor(secrets []string) redactor {
+	var values []string
+	for _, secret := range secrets {
+		values = append(values, secret)
+		// Multi-line secrets such as service account keys are logged a
+		// line at a time.
+		if strings.Contains(secret, "\n") {
+			for line := range strings.Lines(secret) {
+				values = append(values, strings.TrimSpace(line))
+			}
+		}
+	}
+	values = slices.DeleteFunc(values, func(value string) bool { return len(value) < minRedactedSecretLength })
+	// The replacer prefers earlier arguments, so a secret that contains
+	// another is replaced whole.
+	slices.SortFunc(values, func(a, b string) int { return cmp.Compare(len(b), len(a)) })
+	values = slices.Compact(values)
+	pairs := make([]string, 0, 2*len(values))
+	for _, value := range values {
+		pairs = append(pairs, value, "[REDACTED]")
+	}
+	return redactor{secrets: strings.NewReplacer(pairs...)}
+}
+
+func (r redactor) text(value string) string {
+	value = r.secrets.Replace(value)
+	return bearerTokenPattern.ReplaceAllString(value, "${1}[REDACTED]")
+}
+
+func (r redactor) lines(lines []string) {
+	for i, line := range lines {
+		lines[i] = r.text(line)
+	}
+}
+
+func (r redactor) stages(stages []boot.Stage) {
+	for i := range stages {
+		stages[i].Detail = r.text(stages[i].Detail)
+		r.stages(stages[i].Stages)
+	}
+}
+
+func (r redactor) bundle(bundle *diagnosticsBundle) {
+	bundle.Error = r.text(bundle.Error)
+	r.lines(bundle.Log)
+	r.lines(bundle.ServiceLog)
+	r.lines(bundle.KernelLog)
+	if bundle.Boot != nil {
+		r.stages(bundle.Boot.Stages)
+	}
+	for section, reason := range bundle.Unavailable {
+		bundle.Unavailable[section] = r.text(reason)
+	}
+}
+
+func truncateLine(line string) string {
+	if len(line) <= diagnosticsLineLimit {
+		return line
+	}
+	return strings.ToValidUTF8(line[:diagnosticsLineLimit], "") + "…"
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	shimconfig "tinfoil/internal/config"
+	tlsutil "tinfoil/internal/tls"
+)
+
+const dnsLookupTimeout = 5 * time.Second
+
+// The certificate stage waits this long for DNS before it gives up an
+// attempt, checking at each interval. Tests shorten both.
+var (
+	dnsPreflightTimeout  = 10 * time.Minute
+	dnsPreflightInterval = 15 * time.Second
+)
+
+// lookupIPv4 resolves host to its IPv4 addresses through the fixed
+// resolver. Tests replace it.
+var lookupIPv4 = lookupIPv4FixedResolver
+
+func lookupIPv4FixedResolver(ctx context.Context, host string) ([]netip.Addr, error) {
+	var lastErr error
+	for _, server := range []string{primaryNameserver, secondaryNameserver} {
+		resolver := &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, net.JoinHostPort(server, "53"))
+			},
+		}
+		lookupCtx, cancel := context.WithTimeout(ctx, dnsLookupTimeout)
+		addrs, err := resolver.LookupNetIP(lookupCtx, "ip4", host+".")
+		cancel()
+		if err == nil {
+			return addrs, nil
+		}
+		// A name that does not exist is an answer; only ask the second
+		// server when the first did not give one.
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, err
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// directChallengeDomains returns the names the CA validates by connecting
+// to the node, over HTTP-01 or TLS-ALPN-01. DNS-01 names, including those
+// the cert proxy solves, do not need to point at the node yet.
+func directChallengeDomains(id *NodeIdentity, shimCfg *shimconfig.Config) []string {
+	if id.Domain == "localhost" || shimCfg.TLSMode == "self-signed" {
+		return nil
+	}
+	direct := func(mode tlsutil.ChallengeMode) bool {
+		if shimCfg.TLSMode == "cert-proxy" {
+			return mode == tlsutil.ChallengeModeHTTP01
+		}
+		return mode == tlsutil.ChallengeModeHTTP01 || mode == tlsutil.ChallengeModeTLSALPN01
+	}
+	var domains []string
+	if direct(tlsutil.ChallengeMode(shimCfg.TLSChallengeMode)) {
+		domains = append(domains, id.Domain)
+	}
+	modes := aliasChallengeModes(id, shimCfg)
+	for _, alias := range id.Aliases {
+		if direct(modes[alias.Name]) {
+			domains = append(domains, alias.Name)
+		}
+	}
+	return domains
+}
+
+// checkChallengeDNS waits until every direct-challenge domain resolves to
+// the node's external address and nothing else, so no certificate order is
+// placed that the CA would fail to validate. progress reports each failed
+// check.
+func checkChallengeDNS(ctx context.Context, id *NodeIdentity, shimCfg *shimconfig.Config, network *shimconfig.ExternalNetworkConfig, progress func(string)) error {
+	domains := directChallengeDomains(id, shimCfg)
+	if len(domains) == 0 {
+		return nil
+	}
+	prefix, err := netip.ParsePrefix(network.Address)
+	if err != nil {
+		return fmt.Errorf("parsing external address: %w", err)
+	}
+	return waitForDNS(ctx, domains, prefix.Addr(), progress)
+}
+
+func waitForDNS(ctx context.Context, domains []string, address netip.Addr, progress func(string)) error {
+	ctx, cancel := context.WithTimeout(ctx, dnsPreflightTimeout)
+	defer cancel()
+	ticker := time.NewTicker(dnsPreflightInterval)
+	defer ticker.Stop()
+	for {
+		var problems []string
+		for _, domain := range domains {
+			if err := checkDomainDNS(ctx, domain, address); err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+		if len(problems) == 0 {
+			log.Printf("DNS preflight passed: %s resolve to %s", strings.Join(domains, ", "), address)
+			return nil
+		}
+		detail := "waiting for DNS: " + strings.Join(problems, "; ")
+		log.Print(detail)
+		progress(detail)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("DNS preflight did not pass within %s: %s", dnsPreflightTimeout, strings.Join(problems, "; "))
+		case <-ticker.C:
+		}
+	}
+}
+
+func checkDomainDNS(ctx context.Context, domain string, address netip.Addr) error {
+	addrs, err := lookupIPv4(ctx, domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return fmt.Errorf("%s does not resolve", domain)
+		}
+		return fmt.Errorf("resolving %s: %v", domain, err)
+	}
+	if len(addrs) == 0 {
+		return fmt.Errorf("%s has no IPv4 address", domain)
+	}
+	var resolved []string
+	mismatch := false
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		resolved = append(resolved, addr.String())
+		mismatch = mismatch || addr != address
+	}
+	if mismatch {
+		return fmt.Errorf("%s resolves to %s, want %s", domain, strings.Join(resolved, ", "), address)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	shimconfig "tinfoil/internal/config"
+)
+
+func TestDirectChallengeDomains(t *testing.T) {
+	id := &NodeIdentity{Domain: "node.example.com", Aliases: []shimconfig.DomainAlias{
+		{Name: "api.customer.com", ChallengeMode: "http"},
+		{Name: "chat.customer.com", ChallengeMode: "tls"},
+		{Name: "*.customer.org", ChallengeMode: "dns"},
+	}}
+	for _, test := range []struct {
+		name string
+		cfg  shimconfig.Config
+		want []string
+	}{
+		{"acme dns", shimconfig.Config{TLSChallengeMode: "dns"}, []string{"api.customer.com", "chat.customer.com"}},
+		{"acme tls", shimconfig.Config{TLSChallengeMode: "tls"}, []string{"node.example.com", "api.customer.com", "chat.customer.com"}},
+		{"cert-proxy http", shimconfig.Config{TLSMode: "cert-proxy", TLSChallengeMode: "http"}, []string{"node.example.com", "api.customer.com"}},
+		{"self-signed", shimconfig.Config{TLSMode: "self-signed", TLSChallengeMode: "http"}, nil},
+	} {
+		if got := directChallengeDomains(id, &test.cfg); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: directChallengeDomains = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestWaitForDNSRetriesUntilDomainsPointAtNode(t *testing.T) {
+	oldLookup, oldInterval := lookupIPv4, dnsPreflightInterval
+	t.Cleanup(func() { lookupIPv4, dnsPreflightInterval = oldLookup, oldInterval })
+	dnsPreflightInterval = time.Millisecond
+
+	node := netip.MustParseAddr("203.0.113.7")
+	answers := []map[string][]netip.Addr{
+		{"api.customer.com": {netip.MustParseAddr("198.51.100.1")}},
+		{"api.customer.com": {node, netip.MustParseAddr("198.51.100.1")}},
+		{"api.customer.com": {node}, "node.example.com": {node}},
+	}
+	lookups := 0
+	lookupIPv4 = func(_ context.Context, host string) ([]netip.Addr, error) {
+		answer := answers[min(lookups/2, len(answers)-1)]
+		lookups++
+		if addrs, ok := answer[host]; ok {
+			return addrs, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	var details []string
+	if err := waitForDNS(context.Background(), []string{"node.example.com", "api.customer.com"}, node, func(detail string) {
+		details = append(details, detail)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"waiting for DNS: node.example.com does not resolve; api.customer.com resolves to 198.51.100.1, want 203.0.113.7",
+		"waiting for DNS: node.example.com does not resolve; api.customer.com resolves to 203.0.113.7, 198.51.100.1, want 203.0.113.7",
+	}
+	if !reflect.DeepEqual(details, want) {
+		t.Fatalf("progress = %q, want %q", details, want)
+	}
+}
+
+func TestWaitForDNSGivesUp(t *testing.T) {
+	oldLookup, oldInterval, oldTimeout := lookupIPv4, dnsPreflightInterval, dnsPreflightTimeout
+	t.Cleanup(func() { lookupIPv4, dnsPreflightInterval, dnsPreflightTimeout = oldLookup, oldInterval, oldTimeout })
+	dnsPreflightInterval, dnsPreflightTimeout = time.Millisecond, 20*time.Millisecond
+	lookupIPv4 = func(context.Context, string) ([]netip.Addr, error) {
+		return []netip.Addr{netip.MustParseAddr("198.51.100.1")}, nil
+	}
+
+	err := waitForDNS(context.Background(), []string{"node.example.com"}, netip.MustParseAddr("203.0.113.7"), func(string) {})
+	if err == nil || !strings.Contains(err.Error(), "node.example.com resolves to 198.51.100.1") {
+		t.Fatalf("err = %v", err)
+	}
+}
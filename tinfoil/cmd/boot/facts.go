@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"tinfoil/internal/boot"
+	"tinfoil/internal/device"
+	"tinfoil/internal/nvidia"
+)
+
+var (
+	procCPUInfo = "/proc/cpuinfo"
+	procMeminfo = "/proc/meminfo"
+)
+
+// nodeFacts describes the hardware and software of this node for fleet
+// management. Sections that could not be collected are named in
+// Unavailable.
+type nodeFacts struct {
+	GeneratedAt time.Time           `json:"generated_at"`
+	CPU         cpuFacts            `json:"cpu"`
+	MemoryBytes uint64              `json:"memory_bytes"`
+	TEE         teeFacts            `json:"tee"`
+	NVIDIA      *nvidia.Inventory   `json:"nvidia,omitempty"`
+	NICs        []networkInterface  `json:"nics"`
+	Disks       []device.Controller `json:"disks"`
+	Binaries    []boot.Binary       `json:"binaries"`
+	Unavailable map[string]string   `json:"unavailable,omitempty"`
+}
+
+type cpuFacts struct {
+	Model string `json:"model"`
+	Count int    `json:"count"`
+}
+
+type teeFacts struct {
+	Platform      string `json:"platform"`
+	ReportVersion uint32 `json:"report_version,omitempty"`
+	TCB           string `json:"tcb,omitempty"`
+}
+
+// publishNodeFacts collects the node facts and writes them world-readable
+// to path.
+func publishNodeFacts(path string, cpu *CPUAttestation) error {
+	data, err := json.MarshalIndent(collectNodeFacts(cpu), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0o644)
+}
+
+func collectNodeFacts(cpu *CPUAttestation) nodeFacts {
+	facts := nodeFacts{
+		GeneratedAt: time.Now().UTC(),
+		Disks:       device.Inventory(),
+		Unavailable: make(map[string]string),
+	}
+	var err error
+	if facts.CPU, err = readCPUFacts(procCPUInfo); err != nil {
+		facts.Unavailable["cpu"] = err.Error()
+	}
+	if facts.MemoryBytes, err = readMemTotal(procMeminfo); err != nil {
+		facts.Unavailable["memory"] = err.Error()
+	}
+	if cpu != nil {
+		facts.TEE.Platform = cpu.Platform
+		if cpu.TCB != nil {
+			facts.TEE.ReportVersion = cpu.TCB.ReportVersion
+			facts.TEE.TCB = cpu.TCB.String()
+		}
+	}
+	if inventory, err := nvidia.ReadInventory(); err != nil {
+		facts.Unavailable["nvidia"] = err.Error()
+	} else {
+		facts.NVIDIA = &inventory
+	}
+	if interfaces, err := networkState(); err != nil {
+		facts.Unavailable["nics"] = err.Error()
+	} else {
+		for _, iface := range interfaces {
+			if !strings.Contains(iface.Flags, net.FlagLoopback.String()) {
+				facts.NICs = append(facts.NICs, iface)
+			}
+		}
+	}
+	binaries := boot.Binaries()
+	for _, name := range boot.SortedBinaryNames(binaries) {
+		binary, err := boot.ReadBinary(name, binaries[name])
+		if err != nil {
+			facts.Unavailable["binaries."+name] = err.Error()
+		}
+		facts.Binaries = append(facts.Binaries, binary)
+	}
+	return facts
+}
+
+// readCPUFacts returns the model of the first logical CPU and the number of
+// logical CPUs in /proc/cpuinfo.
+func readCPUFacts(path string) (cpuFacts, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return cpuFacts{}, err
+	}
+	defer file.Close()
+	var facts cpuFacts
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "processor":
+			facts.Count++
+		case "model name":
+			if facts.Model == "" {
+				facts.Model = strings.TrimSpace(value)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return cpuFacts{}, err
+	}
+	if facts.Count == 0 {
+		return cpuFacts{}, fmt.Errorf("no processors in %s", path)
+	}
+	return facts, nil
+}
+
+// readMemTotal returns MemTotal from /proc/meminfo in bytes.
+func readMemTotal(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	for line := range strings.Lines(string(data)) {
+		value, ok := strings.CutPrefix(line, "MemTotal:")
+		if !ok {
+			continue
+		}
+		kib, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimSpace(value), " kB"), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("parsing MemTotal %q: %w", strings.TrimSpace(value), err)
+		}
+		return kib * 1024, nil
+	}
+	return 0, fmt.Errorf("no MemTotal in %s", path)
+}
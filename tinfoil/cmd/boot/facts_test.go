@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadCPUAndMemoryFacts(t *testing.T) {
+	dir := t.TempDir()
+	cpuinfo := filepath.Join(dir, "cpuinfo")
+	meminfo := filepath.Join(dir, "meminfo")
+	model := "model name\t: AMD EPYC 9654 96-Core Processor\n"
+	if err := os.WriteFile(cpuinfo, []byte("processor\t: 0\n"+model+"\nprocessor\t: 1\n"+model), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(meminfo, []byte("MemTotal:       263856128 kB\nMemFree:        1024 kB\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cpu, err := readCPUFacts(cpuinfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cpu != (cpuFacts{Model: "AMD EPYC 9654 96-Core Processor", Count: 2}) {
+		t.Fatalf("readCPUFacts = %+v", cpu)
+	}
+	memory, err := readMemTotal(meminfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if memory != 263856128*1024 {
+		t.Fatalf("readMemTotal = %d", memory)
+	}
+
+	if err := os.WriteFile(meminfo, []byte("MemFree: 1 kB\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readMemTotal(meminfo); err == nil {
+		t.Fatal("readMemTotal accepted meminfo without MemTotal")
+	}
+}
+
+func TestNetworkDeviceFindsPCIFunctionBelowVirtio(t *testing.T) {
+	root := t.TempDir()
+	virtio := filepath.Join(root, "devices/pci0000:00/0000:00:02.0/virtio1")
+	if err := os.MkdirAll(virtio, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../../../bus/virtio/drivers/virtio_net", filepath.Join(virtio, "driver")); err != nil {
+		t.Fatal(err)
+	}
+	classNet := filepath.Join(root, "class/net")
+	for _, dir := range []string{filepath.Join(classNet, "eth0"), filepath.Join(classNet, "lo")} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(virtio, filepath.Join(classNet, "eth0", "device")); err != nil {
+		t.Fatal(err)
+	}
+
+	if pci, driver := networkDevice(classNet, "eth0"); pci != "0000:00:02.0" || driver != "virtio_net" {
+		t.Fatalf("networkDevice(eth0) = %q, %q", pci, driver)
+	}
+	if pci, driver := networkDevice(classNet, "lo"); pci != "" || driver != "" {
+		t.Fatalf("networkDevice(lo) = %q, %q", pci, driver)
+	}
+}
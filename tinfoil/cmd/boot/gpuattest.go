@@ -101,9 +101,9 @@ func detectGPUArch() (string, error) {
 	return arch, err
 }
 
-func runNvattest(device string) error {
+func runNvattest(ctx context.Context, device string) error {
 	log.Printf("Running nvattest attest for %s", device)
-	ctx, cancel := context.WithTimeout(context.Background(), nvattestTimeout)
+	ctx, cancel := context.WithTimeout(ctx, nvattestTimeout)
 	defer cancel()
 
 	cmd := exec.CommandContext(ctx, "nvattest", "attest", "--device", device, "--verifier", "local")
@@ -127,8 +127,8 @@ type nvattestEvidenceOutput struct {
 	ResultMessage string `json:"result_message"`
 }
 
-func collectEvidence(device string) ([][]byte, json.RawMessage, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), nvattestTimeout)
+func collectEvidence(ctx context.Context, device string) ([][]byte, json.RawMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, nvattestTimeout)
 	defer cancel()
 
 	cmd := exec.CommandContext(ctx, "nvattest", "collect-evidence", "--device", device, "--format", "json")
@@ -188,7 +188,7 @@ type GPURawEvidence struct {
 
 // verifyGPUAttestation runs attestation for the expected number of GPUs (1 or 8).
 // Returns the raw evidence for inclusion in the attestation envelope.
-func verifyGPUAttestation(expectedGPUs int) (*GPURawEvidence, error) {
+func verifyGPUAttestation(ctx context.Context, expectedGPUs int) (*GPURawEvidence, error) {
 	ok := false
 	defer func() {
 		if !ok {
@@ -198,14 +198,14 @@ func verifyGPUAttestation(expectedGPUs int) (*GPURawEvidence, error) {
 		}
 	}()
 
-	if err := runNvattest("gpu"); err != nil {
+	if err := runNvattest(ctx, "gpu"); err != nil {
 		return nil, err
 	}
 
 	evidence := &GPURawEvidence{}
 
 	log.Println("Collecting GPU evidence")
-	gpuReports, gpuRaw, err := collectEvidence("gpu")
+	gpuReports, gpuRaw, err := collectEvidence(ctx, "gpu")
 	if err != nil {
 		return nil, fmt.Errorf("collecting GPU evidence: %w", err)
 	}
@@ -223,11 +223,11 @@ func verifyGPUAttestation(expectedGPUs int) (*GPURawEvidence, error) {
 		return nil, fmt.Errorf("GPU shape validation: %w", err)
 	}
 	if needSwitch {
-		if err := runNvattest("nvswitch"); err != nil {
+		if err := runNvattest(ctx, "nvswitch"); err != nil {
 			return nil, err
 		}
 		log.Println("Collecting NVSwitch evidence for topology validation")
-		switchReports, switchRaw, err := collectEvidence("nvswitch")
+		switchReports, switchRaw, err := collectEvidence(ctx, "nvswitch")
 		if err != nil {
 			return nil, fmt.Errorf("collecting switch evidence: %w", err)
 		}
@@ -4,9 +4,12 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/tinfoilsh/encrypted-http-body-protocol/identity"
 
@@ -19,20 +22,68 @@ type NodeIdentity struct {
 	TLSKey       *ecdsa.PrivateKey
 	HPKEKeyBytes []byte
 	Domain       string
+	// Aliases are the hostnames served next to Domain.
+	Aliases []shimconfig.DomainAlias
 }
 
-const x25519PublicKeySize = 32
+// Domains returns Domain followed by the alias names.
+func (id *NodeIdentity) Domains() []string {
+	domains := []string{id.Domain}
+	for _, alias := range id.Aliases {
+		domains = append(domains, alias.Name)
+	}
+	return domains
+}
 
-func generateIdentity(shimCfg *shimconfig.Config, externalConfig *shimconfig.ExternalConfig) (*NodeIdentity, error) {
-	domain := ""
-	if externalConfig.Env != nil {
-		domain = externalConfig.Env["DOMAIN"]
+// nodeIdentityJSON is the checkpointed form of NodeIdentity. A resumed boot
+// must keep the TLS key its attestation and certificate are bound to.
+type nodeIdentityJSON struct {
+	TLSKey  []byte                   `json:"tls_key"`
+	HPKEKey []byte                   `json:"hpke_key"`
+	Domain  string                   `json:"domain"`
+	Aliases []shimconfig.DomainAlias `json:"aliases,omitempty"`
+}
+
+func (id *NodeIdentity) MarshalJSON() ([]byte, error) {
+	key, err := x509.MarshalECPrivateKey(id.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("encoding TLS key: %w", err)
 	}
-	if domain == "" && !shimCfg.DummyAttestation {
-		return nil, fmt.Errorf("DOMAIN not set in external config (set dummy-attestation: true for local dev)")
+	return json.Marshal(nodeIdentityJSON{
+		TLSKey:  key,
+		HPKEKey: id.HPKEKeyBytes,
+		Domain:  id.Domain,
+		Aliases: id.Aliases,
+	})
+}
+
+func (id *NodeIdentity) UnmarshalJSON(data []byte) error {
+	var encoded nodeIdentityJSON
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
 	}
-	if domain == "" {
-		domain = "localhost"
+	key, err := x509.ParseECPrivateKey(encoded.TLSKey)
+	if err != nil {
+		return fmt.Errorf("parsing TLS key: %w", err)
+	}
+	*id = NodeIdentity{
+		TLSKey:       key,
+		HPKEKeyBytes: encoded.HPKEKey,
+		Domain:       encoded.Domain,
+		Aliases:      encoded.Aliases,
+	}
+	return nil
+}
+
+const x25519PublicKeySize = 32
+
+func generateIdentity(shimCfg *shimconfig.Config, externalConfig *shimconfig.ExternalConfig, extensions *shimconfig.Extensions) (*NodeIdentity, error) {
+	domain, err := identityDomain(shimCfg, externalConfig)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDomainAliases(domain, extensions.DomainAliases); err != nil {
+		return nil, err
 	}
 
 	serverIdentity, err := loadOrCreateHPKEIdentity(boot.HPKEKeyPath)
@@ -50,12 +101,41 @@ func generateIdentity(shimCfg *shimconfig.Config, externalConfig *shimconfig.Ext
 		return nil, fmt.Errorf("generating TLS key: %w", err)
 	}
 
-	log.Printf("Identity generated: domain=%s", domain)
-	return &NodeIdentity{
+	id := &NodeIdentity{
 		TLSKey:       privateKey,
 		HPKEKeyBytes: hpkeKeyBytes,
 		Domain:       domain,
-	}, nil
+		Aliases:      extensions.DomainAliases,
+	}
+	log.Printf("Identity generated: domains=%s", strings.Join(id.Domains(), ","))
+	return id, nil
+}
+
+// identityDomain is the node's DOMAIN, defaulting to localhost only in
+// dummy-attestation mode.
+func identityDomain(shimCfg *shimconfig.Config, externalConfig *shimconfig.ExternalConfig) (string, error) {
+	domain := ""
+	if externalConfig.Env != nil {
+		domain = externalConfig.Env["DOMAIN"]
+	}
+	if domain == "" && !shimCfg.DummyAttestation {
+		return "", fmt.Errorf("DOMAIN not set in external config (set dummy-attestation: true for local dev)")
+	}
+	if domain == "" {
+		domain = "localhost"
+	}
+	return domain, nil
+}
+
+// checkDomainAliases rejects an alias repeating DOMAIN, which only the
+// external config sets.
+func checkDomainAliases(domain string, aliases []shimconfig.DomainAlias) error {
+	for _, alias := range aliases {
+		if strings.EqualFold(alias.Name, domain) {
+			return fmt.Errorf("domain alias %s is the node's DOMAIN", alias.Name)
+		}
+	}
+	return nil
 }
 
 // loadOrCreateHPKEIdentity returns the HPKE identity at path, generating and
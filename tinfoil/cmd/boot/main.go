@@ -2,17 +2,24 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/signal"
+	"slices"
+	"strings"
 	"syscall"
 	"time"
 
+	wire "github.com/tinfoilsh/tinfoil-go/verifier/collaterals"
+
 	"tinfoil/internal/boot"
+	shimconfig "tinfoil/internal/config"
 	"tinfoil/internal/nvidia"
+	"tinfoil/internal/runtimeconfig"
 )
 
 func init() {
@@ -29,12 +36,36 @@ func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
 	defer stop()
 
+	if invocation.plan {
+		if err := printBootPlan(os.Stdout, invocation); err != nil {
+			log.Printf("Plan failed: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// The log tail goes into the diagnostics bundle if boot fails.
+	tail := newLogTail(diagnosticsLogLines)
+	log.SetOutput(io.MultiWriter(os.Stderr, tail))
+
 	log.Println("Tinfoil boot starting")
 
-	if err := run(ctx, invocation); err != nil {
+	if externalConfig, err := run(ctx, invocation); err != nil {
 		log.Printf("Boot failed: %v", err)
+		if writeErr := writeDiagnostics(boot.DiagnosticsPath, err, tail, externalConfig); writeErr != nil {
+			log.Printf("Warning: failed to write diagnostics bundle: %v", writeErr)
+		} else {
+			log.Printf("Diagnostics bundle written to %s", boot.DiagnosticsPath)
+		}
+		if bootRetryable(err) {
+			os.Exit(boot.ExitRetryable)
+		}
 		os.Exit(1)
 	}
+	// A bundle from an earlier failed run no longer describes this boot.
+	if err := os.Remove(boot.DiagnosticsPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Warning: failed to remove stale diagnostics bundle: %v", err)
+	}
 
 	log.Println("Tinfoil boot complete")
 }
@@ -43,6 +74,10 @@ type invocation struct {
 	configHash string
 	debug      bool
 	secretsFD  int
+	// plan reports the boot stages without running them; deviceRoot is
+	// the device tree it checks.
+	plan       bool
+	deviceRoot string
 }
 
 func parseInvocation(args []string) (invocation, error) {
@@ -55,138 +90,270 @@ func parseInvocation(args []string) (invocation, error) {
 	flags.StringVar(&parsed.configHash, "config-hash", "", "verified config hash from the kernel command line")
 	flags.BoolVar(&parsed.debug, "debug", false, "enable the measured debug policy")
 	flags.IntVar(&parsed.secretsFD, "secrets-fd", -1, "sealed container-secret handoff descriptor")
+	flags.BoolVar(&parsed.plan, "plan", false, "print the boot plan without side effects")
+	flags.StringVar(&parsed.deviceRoot, "device-root", "/", "device tree checked by --plan")
 	if err := flags.Parse(args[1:]); err != nil {
 		return invocation{}, err
 	}
 	if flags.NArg() != 0 {
 		return invocation{}, fmt.Errorf("tinfoil-boot does not accept maintenance commands")
 	}
+	if parsed.deviceRoot != "/" && !parsed.plan {
+		return invocation{}, fmt.Errorf("--device-root requires --plan")
+	}
 	return parsed, nil
 }
 
-func run(ctx context.Context, invocation invocation) error {
+// run boots the node. It also returns the external config as it stands in
+// memory, with any secrets vault released, so a failed boot's diagnostics
+// can redact them; it is nil when the config never loaded.
+func run(ctx context.Context, invocation invocation) (*shimconfig.ExternalConfig, error) {
 	if invocation.secretsFD < 0 {
-		return fmt.Errorf("container-secret handoff descriptor is required")
+		return nil, fmt.Errorf("container-secret handoff descriptor is required")
 	}
 	secretHandoff := os.NewFile(uintptr(invocation.secretsFD), "tinfoil-container-secrets")
 	defer secretHandoff.Close()
 
-	tracker := boot.NewTracker(boot.InitialStages)
+	tracker := loadTracker()
 
-	// 1. Config
-	start := time.Now()
-	log.Println("Loading configuration")
-	config, err := loadAndVerifyConfig(invocation.configHash, invocation.debug)
+	// The verified config decides the rest of the graph, so it loads first.
+	// It is verified again on every run, including resumed ones.
+	var (
+		config         *Config
+		externalConfig *shimconfig.ExternalConfig
+		extensions     *runtimeconfig.Extensions
+	)
+	err := runStages(ctx, tracker, nil, []bootStage{{
+		name:       boot.StageConfig,
+		idempotent: true,
+		run: func(context.Context) (stageResult, error) {
+			log.Println("Loading configuration")
+			var err error
+			if config, err = loadAndVerifyConfig(invocation.configHash, invocation.debug); err != nil {
+				return stageResult{}, err
+			}
+			if externalConfig, err = getExternalConfig(); err != nil {
+				return stageResult{}, fmt.Errorf("loading external config: %w", err)
+			}
+			if extensions, err = loadVerifiedExtensions(); err != nil {
+				return stageResult{}, err
+			}
+			return stageOK(""), nil
+		},
+	}})
 	if err != nil {
-		tracker.Record("config", boot.StatusFailed, time.Since(start), err.Error())
-		return err
+		return externalConfig, err
 	}
-	externalConfig, err := getExternalConfig()
-	if err != nil {
-		tracker.Record("config", boot.StatusFailed, time.Since(start), err.Error())
-		return fmt.Errorf("loading external config: %w", err)
-	}
-	tracker.Record("config", boot.StatusOK, time.Since(start), "")
 
-	// 2. Network
-	start = time.Now()
-	log.Println("Configuring guest network")
-	networkDetail, err := configureGuestNetwork(ctx, externalConfig.Network)
-	if err != nil {
-		tracker.Record(boot.StageNetwork, boot.StatusFailed, time.Since(start), err.Error())
-		return fmt.Errorf("network configuration failed: %w", err)
+	var (
+		nodeID *NodeIdentity
+		cpu    struct {
+			Attestation       *CPUAttestation `json:"attestation"`
+			CollateralRequest wire.Request    `json:"collateral_request"`
+		}
+	)
+	stages := []bootStage{
+		{
+			name:       boot.StageNetwork,
+			deps:       []string{boot.StageConfig},
+			idempotent: true,
+			run: func(ctx context.Context) (stageResult, error) {
+				log.Println("Configuring guest network")
+				detail, err := configureGuestNetwork(ctx, externalConfig.Network)
+				if err != nil {
+					return stageResult{}, fmt.Errorf("network configuration failed: %w", err)
+				}
+				return stageOK(detail), nil
+			},
+		},
+		{
+			name:       boot.StageSecureTime,
+			deps:       []string{boot.StageNetwork},
+			idempotent: true,
+			retry:      secureTimeRetry,
+			run: func(ctx context.Context) (stageResult, error) {
+				log.Println("Checking the clock against Roughtime servers")
+				return checkSecureTime(ctx, extensions.Shim.SecureTime)
+			},
+		},
+		{
+			name:       boot.StageIdentity,
+			deps:       []string{boot.StageConfig},
+			idempotent: true,
+			output:     &nodeID,
+			run: func(context.Context) (stageResult, error) {
+				log.Println("Generating node identity")
+				var err error
+				if nodeID, err = generateIdentity(config.ShimCfg, externalConfig, &extensions.Shim); err != nil {
+					return stageResult{}, err
+				}
+				return stageOK(strings.Join(nodeID.Domains(), ", ")), nil
+			},
+		},
+		{
+			name:       boot.StageCPUAttestation,
+			deps:       []string{boot.StageSecureTime, boot.StageIdentity},
+			idempotent: true,
+			output:     &cpu,
+			run: func(context.Context) (stageResult, error) {
+				log.Println("Fetching CPU attestation")
+				var err error
+				if cpu.Attestation, err = fetchCPUAttestation(nodeID, config.ShimCfg, extensions.Boot.MinimumTCB); err != nil {
+					return stageResult{}, err
+				}
+				if cpu.CollateralRequest, err = writeCollateralRequest(boot.CollateralRequestPath, cpu.Attestation, externalConfig); err != nil {
+					return stageResult{}, err
+				}
+				detail := string(cpu.Attestation.V2Doc.Format)
+				if cpu.Attestation.TCB != nil {
+					detail += ", " + cpu.Attestation.TCB.String()
+				}
+				return stageOK(detail), nil
+			},
+		},
+		{
+			// nvattest verifies locally but fetches RIMs and OCSP
+			// responses over HTTPS, so it waits for the network and then
+			// overlaps the remaining network-bound stages.
+			name:       boot.StageGPUAttestation,
+			deps:       []string{boot.StageNetwork},
+			idempotent: true,
+			run: func(ctx context.Context) (stageResult, error) {
+				return attestGPUs(ctx, config)
+			},
+		},
+		{
+			name:       boot.StageCertificate,
+			deps:       []string{boot.StageCPUAttestation},
+			idempotent: true,
+			retry:      certificateRetry(config.ShimCfg),
+			run: func(ctx context.Context) (stageResult, error) {
+				// Only place an order the CA can validate.
+				started := time.Now()
+				if err := checkChallengeDNS(ctx, nodeID, config.ShimCfg, externalConfig.Network, func(detail string) {
+					tracker.Record(boot.StageCertificate, boot.StatusPending, time.Since(started), detail)
+				}); err != nil {
+					return stageResult{}, err
+				}
+				log.Println("Obtaining TLS certificate")
+				if err := obtainCertificate(nodeID, cpu.Attestation.V2Doc, config.ShimCfg, externalConfig, extensions.Boot.ACME); err != nil {
+					return stageResult{}, fmt.Errorf("certificate acquisition failed: %w", err)
+				}
+				return stageOK(""), nil
+			},
+		},
+		{
+			// Resolve declared secrets and hand workload values to the
+			// container manager. The vault attestation carries GPU evidence
+			// and is sent over the enclave certificate. The handoff is only
+			// written once every secret resolved, so a failed attempt can be
+			// retried. Secret values are never checkpointed: a resumed boot
+			// fetches them again and writes the handoff it was given.
+			name:       boot.StageVaultSecrets,
+			deps:       []string{boot.StageGPUAttestation, boot.StageCertificate},
+			idempotent: true,
+			rerun:      true,
+			retry:      vaultRetry,
+			run: func(ctx context.Context) (stageResult, error) {
+				detail, err := prepareSecretHandoff(ctx, config, externalConfig, secretHandoff, invocation.configHash, nodeID, cpu.CollateralRequest)
+				if err != nil {
+					return stageResult{}, err
+				}
+				return stageOK(detail), nil
+			},
+		},
+		{
+			// Registry tokens may come from vault.
+			name:       boot.StageRegistryAuth,
+			deps:       []string{boot.StageVaultSecrets},
+			idempotent: true,
+			run: func(context.Context) (stageResult, error) {
+				log.Println("Setting up registry authentication")
+				if err := setupRegistryAuth(externalConfig); err != nil {
+					return stageResult{}, fmt.Errorf("registry auth setup failed: %w", err)
+				}
+				return stageOK(""), nil
+			},
+		},
+		{
+			// dm-verity and dm-crypt mappings survive a failed attempt, so
+			// models are mounted at most once.
+			name: boot.StageModels,
+			deps: modelStageDeps(config),
+			run: func(context.Context) (stageResult, error) {
+				log.Println("Mounting models")
+				if err := mountModels(config, externalConfig); err != nil {
+					return stageResult{}, fmt.Errorf("model mount failed: %w", err)
+				}
+				return stageOK(""), nil
+			},
+		},
 	}
-	tracker.Record(boot.StageNetwork, boot.StatusOK, time.Since(start), networkDetail)
-
-	// 3. Identity
-	start = time.Now()
-	log.Println("Generating node identity")
-	nodeID, err := generateIdentity(config.ShimCfg, externalConfig)
+	checkpoints := &checkpointStore{dir: boot.CheckpointDir, configHash: invocation.configHash}
+	stages, completed, err := resumeStages(checkpoints, tracker, stages, boot.StageConfig)
 	if err != nil {
-		tracker.Record("identity", boot.StatusFailed, time.Since(start), err.Error())
-		return err
+		return externalConfig, err
+	}
+	if err := runStages(ctx, tracker, checkpoints, stages, completed...); err != nil {
+		return externalConfig, err
 	}
-	tracker.Record("identity", boot.StatusOK, time.Since(start), nodeID.Domain)
+	tracker.MarkCriticalPath()
+	// Node facts are informational, so failing to publish them does not
+	// fail boot.
+	if err := publishNodeFacts(boot.NodeFactsPath, cpu.Attestation); err != nil {
+		log.Printf("Warning: failed to publish node facts: %v", err)
+	}
+	return externalConfig, nil
+}
 
-	// 4. CPU attestation
-	start = time.Now()
-	log.Println("Fetching CPU attestation")
-	cpuAtt, err := fetchCPUAttestation(nodeID, config.ShimCfg)
-	if err != nil {
-		tracker.Record("cpu-attestation", boot.StatusFailed, time.Since(start), err.Error())
-		return err
+// vaultRetry rides out vault restarts and network blips.
+var vaultRetry = retryPolicy{attempts: 5, backoff: 5 * time.Second, maxBackoff: time.Minute}
+
+// loadTracker continues the boot state a previous run of tinfoil-boot left
+// behind, or starts a fresh one.
+func loadTracker() *boot.Tracker {
+	tracker, err := boot.ResumeTracker()
+	if err == nil {
+		log.Println("Resuming boot state from a previous run")
+		return tracker
 	}
-	collateralRequest, err := writeCollateralRequest(boot.CollateralRequestPath, cpuAtt, externalConfig)
-	if err != nil {
-		tracker.Record("cpu-attestation", boot.StatusFailed, time.Since(start), err.Error())
-		return err
+	if !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Warning: discarding boot state: %v", err)
+	}
+	return boot.NewTracker(boot.InitialStages)
+}
+
+// modelStageDeps lets plaintext model packs mount as soon as the config is
+// verified. Encrypted packs need their keys, which vault may release.
+func modelStageDeps(config *Config) []string {
+	encrypted := slices.ContainsFunc(config.Models, func(model ModelSpec) bool { return model.EMWP != "" })
+	if encrypted {
+		return []string{boot.StageVaultSecrets}
 	}
-	tracker.Record("cpu-attestation", boot.StatusOK, time.Since(start), string(cpuAtt.V2Doc.Format))
+	return []string{boot.StageConfig}
+}
 
-	// 5. GPU attestation
-	start = time.Now()
+// attestGPUs verifies the GPU (and NVSwitch) attestation the config expects.
+func attestGPUs(ctx context.Context, config *Config) (stageResult, error) {
 	gpuCount := config.GPUs
 	if err := validateGPUAttestationBootstrap(boot.NVIDIABootstrapStatusPath, config); err != nil {
-		wrapped := fmt.Errorf("NVIDIA bootstrap status: %w", err)
-		tracker.Record("gpu-attestation", boot.StatusFailed, time.Since(start), wrapped.Error())
-		return wrapped
+		return stageResult{}, fmt.Errorf("NVIDIA bootstrap status: %w", err)
 	}
 	if gpuCount > 0 && config.ShimCfg.DummyAttestation {
 		log.Printf("Skipping GPU attestation for %d GPUs (dummy-attestation mode)", gpuCount)
 		if err := setGPUReadyState(true); err != nil {
 			log.Printf("Warning: failed to set GPU ready state: %v", err)
 		}
-		tracker.Record("gpu-attestation", boot.StatusSkipped, time.Since(start), fmt.Sprintf("%d GPUs (dummy)", gpuCount))
-	} else if gpuCount > 0 {
-		log.Printf("Verifying GPU attestation (%d GPUs)", gpuCount)
-		var err error
-		_, err = verifyGPUAttestation(gpuCount)
-		if err != nil {
-			tracker.Record("gpu-attestation", boot.StatusFailed, time.Since(start), err.Error())
-			return err
-		}
-		tracker.Record("gpu-attestation", boot.StatusOK, time.Since(start), fmt.Sprintf("%d GPUs", gpuCount))
-	} else {
-		tracker.Record("gpu-attestation", boot.StatusSkipped, time.Since(start), "no GPUs")
+		return stageSkipped(fmt.Sprintf("%d GPUs (dummy)", gpuCount)), nil
 	}
-
-	// 6. Certificate
-	start = time.Now()
-	log.Println("Obtaining TLS certificate")
-	if err := obtainCertificate(nodeID, cpuAtt.V2Doc, config.ShimCfg, externalConfig); err != nil {
-		tracker.Record("certificate", boot.StatusFailed, time.Since(start), err.Error())
-		return fmt.Errorf("certificate acquisition failed: %w", err)
-	}
-	tracker.Record("certificate", boot.StatusOK, time.Since(start), "")
-
-	// 7. Resolve declared secrets and hand workload values to the container manager.
-	start = time.Now()
-	secretDetail, err := prepareSecretHandoff(ctx, config, externalConfig, secretHandoff, invocation.configHash, nodeID, collateralRequest)
-	if err != nil {
-		tracker.Record(boot.StageVaultSecrets, boot.StatusFailed, time.Since(start), err.Error())
-		return err
+	if gpuCount == 0 {
+		return stageSkipped("no GPUs"), nil
 	}
-	tracker.Record(boot.StageVaultSecrets, boot.StatusOK, time.Since(start), secretDetail)
-
-	// 8. Registry auth
-	start = time.Now()
-	log.Println("Setting up registry authentication")
-	if err := setupRegistryAuth(externalConfig); err != nil {
-		tracker.Record("registry-auth", boot.StatusFailed, time.Since(start), err.Error())
-		return fmt.Errorf("registry auth setup failed: %w", err)
-	}
-	tracker.Record("registry-auth", boot.StatusOK, time.Since(start), "")
-
-	// 9. Models
-	start = time.Now()
-	log.Println("Mounting models")
-	if err := mountModels(config, externalConfig); err != nil {
-		tracker.Record("models", boot.StatusFailed, time.Since(start), err.Error())
-		return fmt.Errorf("model mount failed: %w", err)
+	log.Printf("Verifying GPU attestation (%d GPUs)", gpuCount)
+	if _, err := verifyGPUAttestation(ctx, gpuCount); err != nil {
+		return stageResult{}, err
 	}
-	tracker.Record("models", boot.StatusOK, time.Since(start), "")
-
-	return nil
+	return stageOK(fmt.Sprintf("%d GPUs", gpuCount)), nil
 }
 
 func validateGPUAttestationBootstrap(path string, config *Config) error {
@@ -21,3 +21,16 @@ func TestParseInvocation(t *testing.T) {
 		})
 	}
 }
+
+func TestParseInvocationPlan(t *testing.T) {
+	invocation, err := parseInvocation([]string{"tinfoil-boot", "--config-hash=abc", "--plan", "--device-root=/tmp/tree"})
+	if err != nil {
+		t.Fatalf("plan invocation failed: %v", err)
+	}
+	if !invocation.plan || invocation.deviceRoot != "/tmp/tree" {
+		t.Fatalf("invocation = %#v", invocation)
+	}
+	if _, err := parseInvocation([]string{"tinfoil-boot", "--device-root=/tmp/tree"}); err == nil {
+		t.Fatal("device root accepted outside plan mode")
+	}
+}
@@ -48,17 +48,17 @@ func mountModels(config *Config, externalConfig *shimconfig.ExternalConfig) erro
 			if err != nil {
 				return err
 			}
-			sourceDevice, err := device.ModelDisk(index)
+			sourceDevice, err := modelSourceDevice(index, kind)
 			if err != nil {
-				return fmt.Errorf("finding model disk %d: %w", index, err)
+				return err
 			}
 			if err := mountModelPack(ref, salt, sourceDevice); err != nil {
 				return fmt.Errorf("mounting model pack %s: %w", ref.raw, err)
 			}
 		case modelKindEncrypted:
-			sourceDevice, err := device.ModelPartition(index, device.EMWPPayloadPartition)
+			sourceDevice, err := modelSourceDevice(index, kind)
 			if err != nil {
-				return fmt.Errorf("finding encrypted model partition %d: %w", index, err)
+				return err
 			}
 			if err := mountEncryptedModelPack(model, externalConfig, sourceDevice); err != nil {
 				return fmt.Errorf("mounting encrypted model pack %q: %w", model.Name, err)
@@ -69,6 +69,23 @@ func mountModels(config *Config, externalConfig *shimconfig.ExternalConfig) erro
 	return nil
 }
 
+// modelSourceDevice finds the block device of the model at index; its
+// position in the config fixes its disk.
+func modelSourceDevice(index int, kind modelKind) (string, error) {
+	if kind == modelKindEncrypted {
+		sourceDevice, err := device.ModelPartition(index, device.EMWPPayloadPartition)
+		if err != nil {
+			return "", fmt.Errorf("finding encrypted model partition %d: %w", index, err)
+		}
+		return sourceDevice, nil
+	}
+	sourceDevice, err := device.ModelDisk(index)
+	if err != nil {
+		return "", fmt.Errorf("finding model disk %d: %w", index, err)
+	}
+	return sourceDevice, nil
+}
+
 // modelSalt re-derives the dm-verity salt from the attested model
 // identity (repo: name@revision). The salt is required so the artifact's
 // untrusted superblock never has to be read; a wrong repo fails closed
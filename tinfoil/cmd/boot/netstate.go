@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+var sysClassNet = "/sys/class/net"
+
+var pciAddressPattern = regexp.MustCompile(`^[0-9a-f]{4}:[0-9a-f]{2}:[0-9a-f]{2}\.[0-7]$`)
+
+// networkInterface is the state of one guest network interface. Virtual
+// interfaces have no PCI address or driver.
+type networkInterface struct {
+	Name       string   `json:"name"`
+	MAC        string   `json:"mac,omitempty"`
+	MTU        int      `json:"mtu"`
+	Flags      string   `json:"flags"`
+	PCIAddress string   `json:"pci_address,omitempty"`
+	Driver     string   `json:"driver,omitempty"`
+	Addresses  []string `json:"addresses,omitempty"`
+}
+
+func networkState() ([]networkInterface, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	state := make([]networkInterface, 0, len(interfaces))
+	for _, iface := range interfaces {
+		entry := networkInterface{
+			Name:  iface.Name,
+			MAC:   iface.HardwareAddr.String(),
+			MTU:   iface.MTU,
+			Flags: iface.Flags.String(),
+		}
+		entry.PCIAddress, entry.Driver = networkDevice(sysClassNet, iface.Name)
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("addresses of %s: %w", iface.Name, err)
+		}
+		for _, addr := range addrs {
+			entry.Addresses = append(entry.Addresses, addr.String())
+		}
+		state = append(state, entry)
+	}
+	return state, nil
+}
+
+// networkDevice returns the PCI function below which an interface sits and
+// the driver bound to its device. virtio-net interfaces hang off a virtio
+// device below the PCI function.
+func networkDevice(sysClassNet, name string) (string, string) {
+	device, err := filepath.EvalSymlinks(filepath.Join(sysClassNet, name, "device"))
+	if err != nil {
+		return "", ""
+	}
+	var pciAddress string
+	for dir := device; dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if pciAddressPattern.MatchString(filepath.Base(dir)) {
+			pciAddress = filepath.Base(dir)
+			break
+		}
+	}
+	var driver string
+	if target, err := os.Readlink(filepath.Join(device, "driver")); err == nil {
+		driver = filepath.Base(target)
+	}
+	return pciAddress, driver
+}
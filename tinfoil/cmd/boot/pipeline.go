@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"tinfoil/internal/boot"
+)
+
+// bootStage is one node of the boot dependency graph. run starts once every
+// stage in deps has succeeded; values it produces for later stages are
+// safe to read from stages that depend on it.
+type bootStage struct {
+	name  string
+	deps  []string
+	run   func(ctx context.Context) (stageResult, error)
+	retry retryPolicy
+	// idempotent stages may run again after a failed or interrupted
+	// attempt. Only they are retried or re-run by a resumed boot.
+	idempotent bool
+	// output points at the values run produces for later stages. It is
+	// checkpointed as JSON and restored when a resumed boot skips the stage;
+	// nil means the stage's effects all live outside the process.
+	output any
+	// rerun stages run again on every resumed boot, even after they
+	// succeeded, because their effects do not outlive the tinfoil-boot
+	// process. Stages after them still resume from their checkpoints.
+	rerun bool
+}
+
+// retryPolicy decides how often a failing stage is attempted. The zero
+// policy runs the stage once.
+type retryPolicy struct {
+	attempts int
+	// backoff is the wait after the first failure. It doubles after each
+	// further failure up to maxBackoff, or stays fixed without one.
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+func (p retryPolicy) delay(failures int) time.Duration {
+	delay := p.backoff
+	for range failures - 1 {
+		if delay >= p.maxBackoff {
+			break
+		}
+		delay = min(delay*2, p.maxBackoff)
+	}
+	return delay
+}
+
+// stageResult is how a successful stage is recorded.
+type stageResult struct {
+	status string
+	detail string
+}
+
+func stageOK(detail string) stageResult { return stageResult{status: boot.StatusOK, detail: detail} }
+func stageSkipped(detail string) stageResult {
+	return stageResult{status: boot.StatusSkipped, detail: detail}
+}
+
+// stageRecorder is the part of boot.Tracker the pipeline reports to.
+type stageRecorder interface {
+	Start(name string, dependsOn []string)
+	Record(name, status string, duration time.Duration, detail string)
+}
+
+// runStages runs stages concurrently as their dependencies allow; stages
+// may also depend on the completed stages that already succeeded. Each
+// stage is retried according to its policy and checkpointed once it
+// succeeds. The first failure cancels ctx for the running stages, stops
+// dependents from starting, and is returned once every started stage has
+// returned; stages that never started stay pending.
+func runStages(ctx context.Context, recorder stageRecorder, checkpoints *checkpointStore, stages []bootStage, completed ...string) error {
+	if err := validateStageGraph(stages, completed); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	succeeded := make(map[string]chan struct{}, len(completed)+len(stages))
+	for _, name := range completed {
+		succeeded[name] = make(chan struct{})
+		close(succeeded[name])
+	}
+	for _, stage := range stages {
+		succeeded[stage.name] = make(chan struct{})
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	for _, stage := range stages {
+		wg.Go(func() {
+			for _, dep := range stage.deps {
+				select {
+				case <-succeeded[dep]:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if ctx.Err() != nil {
+				return
+			}
+
+			log.Printf("Starting boot stage %s", stage.name)
+			recorder.Start(stage.name, stage.deps)
+			if err := checkpoints.begin(stage.name); err != nil {
+				log.Printf("Warning: failed to checkpoint boot stage %s: %v", stage.name, err)
+			}
+			start := time.Now()
+			result, err := runWithRetry(ctx, recorder, stage, start)
+			if err != nil {
+				recorder.Record(stage.name, boot.StatusFailed, time.Since(start), err.Error())
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = &stageFailure{err: err, retryable: retryableFailure(stage, err)}
+				}
+				mu.Unlock()
+				cancel()
+				return
+			}
+			duration := time.Since(start)
+			recorder.Record(stage.name, result.status, duration, result.detail)
+			if err := checkpoints.finish(stage, result, duration); err != nil {
+				log.Printf("Warning: failed to checkpoint boot stage %s: %v", stage.name, err)
+			}
+			close(succeeded[stage.name])
+		})
+	}
+	wg.Wait()
+
+	if firstErr == nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return firstErr
+}
+
+// stageFailure is the error of the stage that failed a boot.
+type stageFailure struct {
+	err error
+	// retryable failures may clear on another run of tinfoil-boot.
+	retryable bool
+}
+
+func (f *stageFailure) Error() string { return f.err.Error() }
+func (f *stageFailure) Unwrap() error { return f.err }
+
+// retryableFailure reports whether another run of tinfoil-boot may get past
+// err from stage. Only network failures of idempotent stages qualify, and
+// only for stages without a retry policy: a stage with one has spent its
+// attempts, and running it again would, for example, place more ACME
+// orders. Everything else, such as a config or attestation that fails
+// verification, fails the same way on every run.
+func retryableFailure(stage bootStage, err error) bool {
+	if !stage.idempotent || stage.retry.attempts > 1 {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EHOSTUNREACH) ||
+		errors.Is(err, syscall.ENETUNREACH)
+}
+
+// bootRetryable reports whether err, as returned by runStages, failed a
+// stage in a way another run of tinfoil-boot may get past.
+func bootRetryable(err error) bool {
+	var failure *stageFailure
+	return errors.As(err, &failure) && failure.retryable
+}
+
+// runWithRetry runs stage until it succeeds, its attempts are used up, or
+// ctx is canceled, waiting out the policy's backoff between attempts.
+func runWithRetry(ctx context.Context, recorder stageRecorder, stage bootStage, start time.Time) (stageResult, error) {
+	attempts := max(stage.retry.attempts, 1)
+	for attempt := 1; ; attempt++ {
+		result, err := stage.run(ctx)
+		if err == nil {
+			return result, nil
+		}
+		if attempt == attempts || ctx.Err() != nil {
+			if attempts > 1 {
+				return stageResult{}, fmt.Errorf("failed after %d attempts: %w", attempt, err)
+			}
+			return stageResult{}, err
+		}
+		delay := stage.retry.delay(attempt)
+		log.Printf("Boot stage %s failed (attempt %d/%d), retrying in %s: %v", stage.name, attempt, attempts, delay, err)
+		recorder.Record(stage.name, boot.StatusPending, time.Since(start),
+			fmt.Sprintf("attempt %d/%d failed, retrying: %v", attempt, attempts, err))
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return stageResult{}, fmt.Errorf("failed after %d attempts: %w", attempt, err)
+		}
+	}
+}
+
+// validateStageGraph requires unique names and dependencies that completed
+// or are declared earlier in the list, which also rules out cycles. Only
+// idempotent stages may be retried, and rerun stages have no output to
+// checkpoint.
+func validateStageGraph(stages []bootStage, completed []string) error {
+	declared := make(map[string]bool, len(completed)+len(stages))
+	for _, name := range completed {
+		declared[name] = true
+	}
+	for _, stage := range stages {
+		if stage.name == "" || declared[stage.name] {
+			return fmt.Errorf("boot stage %q is declared twice or unnamed", stage.name)
+		}
+		if stage.retry.attempts > 1 && !stage.idempotent {
+			return fmt.Errorf("boot stage %q is not idempotent and cannot be retried", stage.name)
+		}
+		if stage.rerun && stage.output != nil {
+			return fmt.Errorf("boot stage %q runs on every boot and cannot checkpoint its output", stage.name)
+		}
+		for _, dep := range stage.deps {
+			if !declared[dep] {
+				return fmt.Errorf("boot stage %q depends on %q, which is not declared before it", stage.name, dep)
+			}
+		}
+		declared[stage.name] = true
+	}
+	return nil
+}
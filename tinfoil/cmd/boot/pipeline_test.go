@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"tinfoil/internal/boot"
+)
+
+type recordedStage struct {
+	started bool
+	deps    []string
+	status  string
+	detail  string
+}
+
+type fakeRecorder struct {
+	mu     sync.Mutex
+	stages map[string]*recordedStage
+}
+
+func newFakeRecorder() *fakeRecorder {
+	return &fakeRecorder{stages: map[string]*recordedStage{}}
+}
+
+func (r *fakeRecorder) stage(name string) *recordedStage {
+	if r.stages[name] == nil {
+		r.stages[name] = &recordedStage{}
+	}
+	return r.stages[name]
+}
+
+func (r *fakeRecorder) Start(name string, dependsOn []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stage := r.stage(name)
+	stage.started = true
+	stage.deps = dependsOn
+}
+
+func (r *fakeRecorder) Record(name, status string, _ time.Duration, detail string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stage := r.stage(name)
+	stage.status = status
+	stage.detail = detail
+}
+
+func TestRunStagesRunsIndependentStagesConcurrently(t *testing.T) {
+	// a and b only finish once both are running.
+	var running sync.WaitGroup
+	running.Add(2)
+	both := func(context.Context) (stageResult, error) {
+		running.Done()
+		running.Wait()
+		return stageOK(""), nil
+	}
+	var order []string
+	var mu sync.Mutex
+	last := func(context.Context) (stageResult, error) {
+		mu.Lock()
+		order = append(order, "c")
+		mu.Unlock()
+		return stageSkipped("nothing to do"), nil
+	}
+
+	recorder := newFakeRecorder()
+	err := runStages(context.Background(), recorder, nil, []bootStage{
+		{name: "a", deps: []string{"root"}, run: both},
+		{name: "b", deps: []string{"root"}, run: both},
+		{name: "c", deps: []string{"a", "b"}, run: last},
+	}, "root")
+	if err != nil {
+		t.Fatalf("runStages: %v", err)
+	}
+	if recorder.stages["a"].status != boot.StatusOK || recorder.stages["c"].status != boot.StatusSkipped {
+		t.Fatalf("recorded stages = %+v", recorder.stages)
+	}
+	if !slices.Equal(recorder.stages["c"].deps, []string{"a", "b"}) || len(order) != 1 {
+		t.Fatalf("c deps = %v, runs = %v", recorder.stages["c"].deps, order)
+	}
+}
+
+func TestRunStagesStopsAfterFailure(t *testing.T) {
+	failure := errors.New("issuer rejected request")
+	var slowCanceled bool
+	slowRunning := make(chan struct{})
+	recorder := newFakeRecorder()
+	err := runStages(context.Background(), recorder, nil, []bootStage{
+		{name: "fail", run: func(context.Context) (stageResult, error) {
+			<-slowRunning
+			return stageResult{}, failure
+		}},
+		{name: "slow", run: func(ctx context.Context) (stageResult, error) {
+			close(slowRunning)
+			<-ctx.Done()
+			slowCanceled = true
+			return stageResult{}, ctx.Err()
+		}},
+		{name: "dependent", deps: []string{"fail"}, run: func(context.Context) (stageResult, error) {
+			t.Error("dependent of a failed stage ran")
+			return stageOK(""), nil
+		}},
+	})
+	if !errors.Is(err, failure) {
+		t.Fatalf("runStages = %v, want the first failure", err)
+	}
+	if !slowCanceled {
+		t.Fatal("running stage was not canceled")
+	}
+	if got := recorder.stages["fail"]; got.status != boot.StatusFailed || got.detail != failure.Error() {
+		t.Fatalf("failed stage recorded as %+v", got)
+	}
+	if _, started := recorder.stages["dependent"]; started {
+		t.Fatal("dependent stage was recorded")
+	}
+}
+
+func TestRunStagesRejectsInvalidGraph(t *testing.T) {
+	noop := func(context.Context) (stageResult, error) { return stageOK(""), nil }
+	graphs := map[string][]bootStage{
+		"unknown dependency":  {{name: "a", deps: []string{"missing"}, run: noop}},
+		"forward dependency":  {{name: "a", deps: []string{"b"}, run: noop}, {name: "b", deps: []string{"a"}, run: noop}},
+		"duplicate":           {{name: "a", run: noop}, {name: "a", run: noop}},
+		"retried side effect": {{name: "a", run: noop, retry: retryPolicy{attempts: 2}}},
+	}
+	for name, stages := range graphs {
+		if err := runStages(context.Background(), newFakeRecorder(), nil, stages); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestModelStageDepsWaitForVaultOnlyForEncryptedPacks(t *testing.T) {
+	plaintext := &Config{Models: []ModelSpec{{Name: "m", MWP: "ref"}}}
+	if deps := modelStageDeps(plaintext); !slices.Equal(deps, []string{boot.StageConfig}) {
+		t.Fatalf("plaintext deps = %v", deps)
+	}
+	encrypted := &Config{Models: []ModelSpec{{Name: "m", MWP: "ref"}, {Name: "e", EMWP: "ref"}}}
+	if deps := modelStageDeps(encrypted); !slices.Equal(deps, []string{boot.StageVaultSecrets}) {
+		t.Fatalf("encrypted deps = %v", deps)
+	}
+}
+
+func TestRunStagesRetriesTransientFailures(t *testing.T) {
+	failures := 2
+	recorder := newFakeRecorder()
+	err := runStages(context.Background(), recorder, nil, []bootStage{{
+		name:       "vault",
+		idempotent: true,
+		retry:      retryPolicy{attempts: 3, backoff: time.Millisecond},
+		run: func(context.Context) (stageResult, error) {
+			if failures > 0 {
+				failures--
+				return stageResult{}, errors.New("vault timed out")
+			}
+			return stageOK("fetched"), nil
+		},
+	}})
+	if err != nil {
+		t.Fatalf("runStages: %v", err)
+	}
+	if got := recorder.stages["vault"]; got.status != boot.StatusOK || got.detail != "fetched" {
+		t.Fatalf("recorded %+v", got)
+	}
+
+	err = runStages(context.Background(), newFakeRecorder(), nil, []bootStage{{
+		name:       "vault",
+		idempotent: true,
+		retry:      retryPolicy{attempts: 2, backoff: time.Millisecond},
+		run: func(context.Context) (stageResult, error) {
+			return stageResult{}, errors.New("vault timed out")
+		},
+	}})
+	if err == nil || err.Error() != "failed after 2 attempts: vault timed out" {
+		t.Fatalf("runStages = %v", err)
+	}
+}
+
+func TestRunStagesReportsRetryableFailures(t *testing.T) {
+	refused := fmt.Errorf("fetching RIMs: %w", syscall.ECONNREFUSED)
+	for _, tc := range []struct {
+		name  string
+		stage bootStage
+		err   error
+		want  bool
+	}{
+		{"network error", bootStage{idempotent: true}, refused, true},
+		{"timeout", bootStage{idempotent: true}, &net.DNSError{Err: "timeout", IsTimeout: true}, true},
+		{"verification failure", bootStage{idempotent: true}, errors.New("attestation measurement mismatch"), false},
+		{"spent retry policy", bootStage{idempotent: true, retry: retryPolicy{attempts: 2, backoff: time.Millisecond}}, refused, false},
+		{"side effect", bootStage{}, refused, false},
+	} {
+		stage := tc.stage
+		stage.name = "stage"
+		stage.run = func(context.Context) (stageResult, error) { return stageResult{}, tc.err }
+		err := runStages(context.Background(), newFakeRecorder(), nil, []bootStage{stage})
+		if !errors.Is(err, tc.err) {
+			t.Fatalf("%s: runStages = %v, want the stage failure", tc.name, err)
+		}
+		if got := bootRetryable(err); got != tc.want {
+			t.Errorf("%s: retryable = %t, want %t", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	fixed := retryPolicy{attempts: 3, backoff: time.Minute}
+	doubling := retryPolicy{attempts: 6, backoff: 10 * time.Second, maxBackoff: time.Minute}
+	for _, tc := range []struct {
+		policy   retryPolicy
+		failures int
+		want     time.Duration
+	}{
+		{fixed, 1, time.Minute},
+		{fixed, 2, time.Minute},
+		{doubling, 1, 10 * time.Second},
+		{doubling, 3, 40 * time.Second},
+		{doubling, 4, time.Minute},
+		{doubling, 5, time.Minute},
+	} {
+		if got := tc.policy.delay(tc.failures); got != tc.want {
+			t.Errorf("%+v.delay(%d) = %s, want %s", tc.policy, tc.failures, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"tinfoil/internal/attestation"
+	"tinfoil/internal/boot"
+	shimconfig "tinfoil/internal/config"
+	"tinfoil/internal/device"
+	"tinfoil/internal/runtimeconfig"
+	"tinfoil/internal/secretstore"
+)
+
+// plannedStage is one line of the --plan report.
+type plannedStage struct {
+	name   string
+	action string
+	err    error
+}
+
+// printBootPlan checks the config disks and device tree the way a boot
+// would and prints every tinfoil-boot stage in order with what it would do.
+// It only reads files: nothing is written, mounted, fetched, or opened in
+// the firewall. It fails when any stage would.
+func printBootPlan(w io.Writer, invocation invocation) error {
+	device.UseTree(invocation.deviceRoot)
+	stages := planBoot(invocation)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	failed := 0
+	for _, stage := range stages {
+		status, detail := "ok", stage.action
+		if stage.err != nil {
+			status, detail = "FAIL", stage.err.Error()
+			failed++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", stage.name, status, detail)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d boot stage(s) would fail", failed)
+	}
+	return nil
+}
+
+func planBoot(invocation invocation) []plannedStage {
+	config, external, extensions, err := readPlanConfig(invocation)
+	if err != nil {
+		return []plannedStage{{name: boot.StageConfig, err: err}}
+	}
+	p := newBootPlanner(config, external, extensions, filepath.Join(invocation.deviceRoot, "sys/bus/pci/devices"))
+	return []plannedStage{
+		{name: boot.StageConfig, action: fmt.Sprintf(
+			"verify config %s: %d GPU(s), %d container(s), %d model(s)",
+			invocation.configHash, config.GPUs, len(config.Containers), len(config.Models),
+		)},
+		p.network(),
+		p.secureTime(),
+		p.identity(),
+		p.cpuAttestation(),
+		p.gpuAttestation(),
+		p.certificate(),
+		p.vaultSecrets(),
+		p.registryAuth(),
+		p.models(),
+	}
+}
+
+func readPlanConfig(invocation invocation) (*Config, *shimconfig.ExternalConfig, *runtimeconfig.Extensions, error) {
+	configData, err := readVerifiedConfig(invocation.configHash)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	config, err := decodeVerifiedConfig(configData, invocation.debug)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	extensions, err := runtimeconfig.DecodeExtensions(configData)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	_, external, err := readExternalConfigDisk()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return config, external, extensions, nil
+}
+
+// bootPlanner describes the stages of a boot with a verified config.
+type bootPlanner struct {
+	config     *Config
+	external   *shimconfig.ExternalConfig
+	extensions *runtimeconfig.Extensions
+	sysBusPCI  string
+
+	domain    string
+	domainErr error
+	// fromVault are the declared secrets the external config lacks.
+	fromVault []string
+}
+
+func newBootPlanner(config *Config, external *shimconfig.ExternalConfig, extensions *runtimeconfig.Extensions, sysBusPCI string) *bootPlanner {
+	p := &bootPlanner{config: config, external: external, extensions: extensions, sysBusPCI: sysBusPCI}
+	p.domain, p.domainErr = identityDomain(config.ShimCfg, external)
+	if p.domainErr == nil {
+		p.domainErr = checkDomainAliases(p.domain, extensions.Shim.DomainAliases)
+	}
+	p.fromVault = secretstore.MissingReferences(config, external)
+	return p
+}
+
+func (p *bootPlanner) dummyAttestation() bool {
+	return p.domain == "localhost" || p.config.ShimCfg.DummyAttestation
+}
+
+// certifiedNames lists DOMAIN and the aliases with their own challenge.
+func (p *bootPlanner) certifiedNames() string {
+	names := []string{p.domain}
+	for _, alias := range p.extensions.Shim.DomainAliases {
+		if alias.ChallengeMode != "" {
+			names = append(names, fmt.Sprintf("%s (%s challenge)", alias.Name, alias.ChallengeMode))
+		} else {
+			names = append(names, alias.Name)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+func (p *bootPlanner) network() plannedStage {
+	stage := plannedStage{name: boot.StageNetwork}
+	iface, err := networkInterfaceAtPCI(p.sysBusPCI, boot.ExternalNICPCIAddress)
+	if err != nil {
+		stage.err = err
+		return stage
+	}
+	stage.action = fmt.Sprintf("configure %s on %s via gateway %s", p.external.Network.Address, iface, p.external.Network.Gateway)
+	return stage
+}
+
+func (p *bootPlanner) secureTime() plannedStage {
+	stage := plannedStage{name: boot.StageSecureTime, action: "skip: not configured"}
+	secureTime := p.extensions.Shim.SecureTime
+	if secureTime == nil {
+		return stage
+	}
+	policy, err := secureTime.Policy()
+	if err != nil {
+		stage.err = err
+		return stage
+	}
+	onSkew := "fail"
+	if secureTime.Warn() {
+		onSkew = "warn"
+	}
+	stage.action = fmt.Sprintf("check the clock against %d of %d Roughtime server(s); %s beyond %s skew; re-check every %s",
+		policy.Quorum, len(policy.Servers), onSkew, policy.MaxSkew, secureTime.Interval())
+	return stage
+}
+
+func (p *bootPlanner) identity() plannedStage {
+	stage := plannedStage{name: boot.StageIdentity, err: p.domainErr}
+	stage.action = fmt.Sprintf("generate a TLS key for %s and load the HPKE key", p.certifiedNames())
+	return stage
+}
+
+func (p *bootPlanner) cpuAttestation() plannedStage {
+	stage := plannedStage{name: boot.StageCPUAttestation, action: "fetch a CPU attestation report bound to the node keys"}
+	minimum := p.extensions.Boot.MinimumTCB
+	switch {
+	case p.dummyAttestation():
+		stage.action = "use a dummy attestation report"
+	case minimum != nil:
+		var platforms []string
+		if minimum.SEVSNP != nil {
+			platforms = append(platforms, attestation.PlatformSEVSNP)
+		}
+		if minimum.TDX != nil {
+			platforms = append(platforms, attestation.PlatformTDX)
+		}
+		if len(platforms) > 0 {
+			stage.action += "; require the minimum " + strings.Join(platforms, " and ") + " TCB"
+		}
+	}
+	return stage
+}
+
+func (p *bootPlanner) gpuAttestation() plannedStage {
+	stage := plannedStage{name: boot.StageGPUAttestation}
+	switch {
+	case p.config.GPUs == 0:
+		stage.action = "skip: no GPUs"
+	case p.config.ShimCfg.DummyAttestation:
+		stage.action = fmt.Sprintf("skip: %d GPUs (dummy-attestation)", p.config.GPUs)
+	default:
+		stage.action = fmt.Sprintf("verify %d GPU(s) and their NVSwitch topology", p.config.GPUs)
+	}
+	return stage
+}
+
+func (p *bootPlanner) certificate() plannedStage {
+	stage := plannedStage{name: boot.StageCertificate}
+	if p.domainErr != nil {
+		stage.err = fmt.Errorf("no domain to certify")
+		return stage
+	}
+	shimCfg := p.config.ShimCfg
+	switch {
+	case p.domain == "localhost" || shimCfg.TLSMode == "self-signed":
+		stage.action = fmt.Sprintf("issue a self-signed certificate for %s", p.certifiedNames())
+		return stage
+	case shimCfg.TLSMode == "cert-proxy":
+		if shimCfg.ControlPlane == "" {
+			stage.err = fmt.Errorf("cert-proxy requires control-plane URL")
+			return stage
+		}
+		stage.action = fmt.Sprintf("request a certificate for %s from the cert proxy at %s", p.certifiedNames(), shimCfg.ControlPlane)
+	default:
+		directory := "the Let's Encrypt production directory"
+		switch {
+		case p.extensions.Boot.ACME != nil:
+			directory = acmeDirectory(shimCfg, p.extensions.Boot.ACME)
+		case shimCfg.TLSEnv == "staging":
+			directory = "the Let's Encrypt staging directory"
+		}
+		stage.action = fmt.Sprintf("request an ACME certificate for %s from %s", p.certifiedNames(), directory)
+	}
+	if shimCfg.TLSChallengeMode != "" {
+		stage.action += fmt.Sprintf(" (%s challenge)", shimCfg.TLSChallengeMode)
+	}
+	id := &NodeIdentity{Domain: p.domain, Aliases: p.extensions.Shim.DomainAliases}
+	if shimCfg.TLSMode != "cert-proxy" {
+		keyID, _, err := acmeAccountBinding(p.external)
+		if err != nil {
+			stage.err = err
+			return stage
+		}
+		if keyID != "" {
+			stage.action += fmt.Sprintf(" with external account binding %s", keyID)
+		}
+		if usesDNSChallenge(id, shimCfg) {
+			provider, err := acmeDNSProviderName(p.external)
+			if err != nil {
+				stage.err = err
+				return stage
+			}
+			stage.action += fmt.Sprintf(" using the %s DNS provider", provider)
+		}
+	}
+	if domains := directChallengeDomains(id, shimCfg); len(domains) > 0 && p.external.Network != nil {
+		address, _, _ := strings.Cut(p.external.Network.Address, "/")
+		stage.action = fmt.Sprintf("wait for %s to resolve to %s, then %s", strings.Join(domains, ", "), address, stage.action)
+	}
+	retry := certificateRetry(shimCfg)
+	stage.action += fmt.Sprintf("; up to %d attempts %s apart", retry.attempts, retry.backoff)
+	return stage
+}
+
+func (p *bootPlanner) vaultSecrets() plannedStage {
+	stage := plannedStage{name: boot.StageVaultSecrets}
+	handoff := fmt.Sprintf("hand off %d workload secret(s)", len(secretstore.WorkloadReferences(p.config)))
+	switch {
+	case len(p.fromVault) == 0:
+		stage.action = handoff + "; all declared secrets are in the external config"
+	case p.config.VaultURL == "":
+		stage.err = fmt.Errorf("secret(s) %s are not in the external config and no vault is configured", strings.Join(p.fromVault, ", "))
+	case p.external.Metadata.Repo == "":
+		stage.err = fmt.Errorf("vault secret fetch requires repository metadata")
+	case p.dummyAttestation():
+		stage.err = fmt.Errorf("vault secret fetch requires raw CPU attestation, which dummy attestation does not produce")
+	default:
+		if _, err := vaultBaseURL(p.config.VaultURL); err != nil {
+			stage.err = err
+			break
+		}
+		stage.action = fmt.Sprintf("fetch %s from %s; %s", strings.Join(p.fromVault, ", "), p.config.VaultURL, handoff)
+	}
+	return stage
+}
+
+func (p *bootPlanner) registryAuth() plannedStage {
+	stage := plannedStage{name: boot.StageRegistryAuth}
+	auths, _ := resolveRegistryAuths(p.external)
+	hosts := make([]string, 0, len(auths))
+	for host := range auths {
+		hosts = append(hosts, host)
+	}
+	slices.Sort(hosts)
+	stage.action = "no registry credentials in the external config"
+	if len(hosts) > 0 {
+		stage.action = "configure credentials for " + strings.Join(hosts, ", ")
+	}
+	if len(p.fromVault) > 0 {
+		stage.action += "; vault secrets may add more"
+	}
+	return stage
+}
+
+func (p *bootPlanner) models() plannedStage {
+	stage := plannedStage{name: boot.StageModels, action: "no models"}
+	var mounts []string
+	seen := map[string]struct{}{}
+	for index, model := range p.config.Models {
+		ref, kind, err := modelPackRefForModel(model)
+		if err != nil {
+			stage.err = err
+			return stage
+		}
+		if _, ok := seen[ref.mapperName()]; ok {
+			stage.err = fmt.Errorf("duplicate model pack root hash: %s", ref.RootHash)
+			return stage
+		}
+		seen[ref.mapperName()] = struct{}{}
+		if _, err := modelSalt(model); err != nil {
+			stage.err = err
+			return stage
+		}
+		if kind == modelKindEncrypted && !slices.Contains(p.fromVault, model.KeySecret) {
+			key, err := encryptedModelKey(model.KeySecret, ref, p.external)
+			if err != nil {
+				stage.err = err
+				return stage
+			}
+			zeroBytes(key)
+		}
+		sourceDevice, err := modelSourceDevice(index, kind)
+		if err != nil {
+			stage.err = err
+			return stage
+		}
+		mounts = append(mounts, fmt.Sprintf("%s (%s) from %s", model.Name, kind, sourceDevice))
+	}
+	if len(mounts) > 0 {
+		stage.action = "mount " + strings.Join(mounts, ", ")
+	}
+	return stage
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	shimconfig "tinfoil/internal/config"
+	"tinfoil/internal/runtimeconfig"
+)
+
+func testPlanner(t *testing.T, config *Config, external *shimconfig.ExternalConfig) *bootPlanner {
+	t.Helper()
+	if config.ShimCfg == nil {
+		config.ShimCfg = &shimconfig.Config{}
+	}
+	if external.Env == nil {
+		external.Env = map[string]string{"DOMAIN": "node.example.com"}
+	}
+	return newBootPlanner(config, external, &runtimeconfig.Extensions{}, filepath.Join(t.TempDir(), "sys/bus/pci/devices"))
+}
+
+func TestPlanVaultSecrets(t *testing.T) {
+	config := &Config{Containers: []Container{{Name: "app", Secrets: []string{"API_KEY", "DB_PASSWORD"}}}}
+	external := &shimconfig.ExternalConfig{Secrets: map[string]string{"API_KEY": "k"}}
+
+	stage := testPlanner(t, config, external).vaultSecrets()
+	if stage.err == nil || !strings.Contains(stage.err.Error(), "DB_PASSWORD") {
+		t.Fatalf("without vault: %+v", stage)
+	}
+
+	config.VaultURL = "https://vault.example.com"
+	external.Metadata.Repo = "tinfoilsh/workload"
+	stage = testPlanner(t, config, external).vaultSecrets()
+	if stage.err != nil {
+		t.Fatal(stage.err)
+	}
+	if want := "fetch DB_PASSWORD from https://vault.example.com; hand off 2 workload secret(s)"; stage.action != want {
+		t.Fatalf("action = %q, want %q", stage.action, want)
+	}
+
+	config.ShimCfg.DummyAttestation = true
+	if stage := testPlanner(t, config, external).vaultSecrets(); stage.err == nil {
+		t.Fatal("planned a vault fetch without hardware attestation")
+	}
+}
+
+func TestPlanNetworkChecksDeviceTree(t *testing.T) {
+	external := &shimconfig.ExternalConfig{Network: &shimconfig.ExternalNetworkConfig{Address: "10.0.0.2/24", Gateway: "10.0.0.1"}}
+	p := testPlanner(t, &Config{}, external)
+	if stage := p.network(); stage.err == nil {
+		t.Fatalf("planned network without the NIC: %+v", stage)
+	}
+
+	if err := os.MkdirAll(filepath.Join(p.sysBusPCI, "0000:00:02.0", "virtio1", "net", "eth0"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	stage := p.network()
+	if stage.err != nil || stage.action != "configure 10.0.0.2/24 on eth0 via gateway 10.0.0.1" {
+		t.Fatalf("network plan = %+v", stage)
+	}
+}
+
+func TestPlanRegistryAuthAndCertificate(t *testing.T) {
+	external := &shimconfig.ExternalConfig{Secrets: map[string]string{
+		"REGISTRY_GHCR_IO_TOKEN": "token",
+		"GCLOUD_KEY":             "{}",
+		"GCLOUD_REGISTRY":        "us-docker.pkg.dev",
+	}}
+	p := testPlanner(t, &Config{ShimCfg: &shimconfig.Config{TLSMode: "cert-proxy"}}, external)
+	if stage := p.registryAuth(); stage.action != "configure credentials for ghcr.io, us-docker.pkg.dev" {
+		t.Fatalf("registry plan = %+v", stage)
+	}
+	if stage := p.certificate(); stage.err == nil {
+		t.Fatalf("cert-proxy without control plane planned: %+v", stage)
+	}
+}
+
+func TestPlanCPUAttestationMinimumTCB(t *testing.T) {
+	p := testPlanner(t, &Config{}, &shimconfig.ExternalConfig{})
+	p.extensions.Boot.MinimumTCB = &runtimeconfig.MinimumTCB{TDX: &runtimeconfig.MinimumTDXTCB{}}
+	if stage := p.cpuAttestation(); !strings.HasSuffix(stage.action, "; require the minimum tdx TCB") {
+		t.Fatalf("cpu attestation plan = %+v", stage)
+	}
+}
+
+func TestPlanModelsChecksReferences(t *testing.T) {
+	config := &Config{Models: []ModelSpec{{Name: "weights"}}}
+	stage := testPlanner(t, config, &shimconfig.ExternalConfig{}).models()
+	if stage.err == nil || !strings.Contains(stage.err.Error(), "exactly one of") {
+		t.Fatalf("models plan = %+v", stage)
+	}
+	if stage := testPlanner(t, &Config{}, &shimconfig.ExternalConfig{}).models(); stage.err != nil || stage.action != "no models" {
+		t.Fatalf("empty models plan = %+v", stage)
+	}
+}
+
+func TestPlanCertificateListsDomainAliases(t *testing.T) {
+	p := testPlanner(t, &Config{ShimCfg: &shimconfig.Config{TLSMode: "self-signed"}}, &shimconfig.ExternalConfig{})
+	p.extensions.Shim.DomainAliases = []shimconfig.DomainAlias{{Name: "api.customer.com", ChallengeMode: "http"}, {Name: "chat.customer.com"}}
+	if stage := p.certificate(); stage.action != "issue a self-signed certificate for node.example.com, api.customer.com (http challenge), chat.customer.com" {
+		t.Fatalf("certificate plan = %+v", stage)
+	}
+
+	p = newBootPlanner(p.config, p.external, &runtimeconfig.Extensions{Shim: shimconfig.Extensions{DomainAliases: []shimconfig.DomainAlias{{Name: "node.example.com"}}}}, p.sysBusPCI)
+	if stage := p.identity(); stage.err == nil {
+		t.Fatal("planned an alias repeating DOMAIN")
+	}
+}
+
+func TestPlanCertificateWaitsForChallengeDNS(t *testing.T) {
+	external := &shimconfig.ExternalConfig{Network: &shimconfig.ExternalNetworkConfig{Address: "203.0.113.7/24", Gateway: "203.0.113.1"}}
+	p := testPlanner(t, &Config{ShimCfg: &shimconfig.Config{TLSChallengeMode: "http", TLSEnv: "staging"}}, external)
+	want := "wait for node.example.com to resolve to 203.0.113.7, then request an ACME certificate for node.example.com from the Let's Encrypt staging directory (http challenge); up to 10 attempts 18m0s apart"
+	if stage := p.certificate(); stage.action != want {
+		t.Fatalf("certificate action = %q, want %q", stage.action, want)
+	}
+}
+
+func TestPlanCertificateNamesACMEDirectoryAndDNSProvider(t *testing.T) {
+	external := &shimconfig.ExternalConfig{Secrets: map[string]string{
+		secretACMEEABKeyID:      "kid-1",
+		secretACMEEABHMAC:       "aG1hYw",
+		secretRFC2136Nameserver: "ns1.corp.example",
+	}}
+	p := testPlanner(t, &Config{ShimCfg: &shimconfig.Config{TLSChallengeMode: "dns"}}, external)
+	p.extensions.Boot.ACME = &runtimeconfig.ACME{DirectoryURL: "https://acme.corp.example/directory"}
+	want := "request an ACME certificate for node.example.com from https://acme.corp.example/directory (dns challenge) with external account binding kid-1 using the rfc2136 DNS provider; up to 10 attempts 18m0s apart"
+	if stage := p.certificate(); stage.action != want {
+		t.Fatalf("certificate action = %q, want %q", stage.action, want)
+	}
+
+	external.Secrets[secretCloudflareDNSToken] = "token"
+	if stage := p.certificate(); stage.err == nil {
+		t.Fatal("planned a certificate with two DNS providers")
+	}
+}
+
+func TestPlanSecureTime(t *testing.T) {
+	p := testPlanner(t, &Config{}, &shimconfig.ExternalConfig{})
+	if stage := p.secureTime(); stage.action != "skip: not configured" {
+		t.Fatalf("secure-time plan = %+v", stage)
+	}
+	key := base64.StdEncoding.EncodeToString(make([]byte, ed25519.PublicKeySize))
+	p.extensions.Shim.SecureTime = &shimconfig.SecureTime{
+		Servers: []shimconfig.RoughtimeServer{
+			{Name: "a", Address: "time-a.example.com:2002", PublicKey: key},
+			{Name: "b", Address: "time-b.example.com:2002", PublicKey: key},
+			{Name: "c", Address: "time-c.example.com:2002", PublicKey: key},
+		},
+		OnSkew: shimconfig.SecureTimeWarn,
+	}
+	want := "check the clock against 2 of 3 Roughtime server(s); warn beyond 10s skew; re-check every 1h0m0s"
+	if stage := p.secureTime(); stage.action != want {
+		t.Fatalf("secure-time action = %q, want %q", stage.action, want)
+	}
+}
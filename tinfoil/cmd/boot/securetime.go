@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"tinfoil/internal/boot"
+	shimconfig "tinfoil/internal/config"
+	"tinfoil/internal/roughtime"
+)
+
+// secureTimeRetry rides out dropped UDP answers. Only the fail policy
+// returns errors, so the warn policy never waits for it.
+var secureTimeRetry = retryPolicy{attempts: 3, backoff: 10 * time.Second}
+
+// checkRoughtime is replaced by tests.
+var checkRoughtime = roughtime.Check
+
+// checkSecureTime compares the guest clock with the measured Roughtime
+// servers before anything relies on it: certificate and collateral
+// validity, JWT expiry and vault nonces all do.
+func checkSecureTime(ctx context.Context, secureTime *shimconfig.SecureTime) (stageResult, error) {
+	if secureTime == nil {
+		return stageSkipped("not configured"), nil
+	}
+	policy, err := secureTime.Policy()
+	if err != nil {
+		return stageResult{}, err
+	}
+	measurement, err := checkRoughtime(ctx, policy)
+	if err != nil {
+		if secureTime.Warn() {
+			log.Printf("Warning: secure time check failed: %v", err)
+			return stageResult{status: boot.StatusWarning, detail: err.Error()}, nil
+		}
+		return stageResult{}, fmt.Errorf("secure time check failed: %w", err)
+	}
+	detail := secureTimeDetail(measurement)
+	log.Printf("Secure time: %s", detail)
+	return stageOK(detail), nil
+}
+
+func secureTimeDetail(m *roughtime.Measurement) string {
+	detail := fmt.Sprintf("clock offset %s from %d Roughtime server(s)", m.Offset.Round(time.Millisecond), len(m.Samples))
+	if len(m.Failures) > 0 {
+		detail += fmt.Sprintf(", %d unreachable", len(m.Failures))
+	}
+	return detail
+}
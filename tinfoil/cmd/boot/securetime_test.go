@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"tinfoil/internal/boot"
+	shimconfig "tinfoil/internal/config"
+	"tinfoil/internal/roughtime"
+)
+
+func TestCheckSecureTime(t *testing.T) {
+	if result, err := checkSecureTime(context.Background(), nil); err != nil || result.status != boot.StatusSkipped {
+		t.Fatalf("unconfigured check = %+v, %v", result, err)
+	}
+
+	var measured *roughtime.Measurement
+	var checkErr error
+	previous := checkRoughtime
+	checkRoughtime = func(context.Context, roughtime.Policy) (*roughtime.Measurement, error) {
+		return measured, checkErr
+	}
+	t.Cleanup(func() { checkRoughtime = previous })
+
+	secureTime := &shimconfig.SecureTime{}
+	measured = &roughtime.Measurement{
+		Offset:   1500 * time.Millisecond,
+		Samples:  make([]roughtime.Sample, 2),
+		Failures: []string{"c: i/o timeout"},
+	}
+	result, err := checkSecureTime(context.Background(), secureTime)
+	if err != nil || result.status != boot.StatusOK || result.detail != "clock offset 1.5s from 2 Roughtime server(s), 1 unreachable" {
+		t.Fatalf("check = %+v, %v", result, err)
+	}
+
+	checkErr = fmt.Errorf("%w: clock is off by 1m0s, limit 10s", roughtime.ErrSkew)
+	if _, err := checkSecureTime(context.Background(), secureTime); !errors.Is(err, roughtime.ErrSkew) {
+		t.Fatalf("fail policy error = %v", err)
+	}
+	secureTime.OnSkew = shimconfig.SecureTimeWarn
+	result, err = checkSecureTime(context.Background(), secureTime)
+	if err != nil || result.status != boot.StatusWarning || !strings.Contains(result.detail, "off by 1m0s") {
+		t.Fatalf("warn policy = %+v, %v", result, err)
+	}
+}
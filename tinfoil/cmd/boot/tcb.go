@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"tinfoil/internal/attestation"
+	"tinfoil/internal/runtimeconfig"
+)
+
+// checkMinimumTCB fails when the attested TCB is below the config's minimum
+// for its platform, naming every component that falls short.
+func checkMinimumTCB(minimum *runtimeconfig.MinimumTCB, tcb attestation.TCB) error {
+	if minimum == nil {
+		return nil
+	}
+	var below []string
+	switch tcb.Platform {
+	case attestation.PlatformSEVSNP:
+		if minimum.SEVSNP == nil {
+			return nil
+		}
+		below = append(below, belowSEVSNPTCB("reported", tcb.Reported, minimum.SEVSNP.Reported)...)
+		below = append(below, belowSEVSNPTCB("committed", tcb.Committed, minimum.SEVSNP.Committed)...)
+	case attestation.PlatformTDX:
+		if minimum.TDX == nil {
+			return nil
+		}
+		required, err := minimum.TDX.SVN()
+		if err != nil {
+			return err
+		}
+		for i, svn := range tcb.TEETCBSVN {
+			if svn < required[i] {
+				below = append(below, fmt.Sprintf("TEE_TCB_SVN[%d] is %d, policy requires %d", i, svn, required[i]))
+			}
+		}
+	default:
+		return nil
+	}
+	if len(below) > 0 {
+		return fmt.Errorf("host %s TCB is below the minimum: %s", tcb.Platform, strings.Join(below, "; "))
+	}
+	return nil
+}
+
+func belowSEVSNPTCB(kind string, got attestation.SEVSNPTCB, required runtimeconfig.SEVSNPTCBParts) []string {
+	parts := [...]struct {
+		name          string
+		got, required uint8
+	}{
+		{"FMC", got.FMC, required.FMC},
+		{"bootloader", got.Bootloader, required.Bootloader},
+		{"TEE", got.TEE, required.TEE},
+		{"SNP", got.SNP, required.SNP},
+		{"microcode", got.Microcode, required.Microcode},
+	}
+	var below []string
+	for _, part := range parts {
+		if part.got < part.required {
+			below = append(below, fmt.Sprintf("%s %s SPL is %d, policy requires %d", kind, part.name, part.got, part.required))
+		}
+	}
+	return below
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"tinfoil/internal/attestation"
+	"tinfoil/internal/runtimeconfig"
+)
+
+func TestCheckMinimumTCB(t *testing.T) {
+	minimum := &runtimeconfig.MinimumTCB{
+		SEVSNP: &runtimeconfig.MinimumSEVSNPTCB{
+			Reported:  runtimeconfig.SEVSNPTCBParts{Bootloader: 9, SNP: 23, Microcode: 213},
+			Committed: runtimeconfig.SEVSNPTCBParts{SNP: 22},
+		},
+		TDX: &runtimeconfig.MinimumTDXTCB{TEETCBSVN: "0d010400000000000000000000000000"},
+	}
+	current := attestation.SEVSNPTCB{Bootloader: 9, TEE: 0, SNP: 23, Microcode: 213}
+	for _, test := range []struct {
+		name    string
+		minimum *runtimeconfig.MinimumTCB
+		tcb     attestation.TCB
+		want    string
+	}{
+		{name: "no policy", tcb: attestation.TCB{Platform: attestation.PlatformSEVSNP}},
+		{name: "sev-snp at minimum", minimum: minimum, tcb: attestation.TCB{Platform: attestation.PlatformSEVSNP, Reported: current, Committed: current}},
+		{
+			name:    "sev-snp below",
+			minimum: minimum,
+			tcb: attestation.TCB{
+				Platform:  attestation.PlatformSEVSNP,
+				Reported:  attestation.SEVSNPTCB{Bootloader: 9, SNP: 23, Microcode: 211},
+				Committed: attestation.SEVSNPTCB{SNP: 21},
+			},
+			want: "host sev-snp TCB is below the minimum: reported microcode SPL is 211, policy requires 213; committed SNP SPL is 21, policy requires 22",
+		},
+		{name: "tdx above", minimum: minimum, tcb: attestation.TCB{Platform: attestation.PlatformTDX, TEETCBSVN: [16]byte{0x0e, 0x01, 0x04}}},
+		{
+			name:    "tdx below",
+			minimum: minimum,
+			tcb:     attestation.TCB{Platform: attestation.PlatformTDX, TEETCBSVN: [16]byte{0x0e, 0x01, 0x03}},
+			want:    "TEE_TCB_SVN[2] is 3, policy requires 4",
+		},
+		{
+			name:    "platform without policy",
+			minimum: &runtimeconfig.MinimumTCB{SEVSNP: minimum.SEVSNP},
+			tcb:     attestation.TCB{Platform: attestation.PlatformTDX},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkMinimumTCB(test.minimum, test.tcb)
+			if test.want == "" {
+				if err != nil {
+					t.Fatalf("checkMinimumTCB() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("checkMinimumTCB() = %v, want %q", err, test.want)
+			}
+		})
+	}
+}
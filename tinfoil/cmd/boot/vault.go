@@ -97,6 +97,7 @@ func fetchVaultSecrets(
 		nonce,
 		deviceEvidence,
 		collateral,
+		nil,
 	)
 	if err != nil {
 		return 0, fmt.Errorf("building vault attestation: %w", err)
@@ -12,6 +12,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
 	"sync"
 	"syscall"
 	"time"
@@ -203,6 +204,10 @@ func (m *manager) boot(override []byte) (result error) {
 	if err != nil {
 		return err
 	}
+	extensions, err := runtimeconfig.DecodeExtensions(source)
+	if err != nil {
+		return err
+	}
 	externalData, err := os.ReadFile(boot.ExternalConfigPath)
 	if err != nil {
 		return fmt.Errorf("reading external config: %w", err)
@@ -249,7 +254,7 @@ func (m *manager) boot(override []byte) (result error) {
 	if err := containers.RemoveManagedExcept(m.ctx, previous, preserved); err != nil {
 		return err
 	}
-	if err := writeRuntimeArtifacts(config, source); err != nil {
+	if err := writeRuntimeArtifacts(config, extensions, source); err != nil {
 		return err
 	}
 	tracker, err := boot.ResumeTracker()
@@ -257,7 +262,8 @@ func (m *manager) boot(override []byte) (result error) {
 		return err
 	}
 	start := time.Now()
-	if err := firewall.ApplyInbound(config.CVMNetwork.InboundPorts); err != nil {
+	inboundPorts := append(slices.Clip(config.CVMNetwork.InboundPorts), extensions.Shim.InboundPorts()...)
+	if err := firewall.ApplyInbound(inboundPorts); err != nil {
 		tracker.Record(boot.StageFirewall, boot.StatusFailed, time.Since(start), err.Error())
 		return err
 	}
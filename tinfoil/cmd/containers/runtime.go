@@ -51,10 +51,19 @@ func loadRuntimeConfig() (*runtimeconfig.Config, error) {
 	return &config, nil
 }
 
-func writeRuntimeArtifacts(config *runtimeconfig.Config, source []byte) error {
+func writeRuntimeArtifacts(config *runtimeconfig.Config, extensions *runtimeconfig.Extensions, source []byte) error {
 	if err := atomicWrite(boot.RuntimeConfigPath, source, 0o600); err != nil {
 		return err
 	}
+	// The shim reads its extensions when it restarts for the new shim.yml,
+	// so they are written first.
+	extensionsYAML, err := yaml.Marshal(extensions.Shim)
+	if err != nil {
+		return err
+	}
+	if err := atomicWrite(boot.ShimExtensionsPath, extensionsYAML, 0o644); err != nil {
+		return err
+	}
 	shimYAML, err := yaml.Marshal(config.ShimCfg)
 	if err != nil {
 		return err
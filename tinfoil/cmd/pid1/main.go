@@ -35,6 +35,7 @@ const (
 	nvidiaDeviceWait     = 15 * time.Second
 	nvidiaDevicePoll     = 500 * time.Millisecond
 	cdiGenerateLimit     = 30 * time.Second
+	bootAttempts         = 3
 
 	containerdName    = "containerd"
 	dockerName        = "dockerd"
@@ -45,7 +46,7 @@ const (
 	fabricManagerName = "nvidia-fabricmanager"
 	containerdSocket  = "/run/containerd/containerd.sock"
 	dockerSocket      = "/run/docker.sock"
-	readyPath         = "/run/tinfoil-pid1.ready"
+	readyPath         = boot.PID1ReadyPath
 	selfExecPath      = "/proc/self/exe"
 	pid1Env           = "TINFOIL_PID1"
 	pid1EnvValue      = "tinfoil-pid1"
@@ -207,11 +208,6 @@ func runLifecycle(parent context.Context, deps lifecycleDeps, readiness *readine
 	if err := deps.limits(); err != nil {
 		return fmt.Errorf("runtime limits: %w", err)
 	}
-	secretHandoff, err := secretstore.NewHandoffFile()
-	if err != nil {
-		return err
-	}
-	defer secretHandoff.Close()
 	if err := deps.oneShot(bootCtx, command("loopback", "/usr/sbin/ip", "link", "set", "dev", "lo", "up")); err != nil {
 		return err
 	}
@@ -251,15 +247,11 @@ func runLifecycle(parent context.Context, deps lifecycleDeps, readiness *readine
 	}); err != nil {
 		return err
 	}
-	bootCommand := hardenedCommand(
-		hardening.ServiceBoot, boot.BootBinary,
-		"--config-hash="+deps.cmdline.ConfigHash,
-		fmt.Sprintf("--debug=%t", deps.cmdline.Debug),
-	)
-	bootCommand = withSecretHandoff(bootCommand, secretHandoff)
-	if err := deps.oneShot(bootCtx, bootCommand); err != nil {
+	secretHandoff, err := runBoot(bootCtx, deps)
+	if err != nil {
 		return err
 	}
+	defer secretHandoff.Close()
 	containersCommand := hardenedCommand(hardening.ServiceContainers, boot.ContainersBinary,
 		fmt.Sprintf("--debug=%t", deps.cmdline.Debug))
 	containersCommand = withSecretHandoff(containersCommand, secretHandoff)
@@ -287,6 +279,46 @@ func runLifecycle(parent context.Context, deps lifecycleDeps, readiness *readine
 	return nil
 }
 
+// runBoot runs tinfoil-boot until it succeeds, fails in a way it reports as
+// final, or bootAttempts are used up. A failed run leaves its stage
+// checkpoints behind, so the next one resumes from the first incomplete
+// stage. A written handoff is sealed, so every
+// run gets a fresh one; the handoff of the run that succeeded is returned.
+func runBoot(ctx context.Context, deps lifecycleDeps) (*os.File, error) {
+	var err error
+	for attempt := 1; attempt <= bootAttempts; attempt++ {
+		if attempt > 1 {
+			initLogf("tinfoil-boot failed, resuming it (attempt %d/%d): %v", attempt, bootAttempts, err)
+		}
+		handoff, handoffErr := secretstore.NewHandoffFile()
+		if handoffErr != nil {
+			return nil, handoffErr
+		}
+		command := hardenedCommand(
+			hardening.ServiceBoot, boot.BootBinary,
+			"--config-hash="+deps.cmdline.ConfigHash,
+			fmt.Sprintf("--debug=%t", deps.cmdline.Debug),
+		)
+		if err = deps.oneShot(ctx, withSecretHandoff(command, handoff)); err == nil {
+			return handoff, nil
+		}
+		handoff.Close()
+		if ctx.Err() != nil || !bootRetryable(err) {
+			break
+		}
+	}
+	return nil, err
+}
+
+// bootRetryable reports whether tinfoil-boot exited with
+// boot.ExitRetryable. Bad config, a rejected TCB or a failed attestation
+// fail the same way on every run, so only failures it reports as retryable
+// are run again.
+func bootRetryable(err error) bool {
+	var exit *supervisor.ExitError
+	return errors.As(err, &exit) && exit.Code == boot.ExitRetryable
+}
+
 func withSecretHandoff(command supervisor.Command, handoff *os.File) supervisor.Command {
 	childFD := command.AddExtraFile(handoff)
 	command.Args = append(command.Args, fmt.Sprintf("--secrets-fd=%d", childFD))
@@ -152,6 +152,80 @@ func TestLifecycleCommandsCarryCapturedKernelPolicy(t *testing.T) {
 	}
 }
 
+func TestLifecycleResumesFailedBootWithFreshHandoff(t *testing.T) {
+	harness := newLifecycleHarness()
+	var bootCommands []supervisor.Command
+	harness.deps.oneShot = func(_ context.Context, command supervisor.Command) error {
+		if command.Name != string(hardening.ServiceBoot) {
+			return nil
+		}
+		bootCommands = append(bootCommands, command)
+		if len(bootCommands) == 1 {
+			return &supervisor.ExitError{Code: boot.ExitRetryable}
+		}
+		return nil
+	}
+	parent, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() { result <- runLifecycle(parent, harness.deps, harness.readiness) }()
+	if ready := receiveTest(t, harness.ready); !ready {
+		t.Fatal("lifecycle did not become ready")
+	}
+	cancel()
+	if err := receiveTest(t, result); err != nil {
+		t.Fatal(err)
+	}
+	if len(bootCommands) != 2 {
+		t.Fatalf("boot ran %d times, want 2", len(bootCommands))
+	}
+	if bootCommands[0].ExtraFiles[0] == bootCommands[1].ExtraFiles[0] {
+		t.Fatal("resumed boot reused the first run's secret handoff")
+	}
+	for _, service := range harness.services.started {
+		if service.Name == containersName && service.Command.ExtraFiles[0] != bootCommands[1].ExtraFiles[0] {
+			t.Fatal("containers did not receive the handoff of the boot that succeeded")
+		}
+	}
+}
+
+func TestLifecycleGivesUpAfterBootAttempts(t *testing.T) {
+	harness := newLifecycleHarness()
+	bootErr := &supervisor.ExitError{Code: boot.ExitRetryable}
+	runs := 0
+	harness.deps.oneShot = func(_ context.Context, command supervisor.Command) error {
+		if command.Name != string(hardening.ServiceBoot) {
+			return nil
+		}
+		runs++
+		return bootErr
+	}
+	if err := runLifecycle(context.Background(), harness.deps, harness.readiness); !errors.Is(err, bootErr) {
+		t.Fatalf("runLifecycle error = %v, want boot failure", err)
+	}
+	if runs != bootAttempts {
+		t.Fatalf("boot ran %d times, want %d", runs, bootAttempts)
+	}
+}
+
+func TestLifecycleDoesNotRetryFinalBootFailure(t *testing.T) {
+	harness := newLifecycleHarness()
+	bootErr := &supervisor.ExitError{Code: 1}
+	runs := 0
+	harness.deps.oneShot = func(_ context.Context, command supervisor.Command) error {
+		if command.Name != string(hardening.ServiceBoot) {
+			return nil
+		}
+		runs++
+		return bootErr
+	}
+	if err := runLifecycle(context.Background(), harness.deps, harness.readiness); !errors.Is(err, bootErr) {
+		t.Fatalf("runLifecycle error = %v, want boot failure", err)
+	}
+	if runs != 1 {
+		t.Fatalf("boot ran %d times, want 1", runs)
+	}
+}
+
 type fakeNVIDIA struct {
 	mu         sync.Mutex
 	calls      []string
@@ -0,0 +1,924 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	anthropicMessagesPath = "/v1/messages"
+
+	// Translation needs whole request and response bodies in memory, so
+	// both are bounded.
+	maxAnthropicRequestBytes  = 16 << 20
+	maxAnthropicResponseBytes = 16 << 20
+)
+
+// Anthropic error type strings returned in translated error responses.
+const (
+	anthropicErrInvalidRequest = "invalid_request_error"
+	anthropicErrAuthentication = "authentication_error"
+	anthropicErrPermission     = "permission_error"
+	anthropicErrNotFound       = "not_found_error"
+	anthropicErrTooLarge       = "request_too_large"
+	anthropicErrRateLimit      = "rate_limit_error"
+	anthropicErrAPI            = "api_error"
+	anthropicErrOverloaded     = "overloaded_error"
+)
+
+type anthropicRequest struct {
+	Model         string               `json:"model"`
+	MaxTokens     *int                 `json:"max_tokens"`
+	System        json.RawMessage      `json:"system,omitempty"`
+	Messages      []anthropicMessage   `json:"messages"`
+	StopSequences []string             `json:"stop_sequences,omitempty"`
+	Temperature   *float64             `json:"temperature,omitempty"`
+	TopP          *float64             `json:"top_p,omitempty"`
+	TopK          *int                 `json:"top_k,omitempty"`
+	Stream        bool                 `json:"stream,omitempty"`
+	Metadata      *anthropicMetadata   `json:"metadata,omitempty"`
+	Tools         []anthropicTool      `json:"tools,omitempty"`
+	ToolChoice    *anthropicToolChoice `json:"tool_choice,omitempty"`
+}
+
+type anthropicMetadata struct {
+	UserID string `json:"user_id,omitempty"`
+}
+
+type anthropicMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+type anthropicBlock struct {
+	Type      string           `json:"type"`
+	Text      string           `json:"text,omitempty"`
+	Source    *anthropicSource `json:"source,omitempty"`
+	ID        string           `json:"id,omitempty"`
+	Name      string           `json:"name,omitempty"`
+	Input     json.RawMessage  `json:"input,omitempty"`
+	ToolUseID string           `json:"tool_use_id,omitempty"`
+	Content   json.RawMessage  `json:"content,omitempty"`
+}
+
+type anthropicSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+type anthropicTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+type anthropicToolChoice struct {
+	Type                   string `json:"type"`
+	Name                   string `json:"name,omitempty"`
+	DisableParallelToolUse bool   `json:"disable_parallel_tool_use,omitempty"`
+}
+
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type anthropicResponse struct {
+	ID           string           `json:"id"`
+	Type         string           `json:"type"`
+	Role         string           `json:"role"`
+	Model        string           `json:"model"`
+	Content      []anthropicBlock `json:"content"`
+	StopReason   *string          `json:"stop_reason"`
+	StopSequence *string          `json:"stop_sequence"`
+	Usage        anthropicUsage   `json:"usage"`
+}
+
+type chatRequest struct {
+	Model             string             `json:"model"`
+	Messages          []chatMessage      `json:"messages"`
+	MaxTokens         int                `json:"max_tokens"`
+	Stop              []string           `json:"stop,omitempty"`
+	Temperature       *float64           `json:"temperature,omitempty"`
+	TopP              *float64           `json:"top_p,omitempty"`
+	TopK              *int               `json:"top_k,omitempty"`
+	User              string             `json:"user,omitempty"`
+	Stream            bool               `json:"stream,omitempty"`
+	StreamOptions     *chatStreamOptions `json:"stream_options,omitempty"`
+	Tools             []chatTool         `json:"tools,omitempty"`
+	ToolChoice        any                `json:"tool_choice,omitempty"`
+	ParallelToolCalls *bool              `json:"parallel_tool_calls,omitempty"`
+}
+
+type chatStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type chatMessage struct {
+	Role       string         `json:"role"`
+	Content    any            `json:"content"`
+	ToolCalls  []chatToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string         `json:"tool_call_id,omitempty"`
+}
+
+type chatContentPart struct {
+	Type     string        `json:"type"`
+	Text     string        `json:"text,omitempty"`
+	ImageURL *chatImageURL `json:"image_url,omitempty"`
+}
+
+type chatImageURL struct {
+	URL string `json:"url"`
+}
+
+type chatTool struct {
+	Type     string       `json:"type"`
+	Function chatFunction `json:"function"`
+}
+
+type chatFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+type chatToolCall struct {
+	Index    *int             `json:"index,omitempty"`
+	ID       string           `json:"id,omitempty"`
+	Type     string           `json:"type,omitempty"`
+	Function chatFunctionCall `json:"function"`
+}
+
+type chatFunctionCall struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
+}
+
+type chatUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+}
+
+// chatChoice covers both a completion choice and a stream chunk choice.
+// StopReason is vLLM's extension naming the stop string or token that ended
+// generation.
+type chatChoice struct {
+	Message      *chatResponseMessage `json:"message,omitempty"`
+	Delta        *chatResponseMessage `json:"delta,omitempty"`
+	FinishReason string               `json:"finish_reason"`
+	StopReason   json.RawMessage      `json:"stop_reason,omitempty"`
+}
+
+type chatResponseMessage struct {
+	Content   string         `json:"content"`
+	ToolCalls []chatToolCall `json:"tool_calls,omitempty"`
+}
+
+type chatResponse struct {
+	Model   string          `json:"model"`
+	Choices []chatChoice    `json:"choices"`
+	Usage   *chatUsage      `json:"usage,omitempty"`
+	Error   json.RawMessage `json:"error,omitempty"`
+}
+
+type anthropicRequestError struct {
+	message string
+}
+
+func (e *anthropicRequestError) Error() string { return e.message }
+
+func invalidAnthropicRequest(format string, args ...any) error {
+	return &anthropicRequestError{message: fmt.Sprintf(format, args...)}
+}
+
+// writeAnthropicError writes an Anthropic-compatible JSON error response.
+func writeAnthropicError(w http.ResponseWriter, message string, errorType string, statusCode int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]any{
+		"type": "error",
+		"error": map[string]string{
+			"type":    errorType,
+			"message": message,
+		},
+	})
+}
+
+func anthropicErrorType(statusCode int) string {
+	switch statusCode {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity, http.StatusGone:
+		return anthropicErrInvalidRequest
+	case http.StatusUnauthorized:
+		return anthropicErrAuthentication
+	case http.StatusForbidden, http.StatusPaymentRequired:
+		return anthropicErrPermission
+	case http.StatusNotFound:
+		return anthropicErrNotFound
+	case http.StatusRequestEntityTooLarge:
+		return anthropicErrTooLarge
+	case http.StatusTooManyRequests:
+		return anthropicErrRateLimit
+	case http.StatusServiceUnavailable, 529:
+		return anthropicErrOverloaded
+	default:
+		return anthropicErrAPI
+	}
+}
+
+// translateAnthropicRequest rewrites an Anthropic Messages request into a
+// chat completion request and returns it with a writer that translates the
+// response back. It writes an error and reports false if the request cannot
+// be translated. The caller must call finish on the writer once the
+// translated request has been served.
+func translateAnthropicRequest(w http.ResponseWriter, r *http.Request) (*anthropicResponseWriter, *http.Request, bool) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeAnthropicError(w, "Method not allowed.", anthropicErrInvalidRequest, http.StatusMethodNotAllowed)
+		return nil, nil, false
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxAnthropicRequestBytes+1))
+	if err != nil {
+		writeAnthropicError(w, "Failed to read request body.", anthropicErrInvalidRequest, http.StatusBadRequest)
+		return nil, nil, false
+	}
+	if len(body) > maxAnthropicRequestBytes {
+		writeAnthropicError(w, "Request body is too large.", anthropicErrTooLarge, http.StatusRequestEntityTooLarge)
+		return nil, nil, false
+	}
+	var request anthropicRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		writeAnthropicError(w, "Request body is not valid JSON.", anthropicErrInvalidRequest, http.StatusBadRequest)
+		return nil, nil, false
+	}
+	chat, err := toChatRequest(&request)
+	if err != nil {
+		writeAnthropicError(w, err.Error(), anthropicErrInvalidRequest, http.StatusBadRequest)
+		return nil, nil, false
+	}
+	translated, err := json.Marshal(chat)
+	if err != nil {
+		writeAnthropicError(w, errMsgServerError, anthropicErrAPI, http.StatusInternalServerError)
+		return nil, nil, false
+	}
+
+	out := r.Clone(r.Context())
+	out.URL.Path = chatCompletionsPath
+	out.URL.RawPath = ""
+	out.RequestURI = ""
+	out.Body = io.NopCloser(bytes.NewReader(translated))
+	out.ContentLength = int64(len(translated))
+	out.Header.Set("Content-Type", "application/json")
+	out.Header.Set("Content-Length", strconv.Itoa(len(translated)))
+	// The response body is parsed for translation, so it must not arrive
+	// compressed.
+	out.Header.Del("Accept-Encoding")
+	out.Header.Del(lastEventIDHeader)
+	setAnthropicAuthorization(out.Header)
+	for name := range out.Header {
+		if name == "X-Api-Key" || strings.HasPrefix(name, "Anthropic-") {
+			out.Header.Del(name)
+		}
+	}
+	return newAnthropicResponseWriter(w, request.Model), out, true
+}
+
+// withAnthropicAuthorization returns r with its x-api-key, if any, also
+// presented as a bearer token, so it authenticates like a chat completion.
+func withAnthropicAuthorization(r *http.Request) *http.Request {
+	if r.Header.Get("X-Api-Key") == "" {
+		return r
+	}
+	r = r.Clone(r.Context())
+	setAnthropicAuthorization(r.Header)
+	return r
+}
+
+func setAnthropicAuthorization(header http.Header) {
+	if apiKey := header.Get("X-Api-Key"); apiKey != "" && header.Get("Authorization") == "" {
+		header.Set("Authorization", "Bearer "+apiKey)
+	}
+}
+
+func toChatRequest(request *anthropicRequest) (*chatRequest, error) {
+	if request.Model == "" {
+		return nil, invalidAnthropicRequest("model: field required")
+	}
+	if request.MaxTokens == nil {
+		return nil, invalidAnthropicRequest("max_tokens: field required")
+	}
+	if len(request.Messages) == 0 {
+		return nil, invalidAnthropicRequest("messages: at least one message is required")
+	}
+	chat := &chatRequest{
+		Model:       request.Model,
+		MaxTokens:   *request.MaxTokens,
+		Stop:        request.StopSequences,
+		Temperature: request.Temperature,
+		TopP:        request.TopP,
+		TopK:        request.TopK,
+		Stream:      request.Stream,
+	}
+	if request.Stream {
+		chat.StreamOptions = &chatStreamOptions{IncludeUsage: true}
+	}
+	if request.Metadata != nil {
+		chat.User = request.Metadata.UserID
+	}
+
+	if len(request.System) > 0 && string(request.System) != "null" {
+		system, err := anthropicText(request.System, "system")
+		if err != nil {
+			return nil, err
+		}
+		chat.Messages = append(chat.Messages, chatMessage{Role: "system", Content: system})
+	}
+	for i, message := range request.Messages {
+		messages, err := toChatMessages(message, fmt.Sprintf("messages.%d", i))
+		if err != nil {
+			return nil, err
+		}
+		chat.Messages = append(chat.Messages, messages...)
+	}
+
+	for _, tool := range request.Tools {
+		chat.Tools = append(chat.Tools, chatTool{
+			Type:     "function",
+			Function: chatFunction{Name: tool.Name, Description: tool.Description, Parameters: tool.InputSchema},
+		})
+	}
+	if choice := request.ToolChoice; choice != nil {
+		switch choice.Type {
+		case "auto":
+			chat.ToolChoice = "auto"
+		case "any":
+			chat.ToolChoice = "required"
+		case "none":
+			chat.ToolChoice = "none"
+		case "tool":
+			if choice.Name == "" {
+				return nil, invalidAnthropicRequest("tool_choice.name: field required")
+			}
+			chat.ToolChoice = map[string]any{"type": "function", "function": map[string]string{"name": choice.Name}}
+		default:
+			return nil, invalidAnthropicRequest("tool_choice.type: unsupported value %q", choice.Type)
+		}
+		if choice.DisableParallelToolUse {
+			parallel := false
+			chat.ParallelToolCalls = &parallel
+		}
+	}
+	return chat, nil
+}
+
+// decodeAnthropicContent decodes message content, which is either a string
+// or a list of content blocks.
+func decodeAnthropicContent(raw json.RawMessage, field string) ([]anthropicBlock, error) {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return []anthropicBlock{{Type: "text", Text: text}}, nil
+	}
+	var blocks []anthropicBlock
+	if err := json.Unmarshal(raw, &blocks); err != nil {
+		return nil, invalidAnthropicRequest("%s: expected a string or a list of content blocks", field)
+	}
+	return blocks, nil
+}
+
+// anthropicText flattens text-only content such as a system prompt or a tool
+// result into a single string.
+func anthropicText(raw json.RawMessage, field string) (string, error) {
+	blocks, err := decodeAnthropicContent(raw, field)
+	if err != nil {
+		return "", err
+	}
+	var text strings.Builder
+	for i, block := range blocks {
+		if block.Type != "text" {
+			return "", invalidAnthropicRequest("%s.%d: unsupported content block type %q", field, i, block.Type)
+		}
+		if text.Len() > 0 {
+			text.WriteString("\n")
+		}
+		text.WriteString(block.Text)
+	}
+	return text.String(), nil
+}
+
+func toChatMessages(message anthropicMessage, field string) ([]chatMessage, error) {
+	blocks, err := decodeAnthropicContent(message.Content, field+".content")
+	if err != nil {
+		return nil, err
+	}
+	switch message.Role {
+	case "user":
+		var tools []chatMessage
+		var parts []chatContentPart
+		for i, block := range blocks {
+			blockField := fmt.Sprintf("%s.content.%d", field, i)
+			switch block.Type {
+			case "text":
+				parts = append(parts, chatContentPart{Type: "text", Text: block.Text})
+			case "image":
+				url, err := anthropicImageURL(block.Source, blockField)
+				if err != nil {
+					return nil, err
+				}
+				parts = append(parts, chatContentPart{Type: "image_url", ImageURL: &chatImageURL{URL: url}})
+			case "tool_result":
+				content := ""
+				if len(block.Content) > 0 {
+					if content, err = anthropicText(block.Content, blockField+".content"); err != nil {
+						return nil, err
+					}
+				}
+				tools = append(tools, chatMessage{Role: "tool", Content: content, ToolCallID: block.ToolUseID})
+			default:
+				return nil, invalidAnthropicRequest("%s: unsupported content block type %q", blockField, block.Type)
+			}
+		}
+		// Tool results answer the preceding assistant turn, so they come
+		// before any new user content.
+		messages := tools
+		if len(parts) > 0 {
+			messages = append(messages, chatMessage{Role: "user", Content: parts})
+		}
+		return messages, nil
+	case "assistant":
+		var text strings.Builder
+		var calls []chatToolCall
+		for i, block := range blocks {
+			switch block.Type {
+			case "text":
+				text.WriteString(block.Text)
+			case "tool_use":
+				arguments := "{}"
+				var compact bytes.Buffer
+				if len(block.Input) > 0 && json.Compact(&compact, block.Input) == nil {
+					arguments = compact.String()
+				}
+				calls = append(calls, chatToolCall{
+					ID:       block.ID,
+					Type:     "function",
+					Function: chatFunctionCall{Name: block.Name, Arguments: arguments},
+				})
+			case "thinking", "redacted_thinking":
+				// Clients echo reasoning back; chat completions has no
+				// field for it.
+			default:
+				return nil, invalidAnthropicRequest("%s.content.%d: unsupported content block type %q", field, i, block.Type)
+			}
+		}
+		var content any
+		if text.Len() > 0 || len(calls) == 0 {
+			content = text.String()
+		}
+		return []chatMessage{{Role: "assistant", Content: content, ToolCalls: calls}}, nil
+	default:
+		return nil, invalidAnthropicRequest("%s.role: unsupported value %q", field, message.Role)
+	}
+}
+
+func anthropicImageURL(source *anthropicSource, field string) (string, error) {
+	if source == nil {
+		return "", invalidAnthropicRequest("%s.source: field required", field)
+	}
+	switch source.Type {
+	case "base64":
+		return "data:" + source.MediaType + ";base64," + source.Data, nil
+	case "url":
+		return source.URL, nil
+	default:
+		return "", invalidAnthropicRequest("%s.source.type: unsupported value %q", field, source.Type)
+	}
+}
+
+// anthropicStopReason maps a chat completion finish reason to an Anthropic
+// stop reason and, for a stop string match, the matched sequence.
+func anthropicStopReason(choice chatChoice) (*string, *string) {
+	var reason string
+	switch choice.FinishReason {
+	case "":
+		return nil, nil
+	case "length":
+		reason = "max_tokens"
+	case "tool_calls", "function_call":
+		reason = "tool_use"
+	case "stop":
+		var sequence string
+		if json.Unmarshal(choice.StopReason, &sequence) == nil && sequence != "" {
+			reason = "stop_sequence"
+			return &reason, &sequence
+		}
+		reason = "end_turn"
+	default:
+		reason = "end_turn"
+	}
+	return &reason, nil
+}
+
+func newAnthropicMessageID() string {
+	return "msg_" + rand.Text()
+}
+
+// upstreamErrorMessage extracts the message of an OpenAI or vLLM error body.
+func upstreamErrorMessage(body []byte, statusCode int) string {
+	var payload struct {
+		Message string `json:"message"`
+		Error   struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &payload) == nil {
+		if payload.Error.Message != "" {
+			return payload.Error.Message
+		}
+		if payload.Message != "" {
+			return payload.Message
+		}
+	}
+	if text := http.StatusText(statusCode); text != "" {
+		return text
+	}
+	return errMsgServerError
+}
+
+// anthropicResponseWriter translates a chat completion response into an
+// Anthropic Messages response. Event streams are translated as they arrive;
+// any other response is buffered and translated by finish.
+type anthropicResponseWriter struct {
+	w      http.ResponseWriter
+	header http.Header
+	model  string
+
+	status    int
+	streaming bool
+	body      bytes.Buffer
+	overflow  bool
+	stream    *anthropicStream
+}
+
+func newAnthropicResponseWriter(w http.ResponseWriter, model string) *anthropicResponseWriter {
+	return &anthropicResponseWriter{w: w, header: make(http.Header), model: model}
+}
+
+func (aw *anthropicResponseWriter) Header() http.Header {
+	return aw.header
+}
+
+func (aw *anthropicResponseWriter) WriteHeader(statusCode int) {
+	if aw.status != 0 || statusCode < http.StatusOK {
+		return
+	}
+	aw.status = statusCode
+	if statusCode >= http.StatusMultipleChoices || !isEventStreamContentType(aw.header.Get("Content-Type")) {
+		return
+	}
+
+	aw.streaming = true
+	aw.copyHeaders()
+	aw.w.Header().Set("Content-Type", "text/event-stream")
+	aw.w.Header().Set("Cache-Control", "no-cache")
+	aw.w.WriteHeader(statusCode)
+	aw.stream = &anthropicStream{
+		w:          aw.w,
+		controller: http.NewResponseController(aw.w),
+		id:         newAnthropicMessageID(),
+		model:      aw.model,
+		block:      -1,
+		toolBlocks: make(map[int]int),
+	}
+}
+
+func (aw *anthropicResponseWriter) Write(p []byte) (int, error) {
+	if aw.status == 0 {
+		aw.WriteHeader(http.StatusOK)
+	}
+	if aw.streaming {
+		return aw.stream.write(p)
+	}
+	if aw.body.Len()+len(p) > maxAnthropicResponseBytes {
+		aw.overflow = true
+		return 0, errors.New("response too large to translate")
+	}
+	return aw.body.Write(p)
+}
+
+func (aw *anthropicResponseWriter) FlushError() error {
+	if !aw.streaming {
+		return nil
+	}
+	_ = aw.stream.controller.Flush()
+	return nil
+}
+
+// copyHeaders passes upstream and shim headers through, except those that
+// describe the untranslated body.
+func (aw *anthropicResponseWriter) copyHeaders() {
+	for name, values := range aw.header {
+		switch name {
+		case "Content-Length", "Content-Type", "Content-Encoding":
+			continue
+		}
+		aw.w.Header()[name] = values
+	}
+}
+
+// finish completes the translated response once the chat completion request
+// has been served.
+func (aw *anthropicResponseWriter) finish() {
+	if aw.streaming {
+		aw.stream.close()
+		return
+	}
+	status := aw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	aw.copyHeaders()
+	if aw.overflow {
+		writeAnthropicError(aw.w, errMsgServerError, anthropicErrAPI, http.StatusBadGateway)
+		return
+	}
+	if status >= http.StatusMultipleChoices {
+		writeAnthropicError(aw.w, upstreamErrorMessage(aw.body.Bytes(), status), anthropicErrorType(status), status)
+		return
+	}
+
+	var completion chatResponse
+	if err := json.Unmarshal(aw.body.Bytes(), &completion); err != nil || len(completion.Choices) == 0 || completion.Choices[0].Message == nil {
+		log.Printf("Warning: failed to translate chat completion to Anthropic message: %v", err)
+		writeAnthropicError(aw.w, errMsgServerError, anthropicErrAPI, http.StatusBadGateway)
+		return
+	}
+	choice := completion.Choices[0]
+	response := anthropicResponse{
+		ID:      newAnthropicMessageID(),
+		Type:    "message",
+		Role:    "assistant",
+		Model:   aw.model,
+		Content: []anthropicBlock{},
+	}
+	if completion.Model != "" {
+		response.Model = completion.Model
+	}
+	if choice.Message.Content != "" {
+		response.Content = append(response.Content, anthropicBlock{Type: "text", Text: choice.Message.Content})
+	}
+	for _, call := range choice.Message.ToolCalls {
+		input := json.RawMessage(call.Function.Arguments)
+		if !json.Valid(input) {
+			input = json.RawMessage("{}")
+		}
+		response.Content = append(response.Content, anthropicBlock{Type: "tool_use", ID: call.ID, Name: call.Function.Name, Input: input})
+	}
+	response.StopReason, response.StopSequence = anthropicStopReason(choice)
+	if completion.Usage != nil {
+		response.Usage = anthropicUsage{InputTokens: completion.Usage.PromptTokens, OutputTokens: completion.Usage.CompletionTokens}
+	}
+	aw.w.Header().Set("Content-Type", "application/json")
+	aw.w.WriteHeader(status)
+	json.NewEncoder(aw.w).Encode(response)
+}
+
+// anthropicStream translates chat completion chunks into Anthropic stream
+// events. Content block deltas carry a random padding field like the chunks
+// of a chat completion stream.
+type anthropicStream struct {
+	w          http.ResponseWriter
+	controller *http.ResponseController
+	id         string
+	model      string
+
+	pending    []byte
+	started    bool
+	stopped    bool
+	block      int  // index of the open content block, or -1
+	blockTool  bool // whether the open block is a tool_use block
+	blocks     int  // number of content blocks started
+	toolBlocks map[int]int
+	stopReason *string
+	stopSeq    *string
+	usage      anthropicUsage
+}
+
+func (s *anthropicStream) write(p []byte) (int, error) {
+	s.pending = append(s.pending, p...)
+	for {
+		line, rest, ok := bytes.Cut(s.pending, []byte("\n"))
+		if !ok {
+			break
+		}
+		if err := s.line(string(bytes.TrimSuffix(line, []byte("\r")))); err != nil {
+			return 0, err
+		}
+		s.pending = rest
+	}
+	if len(s.pending) > maxSSELineBytes {
+		return 0, errSSEEventTooLarge
+	}
+	return len(p), nil
+}
+
+func (s *anthropicStream) line(line string) error {
+	data, ok := strings.CutPrefix(line, "data:")
+	if !ok || s.stopped {
+		return nil
+	}
+	data = strings.TrimSpace(data)
+	if data == "[DONE]" {
+		return s.stop()
+	}
+	var chunk chatResponse
+	if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+		return nil
+	}
+	if len(chunk.Error) > 0 {
+		return s.fail(upstreamErrorMessage([]byte(data), http.StatusInternalServerError))
+	}
+	if err := s.start(chunk.Model); err != nil {
+		return err
+	}
+	if chunk.Usage != nil {
+		s.usage = anthropicUsage{InputTokens: chunk.Usage.PromptTokens, OutputTokens: chunk.Usage.CompletionTokens}
+	}
+	for _, choice := range chunk.Choices {
+		if delta := choice.Delta; delta != nil {
+			if delta.Content != "" {
+				if err := s.text(delta.Content); err != nil {
+					return err
+				}
+			}
+			for _, call := range delta.ToolCalls {
+				if err := s.toolCall(call); err != nil {
+					return err
+				}
+			}
+		}
+		if reason, sequence := anthropicStopReason(choice); reason != nil {
+			s.stopReason, s.stopSeq = reason, sequence
+		}
+	}
+	return nil
+}
+
+func (s *anthropicStream) start(model string) error {
+	if s.started {
+		return nil
+	}
+	s.started = true
+	if model != "" {
+		s.model = model
+	}
+	return s.event("message_start", map[string]any{
+		"type": "message_start",
+		"message": anthropicResponse{
+			ID:      s.id,
+			Type:    "message",
+			Role:    "assistant",
+			Model:   s.model,
+			Content: []anthropicBlock{},
+		},
+	})
+}
+
+func (s *anthropicStream) text(text string) error {
+	if s.block < 0 || s.blockTool {
+		if err := s.openBlock(false, map[string]any{"type": "text", "text": ""}); err != nil {
+			return err
+		}
+	}
+	return s.delta(map[string]any{"type": "text_delta", "text": text})
+}
+
+func (s *anthropicStream) toolCall(call chatToolCall) error {
+	index := 0
+	if call.Index != nil {
+		index = *call.Index
+	}
+	block, ok := s.toolBlocks[index]
+	if !ok {
+		if err := s.openBlock(true, map[string]any{
+			"type":  "tool_use",
+			"id":    call.ID,
+			"name":  call.Function.Name,
+			"input": map[string]any{},
+		}); err != nil {
+			return err
+		}
+		s.toolBlocks[index] = s.block
+		block = s.block
+	}
+	if call.Function.Arguments == "" {
+		return nil
+	}
+	if block != s.block {
+		// Interleaved arguments for an earlier tool call cannot be
+		// expressed once its block has been closed.
+		return nil
+	}
+	return s.delta(map[string]any{"type": "input_json_delta", "partial_json": call.Function.Arguments})
+}
+
+func (s *anthropicStream) openBlock(tool bool, content map[string]any) error {
+	if err := s.closeBlock(); err != nil {
+		return err
+	}
+	s.block = s.blocks
+	s.blocks++
+	s.blockTool = tool
+	return s.event("content_block_start", map[string]any{
+		"type":          "content_block_start",
+		"index":         s.block,
+		"content_block": content,
+	})
+}
+
+func (s *anthropicStream) closeBlock() error {
+	if s.block < 0 {
+		return nil
+	}
+	index := s.block
+	s.block = -1
+	return s.event("content_block_stop", map[string]any{"type": "content_block_stop", "index": index})
+}
+
+func (s *anthropicStream) delta(delta map[string]any) error {
+	padding, err := randomPadding()
+	if err != nil {
+		return err
+	}
+	delta["p"] = padding
+	return s.event("content_block_delta", map[string]any{
+		"type":  "content_block_delta",
+		"index": s.block,
+		"delta": delta,
+	})
+}
+
+func (s *anthropicStream) stop() error {
+	if s.stopped {
+		return nil
+	}
+	if err := s.start(""); err != nil {
+		return err
+	}
+	if err := s.closeBlock(); err != nil {
+		return err
+	}
+	s.stopped = true
+	stopReason := s.stopReason
+	if stopReason == nil {
+		endTurn := "end_turn"
+		stopReason = &endTurn
+	}
+	if err := s.event("message_delta", map[string]any{
+		"type":  "message_delta",
+		"delta": map[string]any{"stop_reason": stopReason, "stop_sequence": s.stopSeq},
+		"usage": s.usage,
+	}); err != nil {
+		return err
+	}
+	return s.event("message_stop", map[string]any{"type": "message_stop"})
+}
+
+func (s *anthropicStream) fail(message string) error {
+	s.stopped = true
+	return s.event("error", map[string]any{
+		"type":  "error",
+		"error": map[string]string{"type": anthropicErrAPI, "message": message},
+	})
+}
+
+// close ends a stream that the upstream did not terminate with [DONE].
+func (s *anthropicStream) close() {
+	if s.stopped {
+		return
+	}
+	if s.stopReason != nil {
+		_ = s.stop()
+		return
+	}
+	_ = s.fail(errMsgServerError)
+}
+
+func (s *anthropicStream) event(name string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", name, data); err != nil {
+		return err
+	}
+	_ = s.controller.Flush()
+	return nil
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tinfoilsh/encrypted-http-body-protocol/identity"
+
+	tinfoilattestation "tinfoil/internal/attestation"
+	"tinfoil/internal/config"
+	"tinfoil/internal/key"
+	"tinfoil/internal/legacy"
+)
+
+// serveAnthropic translates body as a Messages request, serves the chat
+// completion request with upstream and returns the translated response.
+func serveAnthropic(t *testing.T, body string, upstream http.HandlerFunc) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, anthropicMessagesPath, strings.NewReader(body))
+	aw, translated, ok := translateAnthropicRequest(rec, req)
+	if !ok {
+		return rec
+	}
+	upstream(aw, translated)
+	aw.finish()
+	return rec
+}
+
+type anthropicEvent struct {
+	name string
+	data map[string]any
+}
+
+func parseAnthropicEvents(t *testing.T, body string) []anthropicEvent {
+	t.Helper()
+	var events []anthropicEvent
+	for _, raw := range strings.Split(strings.TrimSpace(body), "\n\n") {
+		name, data, ok := strings.Cut(raw, "\ndata: ")
+		if !ok || !strings.HasPrefix(name, "event: ") {
+			t.Fatalf("malformed event %q", raw)
+		}
+		event := anthropicEvent{name: strings.TrimPrefix(name, "event: ")}
+		if err := json.Unmarshal([]byte(data), &event.data); err != nil {
+			t.Fatalf("event %q: %v", raw, err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestAnthropicMessagesTranslatesRequest(t *testing.T) {
+	body := `{
+		"model": "m",
+		"max_tokens": 64,
+		"system": [{"type": "text", "text": "be brief"}],
+		"stop_sequences": ["END"],
+		"metadata": {"user_id": "u1"},
+		"tools": [{"name": "lookup", "input_schema": {"type": "object"}}],
+		"tool_choice": {"type": "any", "disable_parallel_tool_use": true},
+		"messages": [
+			{"role": "user", "content": "hi"},
+			{"role": "assistant", "content": [{"type": "text", "text": "checking"}, {"type": "tool_use", "id": "call_1", "name": "lookup", "input": {"q": "x"}}]},
+			{"role": "user", "content": [
+				{"type": "text", "text": "and this"},
+				{"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "AAAA"}},
+				{"type": "tool_result", "tool_use_id": "call_1", "content": [{"type": "text", "text": "found"}]}
+			]}
+		]
+	}`
+	req := httptest.NewRequest(http.MethodPost, anthropicMessagesPath, strings.NewReader(body))
+	req.Header.Set("X-Api-Key", "sk-a")
+	req.Header.Set("Anthropic-Version", "2023-06-01")
+	req.Header.Set(lastEventIDHeader, "x:1")
+	rec := httptest.NewRecorder()
+	_, translated, ok := translateAnthropicRequest(rec, req)
+	if !ok {
+		t.Fatalf("translation failed: %s", rec.Body.String())
+	}
+
+	if translated.URL.Path != chatCompletionsPath {
+		t.Fatalf("path = %q, want %q", translated.URL.Path, chatCompletionsPath)
+	}
+	if got := translated.Header.Get("Authorization"); got != "Bearer sk-a" {
+		t.Fatalf("Authorization = %q, want the x-api-key as a bearer token", got)
+	}
+	for _, name := range []string{"X-Api-Key", "Anthropic-Version", lastEventIDHeader} {
+		if translated.Header.Get(name) != "" {
+			t.Fatalf("%s forwarded to the upstream", name)
+		}
+	}
+
+	raw, _ := io.ReadAll(translated.Body)
+	var chat struct {
+		MaxTokens         int      `json:"max_tokens"`
+		Stop              []string `json:"stop"`
+		User              string   `json:"user"`
+		ToolChoice        any      `json:"tool_choice"`
+		ParallelToolCalls *bool    `json:"parallel_tool_calls"`
+		Tools             []chatTool
+		Messages          []struct {
+			Role       string          `json:"role"`
+			Content    json.RawMessage `json:"content"`
+			ToolCalls  []chatToolCall  `json:"tool_calls"`
+			ToolCallID string          `json:"tool_call_id"`
+		} `json:"messages"`
+	}
+	if err := json.Unmarshal(raw, &chat); err != nil {
+		t.Fatalf("translated body %s: %v", raw, err)
+	}
+	if chat.MaxTokens != 64 || len(chat.Stop) != 1 || chat.User != "u1" || chat.ToolChoice != "required" {
+		t.Fatalf("translated parameters = %s", raw)
+	}
+	if chat.ParallelToolCalls == nil || *chat.ParallelToolCalls {
+		t.Fatalf("disable_parallel_tool_use not translated: %s", raw)
+	}
+	if len(chat.Tools) != 1 || chat.Tools[0].Function.Name != "lookup" {
+		t.Fatalf("tools = %s", raw)
+	}
+
+	var roles []string
+	for _, message := range chat.Messages {
+		roles = append(roles, message.Role)
+	}
+	if got := strings.Join(roles, ","); got != "system,user,assistant,tool,user" {
+		t.Fatalf("roles = %s, want tool results before the following user content", got)
+	}
+	if calls := chat.Messages[2].ToolCalls; len(calls) != 1 || calls[0].ID != "call_1" || calls[0].Function.Arguments != `{"q":"x"}` {
+		t.Fatalf("assistant tool calls = %+v", calls)
+	}
+	if chat.Messages[3].ToolCallID != "call_1" || string(chat.Messages[3].Content) != `"found"` {
+		t.Fatalf("tool message = %+v", chat.Messages[3])
+	}
+	if !strings.Contains(string(chat.Messages[4].Content), "data:image/png;base64,AAAA") {
+		t.Fatalf("image not translated to a data URL: %s", chat.Messages[4].Content)
+	}
+}
+
+func TestAnthropicMessagesRejectsInvalidRequest(t *testing.T) {
+	tests := map[string]string{
+		"not json":           `hello`,
+		"missing max_tokens": `{"model":"m","messages":[{"role":"user","content":"hi"}]}`,
+		"no messages":        `{"model":"m","max_tokens":1,"messages":[]}`,
+		"unknown block":      `{"model":"m","max_tokens":1,"messages":[{"role":"user","content":[{"type":"document"}]}]}`,
+		"unknown role":       `{"model":"m","max_tokens":1,"messages":[{"role":"system","content":"hi"}]}`,
+	}
+	for name, body := range tests {
+		rec := serveAnthropic(t, body, func(http.ResponseWriter, *http.Request) {
+			t.Fatalf("%s: invalid request reached the upstream", name)
+		})
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `"type":"invalid_request_error"`) {
+			t.Errorf("%s: status = %d, body = %s", name, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestAnthropicMessagesTranslatesResponse(t *testing.T) {
+	rec := serveAnthropic(t, `{"model":"m","max_tokens":8,"messages":[{"role":"user","content":"hi"}]}`, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", "999")
+		_, _ = io.WriteString(w, `{"model":"m-1","choices":[{"message":{"content":"hello","tool_calls":[{"id":"call_1","type":"function","function":{"name":"lookup","arguments":"{\"q\":1}"}}]},"finish_reason":"stop","stop_reason":"END"}],"usage":{"prompt_tokens":3,"completion_tokens":2}}`)
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Content-Length") != "" {
+		t.Fatal("upstream Content-Length was forwarded with the translated body")
+	}
+	var message anthropicResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &message); err != nil {
+		t.Fatal(err)
+	}
+	if message.Type != "message" || message.Model != "m-1" || !strings.HasPrefix(message.ID, "msg_") {
+		t.Fatalf("message = %+v", message)
+	}
+	if len(message.Content) != 2 || message.Content[0].Text != "hello" || message.Content[1].Type != "tool_use" || string(message.Content[1].Input) != `{"q":1}` {
+		t.Fatalf("content = %+v", message.Content)
+	}
+	if message.StopReason == nil || *message.StopReason != "stop_sequence" || message.StopSequence == nil || *message.StopSequence != "END" {
+		t.Fatalf("stop = %v %v", message.StopReason, message.StopSequence)
+	}
+	if message.Usage != (anthropicUsage{InputTokens: 3, OutputTokens: 2}) {
+		t.Fatalf("usage = %+v", message.Usage)
+	}
+}
+
+func TestAnthropicMessagesTranslatesErrors(t *testing.T) {
+	tests := []struct {
+		status    int
+		errorType string
+	}{
+		{http.StatusUnauthorized, anthropicErrAuthentication},
+		{http.StatusTooManyRequests, anthropicErrRateLimit},
+		{http.StatusBadGateway, anthropicErrAPI},
+		{http.StatusServiceUnavailable, anthropicErrOverloaded},
+	}
+	for _, tt := range tests {
+		rec := serveAnthropic(t, `{"model":"m","max_tokens":8,"messages":[{"role":"user","content":"hi"}]}`, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", "1")
+			writeJSONError(w, "upstream said no", errTypeInvalidRequest, tt.status)
+		})
+		var body struct {
+			Type  string `json:"type"`
+			Error struct {
+				Type    string `json:"type"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != tt.status || body.Type != "error" || body.Error.Type != tt.errorType || body.Error.Message != "upstream said no" {
+			t.Errorf("status %d: got %d %s", tt.status, rec.Code, rec.Body.String())
+		}
+		if rec.Header().Get("Retry-After") != "1" {
+			t.Errorf("status %d: Retry-After not forwarded", tt.status)
+		}
+	}
+}
+
+func TestAnthropicMessagesTranslatesStream(t *testing.T) {
+	chunks := []string{
+		`{"model":"m","choices":[{"delta":{"role":"assistant","content":"Hel","p":"abcd"}}]}`,
+		`{"model":"m","choices":[{"delta":{"content":"lo"}}]}`,
+		`{"model":"m","choices":[{"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"lookup","arguments":""}}]}}]}`,
+		`{"model":"m","choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"q\":1}"}}]}}]}`,
+		`{"model":"m","choices":[{"delta":{},"finish_reason":"tool_calls"}]}`,
+		`{"model":"m","choices":[],"usage":{"prompt_tokens":5,"completion_tokens":4}}`,
+		`[DONE]`,
+	}
+	rec := serveAnthropic(t, `{"model":"m","max_tokens":8,"stream":true,"messages":[{"role":"user","content":"hi"}]}`, func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		if !strings.Contains(string(raw), `"include_usage":true`) {
+			t.Errorf("streamed request does not ask for usage: %s", raw)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		for _, chunk := range chunks {
+			fmt.Fprintf(w, "data: %s\n\n", chunk)
+		}
+	})
+
+	if rec.Header().Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("content type = %q", rec.Header().Get("Content-Type"))
+	}
+	events := parseAnthropicEvents(t, rec.Body.String())
+	var names []string
+	for _, event := range events {
+		names = append(names, event.name)
+		if event.name == "content_block_delta" {
+			delta := event.data["delta"].(map[string]any)
+			if padding, _ := delta["p"].(string); len(padding) < 4 {
+				t.Fatalf("content_block_delta without padding: %v", event.data)
+			}
+		}
+	}
+	want := "message_start,content_block_start,content_block_delta,content_block_delta,content_block_stop," +
+		"content_block_start,content_block_delta,content_block_stop,message_delta,message_stop"
+	if got := strings.Join(names, ","); got != want {
+		t.Fatalf("events = %s\nwant %s", got, want)
+	}
+	if block := events[5].data["content_block"].(map[string]any); block["type"] != "tool_use" || block["id"] != "call_1" {
+		t.Fatalf("tool block = %v", block)
+	}
+	if delta := events[6].data["delta"].(map[string]any); delta["partial_json"] != `{"q":1}` {
+		t.Fatalf("tool delta = %v", delta)
+	}
+	messageDelta := events[8].data
+	if messageDelta["delta"].(map[string]any)["stop_reason"] != "tool_use" {
+		t.Fatalf("message_delta = %v", messageDelta)
+	}
+	if usage := messageDelta["usage"].(map[string]any); usage["input_tokens"] != 5.0 || usage["output_tokens"] != 4.0 {
+		t.Fatalf("usage = %v", usage)
+	}
+}
+
+func TestAnthropicMessagesStreamReportsTruncation(t *testing.T) {
+	rec := serveAnthropic(t, `{"model":"m","max_tokens":8,"stream":true,"messages":[{"role":"user","content":"hi"}]}`, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Hel\"}}]}\n\n")
+	})
+	events := parseAnthropicEvents(t, rec.Body.String())
+	if last := events[len(events)-1]; last.name != "error" {
+		t.Fatalf("stream cut off without [DONE] ended with %q, want an error event", last.name)
+	}
+}
+
+func TestAnthropicMessagesRouteIsOptIn(t *testing.T) {
+	id, err := identity.NewIdentity()
+	if err != nil {
+		t.Fatalf("creating identity: %v", err)
+	}
+	att := &legacy.Document{Format: "https://tinfoil.sh/predicate/dummy/v2", Body: "deadbeef"}
+	for _, enabled := range []bool{false, true} {
+		cfg := &config.Config{UpstreamPort: 9999, Paths: []string{chatCompletionsPath}}
+		handler := NewShimServer(nil, nil, att, tinfoilattestation.BodyV2{}, 0, id, nil, staticCollateralSource{}, cfg, &config.ExternalConfig{}, &config.Extensions{AnthropicMessages: enabled}, "127.0.0.1:9999")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, anthropicMessagesPath, strings.NewReader(`{}`)))
+		if notFound := rec.Code == http.StatusNotFound; notFound == enabled {
+			t.Fatalf("enabled=%v: status = %d", enabled, rec.Code)
+		}
+	}
+}
+
+// unreadBody fails the test if the handler reads it.
+type unreadBody struct{ t *testing.T }
+
+func (b unreadBody) Read([]byte) (int, error) {
+	b.t.Error("request body read before the caller was authenticated")
+	return 0, io.EOF
+}
+
+func TestAnthropicMessagesAuthenticatesBeforeTranslating(t *testing.T) {
+	validator := &fakeValidator{err: &key.ValidationError{StatusCode: http.StatusUnauthorized}}
+	handler := testAuthServerWithExtensions(t, validator, []string{chatCompletionsPath}, &config.Extensions{AnthropicMessages: true})
+
+	req := httptest.NewRequest(http.MethodPost, anthropicMessagesPath, unreadBody{t})
+	req.Header.Set("X-Api-Key", "sk-a")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if len(validator.calls) != 1 || validator.calls[0].APIKey != "sk-a" || validator.calls[0].Path != chatCompletionsPath {
+		t.Fatalf("validator calls = %+v, want the x-api-key checked for chat completions", validator.calls)
+	}
+	var body struct {
+		Type  string `json:"type"`
+		Error struct {
+			Type string `json:"type"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusUnauthorized || body.Type != "error" || body.Error.Type != anthropicErrAuthentication {
+		t.Fatalf("status = %d, body = %s, want an Anthropic authentication error", rec.Code, rec.Body)
+	}
+}
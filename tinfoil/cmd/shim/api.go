@@ -57,6 +57,15 @@ func pathAllowed(allowedPaths []string, path string) bool {
 	return false
 }
 
+// upstreamPath returns the path a request to path is served as upstream:
+// Anthropic Messages requests are translated to chat completions.
+func upstreamPath(anthropicMessages bool, path string) string {
+	if anthropicMessages && path == anthropicMessagesPath {
+		return chatCompletionsPath
+	}
+	return path
+}
+
 func requestedHost(r *http.Request) string {
 	host, _, err := net.SplitHostPort(r.Host)
 	if err != nil {
@@ -76,6 +85,17 @@ func requiresAuth(authenticatedEndpoints *[]string, path string) bool {
 	return pathAllowed(*authenticatedEndpoints, path)
 }
 
+// routeScope returns the OAuth scope required by the first route scope rule
+// matching path, or "" if the validator's default scope applies.
+func routeScope(rules []config.RouteScope, path string) string {
+	for _, rule := range rules {
+		if pathMatchesPattern(rule.Path, path) {
+			return rule.Scope
+		}
+	}
+	return ""
+}
+
 // metricsValidator validates /metrics online-only: the local JWT leg accepts
 // any inference-scoped token without consulting the control plane, which would
 // bypass its admin-key requirement for /metrics. All other paths use the full
@@ -85,13 +105,16 @@ type metricsValidator struct {
 	chain  key.Validator
 }
 
-func (v *metricsValidator) Validate(req key.Request) error {
+func (v *metricsValidator) Validate(req key.Request) (*key.Claims, error) {
 	if req.Path == "/metrics" {
 		return v.online.Validate(req)
 	}
 	return v.chain.Validate(req)
 }
 
+// dpopHeader carries the RFC 9449 proof of possession for a DPoP token.
+const dpopHeader = "DPoP"
+
 // extractBearerToken returns the token portion of an Authorization header,
 // accepting any capitalization of the "Bearer" scheme.
 func extractBearerToken(header string) string {
@@ -102,10 +125,24 @@ func extractBearerToken(header string) string {
 	return strings.TrimSpace(header[len(scheme):])
 }
 
+// extractAccessToken returns the token of a Bearer or RFC 9449 DPoP
+// Authorization header and whether the DPoP scheme was used.
+func extractAccessToken(header string) (string, bool) {
+	if token := extractBearerToken(header); token != "" {
+		return token, false
+	}
+	const scheme = "dpop "
+	if len(header) < len(scheme) || !strings.EqualFold(header[:len(scheme)], scheme) {
+		return "", false
+	}
+	return strings.TrimSpace(header[len(scheme):]), true
+}
+
 // OpenAI-compatible error type strings returned in API error responses.
 const (
 	errTypeInvalidRequest    = "invalid_request_error"
 	errTypeInsufficientQuota = "insufficient_quota"
+	errTypeInsufficientScope = "insufficient_scope"
 	errTypeServer            = "server_error"
 )
 
@@ -117,6 +154,8 @@ const (
 	errMsgQuotaExceeded  = "Insufficient quota."
 	errMsgRateLimited    = "Rate limit reached for requests."
 	errMsgServerError    = "The server had an error while processing your request."
+	errMsgMisdirected    = "This server does not serve the requested host."
+	errMsgScopeRequired  = "The API key lacks the scope this endpoint requires."
 )
 
 // writeJSONError writes an OpenAI-compatible JSON error response.
@@ -145,6 +184,8 @@ func writeValidationFailure(w http.ResponseWriter, err error) {
 		writeJSONError(w, errMsgQuotaExceeded, errTypeInsufficientQuota, validationErr.StatusCode)
 	case http.StatusTooManyRequests:
 		writeJSONError(w, errMsgRateLimited, errTypeInsufficientQuota, validationErr.StatusCode)
+	case http.StatusServiceUnavailable:
+		writeJSONError(w, errMsgServerError, errTypeServer, validationErr.StatusCode)
 	default:
 		writeJSONError(w, errMsgServerError, errTypeServer, http.StatusInternalServerError)
 	}
@@ -165,7 +206,7 @@ func corsMiddleware(config *config.Config, next http.Handler) http.Handler {
 			w.Header().Set("Vary", "Origin") // cache
 			w.Header().Set("Access-Control-Allow-Credentials", "true")
 			w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, POST, HEAD, DELETE, OPTIONS")
-			w.Header().Set("Access-Control-Expose-Headers", "Ehbp-Encapsulated-Key, Ehbp-Response-Nonce, Content-Type, Tinfoil-Pt")
+			w.Header().Set("Access-Control-Expose-Headers", "Ehbp-Encapsulated-Key, Ehbp-Response-Nonce, Content-Type, Tinfoil-Pt, Idempotent-Replayed")
 
 			// Echo requested headers or use a safe default
 			reqHdr := r.Header.Get("Access-Control-Request-Headers")
@@ -198,10 +239,14 @@ func NewShimServer(
 	collateralSource collateralSource,
 	config *config.Config,
 	externalConfig *config.ExternalConfig,
+	extensions *config.Extensions,
 	upstreamAddr string,
 ) http.Handler {
 	ehbpMiddleware := ehbpIdentity.Middleware()
 	mux := http.NewServeMux()
+	idempotency := newIdempotencyStore()
+	streams := newStreamStore()
+	breaker := newUpstreamBreaker(config.UpstreamContainer, boot.ContainerStatusPath)
 
 	proxy := httputil.ReverseProxy{
 		Director: func(req *http.Request) {
@@ -222,7 +267,8 @@ func NewShimServer(
 			// proxied
 		},
 		Transport: &streamTransport{
-			base: http.DefaultTransport,
+			base:    &breakerTransport{base: http.DefaultTransport, breaker: breaker},
+			streams: streams,
 		},
 		ModifyResponse: func(res *http.Response) error {
 			res.Header.Del("Access-Control-Allow-Origin")
@@ -230,57 +276,87 @@ func NewShimServer(
 			return nil
 		},
 		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			var unavailable *upstreamUnavailableError
+			if errors.As(err, &unavailable) {
+				writeUpstreamUnavailable(w, unavailable)
+				return
+			}
 			log.Printf("proxy error: %v", err)
 			writeJSONError(w, errMsgServerError, errTypeServer, http.StatusBadGateway)
 		},
 	}
 
+	authorizer := &requestAuthorizer{validator: validator, rateLimiter: rateLimiter, config: config, extensions: extensions}
+	domains := newServedDomains(externalConfig.Env["DOMAIN"], config.TLSWildcard, extensions.DomainAliases)
+	batches := newBatchStore(boot.BatchDir, authorizer.batchUpstream(&proxy), authorizer.batchAuthorizer(domains), config.Paths, extensions.EHBPRequiredPaths)
+
 	proxyHandler := ehbpMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		apiKey := extractBearerToken(r.Header.Get("Authorization"))
-		if validator != nil && requiresAuth(config.AuthenticatedEndpoints, r.URL.Path) {
-			if len(apiKey) == 0 {
-				writeJSONError(w, errMsgAPIKeyRequired, errTypeInvalidRequest, http.StatusUnauthorized)
-				return
-			}
+		domain, ok := domains.match(requestedHost(r))
+		if !ok {
+			writeJSONError(w, errMsgMisdirected, errTypeInvalidRequest, http.StatusMisdirectedRequest)
+			return
+		}
 
-			validationReq := key.Request{
-				APIKey:        apiKey,
-				Domain:        strings.ToLower(externalConfig.Env["DOMAIN"]),
-				RequestedHost: requestedHost(r),
-				Path:          r.URL.Path,
+		// DPoP proofs are bound to the URL the client called, which
+		// translation below may rewrite.
+		requestURL := "https://" + r.Host + r.URL.EscapedPath()
+
+		// Anthropic Messages requests are served as chat completions. They
+		// are authorized as one before their body is read, and refusals are
+		// answered in the Anthropic error format.
+		anthropic := extensions.AnthropicMessages && r.URL.Path == anthropicMessagesPath
+		authWriter, path := w, r.URL.Path
+		if anthropic {
+			r = withAnthropicAuthorization(r)
+			authWriter, path = newAnthropicResponseWriter(w, ""), chatCompletionsPath
+		}
+		r, apiKey, ok := authorizer.authenticate(authWriter, r, path, domain, requestURL)
+		if !ok || !authorizer.allow(authWriter, apiKey) {
+			if aw, translating := authWriter.(*anthropicResponseWriter); translating {
+				aw.finish()
 			}
+			return
+		}
 
-			if err := validator.Validate(validationReq); err != nil {
-				log.Printf("Warning: failed to validate API key: %v", err)
-				writeValidationFailure(w, err)
+		// Translation happens after EHBP decryption.
+		if anthropic {
+			aw, translated, ok := translateAnthropicRequest(w, r)
+			if !ok {
 				return
 			}
+			defer aw.finish()
+			w, r = aw, translated
 		}
 
-		if rateLimiter != nil {
-			if apiKey == "" {
-				writeJSONError(w, errMsgAPIKeyRequired, errTypeInvalidRequest, http.StatusUnauthorized)
-				return
-			}
-			limiter := rateLimiter.Limit(apiKey)
-			if !limiter.Allow() {
-				writeJSONError(w, errMsgRateLimited, errTypeInvalidRequest, http.StatusTooManyRequests)
+		if authorizer.servesBatches(r.URL.Path) {
+			batches.serve(w, r, apiKey)
+			return
+		}
+
+		if apiKey != "" && r.URL.Path == chatCompletionsPath && !anthropic {
+			if r.Header.Get(lastEventIDHeader) != "" {
+				streams.resume(w, r, apiKey)
 				return
 			}
+			r = r.WithContext(withStreamScope(r.Context(), apiKey))
 		}
 
-		proxy.ServeHTTP(w, r)
+		idempotency.serve(w, r, apiKey, &proxy)
 	}))
 
+	// Plaintext bodies are refused before the EHBP middleware would accept
+	// them as unencrypted requests.
+	proxyHandler = requireEHBP(extensions.EHBPRequiredPaths, extensions.AnthropicMessages, proxyHandler)
+
 	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if len(config.Paths) > 0 && !pathAllowed(config.Paths, r.URL.Path) {
+		if len(config.Paths) > 0 && !pathAllowed(config.Paths, upstreamPath(extensions.AnthropicMessages, r.URL.Path)) {
 			writeJSONError(w, "Not found.", errTypeInvalidRequest, http.StatusNotFound)
 			return
 		}
 		proxyHandler.ServeHTTP(w, r)
 	}))
 
-	registerObservabilityHandlers(mux, ehbpMiddleware, att, identityBody, expectedGPUs, ehbpIdentity, tlsCert, collateralSource, externalConfig)
+	registerObservabilityHandlers(mux, ehbpMiddleware, att, identityBody, expectedGPUs, ehbpIdentity, tlsCert, collateralSource, externalConfig, extensions)
 
 	return wrapShimMux(config, att, mux)
 }
@@ -294,10 +370,11 @@ func NewObservabilityServer(
 	collateralSource collateralSource,
 	config *config.Config,
 	externalConfig *config.ExternalConfig,
+	extensions *config.Extensions,
 ) http.Handler {
 	ehbpMiddleware := ehbpIdentity.Middleware()
 	mux := http.NewServeMux()
-	registerObservabilityHandlers(mux, ehbpMiddleware, att, identityBody, expectedGPUs, ehbpIdentity, tlsCert, collateralSource, externalConfig)
+	registerObservabilityHandlers(mux, ehbpMiddleware, att, identityBody, expectedGPUs, ehbpIdentity, tlsCert, collateralSource, externalConfig, extensions)
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		writeWorkloadUnavailable(w)
 	})
@@ -324,48 +401,67 @@ func registerObservabilityHandlers(
 	tlsCert *tls.Certificate,
 	collateralSource collateralSource,
 	externalConfig *config.ExternalConfig,
+	extensions *config.Extensions,
 ) {
+	// The EHBP policy is bound into fresh attestations so clients can check
+	// which routes refuse plaintext before trusting one not to.
+	var policy []envelope.CryptoMaterialItem
+	if len(extensions.EHBPRequiredPaths) > 0 {
+		policy = append(policy, tinfoilattestation.EHBPPolicyItem(extensions.EHBPRequiredPaths))
+	}
+
+	// freshAttestation builds a v3 attestation for ?nonce=<64 hex chars>
+	// whose crypto material also carries material. It writes the error
+	// response itself and reports whether it succeeded.
+	freshAttestation := func(w http.ResponseWriter, r *http.Request, nonceHex string, material []envelope.CryptoMaterialItem) (*envelope.Document, bool) {
+		nonce, err := hex.DecodeString(nonceHex)
+		if err != nil || len(nonce) != 32 {
+			writeJSONError(w, "Invalid nonce: must be exactly 32 bytes (64 hex chars)", errTypeInvalidRequest, http.StatusBadRequest)
+			return nil, false
+		}
+		var nonce32 [32]byte
+		copy(nonce32[:], nonce)
+		var collateral []envelope.CollateralEntry
+		if collateralSource != nil {
+			collateral, err = collateralSource.Current(r.Context())
+			if err != nil {
+				log.Printf("Attestation collateral unavailable: %v", err)
+				writeJSONError(w, "Attestation collateral unavailable", errTypeServer, http.StatusServiceUnavailable)
+				return nil, false
+			}
+		}
+		deviceEvidence, err := tinfoilattestation.CollectDeviceEvidence(nonce32, expectedGPUs)
+		if err != nil {
+			log.Printf("Device evidence collection failed for %d expected GPU(s): %v", expectedGPUs, err)
+			writeJSONError(w, "GPU attestation evidence unavailable", errTypeServer, http.StatusInternalServerError)
+			return nil, false
+		}
+
+		fresh, err := tinfoilattestation.BuildAttestation(
+			identityBody.TLSKeyFP,
+			identityBody.HPKEKey,
+			nonce,
+			deviceEvidence,
+			collateral,
+			append(slices.Clip(policy), material...),
+		)
+		if err != nil {
+			log.Printf("Fresh attestation failed: %v", err)
+			writeJSONError(w, "Failed to build attestation", errTypeServer, http.StatusInternalServerError)
+			return nil, false
+		}
+		return fresh, true
+	}
+
 	mux.Handle("/.well-known/tinfoil-attestation", ehbpMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
 		// Fresh v3 attestation with nonce: ?nonce=<64 hex chars>
 		if nonceHex := r.URL.Query().Get("nonce"); nonceHex != "" {
-			nonce, err := hex.DecodeString(nonceHex)
-			if err != nil || len(nonce) != 32 {
-				writeJSONError(w, "Invalid nonce: must be exactly 32 bytes (64 hex chars)", errTypeInvalidRequest, http.StatusBadRequest)
-				return
-			}
-			var nonce32 [32]byte
-			copy(nonce32[:], nonce)
-			var collateral []envelope.CollateralEntry
-			if collateralSource != nil {
-				collateral, err = collateralSource.Current(r.Context())
-				if err != nil {
-					log.Printf("Attestation collateral unavailable: %v", err)
-					writeJSONError(w, "Attestation collateral unavailable", errTypeServer, http.StatusServiceUnavailable)
-					return
-				}
-			}
-			deviceEvidence, err := tinfoilattestation.CollectDeviceEvidence(nonce32, expectedGPUs)
-			if err != nil {
-				log.Printf("Device evidence collection failed for %d expected GPU(s): %v", expectedGPUs, err)
-				writeJSONError(w, "GPU attestation evidence unavailable", errTypeServer, http.StatusInternalServerError)
+			fresh, ok := freshAttestation(w, r, nonceHex, nil)
+			if !ok {
 				return
 			}
-
-			fresh, err := tinfoilattestation.BuildAttestation(
-				identityBody.TLSKeyFP,
-				identityBody.HPKEKey,
-				nonce,
-				deviceEvidence,
-				collateral,
-			)
-			if err != nil {
-				log.Printf("Fresh attestation failed: %v", err)
-				writeJSONError(w, "Failed to build attestation", errTypeServer, http.StatusInternalServerError)
-				return
-			}
-
 			json.NewEncoder(w).Encode(fresh)
 			return
 		}
@@ -374,6 +470,8 @@ func registerObservabilityHandlers(
 		json.NewEncoder(w).Encode(att)
 	})))
 
+	mux.Handle(manifestPath, ehbpMiddleware(manifestHandler(newManifestSource(), freshAttestation)))
+
 	mux.HandleFunc("/.well-known/tinfoil-certificate", func(w http.ResponseWriter, r *http.Request) {
 		if tlsCert == nil || len(tlsCert.Certificate) == 0 {
 			http.Error(w, "Certificate not available", http.StatusServiceUnavailable)
@@ -401,6 +499,8 @@ func registerObservabilityHandlers(
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(state)
 	})
+	mux.HandleFunc(diagnosticsPath, diagnosticsHandler(boot.DiagnosticsPath, *externalConfigFile))
+	mux.HandleFunc(nodeFactsPath, nodeFactsHandler(boot.NodeFactsPath, externalConfig.MetricsAPIKey))
 
 	mux.HandleFunc("/.well-known/tinfoil-metrics", metrics.HandleMetrics(externalConfig))
 	mux.HandleFunc("/.well-known/metrics", metrics.HandlePrometheusMetrics(&externalConfig.Metadata, externalConfig.MetricsAPIKey))
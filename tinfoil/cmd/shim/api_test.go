@@ -17,6 +17,7 @@ import (
 	tinfoilattestation "tinfoil/internal/attestation"
 	"tinfoil/internal/config"
 	"tinfoil/internal/key"
+	"tinfoil/internal/key/introspection"
 	"tinfoil/internal/legacy"
 )
 
@@ -33,17 +34,23 @@ func (errorCollateralSource) Current(context.Context) ([]envelope.CollateralEntr
 }
 
 type fakeValidator struct {
-	err   error
-	calls []key.Request
+	claims *key.Claims
+	err    error
+	calls  []key.Request
 }
 
-func (f *fakeValidator) Validate(req key.Request) error {
+func (f *fakeValidator) Validate(req key.Request) (*key.Claims, error) {
 	f.calls = append(f.calls, req)
-	return f.err
+	return f.claims, f.err
 }
 
 func testAuthServer(t *testing.T, validator key.Validator, authenticatedEndpoints []string) http.Handler {
 	t.Helper()
+	return testAuthServerWithExtensions(t, validator, authenticatedEndpoints, &config.Extensions{})
+}
+
+func testAuthServerWithExtensions(t *testing.T, validator key.Validator, authenticatedEndpoints []string, extensions *config.Extensions) http.Handler {
+	t.Helper()
 
 	id, err := identity.NewIdentity()
 	if err != nil {
@@ -60,7 +67,7 @@ func testAuthServer(t *testing.T, validator key.Validator, authenticatedEndpoint
 		Body:   "deadbeef",
 	}
 
-	return NewShimServer(validator, nil, att, tinfoilattestation.BodyV2{}, 0, id, nil, nil, cfg, extCfg, "127.0.0.1:9999")
+	return NewShimServer(validator, nil, att, tinfoilattestation.BodyV2{}, 0, id, nil, nil, cfg, extCfg, extensions, "127.0.0.1:9999")
 }
 
 func testServer(t *testing.T, paths []string, upstreamPort int) http.Handler {
@@ -86,7 +93,7 @@ func testFullServer(t *testing.T, paths []string, upstreamPort int) http.Handler
 		Body:   "deadbeef",
 	}
 	upstreamAddr := fmt.Sprintf("127.0.0.1:%d", upstreamPort)
-	return NewShimServer(nil, nil, att, tinfoilattestation.BodyV2{}, 0, id, nil, staticCollateralSource{}, cfg, extCfg, upstreamAddr)
+	return NewShimServer(nil, nil, att, tinfoilattestation.BodyV2{}, 0, id, nil, staticCollateralSource{}, cfg, extCfg, &config.Extensions{}, upstreamAddr)
 }
 
 func testObservabilityServer(t *testing.T, paths []string) http.Handler {
@@ -103,7 +110,7 @@ func testObservabilityServer(t *testing.T, paths []string) http.Handler {
 		Format: "https://tinfoil.sh/predicate/dummy/v2",
 		Body:   "deadbeef",
 	}
-	return NewObservabilityServer(att, tinfoilattestation.BodyV2{}, 0, id, nil, staticCollateralSource{}, cfg, extCfg)
+	return NewObservabilityServer(att, tinfoilattestation.BodyV2{}, 0, id, nil, staticCollateralSource{}, cfg, extCfg, &config.Extensions{})
 }
 
 func TestV3AttestationReturns503WhenCollateralExpired(t *testing.T) {
@@ -120,6 +127,7 @@ func TestV3AttestationReturns503WhenCollateralExpired(t *testing.T) {
 		errorCollateralSource{},
 		&config.Config{},
 		&config.ExternalConfig{},
+		&config.Extensions{},
 	)
 	req := httptest.NewRequest(http.MethodGet, "/.well-known/tinfoil-attestation?nonce="+strings.Repeat("00", 32), nil)
 	rec := httptest.NewRecorder()
@@ -214,6 +222,96 @@ func TestRequiresAuth(t *testing.T) {
 	}
 }
 
+func TestRouteScope(t *testing.T) {
+	rules := []config.RouteScope{
+		{Path: "/v1/embeddings", Scope: "inference:embeddings"},
+		{Path: "/v1/batches*", Scope: "inference:batch"},
+		{Path: "/v1/*", Scope: "inference:other"},
+	}
+	tests := map[string]string{
+		"/v1/embeddings":         "inference:embeddings",
+		"/v1/batches":            "inference:batch",
+		"/v1/batches/b-1/cancel": "inference:batch",
+		"/v1/chat/completions":   "inference:other",
+		"/metrics":               "",
+	}
+	for path, want := range tests {
+		if got := routeScope(rules, path); got != want {
+			t.Errorf("routeScope(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestRouteScopeIsPassedToValidator(t *testing.T) {
+	validator := &fakeValidator{err: &key.ValidationError{StatusCode: http.StatusForbidden}}
+	extensions := &config.Extensions{RouteScopes: []config.RouteScope{{Path: "/v1/embeddings", Scope: "inference:embeddings"}}}
+	// /v1/embeddings is not an authenticated endpoint, but its route scope
+	// still has to be checked.
+	handler := testAuthServerWithExtensions(t, validator, []string{"/v1/chat/completions"}, extensions)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/embeddings", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if len(validator.calls) != 1 || validator.calls[0].Scope != "inference:embeddings" {
+		t.Fatalf("validator calls = %+v, want one call with the route scope", validator.calls)
+	}
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want 403", rec.Code)
+	}
+}
+
+func TestRouteScopeRejectsOpaqueKeys(t *testing.T) {
+	extensions := &config.Extensions{RouteScopes: []config.RouteScope{{Path: "/v1/embeddings", Scope: "inference:embeddings"}}}
+	tests := []struct {
+		name   string
+		claims *key.Claims
+		status int
+	}{
+		// The online validator accepts opaque keys without claims.
+		{"opaque key", nil, http.StatusForbidden},
+		{"other scope", &key.Claims{Scopes: []string{"inference:api"}}, http.StatusForbidden},
+		{"route scope", &key.Claims{Scopes: []string{"inference:api", "inference:embeddings"}}, http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := testAuthServerWithExtensions(t, &fakeValidator{claims: tt.claims}, nil, extensions)
+			req := httptest.NewRequest(http.MethodPost, "/v1/embeddings", nil)
+			req.Header.Set("Authorization", "Bearer sk-opaque")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			if tt.status == http.StatusForbidden && !strings.Contains(rec.Body.String(), errTypeInsufficientScope) {
+				t.Fatalf("body = %s, want %s", rec.Body.String(), errTypeInsufficientScope)
+			}
+		})
+	}
+}
+
+func TestKeyValidatorIntrospectsWithoutControlPlane(t *testing.T) {
+	extensions := &config.Extensions{TokenIntrospection: &config.TokenIntrospection{URL: "https://auth.example.com/introspect"}}
+	externalConfig := &config.ExternalConfig{Secrets: map[string]string{
+		config.IntrospectionClientIDSecret:     "shim",
+		config.IntrospectionClientSecretSecret: "secret",
+	}}
+	validator, err := newKeyValidator(&config.Config{}, externalConfig, extensions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := validator.(*introspection.Validator); !ok {
+		t.Fatalf("validator = %T, want the introspection validator", validator)
+	}
+
+	validator, err = newKeyValidator(&config.Config{}, externalConfig, &config.Extensions{})
+	if err != nil || validator != nil {
+		t.Fatalf("validator without control plane or introspection = %v, %v", validator, err)
+	}
+}
+
 func TestMetricsValidation_JWTGoesOnline(t *testing.T) {
 	// The local JWT leg accepts any inference-scoped token; /metrics must not
 	// be satisfiable by it, so the online validator's verdict is final.
@@ -305,6 +403,63 @@ func TestExtractBearerToken(t *testing.T) {
 	}
 }
 
+func TestExtractAccessToken(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+		dpop   bool
+	}{
+		{"Bearer sk-test", "sk-test", false},
+		{"DPoP eyJ.a.b", "eyJ.a.b", true},
+		{"dpop  eyJ.a.b ", "eyJ.a.b", true},
+		{"DPoP", "", false},
+		{"Token sk-test", "", false},
+	}
+
+	for _, tt := range tests {
+		got, dpop := extractAccessToken(tt.header)
+		if got != tt.want || dpop != tt.dpop {
+			t.Errorf("extractAccessToken(%q) = %q, %v; want %q, %v", tt.header, got, dpop, tt.want, tt.dpop)
+		}
+	}
+}
+
+func TestDPoPRequiredPaths(t *testing.T) {
+	extensions := &config.Extensions{DPoPRequiredPaths: []string{"/v1/embeddings"}}
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/v1/embeddings?x=1", nil)
+		req.Host = "inference.example.com"
+		req.Header.Set("Authorization", "DPoP token")
+		req.Header.Set("DPoP", "proof")
+		return req
+	}
+
+	// An opaque key carries no proof-of-possession, so it is refused even
+	// when the validator accepts it.
+	validator := &fakeValidator{}
+	rec := httptest.NewRecorder()
+	testAuthServerWithExtensions(t, validator, nil, extensions).ServeHTTP(rec, newRequest())
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("opaque key on DPoP route: status = %d, want 401", rec.Code)
+	}
+	if len(validator.calls) != 1 {
+		t.Fatalf("validator calls = %d, want 1", len(validator.calls))
+	}
+	got := validator.calls[0]
+	if !got.RequireDPoP || !got.DPoPScheme || got.DPoPProof != "proof" || got.Method != http.MethodPost ||
+		got.URL != "https://inference.example.com/v1/embeddings" {
+		t.Fatalf("validation request = %+v", got)
+	}
+
+	req := newRequest()
+	req.Header.Add("DPoP", "second-proof")
+	rec = httptest.NewRecorder()
+	testAuthServerWithExtensions(t, &fakeValidator{}, nil, extensions).ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("multiple proofs: status = %d, want 400", rec.Code)
+	}
+}
+
 func TestRequestedHost(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "https://realtime-model.model.example.com/v1/realtime", nil)
 	req.Host = "Realtime-Model.Model.Example.Com:443"
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"tinfoil/internal/config"
+	"tinfoil/internal/key"
+)
+
+// requestAuthorizer applies the shim's access checks to a request: the
+// validator with the route's scope and DPoP requirement, then the per-key
+// rate limit. Live requests and batch submissions go through it.
+type requestAuthorizer struct {
+	validator   key.Validator
+	rateLimiter *RateLimiter
+	config      *config.Config
+	extensions  *config.Extensions
+}
+
+// authenticates reports whether requests for path must carry a valid token.
+// Routes with their own scope, requiring DPoP, or belonging to the batch
+// API when the shim serves it, which runs completions on the caller's
+// behalf, always do.
+func (a *requestAuthorizer) authenticates(path string) bool {
+	return a.validator != nil && (routeScope(a.extensions.RouteScopes, path) != "" ||
+		pathAllowed(a.extensions.DPoPRequiredPaths, path) ||
+		a.servesBatches(path) ||
+		requiresAuth(a.config.AuthenticatedEndpoints, path))
+}
+
+// servesBatches reports whether path belongs to the shim's batch API.
+func (a *requestAuthorizer) servesBatches(path string) bool {
+	return a.extensions.Batches && isBatchPath(path)
+}
+
+// authenticate validates the token of r for path, the route r is served
+// as, and domain, the served name it matched; requestURL is the URL DPoP
+// proofs are bound to. It writes the error response and returns false when
+// r is refused, and otherwise returns r carrying the token's claims and the
+// token itself.
+func (a *requestAuthorizer) authenticate(w http.ResponseWriter, r *http.Request, path, domain, requestURL string) (*http.Request, string, bool) {
+	apiKey, dpopScheme := extractAccessToken(r.Header.Get("Authorization"))
+	if !a.authenticates(path) {
+		return r, apiKey, true
+	}
+	if len(apiKey) == 0 {
+		writeJSONError(w, errMsgAPIKeyRequired, errTypeInvalidRequest, http.StatusUnauthorized)
+		return nil, "", false
+	}
+	proofs := r.Header.Values(dpopHeader)
+	if len(proofs) > 1 {
+		writeJSONError(w, "Multiple DPoP proofs provided.", errTypeInvalidRequest, http.StatusBadRequest)
+		return nil, "", false
+	}
+
+	scope := routeScope(a.extensions.RouteScopes, path)
+	requireDPoP := pathAllowed(a.extensions.DPoPRequiredPaths, path)
+	validationReq := key.Request{
+		APIKey:        apiKey,
+		Domain:        domain,
+		RequestedHost: requestedHost(r),
+		Path:          path,
+		Scope:         scope,
+		DPoPScheme:    dpopScheme,
+		Method:        r.Method,
+		URL:           requestURL,
+		RequireDPoP:   requireDPoP,
+	}
+	if len(proofs) == 1 {
+		validationReq.DPoPProof = proofs[0]
+	}
+
+	claims, err := a.validator.Validate(validationReq)
+	if err != nil {
+		log.Printf("Warning: failed to validate API key: %v", err)
+		writeValidationFailure(w, err)
+		return nil, "", false
+	}
+	// Opaque keys cannot be sender-constrained, whatever the validator
+	// that accepted them.
+	if requireDPoP && (claims == nil || claims.DPoPKey == "") {
+		writeJSONError(w, errMsgInvalidAPIKey, errTypeInvalidRequest, http.StatusUnauthorized)
+		return nil, "", false
+	}
+	// Not every validator checks Scope, and opaque keys carry no scopes to
+	// check, so a scoped route needs claims that grant it.
+	if scope != "" && !claims.HasScope(scope) {
+		writeJSONError(w, errMsgScopeRequired, errTypeInsufficientScope, http.StatusForbidden)
+		return nil, "", false
+	}
+	if claims != nil {
+		r = r.WithContext(key.NewContext(r.Context(), claims))
+	}
+	return r, apiKey, true
+}
+
+// allow applies the per-key rate limit. It writes the error response and
+// returns false when the request is refused.
+func (a *requestAuthorizer) allow(w http.ResponseWriter, apiKey string) bool {
+	if a.rateLimiter == nil {
+		return true
+	}
+	if apiKey == "" {
+		writeJSONError(w, errMsgAPIKeyRequired, errTypeInvalidRequest, http.StatusUnauthorized)
+		return false
+	}
+	if !a.rateLimiter.Limit(apiKey).Allow() {
+		writeJSONError(w, errMsgRateLimited, errTypeInvalidRequest, http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// waitForRate applies the per-key rate limit to a batch line, which waits
+// for its turn instead of failing. It writes the error response and returns
+// false when the batch stops first.
+func (a *requestAuthorizer) waitForRate(w http.ResponseWriter, r *http.Request, apiKey string) bool {
+	if a.rateLimiter == nil {
+		return true
+	}
+	if apiKey == "" {
+		writeJSONError(w, errMsgAPIKeyRequired, errTypeInvalidRequest, http.StatusUnauthorized)
+		return false
+	}
+	if err := a.rateLimiter.Limit(apiKey).Wait(r.Context()); err != nil {
+		writeJSONError(w, errMsgRateLimited, errTypeInvalidRequest, http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// batchGrant is what the lines of a batch run with: the claims authorized
+// for its endpoint when it was submitted, and the key they are rate limited
+// under.
+type batchGrant struct {
+	claims  *key.Claims
+	rateKey string
+}
+
+type batchGrantKey struct{}
+
+// batchAuthorizer returns the check a batch submission passes: r is
+// authorized for endpoint, the route all of the batch's lines call, as a
+// live request to it would be, proving any DPoP binding with the proof for
+// the submission itself. The lines then run with the grant instead of
+// presenting the token again, which may expire before the batch finishes.
+func (a *requestAuthorizer) batchAuthorizer(domains servedDomains) func(http.ResponseWriter, *http.Request, string) (batchGrant, bool) {
+	return func(w http.ResponseWriter, r *http.Request, endpoint string) (batchGrant, bool) {
+		domain, _ := domains.match(requestedHost(r))
+		r, apiKey, ok := a.authenticate(w, r, endpoint, domain, "https://"+r.Host+r.URL.EscapedPath())
+		if !ok {
+			return batchGrant{}, false
+		}
+		claims, _ := key.FromContext(r.Context())
+		return batchGrant{claims: claims, rateKey: apiKey}, true
+	}
+}
+
+// batchUpstream serves batch lines with the grant of their batch: each
+// waits its turn under the submitter's rate limit and reaches upstream
+// carrying the submitter's claims.
+func (a *requestAuthorizer) batchUpstream(upstream http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		grant, _ := r.Context().Value(batchGrantKey{}).(batchGrant)
+		if !a.waitForRate(w, r, grant.rateKey) {
+			return
+		}
+		if grant.claims != nil {
+			r = r.WithContext(key.NewContext(r.Context(), grant.claims))
+		}
+		upstream.ServeHTTP(w, r)
+	})
+}
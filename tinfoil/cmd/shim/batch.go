@@ -0,0 +1,697 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"tinfoil/internal/key"
+)
+
+const (
+	batchFilesPath = "/v1/files"
+	batchesPath    = "/v1/batches"
+
+	// Batch files live on the private ramdisk, so every byte counts against
+	// enclave memory. The quotas bound what one API key, and all keys
+	// together, can hold there at once.
+	batchFileTTL              = 24 * time.Hour
+	batchCompletionWindow     = 24 * time.Hour
+	batchSweepInterval        = time.Minute
+	maxBatchFileBytes         = 64 << 20
+	maxBatchBytesPerScope     = 256 << 20
+	maxBatchStoreBytes        = 1 << 30
+	maxBatchFilesPerScope     = 64
+	maxBatchesPerScope        = 64
+	maxActiveBatchesPerScope  = 4
+	maxBatchFormOverheadBytes = 64 << 10
+	maxBatchPurposeBytes      = 64
+	maxBatchFilenameBytes     = 255
+
+	// batchConcurrency bounds upstream requests across all batches so that
+	// offline jobs cannot starve interactive traffic.
+	batchConcurrency = 4
+)
+
+const (
+	batchPurposeInput  = "batch"
+	batchPurposeOutput = "batch_output"
+
+	batchStatusValidating = "validating"
+	batchStatusInProgress = "in_progress"
+	batchStatusFinalizing = "finalizing"
+	batchStatusCompleted  = "completed"
+	batchStatusFailed     = "failed"
+	batchStatusExpired    = "expired"
+	batchStatusCancelling = "cancelling"
+	batchStatusCancelled  = "cancelled"
+)
+
+var errBatchQuota = errors.New("batch storage quota exceeded")
+
+// batchFile is an uploaded batch input or a produced result file. Exported
+// fields form the OpenAI-compatible file object.
+type batchFile struct {
+	ID        string `json:"id"`
+	Object    string `json:"object"`
+	Bytes     int64  `json:"bytes"`
+	CreatedAt int64  `json:"created_at"`
+	ExpiresAt int64  `json:"expires_at"`
+	Filename  string `json:"filename"`
+	Purpose   string `json:"purpose"`
+
+	scope    [sha256.Size]byte
+	path     string
+	endpoint string
+	requests int
+}
+
+type batchRequestCounts struct {
+	Total     int `json:"total"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+}
+
+type batchError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type batchErrors struct {
+	Object string       `json:"object"`
+	Data   []batchError `json:"data"`
+}
+
+// batchJob is one submitted batch. Exported fields form the OpenAI-compatible
+// batch object and are guarded by batchStore.mu.
+type batchJob struct {
+	ID               string             `json:"id"`
+	Object           string             `json:"object"`
+	Endpoint         string             `json:"endpoint"`
+	Errors           *batchErrors       `json:"errors"`
+	InputFileID      string             `json:"input_file_id"`
+	CompletionWindow string             `json:"completion_window"`
+	Status           string             `json:"status"`
+	OutputFileID     *string            `json:"output_file_id"`
+	ErrorFileID      *string            `json:"error_file_id"`
+	CreatedAt        int64              `json:"created_at"`
+	InProgressAt     *int64             `json:"in_progress_at"`
+	ExpiresAt        int64              `json:"expires_at"`
+	FinalizingAt     *int64             `json:"finalizing_at"`
+	CompletedAt      *int64             `json:"completed_at"`
+	FailedAt         *int64             `json:"failed_at"`
+	ExpiredAt        *int64             `json:"expired_at"`
+	CancellingAt     *int64             `json:"cancelling_at"`
+	CancelledAt      *int64             `json:"cancelled_at"`
+	RequestCounts    batchRequestCounts `json:"request_counts"`
+	Metadata         map[string]string  `json:"metadata"`
+
+	scope [sha256.Size]byte
+	grant batchGrant
+	// host is the name the batch was created through; its lines are
+	// served as requests to it.
+	host        string
+	cancel      context.CancelCauseFunc
+	done        bool
+	retainUntil time.Time
+}
+
+// batchStore implements the OpenAI /v1/files and /v1/batches workflow inside
+// the enclave. Inputs and results never leave the private ramdisk; requests
+// are replayed against the same upstream proxy that serves live traffic.
+type batchStore struct {
+	dir          string
+	upstream     http.Handler
+	authorize    func(http.ResponseWriter, *http.Request, string) (batchGrant, bool)
+	allowedPaths []string
+	ehbpPaths    []string
+	now          func() time.Time
+	slots        chan struct{}
+	mux          *http.ServeMux
+
+	initOnce sync.Once
+	initErr  error
+
+	mu         sync.Mutex
+	files      map[string]*batchFile
+	batches    map[string]*batchJob
+	scopeBytes map[[sha256.Size]byte]int64
+	bytes      int64
+}
+
+type batchScopeKey struct{}
+
+// newBatchStore returns a store rooted at dir. Nothing touches the disk until
+// the first batch request, so deployments that never use batches pay nothing.
+// Submissions are checked with authorize, when set, for the endpoint their
+// lines call. A plaintext upload may not carry lines for routes in
+// ehbpPaths, which refuse plaintext when called directly.
+func newBatchStore(dir string, upstream http.Handler, authorize func(http.ResponseWriter, *http.Request, string) (batchGrant, bool), allowedPaths, ehbpPaths []string) *batchStore {
+	st := &batchStore{
+		dir:          dir,
+		upstream:     upstream,
+		authorize:    authorize,
+		allowedPaths: allowedPaths,
+		ehbpPaths:    ehbpPaths,
+		now:          time.Now,
+		slots:        make(chan struct{}, batchConcurrency),
+		mux:          http.NewServeMux(),
+		files:        make(map[string]*batchFile),
+		batches:      make(map[string]*batchJob),
+		scopeBytes:   make(map[[sha256.Size]byte]int64),
+	}
+	st.mux.HandleFunc("POST "+batchFilesPath, st.handleUploadFile)
+	st.mux.HandleFunc("GET "+batchFilesPath, st.handleListFiles)
+	st.mux.HandleFunc("GET "+batchFilesPath+"/{id}", st.handleGetFile)
+	st.mux.HandleFunc("DELETE "+batchFilesPath+"/{id}", st.handleDeleteFile)
+	st.mux.HandleFunc("GET "+batchFilesPath+"/{id}/content", st.handleFileContent)
+	st.mux.HandleFunc("POST "+batchesPath, st.handleCreateBatch)
+	st.mux.HandleFunc("GET "+batchesPath, st.handleListBatches)
+	st.mux.HandleFunc("GET "+batchesPath+"/{id}", st.handleGetBatch)
+	st.mux.HandleFunc("POST "+batchesPath+"/{id}/cancel", st.handleCancelBatch)
+	st.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeJSONError(w, "Not found.", errTypeInvalidRequest, http.StatusNotFound)
+	})
+	return st
+}
+
+// isBatchPath reports whether path belongs to the batch subsystem rather than
+// the upstream workload.
+func isBatchPath(path string) bool {
+	return pathMatchesPattern(batchFilesPath+"*", path) || pathMatchesPattern(batchesPath+"*", path)
+}
+
+// serve handles a batch API request on behalf of apiKey. Every object is owned
+// by the caller that created it, as batchOwner identifies them, and is
+// invisible to everyone else.
+func (st *batchStore) serve(w http.ResponseWriter, r *http.Request, apiKey string) {
+	if apiKey == "" {
+		writeJSONError(w, errMsgAPIKeyRequired, errTypeInvalidRequest, http.StatusUnauthorized)
+		return
+	}
+	if err := st.init(); err != nil {
+		log.Printf("Batch store unavailable: %v", err)
+		writeJSONError(w, errMsgServerError, errTypeServer, http.StatusInternalServerError)
+		return
+	}
+	st.sweep()
+	claims, _ := key.FromContext(r.Context())
+	ctx := context.WithValue(r.Context(), batchScopeKey{}, batchOwner(claims, apiKey))
+	st.mux.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// batchOwner returns the scope batch objects are stored under. Validated
+// tokens map to their principal, so a refreshed token keeps access to what
+// the old one created; static keys, which carry no claims, map to the key.
+func batchOwner(claims *key.Claims, apiKey string) [sha256.Size]byte {
+	if claims != nil && (claims.Subject != "" || claims.ClientID != "") {
+		return sha256.Sum256([]byte("principal\x00" + claims.Tenant + "\x00" + claims.Subject + "\x00" + claims.ClientID))
+	}
+	return sha256.Sum256([]byte("key\x00" + apiKey))
+}
+
+func batchScope(r *http.Request) [sha256.Size]byte {
+	scope, _ := r.Context().Value(batchScopeKey{}).([sha256.Size]byte)
+	return scope
+}
+
+// init clears files left behind by a previous shim process, whose index was
+// lost with it, and starts the expiry sweeper.
+func (st *batchStore) init() error {
+	st.initOnce.Do(func() {
+		if err := os.RemoveAll(st.dir); err != nil {
+			st.initErr = fmt.Errorf("clearing %s: %w", st.dir, err)
+			return
+		}
+		if err := os.MkdirAll(st.dir, 0700); err != nil {
+			st.initErr = fmt.Errorf("creating %s: %w", st.dir, err)
+			return
+		}
+		go func() {
+			ticker := time.NewTicker(batchSweepInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				st.sweep()
+			}
+		}()
+	})
+	return st.initErr
+}
+
+// sweep removes expired files and batch records and expires batches that
+// outlived their completion window.
+func (st *batchStore) sweep() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := st.now()
+	for _, file := range st.files {
+		if now.Unix() >= file.ExpiresAt {
+			st.removeFileLocked(file)
+		}
+	}
+	for id, job := range st.batches {
+		switch {
+		case !job.done && now.Unix() >= job.ExpiresAt:
+			job.cancel(errBatchExpired)
+		case job.done && !now.Before(job.retainUntil):
+			delete(st.batches, id)
+		}
+	}
+}
+
+func (st *batchStore) removeFileLocked(file *batchFile) {
+	if st.files[file.ID] != file {
+		return
+	}
+	delete(st.files, file.ID)
+	st.releaseLocked(file.scope, file.Bytes)
+	if err := os.Remove(file.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Warning: removing batch file %s: %v", file.ID, err)
+	}
+}
+
+// reserve charges n bytes to scope, failing when either quota would be
+// exceeded.
+func (st *batchStore) reserve(scope [sha256.Size]byte, n int64) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.scopeBytes[scope]+n > maxBatchBytesPerScope || st.bytes+n > maxBatchStoreBytes {
+		return errBatchQuota
+	}
+	st.scopeBytes[scope] += n
+	st.bytes += n
+	return nil
+}
+
+func (st *batchStore) release(scope [sha256.Size]byte, n int64) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.releaseLocked(scope, n)
+}
+
+func (st *batchStore) releaseLocked(scope [sha256.Size]byte, n int64) {
+	st.bytes -= n
+	if st.scopeBytes[scope] -= n; st.scopeBytes[scope] <= 0 {
+		delete(st.scopeBytes, scope)
+	}
+}
+
+// remainingLocked returns how many more bytes scope may store.
+func (st *batchStore) remainingLocked(scope [sha256.Size]byte) int64 {
+	return min(maxBatchBytesPerScope-st.scopeBytes[scope], maxBatchStoreBytes-st.bytes)
+}
+
+func (st *batchStore) handleUploadFile(w http.ResponseWriter, r *http.Request) {
+	scope := batchScope(r)
+	st.mu.Lock()
+	limit := min(int64(maxBatchFileBytes), st.remainingLocked(scope))
+	fileCount := 0
+	for _, file := range st.files {
+		if file.scope == scope {
+			fileCount++
+		}
+	}
+	st.mu.Unlock()
+	if fileCount >= maxBatchFilesPerScope {
+		writeJSONError(w, "Too many files stored for this API key.", errTypeInsufficientQuota, http.StatusTooManyRequests)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchFileBytes+maxBatchFormOverheadBytes)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		writeJSONError(w, "Request must be multipart/form-data.", errTypeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+
+	var purpose, filename, tmpPath string
+	var size int64
+	defer func() {
+		if tmpPath != "" {
+			os.Remove(tmpPath)
+		}
+	}()
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeJSONError(w, "Malformed multipart body.", errTypeInvalidRequest, http.StatusBadRequest)
+			return
+		}
+		switch part.FormName() {
+		case "purpose":
+			value, err := io.ReadAll(io.LimitReader(part, maxBatchPurposeBytes+1))
+			if err != nil || len(value) > maxBatchPurposeBytes {
+				writeJSONError(w, "Invalid purpose.", errTypeInvalidRequest, http.StatusBadRequest)
+				return
+			}
+			purpose = string(value)
+		case "file":
+			if tmpPath != "" {
+				writeJSONError(w, "Only one file may be uploaded per request.", errTypeInvalidRequest, http.StatusBadRequest)
+				return
+			}
+			filename = part.FileName()
+			tmpPath, size, err = st.writeUpload(part, limit)
+			if errors.Is(err, errBatchQuota) {
+				writeJSONError(w, "File exceeds the batch storage quota.", errTypeInsufficientQuota, http.StatusRequestEntityTooLarge)
+				return
+			}
+			if err != nil {
+				log.Printf("Warning: storing batch upload: %v", err)
+				writeJSONError(w, "Failed to read uploaded file.", errTypeInvalidRequest, http.StatusBadRequest)
+				return
+			}
+		}
+		part.Close()
+	}
+	if purpose != batchPurposeInput {
+		writeJSONError(w, `Only files with purpose "batch" are supported.`, errTypeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+	if tmpPath == "" {
+		writeJSONError(w, "Missing file.", errTypeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+	if len(filename) > maxBatchFilenameBytes {
+		filename = filename[:maxBatchFilenameBytes]
+	}
+
+	endpoint, requests, err := validateBatchInput(tmpPath, st.allowedPaths)
+	if err != nil {
+		writeJSONError(w, fmt.Sprintf("Invalid batch input: %v.", err), errTypeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+	if plaintextBody(r) && rejectPlaintext(w, st.ehbpPaths, endpoint) {
+		return
+	}
+
+	if err := st.reserve(scope, size); err != nil {
+		writeJSONError(w, "File exceeds the batch storage quota.", errTypeInsufficientQuota, http.StatusRequestEntityTooLarge)
+		return
+	}
+	now := st.now()
+	file := &batchFile{
+		ID:        "file-" + rand.Text(),
+		Object:    "file",
+		Bytes:     size,
+		CreatedAt: now.Unix(),
+		ExpiresAt: now.Add(batchFileTTL).Unix(),
+		Filename:  filename,
+		Purpose:   batchPurposeInput,
+		scope:     scope,
+		endpoint:  endpoint,
+		requests:  requests,
+	}
+	file.path = filepath.Join(st.dir, file.ID)
+	if err := os.Rename(tmpPath, file.path); err != nil {
+		st.release(scope, size)
+		log.Printf("Warning: storing batch upload: %v", err)
+		writeJSONError(w, errMsgServerError, errTypeServer, http.StatusInternalServerError)
+		return
+	}
+	tmpPath = ""
+
+	st.mu.Lock()
+	st.files[file.ID] = file
+	view := *file
+	st.mu.Unlock()
+	writeBatchJSON(w, http.StatusOK, view)
+}
+
+// writeUpload copies an uploaded file to the ramdisk, failing with
+// errBatchQuota once it grows past limit.
+func (st *batchStore) writeUpload(src io.Reader, limit int64) (string, int64, error) {
+	tmp, err := os.CreateTemp(st.dir, "upload-*")
+	if err != nil {
+		return "", 0, err
+	}
+	size, err := io.Copy(tmp, io.LimitReader(src, limit+1))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && size > limit {
+		err = errBatchQuota
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", 0, err
+	}
+	return tmp.Name(), size, nil
+}
+
+func (st *batchStore) lookupFile(r *http.Request) (*batchFile, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	file, ok := st.files[r.PathValue("id")]
+	if !ok || file.scope != batchScope(r) {
+		return nil, false
+	}
+	return file, true
+}
+
+func (st *batchStore) handleListFiles(w http.ResponseWriter, r *http.Request) {
+	scope := batchScope(r)
+	purpose := r.URL.Query().Get("purpose")
+	st.mu.Lock()
+	files := make([]batchFile, 0)
+	for _, file := range st.files {
+		if file.scope == scope && (purpose == "" || file.Purpose == purpose) {
+			files = append(files, *file)
+		}
+	}
+	st.mu.Unlock()
+	slices.SortFunc(files, func(a, b batchFile) int { return strings.Compare(a.ID, b.ID) })
+	writeBatchJSON(w, http.StatusOK, map[string]any{"object": "list", "data": files})
+}
+
+func (st *batchStore) handleGetFile(w http.ResponseWriter, r *http.Request) {
+	file, ok := st.lookupFile(r)
+	if !ok {
+		writeJSONError(w, "No such file.", errTypeInvalidRequest, http.StatusNotFound)
+		return
+	}
+	writeBatchJSON(w, http.StatusOK, *file)
+}
+
+func (st *batchStore) handleDeleteFile(w http.ResponseWriter, r *http.Request) {
+	file, ok := st.lookupFile(r)
+	if !ok {
+		writeJSONError(w, "No such file.", errTypeInvalidRequest, http.StatusNotFound)
+		return
+	}
+	st.mu.Lock()
+	st.removeFileLocked(file)
+	st.mu.Unlock()
+	writeBatchJSON(w, http.StatusOK, map[string]any{"id": file.ID, "object": "file", "deleted": true})
+}
+
+func (st *batchStore) handleFileContent(w http.ResponseWriter, r *http.Request) {
+	file, ok := st.lookupFile(r)
+	if !ok {
+		writeJSONError(w, "No such file.", errTypeInvalidRequest, http.StatusNotFound)
+		return
+	}
+	content, err := os.Open(file.path)
+	if err != nil {
+		writeJSONError(w, "No such file.", errTypeInvalidRequest, http.StatusNotFound)
+		return
+	}
+	defer content.Close()
+	w.Header().Set("Content-Type", "application/jsonl")
+	http.ServeContent(w, r, "", time.Unix(file.CreatedAt, 0), content)
+}
+
+type createBatchRequest struct {
+	InputFileID      string            `json:"input_file_id"`
+	Endpoint         string            `json:"endpoint"`
+	CompletionWindow string            `json:"completion_window"`
+	Metadata         map[string]string `json:"metadata"`
+}
+
+func (st *batchStore) handleCreateBatch(w http.ResponseWriter, r *http.Request) {
+	scope := batchScope(r)
+	var request createBatchRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchFormOverheadBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		writeJSONError(w, "Invalid batch request body.", errTypeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+	if request.CompletionWindow != "24h" {
+		writeJSONError(w, `completion_window must be "24h".`, errTypeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+	if err := validateBatchMetadata(request.Metadata); err != nil {
+		writeJSONError(w, fmt.Sprintf("Invalid metadata: %v.", err), errTypeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+	// The lines all call the batch's endpoint, so that is what the caller
+	// must be authorized for.
+	var grant batchGrant
+	if st.authorize != nil {
+		var ok bool
+		if grant, ok = st.authorize(w, r, request.Endpoint); !ok {
+			return
+		}
+	}
+
+	st.mu.Lock()
+	input, ok := st.files[request.InputFileID]
+	if !ok || input.scope != scope || input.Purpose != batchPurposeInput {
+		st.mu.Unlock()
+		writeJSONError(w, "No such input file.", errTypeInvalidRequest, http.StatusNotFound)
+		return
+	}
+	if input.endpoint != request.Endpoint {
+		st.mu.Unlock()
+		writeJSONError(w, "Batch endpoint does not match the requests in the input file.", errTypeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+	var total, active int
+	for _, job := range st.batches {
+		if job.scope == scope {
+			total++
+			if !job.done {
+				active++
+			}
+		}
+	}
+	if total >= maxBatchesPerScope || active >= maxActiveBatchesPerScope {
+		st.mu.Unlock()
+		writeJSONError(w, "Too many batches for this API key.", errTypeInsufficientQuota, http.StatusTooManyRequests)
+		return
+	}
+	// Open the input now so that deleting the file afterwards cannot fail
+	// the batch.
+	content, err := os.Open(input.path)
+	if err != nil {
+		st.mu.Unlock()
+		log.Printf("Warning: opening batch input %s: %v", input.ID, err)
+		writeJSONError(w, errMsgServerError, errTypeServer, http.StatusInternalServerError)
+		return
+	}
+
+	now := st.now()
+	ctx, cancel := context.WithCancelCause(context.Background())
+	job := &batchJob{
+		ID:               "batch_" + rand.Text(),
+		Object:           "batch",
+		Endpoint:         request.Endpoint,
+		InputFileID:      input.ID,
+		CompletionWindow: request.CompletionWindow,
+		Status:           batchStatusValidating,
+		CreatedAt:        now.Unix(),
+		ExpiresAt:        now.Add(batchCompletionWindow).Unix(),
+		RequestCounts:    batchRequestCounts{Total: input.requests},
+		Metadata:         request.Metadata,
+		scope:            scope,
+		grant:            grant,
+		host:             r.Host,
+		cancel:           cancel,
+	}
+	st.batches[job.ID] = job
+	view := *job
+	st.mu.Unlock()
+
+	go st.run(ctx, job, content)
+	writeBatchJSON(w, http.StatusOK, view)
+}
+
+func (st *batchStore) lookupBatch(r *http.Request) (*batchJob, bool) {
+	job, ok := st.batches[r.PathValue("id")]
+	if !ok || job.scope != batchScope(r) {
+		return nil, false
+	}
+	return job, true
+}
+
+func (st *batchStore) handleListBatches(w http.ResponseWriter, r *http.Request) {
+	scope := batchScope(r)
+	st.mu.Lock()
+	jobs := make([]batchJob, 0)
+	for _, job := range st.batches {
+		if job.scope == scope {
+			jobs = append(jobs, *job)
+		}
+	}
+	st.mu.Unlock()
+	slices.SortFunc(jobs, func(a, b batchJob) int { return strings.Compare(a.ID, b.ID) })
+	writeBatchJSON(w, http.StatusOK, map[string]any{"object": "list", "data": jobs})
+}
+
+func (st *batchStore) handleGetBatch(w http.ResponseWriter, r *http.Request) {
+	st.mu.Lock()
+	job, ok := st.lookupBatch(r)
+	var view batchJob
+	if ok {
+		view = *job
+	}
+	st.mu.Unlock()
+	if !ok {
+		writeJSONError(w, "No such batch.", errTypeInvalidRequest, http.StatusNotFound)
+		return
+	}
+	writeBatchJSON(w, http.StatusOK, view)
+}
+
+func (st *batchStore) handleCancelBatch(w http.ResponseWriter, r *http.Request) {
+	st.mu.Lock()
+	job, ok := st.lookupBatch(r)
+	if !ok {
+		st.mu.Unlock()
+		writeJSONError(w, "No such batch.", errTypeInvalidRequest, http.StatusNotFound)
+		return
+	}
+	if job.done {
+		st.mu.Unlock()
+		writeJSONError(w, fmt.Sprintf("Cannot cancel a batch with status %q.", job.Status), errTypeInvalidRequest, http.StatusConflict)
+		return
+	}
+	if job.CancellingAt == nil {
+		job.Status = batchStatusCancelling
+		job.CancellingAt = unixPointer(st.now())
+		job.cancel(errBatchCancelled)
+	}
+	view := *job
+	st.mu.Unlock()
+	writeBatchJSON(w, http.StatusOK, view)
+}
+
+func validateBatchMetadata(metadata map[string]string) error {
+	if len(metadata) > 16 {
+		return fmt.Errorf("at most 16 entries are allowed")
+	}
+	for key, value := range metadata {
+		if len(key) > 64 || len(value) > 512 {
+			return fmt.Errorf("keys are limited to 64 and values to 512 characters")
+		}
+	}
+	return nil
+}
+
+func writeBatchJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func unixPointer(t time.Time) *int64 {
+	unix := t.Unix()
+	return &unix
+}
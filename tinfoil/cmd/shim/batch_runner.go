@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+const (
+	maxBatchRequestsPerFile = 10000
+	maxBatchCustomIDBytes   = 512
+	maxBatchResponseBytes   = 4 << 20
+)
+
+var (
+	errBatchCancelled = errors.New("batch cancelled")
+	errBatchExpired   = errors.New("batch did not complete within its completion window")
+)
+
+// batchEndpoints are the upstream routes a batch may target. Streaming is
+// not supported, so each request produces exactly one response.
+var batchEndpoints = []string{chatCompletionsPath, "/v1/completions", "/v1/embeddings"}
+
+type batchRequestLine struct {
+	CustomID string          `json:"custom_id"`
+	Method   string          `json:"method"`
+	URL      string          `json:"url"`
+	Body     json.RawMessage `json:"body"`
+}
+
+type batchResultResponse struct {
+	StatusCode int    `json:"status_code"`
+	RequestID  string `json:"request_id"`
+	Body       any    `json:"body"`
+}
+
+type batchResultLine struct {
+	ID       string               `json:"id"`
+	CustomID string               `json:"custom_id"`
+	Response *batchResultResponse `json:"response"`
+	Error    *batchError          `json:"error"`
+}
+
+func decodeBatchLine(line []byte) (batchRequestLine, error) {
+	var request batchRequestLine
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		return request, fmt.Errorf("malformed JSON")
+	}
+	return request, nil
+}
+
+// validateBatchInput checks an uploaded JSONL file and returns the single
+// endpoint its requests target and how many requests it holds.
+func validateBatchInput(path string, allowedPaths []string) (string, int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	var endpoint string
+	requests := 0
+	seen := make(map[string]struct{})
+	scanner := newBatchScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		request, err := decodeBatchLine(line)
+		if err != nil {
+			return "", 0, fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+		if err := request.validate(allowedPaths); err != nil {
+			return "", 0, fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+		if _, duplicate := seen[request.CustomID]; duplicate {
+			return "", 0, fmt.Errorf("line %d: duplicate custom_id %q", lineNumber, request.CustomID)
+		}
+		seen[request.CustomID] = struct{}{}
+		if endpoint == "" {
+			endpoint = request.URL
+		} else if request.URL != endpoint {
+			return "", 0, fmt.Errorf("line %d: all requests must target the same url", lineNumber)
+		}
+		if requests++; requests > maxBatchRequestsPerFile {
+			return "", 0, fmt.Errorf("more than %d requests", maxBatchRequestsPerFile)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", 0, fmt.Errorf("reading input: %v", err)
+	}
+	if requests == 0 {
+		return "", 0, fmt.Errorf("file contains no requests")
+	}
+	return endpoint, requests, nil
+}
+
+func (request batchRequestLine) validate(allowedPaths []string) error {
+	if request.CustomID == "" || len(request.CustomID) > maxBatchCustomIDBytes {
+		return fmt.Errorf("custom_id must be between 1 and %d bytes", maxBatchCustomIDBytes)
+	}
+	if request.Method != http.MethodPost {
+		return fmt.Errorf("method must be POST")
+	}
+	if !slices.Contains(batchEndpoints, request.URL) {
+		return fmt.Errorf("unsupported url %q", request.URL)
+	}
+	if len(allowedPaths) > 0 && !pathAllowed(allowedPaths, request.URL) {
+		return fmt.Errorf("url %q is not served by this enclave", request.URL)
+	}
+	var body map[string]json.RawMessage
+	if json.Unmarshal(request.Body, &body) != nil {
+		return fmt.Errorf("body must be a JSON object")
+	}
+	if requestsStream(request.Body) {
+		return fmt.Errorf("streaming is not supported in batches")
+	}
+	return nil
+}
+
+func newBatchScanner(file *os.File) *bufio.Scanner {
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, initialSSEBufferSize), maxSSELineBytes)
+	return scanner
+}
+
+// run executes every request of a batch against the upstream and publishes
+// the output and error files once all requests have finished or the batch
+// was stopped.
+func (st *batchStore) run(ctx context.Context, job *batchJob, input *os.File) {
+	defer input.Close()
+
+	st.mu.Lock()
+	if job.Status == batchStatusValidating {
+		job.Status = batchStatusInProgress
+		job.InProgressAt = unixPointer(st.now())
+	}
+	st.mu.Unlock()
+
+	output := &batchResultWriter{store: st, scope: job.scope, cancel: job.cancel}
+	failures := &batchResultWriter{store: st, scope: job.scope, cancel: job.cancel}
+	var wg sync.WaitGroup
+	scanner := newBatchScanner(input)
+schedule:
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		request, err := decodeBatchLine(line)
+		if err != nil {
+			// The input was validated on upload; this only happens if the
+			// ramdisk copy changed underneath us.
+			job.cancel(fmt.Errorf("input file changed after validation"))
+			break
+		}
+		select {
+		case st.slots <- struct{}{}:
+		case <-ctx.Done():
+			break schedule
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-st.slots }()
+			st.execute(ctx, job, request, output, failures)
+		}()
+	}
+	if err := scanner.Err(); err != nil {
+		job.cancel(fmt.Errorf("reading input file: %w", err))
+	}
+	wg.Wait()
+	st.finish(ctx, job, output, failures)
+}
+
+// execute replays one request through the upstream with the batch's grant
+// and records its result. Requests cut short by the batch being stopped are
+// not recorded.
+func (st *batchStore) execute(ctx context.Context, job *batchJob, request batchRequestLine, output, failures *batchResultWriter) {
+	result := batchResultLine{ID: "batch_req_" + rand.Text(), CustomID: request.CustomID}
+	upstreamReq, err := http.NewRequestWithContext(context.WithValue(ctx, batchGrantKey{}, job.grant), http.MethodPost, "http://localhost"+request.URL, bytes.NewReader(request.Body))
+	if err != nil {
+		result.Error = &batchError{Code: "invalid_request", Message: err.Error()}
+	} else {
+		upstreamReq.Host = job.host
+		upstreamReq.Header.Set("Content-Type", "application/json")
+		recorder := &batchResponseRecorder{header: make(http.Header)}
+		st.upstream.ServeHTTP(recorder, upstreamReq)
+		if ctx.Err() != nil {
+			return
+		}
+		switch {
+		case recorder.overflow:
+			result.Error = &batchError{Code: "response_too_large", Message: fmt.Sprintf("response exceeded %d bytes", maxBatchResponseBytes)}
+		default:
+			result.Response = recorder.result()
+		}
+	}
+
+	succeeded := result.Error == nil && result.Response.StatusCode < http.StatusBadRequest
+	line, err := json.Marshal(result)
+	if err == nil {
+		if succeeded {
+			err = output.write(line)
+		} else {
+			err = failures.write(line)
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	st.mu.Lock()
+	if succeeded {
+		job.RequestCounts.Completed++
+	} else {
+		job.RequestCounts.Failed++
+	}
+	st.mu.Unlock()
+}
+
+// finish publishes result files and moves the batch to its terminal status,
+// derived from why its context ended.
+func (st *batchStore) finish(ctx context.Context, job *batchJob, output, failures *batchResultWriter) {
+	cause := context.Cause(ctx)
+	job.cancel(nil)
+
+	st.mu.Lock()
+	job.Status = batchStatusFinalizing
+	job.FinalizingAt = unixPointer(st.now())
+	st.mu.Unlock()
+
+	outputFile := output.publish()
+	errorFile := failures.publish()
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := st.now()
+	for _, file := range []*batchFile{outputFile, errorFile} {
+		if file != nil {
+			st.files[file.ID] = file
+		}
+	}
+	if outputFile != nil {
+		job.OutputFileID = &outputFile.ID
+	}
+	if errorFile != nil {
+		job.ErrorFileID = &errorFile.ID
+	}
+
+	switch {
+	case cause == nil:
+		job.Status = batchStatusCompleted
+		job.CompletedAt = unixPointer(now)
+	case errors.Is(cause, errBatchCancelled):
+		job.Status = batchStatusCancelled
+		job.CancelledAt = unixPointer(now)
+	case errors.Is(cause, errBatchExpired):
+		job.Status = batchStatusExpired
+		job.ExpiredAt = unixPointer(now)
+	default:
+		log.Printf("Batch %s failed: %v", job.ID, cause)
+		code := "batch_failed"
+		if errors.Is(cause, errBatchQuota) {
+			code = "quota_exceeded"
+		}
+		job.Status = batchStatusFailed
+		job.FailedAt = unixPointer(now)
+		job.Errors = &batchErrors{Object: "list", Data: []batchError{{Code: code, Message: cause.Error()}}}
+	}
+	job.done = true
+	job.grant = batchGrant{}
+	job.retainUntil = now.Add(batchFileTTL)
+}
+
+// batchResultWriter appends JSONL result lines to a ramdisk file, charging
+// each line to the batch owner's quota. Running out of quota fails the batch.
+type batchResultWriter struct {
+	store  *batchStore
+	scope  [sha256.Size]byte
+	cancel context.CancelCauseFunc
+
+	mu    sync.Mutex
+	id    string
+	file  *os.File
+	bytes int64
+	err   error
+}
+
+func (rw *batchResultWriter) write(line []byte) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.err != nil {
+		return rw.err
+	}
+
+	line = append(line, '\n')
+	if err := rw.store.reserve(rw.scope, int64(len(line))); err != nil {
+		rw.err = err
+		rw.cancel(err)
+		return err
+	}
+	if rw.file == nil {
+		rw.id = "file-" + rand.Text()
+		rw.file, rw.err = os.OpenFile(filepath.Join(rw.store.dir, rw.id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	}
+	if rw.err == nil {
+		_, rw.err = rw.file.Write(line)
+	}
+	if rw.err != nil {
+		rw.store.release(rw.scope, int64(len(line)))
+		rw.cancel(rw.err)
+		return rw.err
+	}
+	rw.bytes += int64(len(line))
+	return nil
+}
+
+// publish closes the result file and returns it as a file object, or nil
+// when nothing was written.
+func (rw *batchResultWriter) publish() *batchFile {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.file == nil {
+		return nil
+	}
+	if err := rw.file.Close(); err != nil {
+		log.Printf("Warning: closing batch result %s: %v", rw.id, err)
+	}
+	rw.err = errors.New("result file already published")
+
+	now := rw.store.now()
+	return &batchFile{
+		ID:        rw.id,
+		Object:    "file",
+		Bytes:     rw.bytes,
+		CreatedAt: now.Unix(),
+		ExpiresAt: now.Add(batchFileTTL).Unix(),
+		Filename:  rw.id + ".jsonl",
+		Purpose:   batchPurposeOutput,
+		scope:     rw.scope,
+		path:      rw.file.Name(),
+	}
+}
+
+// batchResponseRecorder captures one upstream response in memory.
+type batchResponseRecorder struct {
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (r *batchResponseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *batchResponseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *batchResponseRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	if r.body.Len()+len(p) > maxBatchResponseBytes {
+		r.overflow = true
+	} else if !r.overflow {
+		r.body.Write(p)
+	}
+	return len(p), nil
+}
+
+func (r *batchResponseRecorder) result() *batchResultResponse {
+	status := r.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	var body any = r.body.String()
+	if json.Valid(r.body.Bytes()) {
+		body = json.RawMessage(bytes.Clone(r.body.Bytes()))
+	}
+	return &batchResultResponse{
+		StatusCode: status,
+		RequestID:  r.header.Get("X-Request-Id"),
+		Body:       body,
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"tinfoil/internal/config"
+	"tinfoil/internal/key"
+)
+
+func testBatchStore(t *testing.T, upstream http.Handler) *batchStore {
+	t.Helper()
+	return newBatchStore(t.TempDir(), upstream, nil, nil, nil)
+}
+
+func batchUpstream() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(string(body), "fail") {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		_, _ = w.Write([]byte(`{"echo":` + string(body) + `}`))
+	})
+}
+
+func doBatchRequest(t *testing.T, st *batchStore, apiKey string, req *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	st.serve(rec, req, apiKey)
+	return rec
+}
+
+func uploadBatchFile(t *testing.T, st *batchStore, apiKey, purpose, content string) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	if err := form.WriteField("purpose", purpose); err != nil {
+		t.Fatal(err)
+	}
+	part, err := form.CreateFormFile("file", "input.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.WriteString(part, content)
+	form.Close()
+	req := httptest.NewRequest(http.MethodPost, batchFilesPath, &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return doBatchRequest(t, st, apiKey, req)
+}
+
+func batchInput(lines ...string) string {
+	var input strings.Builder
+	for i, content := range lines {
+		line, _ := json.Marshal(batchRequestLine{
+			CustomID: "req-" + string(rune('a'+i)),
+			Method:   http.MethodPost,
+			URL:      chatCompletionsPath,
+			Body:     json.RawMessage(`{"model":"m","messages":[{"role":"user","content":"` + content + `"}]}`),
+		})
+		input.Write(line)
+		input.WriteByte('\n')
+	}
+	return input.String()
+}
+
+func decodeBatchResponse[T any](t *testing.T, rec *httptest.ResponseRecorder) T {
+	t.Helper()
+	var value T
+	if err := json.Unmarshal(rec.Body.Bytes(), &value); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body.String(), err)
+	}
+	return value
+}
+
+func createBatch(t *testing.T, st *batchStore, apiKey, fileID string) *httptest.ResponseRecorder {
+	t.Helper()
+	body := `{"input_file_id":"` + fileID + `","endpoint":"/v1/chat/completions","completion_window":"24h"}`
+	return doBatchRequest(t, st, apiKey, httptest.NewRequest(http.MethodPost, batchesPath, strings.NewReader(body)))
+}
+
+func waitForBatch(t *testing.T, st *batchStore, apiKey, batchID string) batchJob {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		rec := doBatchRequest(t, st, apiKey, httptest.NewRequest(http.MethodGet, batchesPath+"/"+batchID, nil))
+		job := decodeBatchResponse[batchJob](t, rec)
+		switch job.Status {
+		case batchStatusCompleted, batchStatusFailed, batchStatusCancelled, batchStatusExpired:
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("batch %s did not finish", batchID)
+	return batchJob{}
+}
+
+func TestBatchRunsRequestsAndPublishesResults(t *testing.T) {
+	st := testBatchStore(t, batchUpstream())
+	upload := uploadBatchFile(t, st, "sk-a", "batch", batchInput("hello", "fail"))
+	if upload.Code != http.StatusOK {
+		t.Fatalf("upload status = %d: %s", upload.Code, upload.Body.String())
+	}
+	file := decodeBatchResponse[batchFile](t, upload)
+
+	created := createBatch(t, st, "sk-a", file.ID)
+	if created.Code != http.StatusOK {
+		t.Fatalf("create status = %d: %s", created.Code, created.Body.String())
+	}
+	job := waitForBatch(t, st, "sk-a", decodeBatchResponse[batchJob](t, created).ID)
+
+	if job.Status != batchStatusCompleted {
+		t.Fatalf("status = %q, want %q", job.Status, batchStatusCompleted)
+	}
+	if job.RequestCounts != (batchRequestCounts{Total: 2, Completed: 1, Failed: 1}) {
+		t.Fatalf("request counts = %+v", job.RequestCounts)
+	}
+	if job.OutputFileID == nil || job.ErrorFileID == nil {
+		t.Fatalf("missing result files: %+v", job)
+	}
+
+	content := doBatchRequest(t, st, "sk-a", httptest.NewRequest(http.MethodGet, batchFilesPath+"/"+*job.OutputFileID+"/content", nil))
+	var result batchResultLine
+	if err := json.Unmarshal(content.Body.Bytes(), &result); err != nil {
+		t.Fatalf("output line %q: %v", content.Body.String(), err)
+	}
+	if result.CustomID != "req-a" || result.Response == nil || result.Response.StatusCode != http.StatusOK {
+		t.Fatalf("output line = %s", content.Body.String())
+	}
+	if !strings.Contains(content.Body.String(), `"hello"`) {
+		t.Fatalf("output line does not carry the upstream body: %s", content.Body.String())
+	}
+
+	failed := doBatchRequest(t, st, "sk-a", httptest.NewRequest(http.MethodGet, batchFilesPath+"/"+*job.ErrorFileID+"/content", nil))
+	if !strings.Contains(failed.Body.String(), `"custom_id":"req-b"`) || !strings.Contains(failed.Body.String(), `"status_code":400`) {
+		t.Fatalf("error file = %s", failed.Body.String())
+	}
+}
+
+func TestBatchObjectsAreScopedToAPIKey(t *testing.T) {
+	st := testBatchStore(t, batchUpstream())
+	file := decodeBatchResponse[batchFile](t, uploadBatchFile(t, st, "sk-a", "batch", batchInput("hello")))
+
+	for _, path := range []string{batchFilesPath + "/" + file.ID, batchFilesPath + "/" + file.ID + "/content"} {
+		rec := doBatchRequest(t, st, "sk-b", httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Fatalf("GET %s with another key: status = %d, want 404", path, rec.Code)
+		}
+	}
+	if rec := createBatch(t, st, "sk-b", file.ID); rec.Code != http.StatusNotFound {
+		t.Fatalf("batch over another key's file: status = %d, want 404", rec.Code)
+	}
+	list := doBatchRequest(t, st, "sk-b", httptest.NewRequest(http.MethodGet, batchFilesPath, nil))
+	if strings.Contains(list.Body.String(), file.ID) {
+		t.Fatalf("file list leaked another key's file: %s", list.Body.String())
+	}
+}
+
+func TestBatchRequiresAPIKey(t *testing.T) {
+	st := testBatchStore(t, batchUpstream())
+	rec := doBatchRequest(t, st, "", httptest.NewRequest(http.MethodGet, batchesPath, nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want 401", rec.Code)
+	}
+}
+
+func TestBatchRejectsInvalidInput(t *testing.T) {
+	st := testBatchStore(t, batchUpstream())
+	streaming := `{"custom_id":"a","method":"POST","url":"/v1/chat/completions","body":{"stream":true}}`
+	tests := map[string]string{
+		"not json":       "hello\n",
+		"empty":          "\n\n",
+		"streaming":      streaming + "\n",
+		"duplicate id":   batchInput("x") + batchInput("y"),
+		"unknown url":    `{"custom_id":"a","method":"POST","url":"/v1/other","body":{}}` + "\n",
+		"get method":     `{"custom_id":"a","method":"GET","url":"/v1/embeddings","body":{}}` + "\n",
+		"mixed endpoint": `{"custom_id":"a","method":"POST","url":"/v1/embeddings","body":{}}` + "\n" + `{"custom_id":"b","method":"POST","url":"/v1/completions","body":{}}` + "\n",
+	}
+	for name, input := range tests {
+		if rec := uploadBatchFile(t, st, "sk-a", "batch", input); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400: %s", name, rec.Code, rec.Body.String())
+		}
+	}
+	if rec := uploadBatchFile(t, st, "sk-a", "fine-tune", batchInput("x")); rec.Code != http.StatusBadRequest {
+		t.Errorf("unsupported purpose: status = %d, want 400", rec.Code)
+	}
+	entries, err := os.ReadDir(st.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("rejected uploads left %d files on the ramdisk", len(entries))
+	}
+}
+
+func TestBatchUploadEnforcesQuota(t *testing.T) {
+	st := testBatchStore(t, batchUpstream())
+	scope := batchOwner(nil, "sk-a")
+	st.scopeBytes[scope] = maxBatchBytesPerScope - 10
+	st.bytes = maxBatchBytesPerScope - 10
+
+	if rec := uploadBatchFile(t, st, "sk-a", "batch", batchInput("hello")); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d, want 413: %s", rec.Code, rec.Body.String())
+	}
+	if rec := uploadBatchFile(t, st, "sk-b", "batch", batchInput("hello")); rec.Code != http.StatusOK {
+		t.Fatalf("another key was limited by a full quota: status = %d", rec.Code)
+	}
+}
+
+func TestBatchFilesExpire(t *testing.T) {
+	st := testBatchStore(t, batchUpstream())
+	now := time.Now()
+	st.now = func() time.Time { return now }
+	file := decodeBatchResponse[batchFile](t, uploadBatchFile(t, st, "sk-a", "batch", batchInput("hello")))
+
+	now = now.Add(batchFileTTL)
+	rec := doBatchRequest(t, st, "sk-a", httptest.NewRequest(http.MethodGet, batchFilesPath+"/"+file.ID, nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expired file: status = %d, want 404", rec.Code)
+	}
+	if _, err := os.Stat(st.dir + "/" + file.ID); !os.IsNotExist(err) {
+		t.Fatalf("expired file still on the ramdisk: %v", err)
+	}
+	if st.bytes != 0 {
+		t.Fatalf("expired file still charged to the quota: %d bytes", st.bytes)
+	}
+}
+
+func TestBatchCancel(t *testing.T) {
+	release := make(chan struct{})
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+	defer close(release)
+	st := testBatchStore(t, upstream)
+	file := decodeBatchResponse[batchFile](t, uploadBatchFile(t, st, "sk-a", "batch", batchInput("a", "b", "c", "d", "e", "f")))
+	job := decodeBatchResponse[batchJob](t, createBatch(t, st, "sk-a", file.ID))
+
+	rec := doBatchRequest(t, st, "sk-a", httptest.NewRequest(http.MethodPost, batchesPath+"/"+job.ID+"/cancel", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("cancel status = %d: %s", rec.Code, rec.Body.String())
+	}
+	if final := waitForBatch(t, st, "sk-a", job.ID); final.Status != batchStatusCancelled {
+		t.Fatalf("status = %q, want %q", final.Status, batchStatusCancelled)
+	}
+}
+
+// scopeValidator accepts tokens for every scope except denied.
+type scopeValidator struct {
+	denied string
+	calls  []key.Request
+}
+
+func (v *scopeValidator) Validate(req key.Request) (*key.Claims, error) {
+	v.calls = append(v.calls, req)
+	if req.Scope == v.denied {
+		return nil, &key.ValidationError{StatusCode: http.StatusForbidden}
+	}
+	return &key.Claims{Subject: "alice", Scopes: []string{req.Scope}}, nil
+}
+
+func TestBatchIsAuthorizedOnceAtSubmit(t *testing.T) {
+	var mu sync.Mutex
+	var seen []*key.Claims
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, _ := key.FromContext(r.Context())
+		mu.Lock()
+		seen = append(seen, claims)
+		mu.Unlock()
+		if r.Header.Get("Authorization") != "" {
+			t.Error("batch line presented the submitter's token again")
+		}
+		w.Write([]byte(`{}`))
+	})
+	newStore := func(validator key.Validator) *batchStore {
+		authorizer := &requestAuthorizer{
+			validator:   validator,
+			rateLimiter: NewRateLimiter(rate.Inf, 1),
+			config:      &config.Config{},
+			extensions:  &config.Extensions{Batches: true, RouteScopes: []config.RouteScope{{Path: chatCompletionsPath, Scope: "inference:chat"}}},
+		}
+		return newBatchStore(t.TempDir(), authorizer.batchUpstream(upstream), authorizer.batchAuthorizer(newServedDomains("node.example.com", false, nil)), nil, nil)
+	}
+	submit := func(st *batchStore) *httptest.ResponseRecorder {
+		file := decodeBatchResponse[batchFile](t, uploadBatchFile(t, st, "sk-a", "batch", batchInput("one", "two", "three")))
+		req := httptest.NewRequest(http.MethodPost, batchesPath, strings.NewReader(`{"input_file_id":"`+file.ID+`","endpoint":"/v1/chat/completions","completion_window":"24h"}`))
+		req.Host = "node.example.com"
+		req.Header.Set("Authorization", "Bearer sk-a")
+		return doBatchRequest(t, st, "sk-a", req)
+	}
+
+	denied := &scopeValidator{denied: "inference:chat"}
+	if rec := submit(newStore(denied)); rec.Code != http.StatusForbidden {
+		t.Fatalf("submit without the endpoint's scope: status = %d, want 403", rec.Code)
+	}
+
+	validator := &scopeValidator{}
+	st := newStore(validator)
+	created := submit(st)
+	if created.Code != http.StatusOK {
+		t.Fatalf("submit status = %d: %s", created.Code, created.Body)
+	}
+	job := waitForBatch(t, st, "sk-a", decodeBatchResponse[batchJob](t, created).ID)
+	if job.RequestCounts != (batchRequestCounts{Total: 3, Completed: 3}) {
+		t.Fatalf("request counts = %+v", job.RequestCounts)
+	}
+	if len(validator.calls) != 1 || validator.calls[0].Path != chatCompletionsPath || validator.calls[0].Domain != "node.example.com" {
+		t.Fatalf("validator calls = %+v, want one check of the endpoint at submit", validator.calls)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, claims := range seen {
+		if claims == nil || claims.Subject != "alice" {
+			t.Fatalf("line served with claims %+v, want the submitter's", claims)
+		}
+	}
+}
+
+func TestBatchRoutesAlwaysAuthenticate(t *testing.T) {
+	validator := &fakeValidator{err: &key.ValidationError{StatusCode: http.StatusUnauthorized}}
+	// An empty authenticated-endpoints list must not leave the batch API,
+	// which runs completions, open to any bearer string.
+	handler := testAuthServerWithExtensions(t, validator, []string{}, &config.Extensions{Batches: true})
+	for _, path := range []string{batchesPath, batchFilesPath + "/file-1"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer anything")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("%s: status = %d, want 401", path, rec.Code)
+		}
+	}
+	if len(validator.calls) != 2 {
+		t.Fatalf("validator calls = %d, want 2", len(validator.calls))
+	}
+}
+
+func TestBatchRoutesAreOptIn(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream " + r.URL.Path))
+	}))
+	defer upstream.Close()
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+	upstreamPort, _ := strconv.Atoi(port)
+
+	// A workload that serves its own batch API keeps receiving it.
+	handler := testServer(t, nil, upstreamPort)
+	req := httptest.NewRequest(http.MethodGet, batchesPath, nil)
+	req.Header.Set("Authorization", "Bearer sk-a")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "upstream "+batchesPath {
+		t.Fatalf("status = %d, body = %q, want the upstream's answer", rec.Code, rec.Body)
+	}
+}
+
+func TestBatchOwnerFollowsThePrincipal(t *testing.T) {
+	st := testBatchStore(t, batchUpstream())
+	alice := &key.Claims{Subject: "alice", ClientID: "app"}
+	withClaims := func(req *http.Request, claims *key.Claims) *http.Request {
+		return req.WithContext(key.NewContext(req.Context(), claims))
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("purpose", batchPurposeInput)
+	part, _ := form.CreateFormFile("file", "input.jsonl")
+	io.WriteString(part, batchInput("hello"))
+	form.Close()
+	upload := httptest.NewRequest(http.MethodPost, batchFilesPath, &body)
+	upload.Header.Set("Content-Type", form.FormDataContentType())
+	file := decodeBatchResponse[batchFile](t, doBatchRequest(t, st, "jwt-1", withClaims(upload, alice)))
+
+	// A refreshed token for the same principal still sees the file; a
+	// token for another subject does not.
+	get := func(token string, claims *key.Claims) int {
+		req := withClaims(httptest.NewRequest(http.MethodGet, batchFilesPath+"/"+file.ID, nil), claims)
+		return doBatchRequest(t, st, token, req).Code
+	}
+	if code := get("jwt-2", &key.Claims{Subject: "alice", ClientID: "app"}); code != http.StatusOK {
+		t.Fatalf("refreshed token: status = %d, want 200", code)
+	}
+	if code := get("jwt-1", &key.Claims{Subject: "bob", ClientID: "app"}); code != http.StatusNotFound {
+		t.Fatalf("other subject: status = %d, want 404", code)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// The upstream circuit opens after this many consecutive connection
+	// failures and stays open for a backoff that doubles with each further
+	// failure, up to the maximum.
+	breakerFailureThreshold = 3
+	breakerMinOpen          = time.Second
+	breakerMaxOpen          = 30 * time.Second
+
+	// Container status is re-read at most once per interval. A status older
+	// than the max age is ignored, since tinfoil-containers may have stopped
+	// publishing; it normally publishes every few seconds.
+	containerStatusReadInterval = time.Second
+	containerStatusMaxAge       = 30 * time.Second
+	containerDownRetryAfter     = 5 * time.Second
+
+	upstreamRetryDelay = 250 * time.Millisecond
+)
+
+// upstreamUnavailableError is returned by breakerTransport instead of dialling
+// an upstream that is known to be down.
+type upstreamUnavailableError struct {
+	reason     string
+	retryAfter time.Duration
+}
+
+func (e *upstreamUnavailableError) Error() string {
+	return "upstream unavailable: " + e.reason
+}
+
+// retryAfterSeconds rounds the estimate up to whole seconds for the
+// Retry-After header.
+func (e *upstreamUnavailableError) retryAfterSeconds() int {
+	return max(1, int((e.retryAfter+time.Second-1)/time.Second))
+}
+
+// upstreamStatusFile is the part of the container status document published
+// by tinfoil-containers that the breaker reads.
+type upstreamStatusFile struct {
+	ObservedAt time.Time `json:"observed_at"`
+	Containers []struct {
+		Name   string `json:"name"`
+		Status string `json:"status"`
+	} `json:"containers"`
+}
+
+// upstreamBreaker fails requests fast while the upstream is known to be down,
+// either because its container is not running or because recent connections
+// to it were refused.
+type upstreamBreaker struct {
+	container  string
+	statusPath string
+	now        func() time.Time
+
+	mu           sync.Mutex
+	failures     int
+	openUntil    time.Time
+	statusRead   time.Time
+	statusDown   string
+	statusLogged string
+}
+
+func newUpstreamBreaker(container, statusPath string) *upstreamBreaker {
+	return &upstreamBreaker{container: container, statusPath: statusPath, now: time.Now}
+}
+
+// allow returns an *upstreamUnavailableError if the upstream should not be
+// dialled.
+func (b *upstreamBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	if down := b.containerDownLocked(now); down != "" {
+		return &upstreamUnavailableError{reason: down, retryAfter: containerDownRetryAfter}
+	}
+	if now.Before(b.openUntil) {
+		return &upstreamUnavailableError{
+			reason:     fmt.Sprintf("%d consecutive connection failures", b.failures),
+			retryAfter: b.openUntil.Sub(now),
+		}
+	}
+	return nil
+}
+
+// containerDownLocked describes why the upstream container is down according
+// to the published container status, or returns "" if it is running or its
+// state is unknown.
+func (b *upstreamBreaker) containerDownLocked(now time.Time) string {
+	if b.container == "" {
+		return ""
+	}
+	if now.Sub(b.statusRead) < containerStatusReadInterval {
+		return b.statusDown
+	}
+	b.statusRead = now
+	b.statusDown = ""
+
+	data, err := os.ReadFile(b.statusPath)
+	if err != nil {
+		return ""
+	}
+	var status upstreamStatusFile
+	if err := json.Unmarshal(data, &status); err != nil || now.Sub(status.ObservedAt) > containerStatusMaxAge {
+		return ""
+	}
+	for _, container := range status.Containers {
+		if container.Name != b.container || container.Status == "running" {
+			continue
+		}
+		state := container.Status
+		if state == "" {
+			state = "not created"
+		}
+		b.statusDown = fmt.Sprintf("container %s is %s", b.container, state)
+	}
+	if b.statusDown != b.statusLogged {
+		if b.statusDown != "" {
+			log.Printf("Warning: failing upstream requests fast: %s", b.statusDown)
+		} else {
+			log.Printf("Upstream container %s is running again", b.container)
+		}
+		b.statusLogged = b.statusDown
+	}
+	return b.statusDown
+}
+
+// record updates the passive failure count with the outcome of one upstream
+// round trip.
+func (b *upstreamBreaker) record(err error) {
+	if err != nil && !isDialError(err) {
+		// Client cancellations and mid-response failures say nothing about
+		// whether the upstream accepts connections.
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		if b.failures >= breakerFailureThreshold {
+			log.Printf("Upstream circuit closed")
+		}
+		b.failures = 0
+		b.openUntil = time.Time{}
+		return
+	}
+	b.failures++
+	if b.failures < breakerFailureThreshold {
+		return
+	}
+	backoff := breakerMaxOpen
+	if shift := b.failures - breakerFailureThreshold; shift < 8 {
+		backoff = min(breakerMinOpen<<shift, breakerMaxOpen)
+	}
+	b.openUntil = b.now().Add(backoff)
+	log.Printf("Warning: upstream circuit open for %v after %d consecutive connection failures: %v", backoff, b.failures, err)
+}
+
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// breakerTransport consults the breaker before each upstream round trip and
+// retries a replayable request once if the connection was refused, which is
+// what a restarting upstream looks like.
+type breakerTransport struct {
+	base    http.RoundTripper
+	breaker *upstreamBreaker
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.breaker.allow(); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+
+	retry, replayable := replayableRequest(req)
+	resp, err := t.base.RoundTrip(req)
+	if err != nil && replayable && errors.Is(err, syscall.ECONNREFUSED) {
+		t.breaker.record(err)
+		select {
+		case <-time.After(upstreamRetryDelay):
+		case <-req.Context().Done():
+			return nil, err
+		}
+		if next, retryErr := retry(); retryErr == nil {
+			resp, err = t.base.RoundTrip(next)
+		}
+	}
+	t.breaker.record(err)
+	return resp, err
+}
+
+// replayableRequest reports whether req may be sent again, following
+// net/http's rule for idempotent requests, and returns a function that
+// produces the copy to send.
+func replayableRequest(req *http.Request) (func() (*http.Request, error), bool) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+	default:
+		if req.Header.Get(idempotencyKeyHeader) == "" && req.Header.Get("X-Idempotency-Key") == "" {
+			return nil, false
+		}
+	}
+	if req.Body == nil || req.Body == http.NoBody {
+		return func() (*http.Request, error) { return req.Clone(req.Context()), nil }, true
+	}
+	if req.GetBody == nil {
+		return nil, false
+	}
+	return func() (*http.Request, error) {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retry := req.Clone(req.Context())
+		retry.Body = body
+		return retry, nil
+	}, true
+}
+
+// writeUpstreamUnavailable reports a fast failure with the breaker's estimate
+// of when the upstream will accept requests again.
+func writeUpstreamUnavailable(w http.ResponseWriter, err *upstreamUnavailableError) {
+	w.Header().Set("Retry-After", fmt.Sprint(err.retryAfterSeconds()))
+	writeWorkloadUnavailable(w)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func writeContainerStatus(t *testing.T, path string, observedAt time.Time, status string) {
+	t.Helper()
+	data := `{"observed_at":"` + observedAt.UTC().Format(time.RFC3339Nano) + `","containers":[{"name":"model","status":"` + status + `"}]}`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func refusedError() error {
+	return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+}
+
+// scriptedTransport returns the scripted errors in order, then 200 responses.
+type scriptedTransport struct {
+	errs   []error
+	calls  int
+	bodies []string
+}
+
+func (s *scriptedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	s.calls++
+	if req.Body != nil {
+		body, _ := io.ReadAll(req.Body)
+		req.Body.Close()
+		s.bodies = append(s.bodies, string(body))
+	}
+	if len(s.errs) > 0 {
+		err := s.errs[0]
+		s.errs = s.errs[1:]
+		return nil, err
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Header: make(http.Header)}, nil
+}
+
+func TestUpstreamBreakerFollowsContainerStatus(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "container-status.json")
+	now := time.Now()
+	breaker := newUpstreamBreaker("model", path)
+	breaker.now = func() time.Time { return now }
+
+	if err := breaker.allow(); err != nil {
+		t.Fatalf("missing status file blocked the upstream: %v", err)
+	}
+
+	writeContainerStatus(t, path, now, "restarting")
+	now = now.Add(containerStatusReadInterval)
+	var unavailable *upstreamUnavailableError
+	if err := breaker.allow(); !errors.As(err, &unavailable) || unavailable.retryAfter != containerDownRetryAfter {
+		t.Fatalf("restarting container: allow = %v", err)
+	}
+
+	writeContainerStatus(t, path, now.Add(-2*containerStatusMaxAge), "restarting")
+	now = now.Add(containerStatusReadInterval)
+	if err := breaker.allow(); err != nil {
+		t.Fatalf("stale status blocked the upstream: %v", err)
+	}
+
+	writeContainerStatus(t, path, now, "running")
+	now = now.Add(containerStatusReadInterval)
+	if err := breaker.allow(); err != nil {
+		t.Fatalf("running container: allow = %v", err)
+	}
+}
+
+func TestUpstreamBreakerOpensAfterConnectionFailures(t *testing.T) {
+	now := time.Now()
+	breaker := newUpstreamBreaker("", "")
+	breaker.now = func() time.Time { return now }
+	base := &scriptedTransport{errs: []error{refusedError(), refusedError(), refusedError()}}
+	transport := &breakerTransport{base: base, breaker: breaker}
+
+	for range breakerFailureThreshold {
+		req := httptest.NewRequest(http.MethodPost, "http://upstream/v1/chat/completions", strings.NewReader("{}"))
+		if _, err := transport.RoundTrip(req); !isDialError(err) {
+			t.Fatalf("RoundTrip error = %v, want the dial error", err)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://upstream/v1/chat/completions", strings.NewReader("{}"))
+	_, err := transport.RoundTrip(req)
+	var unavailable *upstreamUnavailableError
+	if !errors.As(err, &unavailable) {
+		t.Fatalf("open circuit: RoundTrip error = %v", err)
+	}
+	if base.calls != breakerFailureThreshold {
+		t.Fatalf("open circuit dialled the upstream: %d calls", base.calls)
+	}
+	if unavailable.retryAfterSeconds() != int(breakerMinOpen/time.Second) {
+		t.Fatalf("Retry-After = %d", unavailable.retryAfterSeconds())
+	}
+
+	now = now.Add(breakerMinOpen)
+	if _, err := transport.RoundTrip(httptest.NewRequest(http.MethodGet, "http://upstream/v1/models", nil)); err != nil {
+		t.Fatalf("probe after backoff: %v", err)
+	}
+	if breaker.failures != 0 {
+		t.Fatalf("successful probe left %d failures", breaker.failures)
+	}
+}
+
+func TestUpstreamBreakerIgnoresNonDialErrors(t *testing.T) {
+	breaker := newUpstreamBreaker("", "")
+	for range breakerFailureThreshold + 1 {
+		breaker.record(errors.New("context canceled"))
+	}
+	if err := breaker.allow(); err != nil {
+		t.Fatalf("non-dial errors opened the circuit: %v", err)
+	}
+}
+
+func TestBreakerTransportRetriesRefusedIdempotentRequests(t *testing.T) {
+	newIdempotentPost := func() *http.Request {
+		body := `{"model":"m"}`
+		req := httptest.NewRequest(http.MethodPost, "http://upstream/v1/chat/completions", strings.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader(body)), nil }
+		req.Header.Set(idempotencyKeyHeader, "key-1")
+		return req
+	}
+	tests := []struct {
+		name  string
+		req   *http.Request
+		retry bool
+	}{
+		{name: "get", req: httptest.NewRequest(http.MethodGet, "http://upstream/v1/models", nil), retry: true},
+		{name: "post with idempotency key", req: newIdempotentPost(), retry: true},
+		{name: "post", req: httptest.NewRequest(http.MethodPost, "http://upstream/v1/chat/completions", strings.NewReader("{}"))},
+	}
+	for _, tt := range tests {
+		base := &scriptedTransport{errs: []error{refusedError()}}
+		transport := &breakerTransport{base: base, breaker: newUpstreamBreaker("", "")}
+		resp, err := transport.RoundTrip(tt.req)
+		if tt.retry {
+			if err != nil || resp.StatusCode != http.StatusOK || base.calls != 2 {
+				t.Errorf("%s: err = %v, calls = %d; want a successful retry", tt.name, err, base.calls)
+			}
+			if len(base.bodies) == 2 && base.bodies[1] != base.bodies[0] {
+				t.Errorf("%s: retried body = %q, want %q", tt.name, base.bodies[1], base.bodies[0])
+			}
+			continue
+		}
+		if err == nil || base.calls != 1 {
+			t.Errorf("%s: err = %v, calls = %d; want no retry", tt.name, err, base.calls)
+		}
+	}
+}
+
+func TestWriteUpstreamUnavailableSetsRetryAfter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeUpstreamUnavailable(rec, &upstreamUnavailableError{reason: "down", retryAfter: 1500 * time.Millisecond})
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "2" {
+		t.Fatalf("Retry-After = %q, want 2", got)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+
+	"tinfoil/internal/auth"
+	shimconfig "tinfoil/internal/config"
+)
+
+const diagnosticsPath = "/.well-known/tinfoil-boot-diagnostics"
+
+// diagnosticsHandler serves the bundle tinfoil-boot writes when it fails.
+// The bundle is redacted but still describes the host, so it is only served
+// to operators holding the diagnostics API key; without a key it is not
+// served at all. The key is read from the external config on each request
+// because the shim serves this before its own config has loaded.
+func diagnosticsHandler(bundlePath, externalConfigPath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		apiKey := diagnosticsAPIKey(externalConfigPath)
+		if apiKey == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if !auth.RequireBearer(apiKey, w, r) {
+			return
+		}
+		bundle, err := os.ReadFile(bundlePath)
+		if errors.Is(err, os.ErrNotExist) {
+			http.Error(w, "no boot diagnostics", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "boot diagnostics not available", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(bundle)
+	}
+}
+
+func diagnosticsAPIKey(externalConfigPath string) string {
+	data, err := os.ReadFile(externalConfigPath)
+	if err != nil {
+		return ""
+	}
+	externalConfig, err := shimconfig.DecodeExternal(data)
+	if err != nil {
+		return ""
+	}
+	return externalConfig.DiagnosticsAPIKey
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiagnosticsHandlerRequiresConfiguredKey(t *testing.T) {
+	dir := t.TempDir()
+	bundlePath := filepath.Join(dir, "boot-diagnostics.json")
+	externalPath := filepath.Join(dir, "external-config.yml")
+	if err := os.WriteFile(bundlePath, []byte(`{"error":"boom"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	handler := diagnosticsHandler(bundlePath, externalPath)
+	get := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, diagnosticsPath, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := get(""); rec.Code != http.StatusNotFound {
+		t.Fatalf("without external config: status = %d, want 404", rec.Code)
+	}
+	if err := os.WriteFile(externalPath, []byte("secrets:\n  METRICS_API_KEY: metrics\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if rec := get("metrics"); rec.Code != http.StatusNotFound {
+		t.Fatalf("without diagnostics key: status = %d, want 404", rec.Code)
+	}
+
+	if err := os.WriteFile(externalPath, []byte("secrets:\n  DIAGNOSTICS_API_KEY: operator\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if rec := get("wrong"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong key: status = %d, want 401", rec.Code)
+	}
+	rec := get("operator")
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"error":"boom"}` {
+		t.Fatalf("operator: status = %d, body = %q", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "no-store" {
+		t.Fatalf("Cache-Control = %q, want no-store", got)
+	}
+
+	if err := os.Remove(bundlePath); err != nil {
+		t.Fatal(err)
+	}
+	if rec := get("operator"); rec.Code != http.StatusNotFound {
+		t.Fatalf("no bundle: status = %d, want 404", rec.Code)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+
+	"tinfoil/internal/config"
+)
+
+// servedDomains are the hostnames the enclave's certificate covers: the
+// node's DOMAIN, its wildcard when tls-wildcard is set, and the domain
+// aliases.
+type servedDomains struct {
+	primary  string
+	wildcard bool
+	aliases  []string
+}
+
+func newServedDomains(primary string, wildcard bool, aliases []config.DomainAlias) servedDomains {
+	domains := servedDomains{primary: strings.ToLower(primary), wildcard: wildcard}
+	for _, alias := range aliases {
+		domains.aliases = append(domains.aliases, alias.Name)
+	}
+	return domains
+}
+
+// match returns the served domain a request for host addresses. Without
+// aliases every host belongs to DOMAIN, as before aliases existed.
+func (d servedDomains) match(host string) (string, bool) {
+	if len(d.aliases) == 0 {
+		return d.primary, true
+	}
+	if host == d.primary || (d.wildcard && wildcardMatches("*."+d.primary, host)) {
+		return d.primary, true
+	}
+	for _, alias := range d.aliases {
+		if host == alias || wildcardMatches(alias, host) {
+			return alias, true
+		}
+	}
+	return "", false
+}
+
+// wildcardMatches reports whether host is a single-label subdomain covered
+// by the "*." pattern, as in certificate name matching.
+func wildcardMatches(pattern, host string) bool {
+	suffix, ok := strings.CutPrefix(pattern, "*")
+	if !ok {
+		return false
+	}
+	label, ok := strings.CutSuffix(host, suffix)
+	return ok && label != "" && !strings.Contains(label, ".")
+}
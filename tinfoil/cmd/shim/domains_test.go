@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"tinfoil/internal/config"
+	"tinfoil/internal/key"
+)
+
+func TestServedDomainsMatch(t *testing.T) {
+	domains := newServedDomains("Node.example.com", true, []config.DomainAlias{
+		{Name: "api.customer.com"},
+		{Name: "*.customer.org", ChallengeMode: "dns"},
+	})
+	tests := map[string]string{
+		"node.example.com":      "node.example.com",
+		"eu.node.example.com":   "node.example.com",
+		"api.customer.com":      "api.customer.com",
+		"chat.customer.org":     "*.customer.org",
+		"a.b.customer.org":      "",
+		"customer.org":          "",
+		"other.example.com":     "",
+		"xnode.example.com":     "",
+		"api.customer.com.evil": "",
+	}
+	for host, want := range tests {
+		got, ok := domains.match(host)
+		if got != want || ok != (want != "") {
+			t.Errorf("match(%q) = %q, %t, want %q", host, got, ok, want)
+		}
+	}
+
+	if got, ok := newServedDomains("node.example.com", false, nil).match("10.0.0.2"); !ok || got != "node.example.com" {
+		t.Fatalf("without aliases: match = %q, %t", got, ok)
+	}
+}
+
+func TestDomainAliasesCheckRequestedHost(t *testing.T) {
+	validator := &fakeValidator{err: &key.ValidationError{StatusCode: http.StatusForbidden}}
+	extensions := &config.Extensions{DomainAliases: []config.DomainAlias{{Name: "api.customer.com"}}}
+	handler := testAuthServerWithExtensions(t, validator, []string{"/v1/chat/completions"}, extensions)
+	post := func(host string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		req.Host = host
+		req.Header.Set("Authorization", "Bearer token")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := post("unknown.example.com"); rec.Code != http.StatusMisdirectedRequest || len(validator.calls) != 0 {
+		t.Fatalf("unknown host: status = %d, validator calls = %d", rec.Code, len(validator.calls))
+	}
+	post("API.customer.com:443")
+	if len(validator.calls) != 1 || validator.calls[0].Domain != "api.customer.com" {
+		t.Fatalf("validator calls = %+v, want the matched alias as domain", validator.calls)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	ehbpProtocol "github.com/tinfoilsh/encrypted-http-body-protocol/protocol"
+
+	"tinfoil/internal/metrics"
+)
+
+const errMsgEHBPRequired = "This endpoint requires an EHBP-encrypted request body."
+
+type plaintextBodyKey struct{}
+
+// requireEHBP rejects requests with a plaintext body on routes matching
+// requiredPaths. Routes are matched on the path a request is served as
+// upstream, so Anthropic Messages requests count as chat completions. It
+// must wrap the EHBP middleware, which otherwise passes requests without an
+// encapsulated key through unencrypted. Plaintext requests it lets through
+// are marked so batch uploads can hold their lines to the same policy.
+func requireEHBP(requiredPaths []string, anthropicMessages bool, next http.Handler) http.Handler {
+	if len(requiredPaths) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength != 0 && r.Header.Get(ehbpProtocol.EncapsulatedKeyHeader) == "" {
+			if rejectPlaintext(w, requiredPaths, upstreamPath(anthropicMessages, r.URL.Path)) {
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), plaintextBodyKey{}, true))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rejectPlaintext writes the EHBP error and reports true when path matches
+// one of requiredPaths.
+func rejectPlaintext(w http.ResponseWriter, requiredPaths []string, path string) bool {
+	for _, pattern := range requiredPaths {
+		if pathMatchesPattern(pattern, path) {
+			metrics.RecordEHBPDowngrade(pattern)
+			writeJSONError(w, errMsgEHBPRequired, errTypeInvalidRequest, http.StatusBadRequest)
+			return true
+		}
+	}
+	return false
+}
+
+// plaintextBody reports whether r arrived with an unencrypted body.
+func plaintextBody(r *http.Request) bool {
+	plaintext, _ := r.Context().Value(plaintextBodyKey{}).(bool)
+	return plaintext
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ehbpProtocol "github.com/tinfoilsh/encrypted-http-body-protocol/protocol"
+)
+
+func TestRequireEHBP(t *testing.T) {
+	var reached int
+	handler := requireEHBP([]string{"/v1/chat/completions"}, true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached++
+	}))
+
+	tests := []struct {
+		name      string
+		path      string
+		body      string
+		encrypted bool
+		want      int
+	}{
+		{name: "plaintext on required route", path: "/v1/chat/completions", body: "{}", want: http.StatusBadRequest},
+		{name: "encrypted on required route", path: "/v1/chat/completions", body: "ciphertext", encrypted: true, want: http.StatusOK},
+		{name: "no body on required route", path: "/v1/chat/completions", want: http.StatusOK},
+		{name: "plaintext Anthropic Messages served as chat completions", path: "/v1/messages", body: "{}", want: http.StatusBadRequest},
+		{name: "plaintext elsewhere", path: "/v1/embeddings", body: "{}", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			if tt.encrypted {
+				req.Header.Set(ehbpProtocol.EncapsulatedKeyHeader, "enc")
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body.String())
+			}
+			if tt.want == http.StatusBadRequest && !strings.Contains(rec.Body.String(), errMsgEHBPRequired) {
+				t.Fatalf("body = %s, want the EHBP error", rec.Body.String())
+			}
+		})
+	}
+	if reached != 3 {
+		t.Fatalf("next handler reached %d times, want 3", reached)
+	}
+}
+
+func TestRequireEHBPChunkedPlaintext(t *testing.T) {
+	handler := requireEHBP([]string{"/v1/*"}, false, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	req := httptest.NewRequest(http.MethodPost, "/v1/responses", strings.NewReader("{}"))
+	req.ContentLength = -1
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("chunked plaintext body: status = %d, want 400", rec.Code)
+	}
+}
+
+func TestRequireEHBPPlaintextBatchLines(t *testing.T) {
+	st := newBatchStore(t.TempDir(), batchUpstream(), nil, nil, []string{"/v1/chat/completions"})
+	handler := requireEHBP(st.ehbpPaths, false, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st.serve(w, r, "key-a")
+	}))
+
+	// The upload route itself is not covered, but its lines are.
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("purpose", batchPurposeInput)
+	part, _ := form.CreateFormFile("file", "input.jsonl")
+	io.WriteString(part, batchInput("hello"))
+	form.Close()
+	req := httptest.NewRequest(http.MethodPost, batchFilesPath, &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), errMsgEHBPRequired) {
+		t.Fatalf("plaintext upload of chat completion lines: status = %d, body = %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"tinfoil/internal/boot"
+)
+
+const (
+	healthPath = "/healthz"
+
+	// healthDrainDelay keeps serving after SIGTERM so load balancers observe
+	// draining before connections are refused. It stays below pid1's TERM
+	// grace.
+	healthDrainDelay = 5 * time.Second
+)
+
+// shimPhase is how far upgradeWhenReady has advanced the public handler.
+type shimPhase int32
+
+const (
+	phaseBootStages shimPhase = iota
+	phaseObservability
+	phaseProxying
+	phaseFailed
+	phaseDraining
+)
+
+// setPhase moves the shim to next unless it is already draining, which only
+// shutdown sets and nothing undoes.
+func setPhase(phase *atomic.Int32, next shimPhase) {
+	for {
+		current := phase.Load()
+		if shimPhase(current) == phaseDraining || phase.CompareAndSwap(current, int32(next)) {
+			return
+		}
+	}
+}
+
+const (
+	healthReady    = "ready"
+	healthStarting = "starting"
+	healthDraining = "draining"
+	healthFailed   = "failed"
+)
+
+// healthSource combines the boot state, pid1 readiness, container health and
+// the shim phase into one coarse status. It reports nothing about the
+// workload, so it is safe to serve without TLS or an API key.
+type healthSource struct {
+	phase               *atomic.Int32
+	pid1ReadyPath       string
+	containerStatusPath string
+	loadBoot            func() (*boot.State, error)
+
+	// pid1WasReady records that pid1 published readiness; pid1 only
+	// withdraws it again when shutting down.
+	pid1WasReady atomic.Bool
+}
+
+func newHealthSource(phase *atomic.Int32) *healthSource {
+	return &healthSource{
+		phase:               phase,
+		pid1ReadyPath:       boot.PID1ReadyPath,
+		containerStatusPath: boot.ContainerStatusPath,
+		loadBoot:            boot.Load,
+	}
+}
+
+func (h *healthSource) status() string {
+	phase := shimPhase(h.phase.Load())
+	if phase == phaseDraining {
+		return healthDraining
+	}
+	state, err := h.loadBoot()
+	if phase == phaseFailed || (err == nil && state.HasFailed()) {
+		return healthFailed
+	}
+
+	_, readyErr := os.Stat(h.pid1ReadyPath)
+	pid1Ready := readyErr == nil
+	if pid1Ready {
+		h.pid1WasReady.Store(true)
+	} else if h.pid1WasReady.Load() {
+		return healthDraining
+	}
+
+	if phase != phaseProxying || err != nil || !state.IsComplete() || !pid1Ready || !h.containersHealthy() {
+		return healthStarting
+	}
+	return healthReady
+}
+
+// containersHealthy reports whether every declared container is running and
+// not failing its health check. One-shot containers that exited cleanly
+// count as healthy.
+func (h *healthSource) containersHealthy() bool {
+	data, err := os.ReadFile(h.containerStatusPath)
+	if errors.Is(err, os.ErrNotExist) {
+		// Nothing is published when the runtime config declares no
+		// containers.
+		return true
+	}
+	if err != nil {
+		return false
+	}
+	var status struct {
+		Containers []struct {
+			Declared      bool   `json:"declared"`
+			Status        string `json:"status"`
+			RestartPolicy string `json:"restart_policy"`
+			ExitCode      int    `json:"exit_code"`
+			Health        *struct {
+				Status string `json:"status"`
+			} `json:"health"`
+		} `json:"containers"`
+		Unavailable string `json:"unavailable"`
+	}
+	if err := json.Unmarshal(data, &status); err != nil || status.Unavailable != "" {
+		return false
+	}
+	for _, c := range status.Containers {
+		if !c.Declared {
+			continue
+		}
+		switch {
+		case c.Status == "exited" && c.ExitCode == 0 && (c.RestartPolicy == "" || c.RestartPolicy == "no"):
+		case c.Status != "running":
+			return false
+		case c.Health != nil && c.Health.Status != "healthy":
+			return false
+		}
+	}
+	return true
+}
+
+// healthHandler answers 200 when the node can take traffic and 503
+// otherwise, with only the coarse status in the body.
+func healthHandler(source *healthSource) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+healthPath, func(w http.ResponseWriter, r *http.Request) {
+		status := source.status()
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if status != healthReady {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": status})
+	})
+	return mux
+}
+
+// startHealthListener serves the health endpoint over plain HTTP on port,
+// which tinfoil-containers opens in the firewall.
+func startHealthListener(port int, source *healthSource) *http.Server {
+	srv := &http.Server{
+		Addr:              fmt.Sprintf(":%d", port),
+		Handler:           healthHandler(source),
+		ReadHeaderTimeout: shimReadHeaderTimeout,
+		IdleTimeout:       shimIdleTimeout,
+	}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Warning: health listener stopped: %v", err)
+		}
+	}()
+	return srv
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"tinfoil/internal/boot"
+)
+
+func testHealthSource(t *testing.T, phase shimPhase, stages []boot.Stage, pid1Ready bool, containers string) *healthSource {
+	t.Helper()
+	dir := t.TempDir()
+	source := &healthSource{
+		phase:               new(atomic.Int32),
+		pid1ReadyPath:       filepath.Join(dir, "pid1.ready"),
+		containerStatusPath: filepath.Join(dir, "container-status.json"),
+		loadBoot: func() (*boot.State, error) {
+			return &boot.State{Stages: stages}, nil
+		},
+	}
+	source.phase.Store(int32(phase))
+	if pid1Ready {
+		if err := os.WriteFile(source.pid1ReadyPath, []byte("ready\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if containers != "" {
+		if err := os.WriteFile(source.containerStatusPath, []byte(containers), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return source
+}
+
+func TestHealthStatus(t *testing.T) {
+	complete := []boot.Stage{{Name: boot.StageContainers, Status: boot.StatusOK}, {Name: boot.StageShim, Status: boot.StatusOK}}
+	pending := []boot.Stage{{Name: boot.StageContainers, Status: boot.StatusPending}}
+	failed := []boot.Stage{{Name: boot.StageContainers, Status: boot.StatusFailed}}
+	running := `{"containers":[{"name":"app","declared":true,"status":"running","health":{"status":"healthy"}},{"name":"init","declared":true,"status":"exited","restart_policy":"no","exit_code":0}]}`
+	unhealthy := `{"containers":[{"name":"app","declared":true,"status":"running","health":{"status":"unhealthy"}}]}`
+	restarting := `{"containers":[{"name":"app","declared":true,"status":"restarting"}]}`
+
+	tests := []struct {
+		name       string
+		phase      shimPhase
+		stages     []boot.Stage
+		pid1Ready  bool
+		containers string
+		want       string
+	}{
+		{name: "ready", phase: phaseProxying, stages: complete, pid1Ready: true, containers: running, want: healthReady},
+		{name: "no containers", phase: phaseProxying, stages: complete, pid1Ready: true, want: healthReady},
+		{name: "booting", phase: phaseBootStages, stages: pending, want: healthStarting},
+		{name: "observability only", phase: phaseObservability, stages: complete, pid1Ready: true, containers: running, want: healthStarting},
+		{name: "pid1 not ready", phase: phaseProxying, stages: complete, containers: running, want: healthStarting},
+		{name: "unhealthy container", phase: phaseProxying, stages: complete, pid1Ready: true, containers: unhealthy, want: healthStarting},
+		{name: "restarting container", phase: phaseProxying, stages: complete, pid1Ready: true, containers: restarting, want: healthStarting},
+		{name: "boot failed", phase: phaseObservability, stages: failed, want: healthFailed},
+		{name: "shim failed", phase: phaseFailed, stages: complete, want: healthFailed},
+		{name: "shutting down", phase: phaseDraining, stages: complete, pid1Ready: true, containers: running, want: healthDraining},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := testHealthSource(t, tt.phase, tt.stages, tt.pid1Ready, tt.containers)
+			if got := source.status(); got != tt.want {
+				t.Fatalf("status = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHealthStatusDrainsWhenPID1WithdrawsReadiness(t *testing.T) {
+	complete := []boot.Stage{{Name: boot.StageShim, Status: boot.StatusOK}}
+	source := testHealthSource(t, phaseProxying, complete, true, "")
+	if got := source.status(); got != healthReady {
+		t.Fatalf("status = %q, want ready", got)
+	}
+	if err := os.Remove(source.pid1ReadyPath); err != nil {
+		t.Fatal(err)
+	}
+	if got := source.status(); got != healthDraining {
+		t.Fatalf("status = %q after pid1 withdrew readiness, want draining", got)
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	source := testHealthSource(t, phaseBootStages, nil, false, "")
+	handler := healthHandler(source)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, healthPath, nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status code = %d, want 503", rec.Code)
+	}
+	var body map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body) != 1 || body["status"] != healthStarting {
+		t.Fatalf("body = %v, want only the starting status", body)
+	}
+
+	source.phase.Store(int32(phaseProxying))
+	source.loadBoot = func() (*boot.State, error) {
+		return &boot.State{Stages: []boot.Stage{{Name: boot.StageShim, Status: boot.StatusOK}}}, nil
+	}
+	if err := os.WriteFile(source.pid1ReadyPath, []byte("ready\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, healthPath, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status code = %d, want 200", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/.well-known/tinfoil-boot-stages", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("boot stages on health port = %d, want 404", rec.Code)
+	}
+}
+
+func TestSetPhaseKeepsDraining(t *testing.T) {
+	var phase atomic.Int32
+	setPhase(&phase, phaseObservability)
+	setPhase(&phase, phaseDraining)
+	setPhase(&phase, phaseProxying)
+	if got := shimPhase(phase.Load()); got != phaseDraining {
+		t.Fatalf("phase = %d, want draining", got)
+	}
+}
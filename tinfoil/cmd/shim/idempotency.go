@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotentReplayedHeader  = "Idempotent-Replayed"
+	maxIdempotencyKeyBytes    = 255
+	maxIdempotentRequestBytes = 16 << 20
+
+	// Completed responses are held in enclave memory only. The limits bound
+	// what one tenant, and all tenants together, can pin there.
+	idempotencyTTL                = time.Hour
+	maxIdempotentResponseBytes    = 1 << 20
+	maxIdempotencyEntries         = 4096
+	maxIdempotencyEntriesPerScope = 256
+	maxIdempotencyStoreBytes      = 64 << 20
+)
+
+var (
+	errIdempotencyConflict = errors.New("idempotency key reused with a different request")
+	errIdempotencyFull     = errors.New("idempotency store is full")
+)
+
+// idempotencyStore deduplicates non-streaming POST requests that carry an
+// Idempotency-Key header. Keys are scoped to the caller's API key, so one
+// tenant can never observe another tenant's stored response.
+type idempotencyStore struct {
+	mu       sync.Mutex
+	entries  map[idempotencyID]*idempotencyEntry
+	order    *list.List
+	perScope map[[sha256.Size]byte]int
+	bytes    int
+	now      func() time.Time
+}
+
+type idempotencyID struct {
+	scope [sha256.Size]byte
+	key   string
+}
+
+type idempotencyEntry struct {
+	id          idempotencyID
+	fingerprint [sha256.Size]byte
+	done        chan struct{}
+	element     *list.Element
+
+	// response and expires are written once before done is closed and are
+	// read-only afterwards. A nil response after done means the original
+	// attempt produced nothing worth replaying and the key was released.
+	response *idempotentResponse
+	expires  time.Time
+}
+
+type idempotentResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+func newIdempotencyStore() *idempotencyStore {
+	return &idempotencyStore{
+		entries:  make(map[idempotencyID]*idempotencyEntry),
+		order:    list.New(),
+		perScope: make(map[[sha256.Size]byte]int),
+		now:      time.Now,
+	}
+}
+
+// serve runs next at most once per (API key, Idempotency-Key) pair. Duplicates
+// that arrive while the original is in flight wait for it; later duplicates
+// get the stored response. Requests without the header, without an API key,
+// or asking for a streamed response pass straight through.
+func (s *idempotencyStore) serve(w http.ResponseWriter, r *http.Request, apiKey string, next http.Handler) {
+	idempotencyKey := r.Header.Get(idempotencyKeyHeader)
+	if idempotencyKey == "" || apiKey == "" || r.Method != http.MethodPost {
+		next.ServeHTTP(w, r)
+		return
+	}
+	if !validIdempotencyKey(idempotencyKey) {
+		writeJSONError(w, "Invalid Idempotency-Key header.", errTypeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxIdempotentRequestBytes+1))
+	if err != nil {
+		writeJSONError(w, "Failed to read request body.", errTypeInvalidRequest, http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxIdempotentRequestBytes {
+		writeJSONError(w, "Request body is too large for an idempotent request.", errTypeInvalidRequest, http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+	r.ContentLength = int64(len(body))
+
+	if requestsStream(body) {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	id := idempotencyID{scope: sha256.Sum256([]byte(apiKey)), key: idempotencyKey}
+	fingerprint := requestFingerprint(r.URL.Path, body)
+	for {
+		entry, owner, err := s.acquire(id, fingerprint)
+		if errors.Is(err, errIdempotencyConflict) {
+			writeJSONError(w, "Idempotency-Key was already used with a different request.", errTypeInvalidRequest, http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("Warning: serving request without idempotency protection: %v", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if owner {
+			recorder := &idempotencyRecorder{w: w, header: make(http.Header)}
+			finished := false
+			defer func() {
+				// An aborted proxy (http.ErrAbortHandler) must neither strand
+				// waiters nor store a truncated response.
+				var response *idempotentResponse
+				if finished {
+					response = recorder.result()
+				}
+				s.complete(entry, response)
+			}()
+			next.ServeHTTP(recorder, r)
+			finished = true
+			return
+		}
+
+		select {
+		case <-entry.done:
+		case <-r.Context().Done():
+			return
+		}
+		if entry.response != nil {
+			entry.response.replay(w)
+			return
+		}
+		// The original attempt was not stored (for example an upstream
+		// failure), so this duplicate competes to run the request itself.
+	}
+}
+
+// acquire returns the entry for id. owner is true when the caller created the
+// entry and must run the request and complete it.
+func (s *idempotencyStore) acquire(id idempotencyID, fingerprint [sha256.Size]byte) (*idempotencyEntry, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if entry, ok := s.entries[id]; ok && (entry.response == nil || now.Before(entry.expires)) {
+		if entry.fingerprint != fingerprint {
+			return nil, false, errIdempotencyConflict
+		}
+		return entry, false, nil
+	}
+
+	scopeFull := func() bool { return s.perScope[id.scope] >= maxIdempotencyEntriesPerScope }
+	storeFull := func() bool { return len(s.entries) >= maxIdempotencyEntries }
+	s.evictLocked(now, id.scope, true, scopeFull)
+	s.evictLocked(now, id.scope, false, storeFull)
+	if scopeFull() || storeFull() {
+		return nil, false, errIdempotencyFull
+	}
+
+	entry := &idempotencyEntry{id: id, fingerprint: fingerprint, done: make(chan struct{})}
+	entry.element = s.order.PushBack(entry)
+	s.entries[id] = entry
+	s.perScope[id.scope]++
+	return entry, true, nil
+}
+
+// complete publishes the owner's response to waiters. Responses that should
+// not be replayed release the key so that a retry runs the request again.
+func (s *idempotencyStore) complete(entry *idempotencyEntry, response *idempotentResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer close(entry.done)
+
+	if response == nil {
+		s.removeLocked(entry)
+		return
+	}
+	bytesFull := func() bool { return s.bytes+len(response.body) > maxIdempotencyStoreBytes }
+	now := s.now()
+	s.evictLocked(now, entry.id.scope, false, bytesFull)
+	if bytesFull() {
+		s.removeLocked(entry)
+		return
+	}
+	entry.response = response
+	entry.expires = now.Add(idempotencyTTL)
+	s.bytes += len(response.body)
+}
+
+// evictLocked drops expired entries and then completed entries, oldest first,
+// while full reports no room. In-flight entries are never evicted; when
+// sameScope is set only entries of scope are candidates, so one tenant
+// cannot push out another tenant's responses by filling its own quota.
+func (s *idempotencyStore) evictLocked(now time.Time, scope [sha256.Size]byte, sameScope bool, full func() bool) {
+	for element := s.order.Front(); element != nil; {
+		next := element.Next()
+		entry := element.Value.(*idempotencyEntry)
+		if entry.response != nil && !now.Before(entry.expires) {
+			s.removeLocked(entry)
+		}
+		element = next
+	}
+	for element := s.order.Front(); element != nil && full(); {
+		next := element.Next()
+		entry := element.Value.(*idempotencyEntry)
+		if entry.response != nil && (!sameScope || entry.id.scope == scope) {
+			s.removeLocked(entry)
+		}
+		element = next
+	}
+}
+
+func (s *idempotencyStore) removeLocked(entry *idempotencyEntry) {
+	if s.entries[entry.id] != entry {
+		return
+	}
+	delete(s.entries, entry.id)
+	s.order.Remove(entry.element)
+	if s.perScope[entry.id.scope]--; s.perScope[entry.id.scope] <= 0 {
+		delete(s.perScope, entry.id.scope)
+	}
+	if entry.response != nil {
+		s.bytes -= len(entry.response.body)
+	}
+}
+
+func validIdempotencyKey(key string) bool {
+	if len(key) > maxIdempotencyKeyBytes {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x21 || key[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// requestsStream reports whether an OpenAI-style JSON body asks for a
+// streamed response. Non-JSON bodies are treated as non-streaming.
+func requestsStream(body []byte) bool {
+	var request struct {
+		Stream bool `json:"stream"`
+	}
+	return json.Unmarshal(body, &request) == nil && request.Stream
+}
+
+func requestFingerprint(path string, body []byte) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write([]byte(path))
+	h.Write([]byte{0})
+	h.Write(body)
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+func (resp *idempotentResponse) replay(w http.ResponseWriter) {
+	for name, values := range resp.header {
+		w.Header()[name] = append([]string(nil), values...)
+	}
+	w.Header().Set(idempotentReplayedHeader, "true")
+	w.WriteHeader(resp.status)
+	_, _ = w.Write(resp.body)
+}
+
+// idempotencyRecorder forwards a response to the client while keeping a
+// bounded copy of it. It hands the proxy a fresh header map so the stored
+// copy holds only upstream headers, never ones set by outer middleware.
+type idempotencyRecorder struct {
+	w        http.ResponseWriter
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+	overflow bool
+	failed   bool
+}
+
+func (r *idempotencyRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *idempotencyRecorder) WriteHeader(status int) {
+	if r.status != 0 {
+		return
+	}
+	r.status = status
+	for name, values := range r.header {
+		r.w.Header()[name] = values
+	}
+	r.w.WriteHeader(status)
+}
+
+func (r *idempotencyRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	if !r.overflow {
+		if r.body.Len()+len(p) > maxIdempotentResponseBytes {
+			r.overflow = true
+			r.body = bytes.Buffer{}
+		} else {
+			r.body.Write(p)
+		}
+	}
+	n, err := r.w.Write(p)
+	if err != nil {
+		r.failed = true
+	}
+	return n, err
+}
+
+func (r *idempotencyRecorder) Flush() {
+	_ = http.NewResponseController(r.w).Flush()
+}
+
+// result returns the response to store, or nil when it must not be replayed:
+// server errors and proxy failures stay retryable, truncated bodies are
+// dropped, and streamed or oversized bodies are never held in memory.
+func (r *idempotencyRecorder) result() *idempotentResponse {
+	if r.status == 0 || r.status >= http.StatusInternalServerError || r.overflow || r.failed {
+		return nil
+	}
+	if length := r.header.Get("Content-Length"); length != "" && length != strconv.Itoa(r.body.Len()) {
+		return nil
+	}
+	if isEventStreamContentType(r.header.Get("Content-Type")) {
+		return nil
+	}
+	return &idempotentResponse{
+		status: r.status,
+		header: r.header.Clone(),
+		body:   bytes.Clone(r.body.Bytes()),
+	}
+}
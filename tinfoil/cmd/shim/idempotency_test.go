@@ -0,0 +1,206 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func idempotentRequest(key, body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set(idempotencyKeyHeader, key)
+	return req
+}
+
+func countingUpstream(calls *atomic.Int32, status int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_, _ = io.WriteString(w, `{"call":`+strconv.Itoa(int(n))+`,"echo":`+string(body)+`}`)
+	})
+}
+
+func TestIdempotencyReplaysCompletedResponse(t *testing.T) {
+	store := newIdempotencyStore()
+	var calls atomic.Int32
+	upstream := countingUpstream(&calls, http.StatusOK)
+
+	first := httptest.NewRecorder()
+	store.serve(first, idempotentRequest("retry-1", `{"n":1}`), "sk-a", upstream)
+	second := httptest.NewRecorder()
+	store.serve(second, idempotentRequest("retry-1", `{"n":1}`), "sk-a", upstream)
+
+	if calls.Load() != 1 {
+		t.Fatalf("upstream calls = %d, want 1", calls.Load())
+	}
+	if second.Code != http.StatusOK || second.Body.String() != first.Body.String() {
+		t.Fatalf("replay = %d %q, want %d %q", second.Code, second.Body.String(), first.Code, first.Body.String())
+	}
+	if second.Header().Get(idempotentReplayedHeader) != "true" {
+		t.Fatal("replayed response is not marked")
+	}
+	if first.Header().Get(idempotentReplayedHeader) != "" {
+		t.Fatal("original response must not be marked as replayed")
+	}
+}
+
+func TestIdempotencyKeysAreScopedToAPIKey(t *testing.T) {
+	store := newIdempotencyStore()
+	var calls atomic.Int32
+	upstream := countingUpstream(&calls, http.StatusOK)
+
+	store.serve(httptest.NewRecorder(), idempotentRequest("shared", `{}`), "sk-a", upstream)
+	other := httptest.NewRecorder()
+	store.serve(other, idempotentRequest("shared", `{}`), "sk-b", upstream)
+
+	if calls.Load() != 2 {
+		t.Fatalf("upstream calls = %d, want 2", calls.Load())
+	}
+	if other.Header().Get(idempotentReplayedHeader) != "" {
+		t.Fatal("another API key received a replayed response")
+	}
+}
+
+func TestIdempotencyRejectsDifferentBody(t *testing.T) {
+	store := newIdempotencyStore()
+	var calls atomic.Int32
+	upstream := countingUpstream(&calls, http.StatusOK)
+
+	store.serve(httptest.NewRecorder(), idempotentRequest("retry-1", `{"n":1}`), "sk-a", upstream)
+	conflict := httptest.NewRecorder()
+	store.serve(conflict, idempotentRequest("retry-1", `{"n":2}`), "sk-a", upstream)
+
+	if conflict.Code != http.StatusConflict {
+		t.Fatalf("status = %d, want %d: %s", conflict.Code, http.StatusConflict, conflict.Body.String())
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("upstream calls = %d, want 1", calls.Load())
+	}
+}
+
+func TestIdempotencyDuplicateWaitsForInFlightOriginal(t *testing.T) {
+	store := newIdempotencyStore()
+	var calls atomic.Int32
+	release := make(chan struct{})
+	started := make(chan struct{})
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		close(started)
+		<-release
+		_, _ = io.WriteString(w, "done")
+	})
+
+	var wg sync.WaitGroup
+	results := make([]*httptest.ResponseRecorder, 2)
+	for i := range results {
+		results[i] = httptest.NewRecorder()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		store.serve(results[0], idempotentRequest("slow", `{}`), "sk-a", upstream)
+	}()
+	<-started
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		store.serve(results[1], idempotentRequest("slow", `{}`), "sk-a", upstream)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls.Load() != 1 {
+		t.Fatalf("upstream calls = %d, want 1", calls.Load())
+	}
+	if results[1].Body.String() != "done" {
+		t.Fatalf("waiting duplicate got %q", results[1].Body.String())
+	}
+}
+
+func TestIdempotencyDoesNotStoreServerErrors(t *testing.T) {
+	store := newIdempotencyStore()
+	var calls atomic.Int32
+	upstream := countingUpstream(&calls, http.StatusBadGateway)
+
+	store.serve(httptest.NewRecorder(), idempotentRequest("retry-1", `{}`), "sk-a", upstream)
+	store.serve(httptest.NewRecorder(), idempotentRequest("retry-1", `{}`), "sk-a", upstream)
+
+	if calls.Load() != 2 {
+		t.Fatalf("upstream calls = %d, want a retry after a server error", calls.Load())
+	}
+}
+
+func TestIdempotencyBypassesStreamingRequests(t *testing.T) {
+	store := newIdempotencyStore()
+	var calls atomic.Int32
+	upstream := countingUpstream(&calls, http.StatusOK)
+
+	for range 2 {
+		store.serve(httptest.NewRecorder(), idempotentRequest("stream", `{"stream":true}`), "sk-a", upstream)
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("upstream calls = %d, want streaming requests to pass through", calls.Load())
+	}
+}
+
+func TestIdempotencyEntriesExpire(t *testing.T) {
+	store := newIdempotencyStore()
+	now := time.Unix(1_700_000_000, 0)
+	store.now = func() time.Time { return now }
+	var calls atomic.Int32
+	upstream := countingUpstream(&calls, http.StatusOK)
+
+	store.serve(httptest.NewRecorder(), idempotentRequest("retry-1", `{}`), "sk-a", upstream)
+	now = now.Add(idempotencyTTL)
+	store.serve(httptest.NewRecorder(), idempotentRequest("retry-1", `{"n":2}`), "sk-a", upstream)
+
+	if calls.Load() != 2 {
+		t.Fatalf("upstream calls = %d, want expired key to be reusable", calls.Load())
+	}
+}
+
+func TestIdempotencyBoundsEntriesPerAPIKey(t *testing.T) {
+	store := newIdempotencyStore()
+	var calls atomic.Int32
+	upstream := countingUpstream(&calls, http.StatusOK)
+
+	store.serve(httptest.NewRecorder(), idempotentRequest("other-tenant", `{}`), "sk-b", upstream)
+	for i := range maxIdempotencyEntriesPerScope + 1 {
+		store.serve(httptest.NewRecorder(), idempotentRequest("key-"+strconv.Itoa(i), `{}`), "sk-a", upstream)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if len(store.entries) != maxIdempotencyEntriesPerScope+1 {
+		t.Fatalf("entries = %d, want %d", len(store.entries), maxIdempotencyEntriesPerScope+1)
+	}
+	var otherScope idempotencyID
+	for id := range store.entries {
+		if id.key == "other-tenant" {
+			otherScope = id
+		}
+	}
+	if otherScope.key == "" {
+		t.Fatal("one API key evicted another API key's entry")
+	}
+}
+
+func TestIdempotencyRejectsInvalidKey(t *testing.T) {
+	store := newIdempotencyStore()
+	var calls atomic.Int32
+	rec := httptest.NewRecorder()
+	store.serve(rec, idempotentRequest("bad key", `{}`), "sk-a", countingUpstream(&calls, http.StatusOK))
+
+	if rec.Code != http.StatusBadRequest || calls.Load() != 0 {
+		t.Fatalf("status = %d calls = %d, want 400 without proxying", rec.Code, calls.Load())
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tinfoil/internal/boot"
+	"tinfoil/internal/config"
+)
+
+const (
+	// l4HandshakeTimeout bounds the TLS handshake so idle connections cannot
+	// hold a goroutine before the service is known.
+	l4HandshakeTimeout = 10 * time.Second
+
+	// l4DialTimeout bounds connecting to the target container.
+	l4DialTimeout = 5 * time.Second
+)
+
+// l4Port serves the L4 services sharing one inbound port. A TCP port has a
+// single service; a TLS port routes by SNI to the service naming it, or to
+// the one without an SNI.
+type l4Port struct {
+	port     int
+	services []config.L4Service
+	cert     *atomic.Pointer[tls.Certificate]
+	resolve  func(container string) (string, error)
+	// postQuantum is the measured TLS key exchange policy; nil keeps the
+	// Go defaults.
+	postQuantum *config.PostQuantum
+}
+
+// startL4Services listens on every L4 service port and forwards accepted
+// connections to the target containers until the process exits.
+func startL4Services(services []config.L4Service, cert *atomic.Pointer[tls.Certificate], postQuantum *config.PostQuantum) error {
+	ports := map[int]*l4Port{}
+	var order []int
+	for _, service := range services {
+		p, ok := ports[service.Port]
+		if !ok {
+			p = &l4Port{port: service.Port, cert: cert, resolve: containerAddressResolver(boot.ContainerStatusPath), postQuantum: postQuantum}
+			ports[service.Port] = p
+			order = append(order, service.Port)
+		}
+		p.services = append(p.services, service)
+	}
+	for _, port := range order {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			return fmt.Errorf("listening on L4 service port %d: %w", port, err)
+		}
+		p := ports[port]
+		mode := config.L4ModeTCP
+		if p.tls() {
+			mode = config.L4ModeTLS
+		}
+		log.Printf("L4 services on port %d (%s): %d service(s)", port, mode, len(p.services))
+		go p.serve(listener)
+	}
+	return nil
+}
+
+func (p *l4Port) tls() bool {
+	return p.services[0].TLS()
+}
+
+func (p *l4Port) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Warning: accepting on L4 port %d: %v", p.port, err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go p.handle(conn)
+	}
+}
+
+func (p *l4Port) handle(conn net.Conn) {
+	defer conn.Close()
+
+	service := p.services[0]
+	if p.tls() {
+		tlsConn := tls.Server(conn, p.tlsConfig())
+		ctx, cancel := context.WithTimeout(context.Background(), l4HandshakeTimeout)
+		err := tlsConn.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
+			return
+		}
+		var ok bool
+		service, ok = p.serviceFor(tlsConn.ConnectionState().ServerName)
+		if !ok {
+			return
+		}
+		conn = tlsConn
+	}
+
+	host, err := p.resolve(service.Container)
+	if err != nil {
+		log.Printf("Warning: L4 service %q: %v", service.Name, err)
+		return
+	}
+	target, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(service.TargetPort)), l4DialTimeout)
+	if err != nil {
+		log.Printf("Warning: L4 service %q: dialing container %q: %v", service.Name, service.Container, err)
+		return
+	}
+	defer target.Close()
+	pipeL4(conn, target)
+}
+
+// tlsConfig serves the enclave certificate and negotiates the ALPN
+// protocols of the service the client names.
+func (p *l4Port) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			service, ok := p.serviceFor(hello.ServerName)
+			if !ok {
+				return nil, fmt.Errorf("no L4 service for server name %q", hello.ServerName)
+			}
+			cfg := &tls.Config{
+				MinVersion: tls.VersionTLS12,
+				NextProtos: service.ALPN,
+				GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+					return p.cert.Load(), nil
+				},
+			}
+			p.postQuantum.ApplyTLS(cfg)
+			return cfg, nil
+		},
+	}
+}
+
+func (p *l4Port) serviceFor(serverName string) (config.L4Service, bool) {
+	var fallback *config.L4Service
+	for i, service := range p.services {
+		if service.SNI == "" {
+			fallback = &p.services[i]
+		} else if strings.EqualFold(service.SNI, serverName) {
+			return service, true
+		}
+	}
+	if fallback == nil {
+		return config.L4Service{}, false
+	}
+	return *fallback, true
+}
+
+// pipeL4 copies in both directions, half-closing each side when the other
+// finishes sending so protocols that rely on EOF keep working.
+func pipeL4(client, target net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(target, client)
+		closeWrite(target)
+	}()
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(client, target)
+		closeWrite(client)
+	}()
+	wg.Wait()
+}
+
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	}
+}
+
+// containerAddressResolver looks up a container's address in the status
+// file tinfoil-containers publishes. It is read per connection so restarted
+// containers are found at their new address.
+func containerAddressResolver(statusPath string) func(string) (string, error) {
+	return func(container string) (string, error) {
+		data, err := os.ReadFile(statusPath)
+		if err != nil {
+			return "", fmt.Errorf("reading container status: %w", err)
+		}
+		var status struct {
+			Containers []struct {
+				Name      string            `json:"name"`
+				Addresses map[string]string `json:"addresses"`
+			} `json:"containers"`
+		}
+		if err := json.Unmarshal(data, &status); err != nil {
+			return "", fmt.Errorf("decoding container status: %w", err)
+		}
+		for _, c := range status.Containers {
+			if c.Name != container || len(c.Addresses) == 0 {
+				continue
+			}
+			networks := make([]string, 0, len(c.Addresses))
+			for network := range c.Addresses {
+				networks = append(networks, network)
+			}
+			slices.Sort(networks)
+			return c.Addresses[networks[0]], nil
+		}
+		return "", fmt.Errorf("container %q has no published address", container)
+	}
+}
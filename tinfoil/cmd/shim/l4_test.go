@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"tinfoil/internal/config"
+)
+
+// echoBackend answers each line with prefix and the line.
+func echoBackend(t *testing.T, prefix string) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					fmt.Fprintf(conn, "%s:%s\n", prefix, scanner.Text())
+				}
+			}()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func serveL4(t *testing.T, services []config.L4Service, postQuantum *config.PostQuantum) string {
+	t.Helper()
+	cert, err := generateEphemeralCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var certPtr atomic.Pointer[tls.Certificate]
+	certPtr.Store(&cert)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	p := &l4Port{
+		services:    services,
+		cert:        &certPtr,
+		resolve:     func(string) (string, error) { return "127.0.0.1", nil },
+		postQuantum: postQuantum,
+	}
+	go p.serve(listener)
+	return listener.Addr().String()
+}
+
+func roundTrip(t *testing.T, conn net.Conn, line string) string {
+	t.Helper()
+	if _, err := fmt.Fprintf(conn, "%s\n", line); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func TestL4TLSRoutesBySNI(t *testing.T) {
+	db := echoBackend(t, "db")
+	grpc := echoBackend(t, "grpc")
+	addr := serveL4(t, []config.L4Service{
+		{Name: "db", Container: "db", TargetPort: db},
+		{Name: "grpc", Container: "api", TargetPort: grpc, SNI: "grpc.example.com", ALPN: []string{"h2"}},
+	}, nil)
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, ServerName: "grpc.example.com", NextProtos: []string{"h2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := conn.ConnectionState().NegotiatedProtocol; got != "h2" {
+		t.Fatalf("negotiated protocol = %q, want h2", got)
+	}
+	if got := roundTrip(t, conn, "ping"); got != "grpc:ping\n" {
+		t.Fatalf("reply = %q, want the grpc backend", got)
+	}
+
+	conn, err = tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, ServerName: "db.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := roundTrip(t, conn, "ping"); got != "db:ping\n" {
+		t.Fatalf("reply = %q, want the default backend", got)
+	}
+}
+
+func TestL4TLSRejectsUnknownSNI(t *testing.T) {
+	addr := serveL4(t, []config.L4Service{
+		{Name: "grpc", Container: "api", TargetPort: echoBackend(t, "grpc"), SNI: "grpc.example.com"},
+	}, nil)
+	if conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, ServerName: "other.example.com"}); err == nil {
+		conn.Close()
+		t.Fatal("handshake succeeded for a server name without a service")
+	}
+}
+
+func TestL4TCPForwardsRawStream(t *testing.T) {
+	addr := serveL4(t, []config.L4Service{
+		{Name: "db", Container: "db", TargetPort: echoBackend(t, "db"), Mode: config.L4ModeTCP},
+	}, nil)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := roundTrip(t, conn, "select 1"); got != "db:select 1\n" {
+		t.Fatalf("reply = %q", got)
+	}
+}
+
+func TestContainerAddressResolver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "container-status.json")
+	status := `{"containers":[{"name":"db","addresses":{"z-net":"172.20.0.3","a-net":"172.19.0.2"}},{"name":"idle"}]}`
+	if err := os.WriteFile(path, []byte(status), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	resolve := containerAddressResolver(path)
+	if got, err := resolve("db"); err != nil || got != "172.19.0.2" {
+		t.Fatalf("resolve(db) = %q, %v", got, err)
+	}
+	if _, err := resolve("idle"); err == nil {
+		t.Fatal("container without addresses resolved")
+	}
+}
+
+func TestL4TLSRequirePostQuantum(t *testing.T) {
+	addr := serveL4(t, []config.L4Service{
+		{Name: "db", Container: "db", TargetPort: echoBackend(t, "db")},
+	}, &config.PostQuantum{TLS: config.PostQuantumTLSRequire})
+
+	classical := &tls.Config{InsecureSkipVerify: true, CurvePreferences: []tls.CurveID{tls.X25519}}
+	if conn, err := tls.Dial("tcp", addr, classical); err == nil {
+		conn.Close()
+		t.Fatal("classical key exchange accepted under the require policy")
+	}
+
+	hybrid := &tls.Config{InsecureSkipVerify: true, CurvePreferences: []tls.CurveID{tls.X25519MLKEM768, tls.X25519}}
+	conn, err := tls.Dial("tcp", addr, hybrid)
+	if err != nil {
+		t.Fatalf("hybrid handshake failed: %v", err)
+	}
+	defer conn.Close()
+	if got := conn.ConnectionState().CurveID; got != tls.X25519MLKEM768 {
+		t.Fatalf("negotiated %v, want X25519MLKEM768", got)
+	}
+	if got := roundTrip(t, conn, "ping"); got != "db:ping\n" {
+		t.Fatalf("reply = %q", got)
+	}
+}
@@ -1,19 +1,23 @@
 package main
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"math/big"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"log"
@@ -27,6 +31,7 @@ import (
 	"tinfoil/internal/boot"
 	shimconfig "tinfoil/internal/config"
 	"tinfoil/internal/key"
+	"tinfoil/internal/key/introspection"
 	localjwt "tinfoil/internal/key/jwt"
 	"tinfoil/internal/key/online"
 	tlsutil "tinfoil/internal/tls"
@@ -35,6 +40,7 @@ import (
 var (
 	configFile         = flag.String("c", boot.ShimConfigPath, "Path to config file")
 	externalConfigFile = flag.String("e", boot.ExternalConfigPath, "Path to external config file")
+	extensionsFile     = flag.String("x", boot.ShimExtensionsPath, "Path to shim extensions file")
 )
 
 const (
@@ -48,6 +54,8 @@ func main() {
 
 	var handler atomic.Value
 	var cert atomic.Pointer[tls.Certificate]
+	var phase atomic.Int32
+	var postQuantum atomic.Pointer[shimconfig.PostQuantum]
 
 	// Start with an ephemeral self-signed cert and a minimal handler that
 	// serves only boot-stages. This lets the backend poll boot progress before
@@ -60,9 +68,22 @@ func main() {
 
 	handler.Store(http.HandlerFunc(bootStagesHandler().ServeHTTP))
 
+	getCertificate := func(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return cert.Load(), nil
+	}
 	tlsConfig := &tls.Config{
-		GetCertificate: func(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
-			return cert.Load(), nil
+		GetCertificate: getCertificate,
+		// The post-quantum key exchange policy is measured config, so it
+		// applies once loaded; until then the Go defaults are offered.
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			pq := postQuantum.Load()
+			if pq == nil {
+				return nil, nil
+			}
+			// net/http only adds its ALPN protocols to srv.TLSConfig.
+			cfg := &tls.Config{GetCertificate: getCertificate, NextProtos: []string{"h2", "http/1.1"}}
+			pq.ApplyTLS(cfg)
+			return cfg, nil
 		},
 	}
 
@@ -80,15 +101,35 @@ func main() {
 		TLSConfig: tlsConfig,
 	}
 
+	// The health listener is opt-in, so it starts once the extensions
+	// enabling it have loaded.
+	var healthSrv atomic.Pointer[http.Server]
+
 	// Wait for boot to provision artifacts, then upgrade to the full handler.
-	go upgradeWhenReady(&handler, &cert)
+	go upgradeWhenReady(&handler, &cert, &phase, &postQuantum, &healthSrv)
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM)
+		<-signals
+		phase.Store(int32(phaseDraining))
+		log.Printf("Draining for %v before shutdown", healthDrainDelay)
+		time.Sleep(healthDrainDelay)
+		if health := healthSrv.Load(); health != nil {
+			health.Close()
+		}
+		srv.Close()
+	}()
 
 	log.Printf("Starting tinfoil shim (waiting for boot)")
-	log.Fatal(srv.ListenAndServeTLS("", ""))
+	if err := srv.ListenAndServeTLS("", ""); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
 }
 
 // bootStagesHandler returns a minimal handler that only serves the
-// boot-stages endpoint, returning 503 for everything else.
+// boot-stages and boot-diagnostics endpoints, returning 503 for everything
+// else.
 func bootStagesHandler() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/.well-known/tinfoil-boot-stages", func(w http.ResponseWriter, r *http.Request) {
@@ -100,6 +141,7 @@ func bootStagesHandler() http.Handler {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(state)
 	})
+	mux.HandleFunc(diagnosticsPath, diagnosticsHandler(boot.DiagnosticsPath, *externalConfigFile))
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "shim is starting, waiting for boot to complete", http.StatusServiceUnavailable)
 	})
@@ -110,24 +152,32 @@ const artifactPollInterval = 1 * time.Second
 
 // upgradeWhenReady advances the public handler through three explicit phases:
 // boot stages only, observability only, and finally workload proxying.
-func upgradeWhenReady(handler *atomic.Value, cert *atomic.Pointer[tls.Certificate]) {
+func upgradeWhenReady(handler *atomic.Value, cert *atomic.Pointer[tls.Certificate], phase *atomic.Int32, postQuantum *atomic.Pointer[shimconfig.PostQuantum], healthSrv *atomic.Pointer[http.Server]) {
 	start := time.Now()
 
 	err := func() error {
 		type configPair struct {
-			config   *shimconfig.Config
-			external *shimconfig.ExternalConfig
+			config     *shimconfig.Config
+			external   *shimconfig.ExternalConfig
+			extensions *shimconfig.Extensions
 		}
 		cfgPair, err := waitForArtifact("Shim config", func() (configPair, error) {
 			c, e, err := shimconfig.Load(*configFile, *externalConfigFile)
-			return configPair{c, e}, err
+			if err != nil {
+				return configPair{}, err
+			}
+			x, err := shimconfig.LoadExtensions(*extensionsFile)
+			return configPair{c, e, x}, err
 		})
 		if err != nil {
 			return err
 		}
-		config, externalConfig := cfgPair.config, cfgPair.external
+		config, externalConfig, extensions := cfgPair.config, cfgPair.external, cfgPair.extensions
 		log.Printf("Shim config loaded: upstream-container=%s upstream-port=%d tls-mode=%s paths=%d",
 			config.UpstreamContainer, config.UpstreamPort, config.TLSMode, len(config.Paths))
+		if extensions.HealthPort != 0 {
+			healthSrv.Store(startHealthListener(extensions.HealthPort, newHealthSource(phase)))
+		}
 
 		realCert, err := waitForArtifact("TLS certificate", func() (tls.Certificate, error) {
 			return tls.LoadX509KeyPair(boot.TLSCertPath, boot.TLSKeyPath)
@@ -136,6 +186,10 @@ func upgradeWhenReady(handler *atomic.Value, cert *atomic.Pointer[tls.Certificat
 			return err
 		}
 		cert.Store(&realCert)
+		postQuantum.Store(extensions.PostQuantum)
+		if extensions.SecureTime != nil {
+			go watchSecureTime(context.Background(), extensions.SecureTime)
+		}
 
 		att, err := waitForArtifact("Attestation document", func() (*verifier.Document, error) {
 			return loadAttestation()
@@ -176,8 +230,9 @@ func upgradeWhenReady(handler *atomic.Value, cert *atomic.Pointer[tls.Certificat
 		expectedGPUs := config.ExpectedGPUs
 		log.Printf("Expected %d GPU(s) for attestation", expectedGPUs)
 
-		observabilityHandler := NewObservabilityServer(att, identityBody, expectedGPUs, serverIdentity, realCertParsed, collateralCache, config, externalConfig)
+		observabilityHandler := NewObservabilityServer(att, identityBody, expectedGPUs, serverIdentity, realCertParsed, collateralCache, config, externalConfig, extensions)
 		handler.Store(http.HandlerFunc(observabilityHandler.ServeHTTP))
+		setPhase(phase, phaseObservability)
 
 		log.Println("Shim observability ready")
 
@@ -201,37 +256,9 @@ func upgradeWhenReady(handler *atomic.Value, cert *atomic.Pointer[tls.Certificat
 			return fmt.Errorf("boot stage failed, not enabling proxy")
 		}
 
-		// API key validator
-		var validator key.Validator
-		if config.ControlPlane != "" {
-			controlPlaneURL, err := url.Parse(config.ControlPlane)
-			if err != nil {
-				return fmt.Errorf("parsing control plane URL: %w", err)
-			}
-
-			if config.Authenticated {
-				onlineValidator, err := online.NewValidator(controlPlaneURL.JoinPath("api", "shim", "validate-key").String())
-				if err != nil {
-					return fmt.Errorf("initializing API key verifier: %w", err)
-				}
-
-				// Verify OAuth JWT access tokens locally against the control
-				// plane's JWKS so they need no per-request round trip; opaque
-				// keys still fall through to the online validator. The JWKS
-				// loads best-effort and self-heals via refresh, so a
-				// control-plane blip at boot never disables local verification.
-				jwksURL := controlPlaneURL.JoinPath(".well-known", "jwks.json").String()
-				jwtValidator := localjwt.NewValidator(jwksURL, config.ControlPlane, localjwt.AccessTokenAudience, localjwt.RequiredScope)
-				log.Println("Local JWT validation enabled (OAuth access tokens verified in-enclave)")
-				validator = &metricsValidator{
-					online: onlineValidator,
-					chain:  key.NewChain(jwtValidator, onlineValidator),
-				}
-			} else {
-				log.Println("Warning: API key verification disabled (unauthenticated endpoint)")
-			}
-		} else {
-			log.Println("Warning: API key verification disabled (no control plane)")
+		validator, err := newKeyValidator(config, externalConfig, extensions)
+		if err != nil {
+			return err
 		}
 
 		var rateLimiter *RateLimiter
@@ -243,15 +270,23 @@ func upgradeWhenReady(handler *atomic.Value, cert *atomic.Pointer[tls.Certificat
 		upstreamAddr := fmt.Sprintf("%s:%d", upstreamHost, config.UpstreamPort)
 		log.Printf("Shim upstream resolved: %s → %s", config.UpstreamContainer, upstreamAddr)
 
-		fullHandler := NewShimServer(validator, rateLimiter, att, identityBody, expectedGPUs, serverIdentity, realCertParsed, collateralCache, config, externalConfig, upstreamAddr)
+		fullHandler := NewShimServer(validator, rateLimiter, att, identityBody, expectedGPUs, serverIdentity, realCertParsed, collateralCache, config, externalConfig, extensions, upstreamAddr)
 		handler.Store(http.HandlerFunc(fullHandler.ServeHTTP))
 
+		if len(extensions.L4Services) > 0 {
+			if err := startL4Services(extensions.L4Services, cert, extensions.PostQuantum); err != nil {
+				return err
+			}
+		}
+
+		setPhase(phase, phaseProxying)
 		log.Println("Shim fully operational")
 		return nil
 	}()
 
 	if err != nil {
 		log.Printf("Shim upgrade failed: %v", err)
+		setPhase(phase, phaseFailed)
 		boot.RecordStage(boot.StageShim, boot.StatusFailed, time.Since(start), err.Error())
 	} else {
 		boot.RecordStage(boot.StageShim, boot.StatusOK, time.Since(start), "")
@@ -313,3 +348,97 @@ func loadAttestation() (*verifier.Document, error) {
 	}
 	return &att, nil
 }
+
+// newKeyValidator builds the API key validator. An authenticated config
+// with a control plane verifies the control plane's JWT access tokens
+// locally and its opaque keys online. A configured introspection endpoint
+// validates opaque tokens with or without a control plane. It returns nil
+// when nothing validates keys.
+func newKeyValidator(config *shimconfig.Config, externalConfig *shimconfig.ExternalConfig, extensions *shimconfig.Extensions) (key.Validator, error) {
+	// Deployments whose opaque tokens come from their own OAuth
+	// authorization server introspect them there instead.
+	var introspector key.Validator
+	if introspectionConfig := extensions.TokenIntrospection; introspectionConfig != nil {
+		validator, err := introspection.NewValidator(
+			introspectionConfig.URL,
+			externalConfig.GetSecret(shimconfig.IntrospectionClientIDSecret),
+			externalConfig.GetSecret(shimconfig.IntrospectionClientSecretSecret),
+			introspectionConfig.Audience,
+			localjwt.RequiredScope,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("initializing token introspection: %w", err)
+		}
+		log.Printf("Token introspection enabled: %s", introspectionConfig.URL)
+		introspector = validator
+	}
+
+	if config.ControlPlane == "" || !config.Authenticated {
+		if introspector != nil {
+			return introspector, nil
+		}
+		if config.ControlPlane == "" {
+			log.Println("Warning: API key verification disabled (no control plane)")
+		} else {
+			log.Println("Warning: API key verification disabled (unauthenticated endpoint)")
+		}
+		return nil, nil
+	}
+
+	controlPlaneURL, err := url.Parse(config.ControlPlane)
+	if err != nil {
+		return nil, fmt.Errorf("parsing control plane URL: %w", err)
+	}
+	onlineValidator, err := online.NewValidator(controlPlaneURL.JoinPath("api", "shim", "validate-key").String())
+	if err != nil {
+		return nil, fmt.Errorf("initializing API key verifier: %w", err)
+	}
+
+	// Verify OAuth JWT access tokens locally against the control plane's
+	// JWKS so they need no per-request round trip; opaque keys still fall
+	// through to the online validator. The JWKS loads best-effort and
+	// self-heals via refresh, so a control-plane blip at boot never disables
+	// local verification. Measured config may instead embed the JWKS, or pin
+	// the fetched keys, so a compromised JWKS endpoint cannot add signing
+	// keys.
+	var jwtValidator *localjwt.Validator
+	jwtKeys := extensions.JWTKeys
+	if jwtKeys == nil {
+		jwtKeys = &shimconfig.JWTKeys{}
+	}
+	keySet, err := jwtKeys.KeySet()
+	if err != nil {
+		return nil, fmt.Errorf("loading JWT signing keys: %w", err)
+	}
+	if keySet != nil {
+		jwtValidator, err = localjwt.NewOfflineValidator(*keySet, config.ControlPlane, localjwt.AccessTokenAudience, localjwt.RequiredScope)
+		if err != nil {
+			return nil, fmt.Errorf("loading JWT signing keys: %w", err)
+		}
+		log.Printf("Local JWT validation enabled with %d measured signing keys", len(keySet.Keys))
+	} else {
+		jwksURL := controlPlaneURL.JoinPath(".well-known", "jwks.json").String()
+		jwtValidator = localjwt.NewValidator(jwksURL, config.ControlPlane, localjwt.AccessTokenAudience, localjwt.RequiredScope)
+		log.Println("Local JWT validation enabled (OAuth access tokens verified in-enclave)")
+	}
+	if len(jwtKeys.PinnedKeyIDs) > 0 || len(jwtKeys.PinnedThumbprints) > 0 {
+		jwtValidator.PinKeys(jwtKeys.PinnedKeyIDs, jwtKeys.PinnedThumbprints)
+		log.Printf("JWKS pinned to %d key ids and %d thumbprints", len(jwtKeys.PinnedKeyIDs), len(jwtKeys.PinnedThumbprints))
+	}
+	if revocation := extensions.JWTRevocation; revocation != nil {
+		feedURL := revocation.URL
+		if feedURL == "" {
+			feedURL = controlPlaneURL.JoinPath("api", "shim", "revocations").String()
+		}
+		jwtValidator.UseRevocationFeed(feedURL, revocation.MaxStaleness, revocation.FailClosed)
+		log.Printf("JWT revocation feed enabled: max-staleness=%v fail-closed=%v", revocation.MaxStaleness, revocation.FailClosed)
+	}
+	opaqueValidator := key.Validator(onlineValidator)
+	if introspector != nil {
+		opaqueValidator = introspector
+	}
+	return &metricsValidator{
+		online: onlineValidator,
+		chain:  key.NewChain(jwtValidator, opaqueValidator),
+	}, nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/tinfoilsh/tinfoil-go/verifier/envelope"
+
+	tinfoilattestation "tinfoil/internal/attestation"
+	"tinfoil/internal/boot"
+)
+
+const (
+	manifestPath     = "/.well-known/tinfoil-manifest"
+	manifestFormatV1 = "tinfoil-manifest-v1"
+)
+
+// workloadManifest describes what runs in the CVM. Everything in it is
+// public: the measured config is already world-readable inside the CVM.
+type workloadManifest struct {
+	Format string `json:"format"`
+	// ConfigSHA256 is the hash of Config, which must equal the
+	// tinfoil-config-hash on the measured kernel command line.
+	ConfigSHA256 string           `json:"config_sha256"`
+	Config       string           `json:"config"`
+	Images       []manifestImage  `json:"images"`
+	ModelPacks   []string         `json:"model_packs"`
+	Binaries     []manifestBinary `json:"binaries"`
+}
+
+// manifestImage is a container's pinned image reference, the ID of the
+// image it actually runs, and the registry digest that image was pulled as.
+type manifestImage struct {
+	Container  string `json:"container"`
+	Image      string `json:"image"`
+	ImageID    string `json:"image_id,omitempty"`
+	RepoDigest string `json:"repo_digest,omitempty"`
+}
+
+type manifestBinary = boot.Binary
+
+// manifestResponse carries the manifest as the exact bytes whose digest the
+// attestation binds, so clients can hash what they received.
+type manifestResponse struct {
+	Manifest       string             `json:"manifest"`
+	ManifestSHA256 string             `json:"manifest_sha256"`
+	Attestation    *envelope.Document `json:"attestation,omitempty"`
+}
+
+// attestationBuilder builds a fresh attestation over extra crypto material,
+// writing the error response itself on failure.
+type attestationBuilder func(w http.ResponseWriter, r *http.Request, nonceHex string, material []envelope.CryptoMaterialItem) (*envelope.Document, bool)
+
+// manifestSource collects the manifest from the files boot and
+// tinfoil-containers publish.
+type manifestSource struct {
+	configPath          string
+	containerStatusPath string
+	modelPackDir        string
+	binaries            map[string]string
+
+	binariesOnce sync.Once
+	binaryInfo   []manifestBinary
+}
+
+func newManifestSource() *manifestSource {
+	return &manifestSource{
+		configPath:          boot.ConfigPath,
+		containerStatusPath: boot.ContainerStatusPath,
+		modelPackDir:        boot.MWPDir,
+		binaries:            boot.Binaries(),
+	}
+}
+
+func (s *manifestSource) manifest() (*workloadManifest, error) {
+	config, err := os.ReadFile(s.configPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading measured config: %w", err)
+	}
+	configHash := sha256.Sum256(config)
+
+	images, err := s.images()
+	if err != nil {
+		return nil, err
+	}
+	modelPacks, err := s.modelPacks()
+	if err != nil {
+		return nil, err
+	}
+
+	// The binaries live on the measured root and never change at runtime.
+	s.binariesOnce.Do(func() { s.binaryInfo = s.readBinaries() })
+
+	return &workloadManifest{
+		Format:       manifestFormatV1,
+		ConfigSHA256: hex.EncodeToString(configHash[:]),
+		Config:       string(config),
+		Images:       images,
+		ModelPacks:   modelPacks,
+		Binaries:     s.binaryInfo,
+	}, nil
+}
+
+func (s *manifestSource) images() ([]manifestImage, error) {
+	images := []manifestImage{}
+	data, err := os.ReadFile(s.containerStatusPath)
+	if os.IsNotExist(err) {
+		return images, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading container status: %w", err)
+	}
+	var status struct {
+		Containers []struct {
+			Name       string `json:"name"`
+			Image      string `json:"image"`
+			ImageID    string `json:"image_id"`
+			RepoDigest string `json:"repo_digest"`
+		} `json:"containers"`
+	}
+	if err := json.Unmarshal(data, &status); err != nil {
+		return nil, fmt.Errorf("decoding container status: %w", err)
+	}
+	for _, c := range status.Containers {
+		images = append(images, manifestImage{Container: c.Name, Image: c.Image, ImageID: c.ImageID, RepoDigest: c.RepoDigest})
+	}
+	return images, nil
+}
+
+// modelPacks returns the dm-verity root hashes of the mounted model packs,
+// which mountModels names mwp-<root hash>.
+func (s *manifestSource) modelPacks() ([]string, error) {
+	packs := []string{}
+	entries, err := os.ReadDir(s.modelPackDir)
+	if os.IsNotExist(err) {
+		return packs, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listing model packs: %w", err)
+	}
+	for _, entry := range entries {
+		if rootHash, ok := strings.CutPrefix(entry.Name(), "mwp-"); ok && entry.IsDir() {
+			packs = append(packs, rootHash)
+		}
+	}
+	slices.Sort(packs)
+	return packs, nil
+}
+
+func (s *manifestSource) readBinaries() []manifestBinary {
+	names := boot.SortedBinaryNames(s.binaries)
+	binaries := make([]manifestBinary, 0, len(names))
+	for _, name := range names {
+		binary, err := boot.ReadBinary(name, s.binaries[name])
+		if err != nil {
+			log.Printf("Warning: reading build info of %s: %v", binary.Path, err)
+		}
+		binaries = append(binaries, binary)
+	}
+	return binaries
+}
+
+// manifestHandler serves the workload manifest. With ?nonce=<64 hex chars>
+// the response also carries a fresh attestation whose crypto material binds
+// the manifest digest.
+func manifestHandler(source *manifestSource, attest attestationBuilder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		manifest, err := source.manifest()
+		if err != nil {
+			log.Printf("Workload manifest unavailable: %v", err)
+			writeJSONError(w, "Workload manifest unavailable", errTypeServer, http.StatusServiceUnavailable)
+			return
+		}
+		data, err := json.Marshal(manifest)
+		if err != nil {
+			writeJSONError(w, errMsgServerError, errTypeServer, http.StatusInternalServerError)
+			return
+		}
+		digest := sha256.Sum256(data)
+		resp := manifestResponse{
+			Manifest:       base64.StdEncoding.EncodeToString(data),
+			ManifestSHA256: hex.EncodeToString(digest[:]),
+		}
+		if nonceHex := r.URL.Query().Get("nonce"); nonceHex != "" {
+			fresh, ok := attest(w, r, nonceHex, []envelope.CryptoMaterialItem{tinfoilattestation.ManifestItem(digest)})
+			if !ok {
+				return
+			}
+			resp.Attestation = fresh
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
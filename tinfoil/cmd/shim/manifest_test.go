@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tinfoilsh/tinfoil-go/verifier/envelope"
+
+	tinfoilattestation "tinfoil/internal/attestation"
+)
+
+func testManifestSource(t *testing.T) *manifestSource {
+	t.Helper()
+	dir := t.TempDir()
+	source := &manifestSource{
+		configPath:          filepath.Join(dir, "config.yml"),
+		containerStatusPath: filepath.Join(dir, "container-status.json"),
+		modelPackDir:        filepath.Join(dir, "mwp"),
+		binaries:            map[string]string{"tinfoil-shim": filepath.Join(dir, "missing")},
+	}
+	if err := os.WriteFile(source.configPath, []byte("cvm-version: 1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	status := `{"containers":[{"name":"model","image":"vllm@sha256:aa","image_id":"sha256:bb","repo_digest":"vllm@sha256:aa","status":"running"}]}`
+	if err := os.WriteFile(source.containerStatusPath, []byte(status), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"mwp-ffff", "mwp-0000", "lost+found"} {
+		if err := os.MkdirAll(filepath.Join(source.modelPackDir, name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return source
+}
+
+func TestManifestHandler(t *testing.T) {
+	source := testManifestSource(t)
+	var bound []envelope.CryptoMaterialItem
+	attest := func(w http.ResponseWriter, r *http.Request, nonceHex string, material []envelope.CryptoMaterialItem) (*envelope.Document, bool) {
+		bound = material
+		return &envelope.Document{}, true
+	}
+
+	rec := httptest.NewRecorder()
+	manifestHandler(source, attest).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, manifestPath+"?nonce="+strings.Repeat("00", 32), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var resp manifestResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	data, err := base64.StdEncoding.DecodeString(resp.Manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(data)
+	if resp.ManifestSHA256 != hex.EncodeToString(digest[:]) {
+		t.Fatalf("manifest_sha256 does not match the served bytes")
+	}
+	if resp.Attestation == nil || len(bound) != 1 || bound[0] != tinfoilattestation.ManifestItem(digest) {
+		t.Fatalf("attestation material = %+v, want the manifest digest", bound)
+	}
+
+	var manifest workloadManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	configHash := sha256.Sum256([]byte("cvm-version: 1\n"))
+	if manifest.ConfigSHA256 != hex.EncodeToString(configHash[:]) || manifest.Config != "cvm-version: 1\n" {
+		t.Fatalf("config = %q (%s)", manifest.Config, manifest.ConfigSHA256)
+	}
+	if len(manifest.Images) != 1 || manifest.Images[0].ImageID != "sha256:bb" || !strings.Contains(manifest.Images[0].RepoDigest, "@sha256:") {
+		t.Fatalf("images = %+v", manifest.Images)
+	}
+	if strings.Join(manifest.ModelPacks, ",") != "0000,ffff" {
+		t.Fatalf("model packs = %v", manifest.ModelPacks)
+	}
+	if len(manifest.Binaries) != 1 || manifest.Binaries[0].Name != "tinfoil-shim" {
+		t.Fatalf("binaries = %+v", manifest.Binaries)
+	}
+}
+
+func TestManifestHandlerWithoutNonceSkipsAttestation(t *testing.T) {
+	attest := func(w http.ResponseWriter, r *http.Request, nonceHex string, material []envelope.CryptoMaterialItem) (*envelope.Document, bool) {
+		t.Fatal("attestation built without a nonce")
+		return nil, false
+	}
+	rec := httptest.NewRecorder()
+	manifestHandler(testManifestSource(t), attest).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, manifestPath, nil))
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), `"attestation"`) {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+
+	"tinfoil/internal/auth"
+)
+
+const nodeFactsPath = "/.well-known/tinfoil-node-facts"
+
+// nodeFactsHandler serves the node facts document tinfoil-boot publishes:
+// the hardware, TEE and binary versions this enclave runs on. The document
+// fingerprints the host, so like the Prometheus metrics it is gated on the
+// metrics API key when one is configured.
+func nodeFactsHandler(factsPath, metricsAPIKey string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !auth.RequireBearer(metricsAPIKey, w, r) {
+			return
+		}
+		facts, err := os.ReadFile(factsPath)
+		if errors.Is(err, os.ErrNotExist) {
+			http.Error(w, "no node facts", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "node facts not available", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(facts)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNodeFactsHandler(t *testing.T) {
+	factsPath := filepath.Join(t.TempDir(), "node-facts.json")
+	handler := nodeFactsHandler(factsPath, "")
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, nodeFactsPath, nil))
+		return rec
+	}
+
+	if rec := get(); rec.Code != http.StatusNotFound {
+		t.Fatalf("before boot published facts: status = %d, want 404", rec.Code)
+	}
+	facts := `{"cpu":{"model":"AMD EPYC 9654 96-Core Processor","count":2}}`
+	if err := os.WriteFile(factsPath, []byte(facts), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rec := get()
+	if rec.Code != http.StatusOK || rec.Body.String() != facts {
+		t.Fatalf("status = %d, body = %q", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Fatalf("Content-Type = %q", got)
+	}
+}
+
+func TestNodeFactsHandlerRequiresMetricsKey(t *testing.T) {
+	factsPath := filepath.Join(t.TempDir(), "node-facts.json")
+	if err := os.WriteFile(factsPath, []byte(`{}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	handler := nodeFactsHandler(factsPath, "metrics-key")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, nodeFactsPath, nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("without a key: status = %d, want 401", rec.Code)
+	}
+	req := httptest.NewRequest(http.MethodGet, nodeFactsPath, nil)
+	req.Header.Set("Authorization", "Bearer metrics-key")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("with the key: status = %d, want 200", rec.Code)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"crypto/rand"
 	"encoding/json"
 	"errors"
@@ -16,6 +17,8 @@ import (
 )
 
 const (
+	chatCompletionsPath = "/v1/chat/completions"
+
 	initialSSEBufferSize = 64 * 1024
 	maxSSELineBytes      = 4 * 1024 * 1024
 )
@@ -30,6 +33,19 @@ func isEventStreamContentType(contentType string) bool {
 	return mediaType == "text/event-stream"
 }
 
+// randomPadding returns a string of random length used to hide the size of
+// streamed tokens from a network observer.
+func randomPadding() (string, error) {
+	const charset = "abcdefghijklmnopqrstuvwxyz0123456789"
+	minLength := 4
+	maxLength := len(charset)
+	r, err := rand.Int(rand.Reader, big.NewInt(int64(maxLength-minLength+1)))
+	if err != nil {
+		return "", err
+	}
+	return charset[:minLength+int(r.Int64())], nil
+}
+
 // addPaddingToStreamChunk adds a random padding field to the delta object in a streaming chunk
 // without parsing the entire response structure
 func addPaddingToStreamChunk(data string) (string, error) {
@@ -56,15 +72,10 @@ func addPaddingToStreamChunk(data string) (string, error) {
 		return data, nil
 	}
 
-	// Generate random padding
-	const charset = "abcdefghijklmnopqrstuvwxyz0123456789"
-	minLength := 4
-	maxLength := len(charset)
-	r, err := rand.Int(rand.Reader, big.NewInt(int64(maxLength-minLength+1)))
+	padding, err := randomPadding()
 	if err != nil {
 		return data, err
 	}
-	padding := charset[:minLength+int(r.Int64())]
 
 	// Add padding field to delta
 	delta["p"] = padding
@@ -79,7 +90,8 @@ func addPaddingToStreamChunk(data string) (string, error) {
 }
 
 type streamTransport struct {
-	base http.RoundTripper
+	base    http.RoundTripper
+	streams *streamStore
 }
 
 type closeOnceReadCloser struct {
@@ -104,18 +116,48 @@ func (b *streamResponseBody) Close() error {
 	return errors.Join(b.PipeReader.Close(), b.upstream.Close())
 }
 
+// cancelOnCloseBody releases the detached upstream context of a response that
+// turned out not to be resumable.
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnCloseBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
 func (t *streamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	if req.URL.Path != "/v1/chat/completions" {
+	if req.URL.Path != chatCompletionsPath {
 		return t.base.RoundTrip(req)
 	}
 
+	scope, resumable := streamScopeFrom(req.Context())
+	resumable = resumable && t.streams != nil
+	cancel := context.CancelFunc(func() {})
+	stopPropagation := func() bool { return false }
+	if resumable {
+		// A resumable stream has to outlive the connection that started it,
+		// so client cancellation only reaches upstream until the response
+		// turns out to be an event stream.
+		ctx, detachedCancel := context.WithCancel(context.WithoutCancel(req.Context()))
+		cancel = detachedCancel
+		stopPropagation = context.AfterFunc(req.Context(), cancel)
+		req = req.WithContext(ctx)
+	}
+
 	// Make the actual request
 	resp, err := t.base.RoundTrip(req)
 	if err != nil {
+		cancel()
 		return nil, err
 	}
 
 	if !isEventStreamContentType(resp.Header.Get("Content-Type")) {
+		if resumable {
+			resp.Body = &cancelOnCloseBody{ReadCloser: resp.Body, cancel: cancel}
+		}
 		return resp, nil
 	}
 
@@ -125,39 +167,56 @@ func (t *streamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	resp.Header.Del("Content-Length")
 	resp.ContentLength = -1
 
+	originalBody := &closeOnceReadCloser{ReadCloser: resp.Body}
+	if resumable {
+		abort := func() {
+			cancel()
+			originalBody.Close()
+		}
+		if stream, ok := t.streams.register(scope, abort); ok {
+			stopPropagation()
+			resp.Body = stream.responseBody()
+			go stream.produce(originalBody)
+			return resp, nil
+		}
+		log.Printf("Warning: resumable stream store is full, streaming without resumption")
+	}
+
 	// Create a pipe to modify the response stream
 	pr, pw := io.Pipe()
-	originalBody := &closeOnceReadCloser{ReadCloser: resp.Body}
 	resp.Body = &streamResponseBody{PipeReader: pr, upstream: originalBody}
 
 	go func() {
+		defer cancel()
 		defer originalBody.Close()
 
-		scanner := bufio.NewScanner(originalBody)
-		scanner.Buffer(make([]byte, 0, initialSSEBufferSize), maxSSELineBytes)
-		for scanner.Scan() {
-			line := scanner.Text()
-			out := line + "\n"
-			if strings.HasPrefix(line, "data: ") && line != "data: [DONE]" {
-				data := strings.TrimPrefix(line, "data: ")
-				modifiedData, err := addPaddingToStreamChunk(data)
-				if err != nil {
-					log.Printf("Warning: failed to add padding to chunk: %v", err)
-				} else {
-					out = "data: " + modifiedData + "\n"
-				}
-			}
-			if _, err := io.WriteString(pw, out); err != nil {
-				pw.CloseWithError(err)
-				return
-			}
-		}
-		if err := scanner.Err(); err != nil {
-			pw.CloseWithError(err)
-			return
-		}
-		pw.Close()
+		pw.CloseWithError(scanStreamLines(originalBody, func(line string) error {
+			_, err := io.WriteString(pw, line+"\n")
+			return err
+		}))
 	}()
 
 	return resp, nil
 }
+
+// scanStreamLines passes each upstream SSE line to emit, padding chunk data
+// lines on the way. It returns the first scanner or emit error.
+func scanStreamLines(upstream io.Reader, emit func(line string) error) error {
+	scanner := bufio.NewScanner(upstream)
+	scanner.Buffer(make([]byte, 0, initialSSEBufferSize), maxSSELineBytes)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if data, ok := strings.CutPrefix(line, "data: "); ok && data != "[DONE]" {
+			modifiedData, err := addPaddingToStreamChunk(data)
+			if err != nil {
+				log.Printf("Warning: failed to add padding to chunk: %v", err)
+			} else {
+				line = "data: " + modifiedData
+			}
+		}
+		if err := emit(line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
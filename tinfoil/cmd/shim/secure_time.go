@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	shimconfig "tinfoil/internal/config"
+	"tinfoil/internal/metrics"
+	"tinfoil/internal/roughtime"
+)
+
+// checkRoughtime is replaced by tests.
+var checkRoughtime = roughtime.Check
+
+// watchSecureTime re-checks the clock against the measured Roughtime
+// servers every interval and publishes the offset in metrics. Boot already
+// gated on the first check, so later failures are only logged.
+func watchSecureTime(ctx context.Context, secureTime *shimconfig.SecureTime) {
+	policy, err := secureTime.Policy()
+	if err != nil {
+		log.Printf("Warning: secure time checks disabled: %v", err)
+		return
+	}
+	ticker := time.NewTicker(secureTime.Interval())
+	defer ticker.Stop()
+	for {
+		recordSecureTime(checkRoughtime(ctx, policy))
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func recordSecureTime(measurement *roughtime.Measurement, err error) {
+	var offset time.Duration
+	if measurement != nil {
+		offset = measurement.Offset
+	}
+	metrics.RecordClockCheck(offset, measurement != nil, err == nil)
+	if err != nil {
+		log.Printf("Warning: secure time check failed: %v", err)
+	}
+}
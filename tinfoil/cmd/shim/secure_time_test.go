@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	shimconfig "tinfoil/internal/config"
+	"tinfoil/internal/roughtime"
+)
+
+func TestWatchSecureTimeChecksImmediatelyAndStops(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(make([]byte, ed25519.PublicKeySize))
+	secureTime := &shimconfig.SecureTime{
+		Servers:         []shimconfig.RoughtimeServer{{Name: "a", Address: "127.0.0.1:2002", PublicKey: key}},
+		RecheckInterval: time.Hour,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	checked := make(chan roughtime.Policy, 1)
+	previous := checkRoughtime
+	checkRoughtime = func(_ context.Context, policy roughtime.Policy) (*roughtime.Measurement, error) {
+		checked <- policy
+		cancel()
+		return &roughtime.Measurement{Offset: time.Second}, nil
+	}
+	t.Cleanup(func() { checkRoughtime = previous })
+
+	done := make(chan struct{})
+	go func() {
+		watchSecureTime(ctx, secureTime)
+		close(done)
+	}()
+	select {
+	case policy := <-checked:
+		if len(policy.Servers) != 1 || policy.Quorum != 1 || policy.MaxSkew != 10*time.Second {
+			t.Fatalf("policy = %+v", policy)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("clock was not checked at start")
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watchSecureTime did not stop when its context ended")
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	lastEventIDHeader = "Last-Event-ID"
+
+	// Stream events are held in enclave memory only. A finished stream stays
+	// resumable for streamResumeTTL; the byte limits bound how much of a
+	// stream, and of all streams together, is kept for reconnecting clients.
+	streamResumeTTL             = 5 * time.Minute
+	maxStreamBufferBytes        = 1 << 20
+	maxStreamStoreBytes         = 64 << 20
+	maxResumableStreams         = 1024
+	maxResumableStreamsPerScope = 32
+)
+
+var (
+	errStreamNotFound   = errors.New("no resumable stream matches Last-Event-ID")
+	errStreamGap        = errors.New("stream events after Last-Event-ID are no longer buffered")
+	errStreamAbandoned  = errors.New("stream abandoned: undelivered events exceeded the resume buffer")
+	errSSEEventTooLarge = errors.New("stream event exceeds maximum size")
+)
+
+// streamStore keeps the recent events of in-flight streamed completions so a
+// client that loses its connection can resume with Last-Event-ID instead of
+// paying for a new generation. Streams are scoped to the caller's API key.
+type streamStore struct {
+	mu       sync.Mutex
+	streams  map[string]*resumableStream
+	perScope map[[sha256.Size]byte]int
+	bytes    int
+	now      func() time.Time
+}
+
+// resumableStream is one upstream stream. A single producer appends events;
+// any number of followers (the original response and resumed ones) replay
+// them. All mutable fields are guarded by store.mu.
+type resumableStream struct {
+	store *streamStore
+	token string
+	scope [sha256.Size]byte
+	abort func()
+
+	events    []streamEvent
+	next      uint64 // sequence number of the next event
+	bytes     int
+	followers int
+	delivered uint64 // one past the last event written to any follower
+	done      bool
+	err       error
+	expires   time.Time
+	notify    chan struct{}
+}
+
+type streamEvent struct {
+	seq  uint64
+	data []byte
+}
+
+type streamScopeKey struct{}
+
+func newStreamStore() *streamStore {
+	return &streamStore{
+		streams:  make(map[string]*resumableStream),
+		perScope: make(map[[sha256.Size]byte]int),
+		now:      time.Now,
+	}
+}
+
+// withStreamScope marks a proxied request as eligible for resumption by the
+// holder of apiKey.
+func withStreamScope(ctx context.Context, apiKey string) context.Context {
+	return context.WithValue(ctx, streamScopeKey{}, sha256.Sum256([]byte(apiKey)))
+}
+
+func streamScopeFrom(ctx context.Context) ([sha256.Size]byte, bool) {
+	scope, ok := ctx.Value(streamScopeKey{}).([sha256.Size]byte)
+	return scope, ok
+}
+
+// register creates a stream for scope. abort stops the upstream request; it
+// is called once the stream finishes or is abandoned. register reports false
+// when the store has no room, in which case the caller streams as before.
+func (st *streamStore) register(scope [sha256.Size]byte, abort func()) (*resumableStream, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := st.now()
+	for _, stream := range st.streams {
+		if stream.done && !now.Before(stream.expires) {
+			st.removeLocked(stream)
+		}
+	}
+	st.evictLocked(scope, true, func() bool { return st.perScope[scope] >= maxResumableStreamsPerScope })
+	st.evictLocked(scope, false, func() bool { return len(st.streams) >= maxResumableStreams })
+	if st.perScope[scope] >= maxResumableStreamsPerScope || len(st.streams) >= maxResumableStreams {
+		return nil, false
+	}
+
+	stream := &resumableStream{
+		store:  st,
+		token:  rand.Text(),
+		scope:  scope,
+		abort:  abort,
+		notify: make(chan struct{}),
+	}
+	st.streams[stream.token] = stream
+	st.perScope[scope]++
+	return stream, true
+}
+
+// evictLocked removes finished streams, the ones closest to expiry first,
+// while full reports no room. Live streams are never evicted. Eviction for a
+// per-scope limit (sameScope) only considers that scope's streams.
+func (st *streamStore) evictLocked(scope [sha256.Size]byte, sameScope bool, full func() bool) {
+	for full() {
+		var oldest *resumableStream
+		for _, stream := range st.streams {
+			if !stream.done || (sameScope && stream.scope != scope) {
+				continue
+			}
+			if oldest == nil || stream.expires.Before(oldest.expires) {
+				oldest = stream
+			}
+		}
+		if oldest == nil {
+			return
+		}
+		st.removeLocked(oldest)
+	}
+}
+
+func (st *streamStore) removeLocked(stream *resumableStream) {
+	if st.streams[stream.token] != stream {
+		return
+	}
+	delete(st.streams, stream.token)
+	if st.perScope[stream.scope]--; st.perScope[stream.scope] <= 0 {
+		delete(st.perScope, stream.scope)
+	}
+	st.bytes -= stream.bytes
+	stream.bytes = 0
+	stream.events = nil
+}
+
+// lookup resolves a Last-Event-ID for the caller's scope and returns the
+// stream and the sequence number to resume from.
+func (st *streamStore) lookup(lastEventID string, scope [sha256.Size]byte) (*resumableStream, uint64, error) {
+	token, seqText, ok := strings.Cut(lastEventID, ":")
+	if !ok {
+		return nil, 0, errStreamNotFound
+	}
+	seq, err := strconv.ParseUint(seqText, 10, 64)
+	if err != nil {
+		return nil, 0, errStreamNotFound
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	stream, ok := st.streams[token]
+	if !ok || stream.scope != scope || (stream.done && !st.now().Before(stream.expires)) || seq >= stream.next {
+		return nil, 0, errStreamNotFound
+	}
+	if seq+1 < stream.firstLocked() {
+		return nil, 0, errStreamGap
+	}
+	return stream, seq + 1, nil
+}
+
+// resume serves a reconnect that carries Last-Event-ID, replaying buffered
+// events after it and then following the stream live until it ends.
+func (st *streamStore) resume(w http.ResponseWriter, r *http.Request, apiKey string) {
+	stream, from, err := st.lookup(r.Header.Get(lastEventIDHeader), sha256.Sum256([]byte(apiKey)))
+	switch {
+	case errors.Is(err, errStreamGap):
+		writeJSONError(w, "Stream events after Last-Event-ID are no longer available.", errTypeInvalidRequest, http.StatusGone)
+		return
+	case err != nil:
+		writeJSONError(w, "No resumable stream matches Last-Event-ID.", errTypeInvalidRequest, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	controller := http.NewResponseController(w)
+	_ = controller.Flush()
+	_ = stream.follow(r.Context(), from, func(event []byte) error {
+		if _, err := w.Write(event); err != nil {
+			return err
+		}
+		return controller.Flush()
+	})
+}
+
+// produce reads upstream SSE lines, groups them into events and appends each
+// event with a shim-assigned ID. Upstream IDs are dropped so that every ID a
+// client sees can be resumed.
+func (s *resumableStream) produce(upstream io.Reader) {
+	var event bytes.Buffer
+	err := scanStreamLines(upstream, func(line string) error {
+		if line == "" {
+			if event.Len() == 0 {
+				return nil
+			}
+			defer event.Reset()
+			return s.append(event.Bytes())
+		}
+		if line == "id" || strings.HasPrefix(line, "id:") {
+			return nil
+		}
+		if event.Len()+len(line) > maxSSELineBytes {
+			return errSSEEventTooLarge
+		}
+		event.WriteString(line)
+		event.WriteByte('\n')
+		return nil
+	})
+	if err == nil && event.Len() > 0 {
+		err = s.append(event.Bytes())
+	}
+	s.finish(err)
+}
+
+func (s *resumableStream) append(fields []byte) error {
+	st := s.store
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	seq := s.next
+	s.next++
+	data := make([]byte, 0, len(fields)+64)
+	data = fmt.Appendf(data, "id: %s:%d\n", s.token, seq)
+	data = append(data, fields...)
+	data = append(data, '\n')
+	s.events = append(s.events, streamEvent{seq: seq, data: data})
+	s.bytes += len(data)
+	st.bytes += len(data)
+	defer s.wakeLocked()
+
+	st.evictLocked(s.scope, false, func() bool { return st.bytes > maxStreamStoreBytes })
+	// The newest event is always kept, so a single event larger than the
+	// buffer is still delivered to a connected client.
+	for len(s.events) > 1 && (s.bytes > maxStreamBufferBytes || st.bytes > maxStreamStoreBytes) {
+		dropped := s.events[0]
+		s.events[0] = streamEvent{}
+		s.events = s.events[1:]
+		s.bytes -= len(dropped.data)
+		st.bytes -= len(dropped.data)
+		if s.followers == 0 && dropped.seq >= s.delivered {
+			// Nobody is connected and the client can no longer resume
+			// without a gap, so generating further output is wasted work.
+			return errStreamAbandoned
+		}
+	}
+	return nil
+}
+
+func (s *resumableStream) finish(err error) {
+	st := s.store
+	st.mu.Lock()
+	s.done = true
+	s.err = err
+	s.expires = st.now().Add(streamResumeTTL)
+	s.wakeLocked()
+	st.mu.Unlock()
+
+	s.abort()
+}
+
+func (s *resumableStream) wakeLocked() {
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
+
+func (s *resumableStream) firstLocked() uint64 {
+	return s.next - uint64(len(s.events))
+}
+
+// follow writes events from sequence number from onwards until the stream
+// ends, ctx is cancelled, write fails, or the follower falls behind the
+// buffer. It returns the stream's terminal error, if any.
+func (s *resumableStream) follow(ctx context.Context, from uint64, write func([]byte) error) error {
+	st := s.store
+	st.mu.Lock()
+	s.followers++
+	defer func() {
+		st.mu.Lock()
+		s.followers--
+		st.mu.Unlock()
+	}()
+
+	for {
+		if from < s.firstLocked() {
+			st.mu.Unlock()
+			return errStreamGap
+		}
+		pending := make([][]byte, 0, s.next-from)
+		for _, event := range s.events[from-s.firstLocked():] {
+			pending = append(pending, event.data)
+		}
+		done, streamErr, notify := s.done, s.err, s.notify
+		st.mu.Unlock()
+
+		for _, data := range pending {
+			if err := write(data); err != nil {
+				return err
+			}
+			from++
+			st.mu.Lock()
+			s.delivered = max(s.delivered, from)
+			st.mu.Unlock()
+		}
+		if done && len(pending) == 0 {
+			return streamErr
+		}
+		if len(pending) == 0 {
+			select {
+			case <-notify:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		st.mu.Lock()
+	}
+}
+
+// followerBody is the original client's view of a resumable stream. Closing
+// it detaches the client without stopping the upstream generation.
+type followerBody struct {
+	*io.PipeReader
+	cancel context.CancelFunc
+}
+
+func (b *followerBody) Close() error {
+	b.cancel()
+	return b.PipeReader.Close()
+}
+
+func (s *resumableStream) responseBody() io.ReadCloser {
+	pr, pw := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer cancel()
+		pw.CloseWithError(s.follow(ctx, 0, func(event []byte) error {
+			_, err := pw.Write(event)
+			return err
+		}))
+	}()
+	return &followerBody{PipeReader: pr, cancel: cancel}
+}
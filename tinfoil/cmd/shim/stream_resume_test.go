@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resumableUpstream starts a resumable stream through streamTransport and
+// returns the client's response and the writer that feeds the upstream body.
+func resumableUpstream(t *testing.T, store *streamStore, apiKey string) (*http.Response, *io.PipeWriter, *blockingCloseReader) {
+	t.Helper()
+	pr, pw := io.Pipe()
+	upstream := &blockingCloseReader{PipeReader: pr, closed: make(chan struct{})}
+	transport := &streamTransport{streams: store, base: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+			Body:       upstream,
+		}, nil
+	})}
+	req, err := http.NewRequest(http.MethodPost, "https://upstream.test/v1/chat/completions", strings.NewReader(`{"stream":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(withStreamScope(context.Background(), apiKey))
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, pw, upstream
+}
+
+type blockingCloseReader struct {
+	*io.PipeReader
+	closed chan struct{}
+}
+
+func (r *blockingCloseReader) Close() error {
+	select {
+	case <-r.closed:
+	default:
+		close(r.closed)
+	}
+	return r.PipeReader.Close()
+}
+
+func readEvent(t *testing.T, reader *bufio.Reader) []string {
+	t.Helper()
+	var lines []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading event: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+func resumeRequest(lastEventID string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"stream":true}`))
+	req.Header.Set(lastEventIDHeader, lastEventID)
+	return req
+}
+
+func TestResumableStreamResumesAfterDisconnect(t *testing.T) {
+	store := newStreamStore()
+	resp, upstream, upstreamBody := resumableUpstream(t, store, "sk-a")
+
+	go func() {
+		_, _ = io.WriteString(upstream, "data: {\"choices\":[{\"delta\":{\"content\":\"one\"}}]}\n\n")
+	}()
+	first := readEvent(t, bufio.NewReader(resp.Body))
+	lastEventID, ok := strings.CutPrefix(first[0], "id: ")
+	if !ok {
+		t.Fatalf("first event has no shim-assigned id: %q", first)
+	}
+	if err := resp.Body.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-upstreamBody.closed:
+		t.Fatal("client disconnect closed the upstream of a resumable stream")
+	default:
+	}
+	if _, err := io.WriteString(upstream, "data: {\"choices\":[{\"delta\":{\"content\":\"two\"}}]}\n\ndata: [DONE]\n\n"); err != nil {
+		t.Fatalf("upstream stopped generating after client disconnect: %v", err)
+	}
+	upstream.Close()
+
+	rec := httptest.NewRecorder()
+	store.resume(rec, resumeRequest(lastEventID), "sk-a")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("resume status = %d: %s", rec.Code, rec.Body.String())
+	}
+	body := rec.Body.String()
+	if strings.Contains(body, `"one"`) || !strings.Contains(body, `"two"`) || !strings.Contains(body, "data: [DONE]") {
+		t.Fatalf("resumed stream = %q, want events after Last-Event-ID only", body)
+	}
+	if rec.Header().Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("resume content type = %q", rec.Header().Get("Content-Type"))
+	}
+}
+
+func TestResumableStreamIsScopedToAPIKey(t *testing.T) {
+	store := newStreamStore()
+	resp, upstream, _ := resumableUpstream(t, store, "sk-a")
+	go func() {
+		_, _ = io.WriteString(upstream, "data: [DONE]\n\n")
+		upstream.Close()
+	}()
+	first := readEvent(t, bufio.NewReader(resp.Body))
+	resp.Body.Close()
+
+	rec := httptest.NewRecorder()
+	store.resume(rec, resumeRequest(strings.TrimPrefix(first[0], "id: ")), "sk-b")
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("resume with another API key: status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestResumableStreamRejectsUnknownEventID(t *testing.T) {
+	store := newStreamStore()
+	for _, id := range []string{"garbage", "unknown:0", ":"} {
+		rec := httptest.NewRecorder()
+		store.resume(rec, resumeRequest(id), "sk-a")
+		if rec.Code != http.StatusNotFound {
+			t.Fatalf("Last-Event-ID %q: status = %d, want %d", id, rec.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func largeStreamEvent() string {
+	return `data: {"choices":[{"delta":{"content":"` + strings.Repeat("a", maxStreamBufferBytes/2+1) + `"}}]}` + "\n\n"
+}
+
+func TestResumableStreamAbortsUpstreamWhenAbandoned(t *testing.T) {
+	store := newStreamStore()
+	resp, upstream, upstreamBody := resumableUpstream(t, store, "sk-a")
+	resp.Body.Close()
+
+	go func() {
+		for range 3 {
+			if _, err := io.WriteString(upstream, largeStreamEvent()); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-upstreamBody.closed:
+	case <-time.After(time.Second):
+		t.Fatal("upstream kept generating after undelivered events were dropped")
+	}
+}
+
+func TestResumableStreamReportsGap(t *testing.T) {
+	store := newStreamStore()
+	resp, upstream, upstreamBody := resumableUpstream(t, store, "sk-a")
+	reader := bufio.NewReader(resp.Body)
+
+	go func() {
+		_, _ = io.WriteString(upstream, "data: {\"choices\":[{\"delta\":{\"content\":\"one\"}}]}\n\n")
+	}()
+	first := readEvent(t, reader)
+	go func() {
+		for range 2 {
+			_, _ = io.WriteString(upstream, largeStreamEvent())
+		}
+		upstream.Close()
+	}()
+	_, _ = io.Copy(io.Discard, reader)
+	resp.Body.Close()
+	select {
+	case <-upstreamBody.closed:
+	case <-time.After(time.Second):
+		t.Fatal("stream did not finish")
+	}
+
+	rec := httptest.NewRecorder()
+	store.resume(rec, resumeRequest(strings.TrimPrefix(first[0], "id: ")), "sk-a")
+	if rec.Code != http.StatusGone {
+		t.Fatalf("resume behind the buffer: status = %d, want %d", rec.Code, http.StatusGone)
+	}
+}
@@ -30,6 +30,41 @@ const (
 	PlatformTDX    = "tdx"
 )
 
+// Crypto material the shim adds to v3 attestations to advertise its EHBP
+// policy: Data is a JSON array of the route patterns on which plaintext
+// request bodies are rejected.
+const (
+	CryptoMaterialIDEHBPPolicy = "ehbp-policy"
+	EHBPRequiredPathsV1Format  = "ehbp-required-paths-v1"
+)
+
+// EHBPPolicyItem returns the crypto material item advertising requiredPaths.
+func EHBPPolicyItem(requiredPaths []string) envelope.CryptoMaterialItem {
+	// Marshalling a string slice cannot fail.
+	data, _ := json.Marshal(requiredPaths)
+	return envelope.CryptoMaterialItem{
+		ID:     CryptoMaterialIDEHBPPolicy,
+		Format: EHBPRequiredPathsV1Format,
+		Data:   string(data),
+	}
+}
+
+// Crypto material binding a /.well-known/tinfoil-manifest response to a v3
+// attestation: Data is the hex SHA-256 of the served manifest bytes.
+const (
+	CryptoMaterialIDManifest = "manifest"
+	ManifestSHA256V1Format   = "manifest-sha256-v1"
+)
+
+// ManifestItem returns the crypto material item binding a manifest digest.
+func ManifestItem(digest [32]byte) envelope.CryptoMaterialItem {
+	return envelope.CryptoMaterialItem{
+		ID:     CryptoMaterialIDManifest,
+		Format: ManifestSHA256V1Format,
+		Data:   hex.EncodeToString(digest[:]),
+	}
+}
+
 type BodyV2 struct {
 	TLSKeyFP [32]byte
 	HPKEKey  [32]byte
@@ -141,13 +176,15 @@ func DummyReport(userData [64]byte) *legacy.Document {
 // hashes and the nonce, obtains a hardware quote over that REPORT_DATA, and
 // returns the complete document. The endorsed sections are carried
 // base64-encoded so verifiers recover the exact hashed bytes with a plain
-// decode.
+// decode. extra items, such as additional keys and policy, are appended to
+// the crypto material after the TLS and HPKE keys.
 func BuildAttestation(
 	tlsKeyFP [32]byte,
 	hpkeKey [32]byte,
 	nonce []byte,
 	deviceEvidence []envelope.DeviceEvidenceItem,
 	collateral []envelope.CollateralEntry,
+	extra []envelope.CryptoMaterialItem,
 ) (*envelope.Document, error) {
 	if len(nonce) != envelope.NonceSize {
 		return nil, fmt.Errorf("nonce must be %d bytes, got %d", envelope.NonceSize, len(nonce))
@@ -174,6 +211,15 @@ func BuildAttestation(
 			},
 		},
 	}
+	// Extra items follow the keys so they are bound by the same hash.
+	for _, item := range extra {
+		for _, existing := range cryptoMaterial.Items {
+			if item.ID == "" || item.ID == existing.ID {
+				return nil, fmt.Errorf("invalid crypto_material item id %q", item.ID)
+			}
+		}
+		cryptoMaterial.Items = append(cryptoMaterial.Items, item)
+	}
 	deviceSection := envelope.DeviceEvidenceSection{
 		Format: envelope.DeviceEvidenceV1Format,
 		Items:  deviceEvidence,
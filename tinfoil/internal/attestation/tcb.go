@@ -0,0 +1,120 @@
+package attestation
+
+import (
+	"fmt"
+
+	sevabi "github.com/google/go-sev-guest/abi"
+	"github.com/google/go-sev-guest/kds"
+	tdxabi "github.com/google/go-tdx-guest/abi"
+	tdxpb "github.com/google/go-tdx-guest/proto/tdx"
+)
+
+// turinFamily is the first CPU family whose SEV-SNP TCB_VERSION carries an
+// FMC level and uses the wider layout.
+const turinFamily = 0x1a
+
+// TCB is the firmware version a hardware report attests to. Only the fields
+// of the report's platform are set.
+type TCB struct {
+	Platform string
+	// ReportVersion is the version of the report or quote format.
+	ReportVersion uint32
+	// SEV-SNP: Reported is the TCB the report claims to verifiers and
+	// Committed the one the firmware cannot be rolled back below.
+	Reported  SEVSNPTCB
+	Committed SEVSNPTCB
+	// TDX: the 16 SVN components of TEE_TCB_SVN.
+	TEETCBSVN [16]byte
+}
+
+// SEVSNPTCB holds the security patch levels of a SEV-SNP TCB_VERSION. FMC
+// is only reported on Turin and later.
+type SEVSNPTCB struct {
+	FMC        uint8
+	Bootloader uint8
+	TEE        uint8
+	SNP        uint8
+	Microcode  uint8
+}
+
+func (t SEVSNPTCB) String() string {
+	s := fmt.Sprintf("bootloader=%d tee=%d snp=%d microcode=%d", t.Bootloader, t.TEE, t.SNP, t.Microcode)
+	if t.FMC != 0 {
+		s = fmt.Sprintf("fmc=%d %s", t.FMC, s)
+	}
+	return s
+}
+
+func (t TCB) String() string {
+	switch t.Platform {
+	case PlatformSEVSNP:
+		return fmt.Sprintf("reported %s, committed %s", t.Reported, t.Committed)
+	case PlatformTDX:
+		return fmt.Sprintf("TEE_TCB_SVN %x", t.TEETCBSVN)
+	default:
+		return t.Platform
+	}
+}
+
+// ParseTCB reads the TCB from a raw report as returned by Report.
+func ParseTCB(rawReport []byte, platform string) (TCB, error) {
+	tcb := TCB{Platform: platform}
+	switch platform {
+	case PlatformSEVSNP:
+		report, err := sevabi.ReportToProto(rawReport)
+		if err != nil {
+			return TCB{}, fmt.Errorf("parsing SEV-SNP report: %w", err)
+		}
+		tcb.ReportVersion = report.GetVersion()
+		// Version 2 reports predate CPUID in the report and Turin.
+		turin := cpuFamily(report.GetCpuid1EaxFms()) >= turinFamily
+		tcb.Reported = decomposeSEVSNPTCB(report.GetReportedTcb(), turin)
+		tcb.Committed = decomposeSEVSNPTCB(report.GetCommittedTcb(), turin)
+	case PlatformTDX:
+		quote, err := tdxabi.QuoteToProto(rawReport)
+		if err != nil {
+			return TCB{}, fmt.Errorf("parsing TDX quote: %w", err)
+		}
+		quoteV4, ok := quote.(*tdxpb.QuoteV4)
+		if !ok {
+			return TCB{}, fmt.Errorf("unsupported TDX quote format %T", quote)
+		}
+		tcb.ReportVersion = quoteV4.GetHeader().GetVersion()
+		svn := quoteV4.GetTdQuoteBody().GetTeeTcbSvn()
+		if len(svn) != len(tcb.TEETCBSVN) {
+			return TCB{}, fmt.Errorf("TDX TEE_TCB_SVN is %d bytes", len(svn))
+		}
+		copy(tcb.TEETCBSVN[:], svn)
+	default:
+		return TCB{}, fmt.Errorf("unsupported platform %q for TCB", platform)
+	}
+	return tcb, nil
+}
+
+func decomposeSEVSNPTCB(version uint64, turin bool) SEVSNPTCB {
+	if turin {
+		return SEVSNPTCB{
+			FMC:        uint8(version),
+			Bootloader: uint8(version >> 8),
+			TEE:        uint8(version >> 16),
+			SNP:        uint8(version >> 24),
+			Microcode:  uint8(version >> 56),
+		}
+	}
+	parts := kds.DecomposeTCBVersion(kds.TCBVersion(version))
+	return SEVSNPTCB{
+		Bootloader: parts.BlSpl,
+		TEE:        parts.TeeSpl,
+		SNP:        parts.SnpSpl,
+		Microcode:  parts.UcodeSpl,
+	}
+}
+
+// cpuFamily decodes the display family from a CPUID leaf 1 EAX value.
+func cpuFamily(eax uint32) uint32 {
+	family := (eax >> 8) & 0xf
+	if family == 0xf {
+		family += (eax >> 20) & 0xff
+	}
+	return family
+}
@@ -0,0 +1,69 @@
+package attestation
+
+import (
+	"encoding/binary"
+	"testing"
+
+	sevabi "github.com/google/go-sev-guest/abi"
+	"github.com/google/go-tdx-guest/testing/testdata"
+)
+
+func sevSNPReport(version uint32, cpuid [3]byte, reported, committed uint64) []byte {
+	report := make([]byte, sevabi.ReportSize)
+	binary.LittleEndian.PutUint32(report[0x00:], version)
+	binary.LittleEndian.PutUint64(report[0x08:], 1<<17) // reserved, must be one
+	binary.LittleEndian.PutUint32(report[0x34:], 1)     // ECDSA P-384
+	binary.LittleEndian.PutUint64(report[0x180:], reported)
+	copy(report[0x188:], cpuid[:])
+	binary.LittleEndian.PutUint64(report[0x1e0:], committed)
+	return report
+}
+
+func TestParseTCBSEVSNP(t *testing.T) {
+	// Milan and Genoa: bootloader, TEE, four reserved, SNP, microcode.
+	genoa := sevSNPReport(3, [3]byte{0x19, 0x11, 0x01}, 0xd517000000000207, 0xd316000000000106)
+	tcb, err := ParseTCB(genoa, PlatformSEVSNP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tcb.ReportVersion != 3 {
+		t.Fatalf("report version = %d, want 3", tcb.ReportVersion)
+	}
+	if want := (SEVSNPTCB{Bootloader: 7, TEE: 2, SNP: 0x17, Microcode: 0xd5}); tcb.Reported != want {
+		t.Fatalf("reported = %+v, want %+v", tcb.Reported, want)
+	}
+	if want := (SEVSNPTCB{Bootloader: 6, TEE: 1, SNP: 0x16, Microcode: 0xd3}); tcb.Committed != want {
+		t.Fatalf("committed = %+v, want %+v", tcb.Committed, want)
+	}
+
+	// Turin: FMC, bootloader, TEE, SNP, three reserved, microcode.
+	turin := sevSNPReport(3, [3]byte{0x1a, 0x02, 0x01}, 0x4800000003020101, 0x4800000003020101)
+	tcb, err = ParseTCB(turin, PlatformSEVSNP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (SEVSNPTCB{FMC: 1, Bootloader: 1, TEE: 2, SNP: 3, Microcode: 0x48}); tcb.Reported != want {
+		t.Fatalf("Turin reported = %+v, want %+v", tcb.Reported, want)
+	}
+
+	if _, err := ParseTCB(genoa[:0x100], PlatformSEVSNP); err == nil {
+		t.Fatal("ParseTCB accepted a truncated report")
+	}
+}
+
+func TestParseTCBTDX(t *testing.T) {
+	tcb, err := ParseTCB(testdata.RawQuote, PlatformTDX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tcb.ReportVersion != 4 {
+		t.Fatalf("quote version = %d, want 4", tcb.ReportVersion)
+	}
+	// TEE_TCB_SVN opens the TD quote body, right after the 48-byte header.
+	if got, want := tcb.TEETCBSVN[:], testdata.RawQuote[48:64]; string(got) != string(want) {
+		t.Fatalf("TEE_TCB_SVN = %x, want %x", got, want)
+	}
+	if _, err := ParseTCB(testdata.RawQuote, PlatformDummy); err == nil {
+		t.Fatal("ParseTCB accepted the dummy platform")
+	}
+}
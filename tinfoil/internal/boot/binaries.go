@@ -0,0 +1,52 @@
+package boot
+
+import (
+	"debug/buildinfo"
+	"maps"
+	"slices"
+)
+
+// Binary is the build information of a tinfoil binary on the measured root.
+type Binary struct {
+	Name      string `json:"name"`
+	Path      string `json:"path"`
+	Module    string `json:"module,omitempty"`
+	Version   string `json:"version,omitempty"`
+	Revision  string `json:"revision,omitempty"`
+	GoVersion string `json:"go_version,omitempty"`
+}
+
+// Binaries maps the tinfoil binaries on the measured root to their paths.
+func Binaries() map[string]string {
+	return map[string]string{
+		"tinfoil-pid1":       InitBinary,
+		"tinfoil-boot":       BootBinary,
+		"tinfoil-containers": ContainersBinary,
+		"tinfoil-egress":     EgressBinary,
+		"tinfoil-shim":       ShimBinary,
+	}
+}
+
+// SortedBinaryNames returns the names of binaries in a stable order.
+func SortedBinaryNames(binaries map[string]string) []string {
+	return slices.Sorted(maps.Keys(binaries))
+}
+
+// ReadBinary reads the Go build information embedded in the binary at path.
+// On error the returned Binary still carries the name and path.
+func ReadBinary(name, path string) (Binary, error) {
+	binary := Binary{Name: name, Path: path}
+	info, err := buildinfo.ReadFile(path)
+	if err != nil {
+		return binary, err
+	}
+	binary.Module = info.Main.Path
+	binary.Version = info.Main.Version
+	binary.GoVersion = info.GoVersion
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			binary.Revision = setting.Value
+		}
+	}
+	return binary, nil
+}
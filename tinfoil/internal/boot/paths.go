@@ -11,6 +11,11 @@ const (
 	ContainerStatusPath = PublicDir + "/container-status.json"
 	MWPDir              = PublicDir + "/mwp"
 	MPKDir              = PublicDir + "/mpk" // Legacy alias directory for MWP mounts.
+	// DiagnosticsPath is the redacted bundle tinfoil-boot writes when it
+	// fails. It is mode 0600 and served only to operators by the shim.
+	DiagnosticsPath = PublicDir + "/boot-diagnostics.json"
+	// NodeFactsPath describes the node's hardware and tinfoil binaries.
+	NodeFactsPath = PublicDir + "/node-facts.json"
 
 	// Private — only accessible to boot, egress, and shim processes (mode 0700).
 	// Holds CVM-level secrets and material that must never reach a container.
@@ -20,6 +25,7 @@ const (
 	HPKEKeyPath           = PrivateDir + "/hpke_key.json"
 	CollateralRequestPath = PrivateDir + "/collateral-request.json"
 	ShimConfigPath        = PrivateDir + "/shim.yml"
+	ShimExtensionsPath    = PrivateDir + "/shim-extensions.yml"
 	EgressConfigPath      = PrivateDir + "/egress.yml"
 	ExternalConfigPath    = PrivateDir + "/external-config.yml"
 	RuntimeConfigPath     = PrivateDir + "/runtime-config.yml"
@@ -28,7 +34,9 @@ const (
 	DockerConfigPath      = DockerConfigDir + "/config.json"
 	GCloudKeyPath         = PrivateDir + "/gcloud_key.json"
 	CacheDir              = PrivateDir + "/tfshim-cache"
+	BatchDir              = PrivateDir + "/batches"
 	StatePath             = PrivateDir + "/boot-state.json"
+	CheckpointDir         = PrivateDir + "/boot-checkpoints"
 	EgressStatePath       = PrivateDir + "/egress-prev"
 
 	// NVIDIABootstrapStatusPath is the fixed PID 1 to tinfoil-boot handoff
@@ -38,6 +46,9 @@ const (
 	ShimPIDPath               = "/run/tinfoil/pids/tinfoil-shim.pid"
 	EgressPIDPath             = "/run/tinfoil/pids/tinfoil-egress.pid"
 
+	// PID1ReadyPath exists while every service pid1 requires is ready.
+	PID1ReadyPath = "/run/tinfoil-pid1.ready"
+
 	// ShimListenPort is the public TLS port served by tinfoil-shim.
 	ShimListenPort = 443
 
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"sync"
 	"time"
@@ -28,6 +29,15 @@ type Stage struct {
 	Duration time.Duration `json:"duration_ns"`
 	Detail   string        `json:"detail,omitempty"`
 	Stages   []Stage       `json:"stages,omitempty"`
+	// StartedAt is set when a stage begins; a pending stage with StartedAt
+	// is running. Stages whose [StartedAt, StartedAt+Duration] intervals
+	// overlap ran in parallel.
+	StartedAt time.Time `json:"started_at,omitzero"`
+	// DependsOn names the stages that had to succeed before this one began.
+	DependsOn []string `json:"depends_on,omitempty"`
+	// CriticalPath marks the chain of dependencies that determined when
+	// boot finished.
+	CriticalPath bool `json:"critical_path,omitempty"`
 }
 
 const (
@@ -38,9 +48,15 @@ const (
 	StatusFailed  = "failed"
 )
 
+// ExitRetryable is the status tinfoil-boot exits with when its failure may
+// clear on another run, such as a network error. Other failures exit 1 and
+// are final.
+const ExitRetryable = 75
+
 const (
 	StageConfig         = "config"
 	StageNetwork        = "network"
+	StageSecureTime     = "secure-time"
 	StageIdentity       = "identity"
 	StageCPUAttestation = "cpu-attestation"
 	StageGPUAttestation = "gpu-attestation"
@@ -56,7 +72,7 @@ const (
 // InitialStages is the ordered list of stages known at boot time.
 // Both boot and shim use this as the starting point.
 var InitialStages = []string{
-	StageConfig, StageNetwork, StageIdentity, StageCPUAttestation, StageGPUAttestation, StageCertificate,
+	StageConfig, StageNetwork, StageSecureTime, StageIdentity, StageCPUAttestation, StageGPUAttestation, StageCertificate,
 	StageVaultSecrets, StageRegistryAuth, StageFirewall, StageModels, StageContainers, StageShim,
 }
 
@@ -119,6 +135,44 @@ func ResumeTracker() (*Tracker, error) {
 	return &Tracker{state: state}, nil
 }
 
+// Start marks a stage as running after dependsOn succeeded, clearing the
+// result of any earlier run. Auto-flushes.
+func (t *Tracker) Start(name string, dependsOn []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stage := t.stageLocked(name)
+	stage.Status = StatusPending
+	stage.Detail = ""
+	stage.StartedAt = time.Now()
+	stage.DependsOn = dependsOn
+	if err := t.flushLocked(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to flush boot state: %v\n", err)
+	}
+}
+
+// stageLocked returns the named stage, appending a pending one if needed.
+func (t *Tracker) stageLocked(name string) *Stage {
+	for i := range t.state.Stages {
+		if t.state.Stages[i].Name == name {
+			return &t.state.Stages[i]
+		}
+	}
+	t.state.Stages = append(t.state.Stages, Stage{Name: name, Status: StatusPending})
+	return &t.state.Stages[len(t.state.Stages)-1]
+}
+
+// MarkCriticalPath flags the stages on the critical path. Auto-flushes.
+func (t *Tracker) MarkCriticalPath() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, name := range t.state.CriticalPath() {
+		t.stageLocked(name).CriticalPath = true
+	}
+	if err := t.flushLocked(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to flush boot state: %v\n", err)
+	}
+}
+
 // Record updates an existing stage by name or appends a new one. Auto-flushes.
 func (t *Tracker) Record(name, status string, duration time.Duration, detail string) {
 	t.mu.Lock()
@@ -128,6 +182,8 @@ func (t *Tracker) Record(name, status string, duration time.Duration, detail str
 	for i := range t.state.Stages {
 		if t.state.Stages[i].Name == name {
 			stage.Stages = t.state.Stages[i].Stages
+			stage.StartedAt = t.state.Stages[i].StartedAt
+			stage.DependsOn = t.state.Stages[i].DependsOn
 			t.state.Stages[i] = stage
 			updated = true
 			break
@@ -187,6 +243,40 @@ func (s *State) IsComplete() bool {
 	return len(s.Stages) > 0
 }
 
+// CriticalPath returns, in execution order, the chain of stages that ended
+// last: starting from the last stage to finish, it follows whichever
+// dependency finished last. Stages without StartedAt are ignored.
+func (s *State) CriticalPath() []string {
+	started := make(map[string]Stage, len(s.Stages))
+	var current Stage
+	for _, stage := range s.Stages {
+		if stage.StartedAt.IsZero() {
+			continue
+		}
+		started[stage.Name] = stage
+		if current.Name == "" || stage.finishedAt().After(current.finishedAt()) {
+			current = stage
+		}
+	}
+	var path []string
+	for current.Name != "" {
+		path = append(path, current.Name)
+		var next Stage
+		for _, dep := range current.DependsOn {
+			if candidate, ok := started[dep]; ok && (next.Name == "" || candidate.finishedAt().After(next.finishedAt())) {
+				next = candidate
+			}
+		}
+		current = next
+	}
+	slices.Reverse(path)
+	return path
+}
+
+func (s Stage) finishedAt() time.Time {
+	return s.StartedAt.Add(s.Duration)
+}
+
 // HasFailed returns true if any stage has a "failed" status.
 func (s *State) HasFailed() bool {
 	for _, stage := range s.Stages {
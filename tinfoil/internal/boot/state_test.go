@@ -3,8 +3,10 @@ package boot
 import (
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestNetworkStagePrecedesIdentityAndAttestation(t *testing.T) {
@@ -167,3 +169,27 @@ func fixedStageIndex(t *testing.T, name string) int {
 	t.Fatalf("fixed stage %q not found", name)
 	return -1
 }
+
+func TestCriticalPathFollowsLatestDependency(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	stage := func(name string, offset, duration time.Duration, deps ...string) Stage {
+		return Stage{Name: name, Status: StatusOK, StartedAt: start.Add(offset), Duration: duration, DependsOn: deps}
+	}
+	state := State{Stages: []Stage{
+		stage(StageConfig, 0, time.Second),
+		stage(StageNetwork, time.Second, 2*time.Second, StageConfig),
+		stage(StageGPUAttestation, time.Second, 30*time.Second, StageConfig),
+		stage(StageCertificate, 3*time.Second, 20*time.Second, StageNetwork),
+		stage(StageVaultSecrets, 31*time.Second, time.Second, StageGPUAttestation, StageCertificate),
+		stage(StageModels, time.Second, 5*time.Second, StageConfig),
+		{Name: StageShim, Status: StatusPending},
+	}}
+	got := state.CriticalPath()
+	want := []string{StageConfig, StageGPUAttestation, StageVaultSecrets}
+	if !slices.Equal(got, want) {
+		t.Fatalf("CriticalPath = %v, want %v", got, want)
+	}
+	if len((&State{}).CriticalPath()) != 0 {
+		t.Fatal("empty state has a critical path")
+	}
+}
@@ -12,7 +12,12 @@ import (
 
 type Config = sharedconfig.ShimConfig
 
-const SecretMetricsAPIKey = "METRICS_API_KEY"
+const (
+	SecretMetricsAPIKey = "METRICS_API_KEY"
+	// SecretDiagnosticsAPIKey guards the boot diagnostics bundle. The bundle
+	// is not served while it is unset.
+	SecretDiagnosticsAPIKey = "DIAGNOSTICS_API_KEY"
+)
 
 type Metadata struct {
 	ID     string `yaml:"id"`
@@ -34,11 +39,12 @@ type ExternalNetworkConfig struct {
 }
 
 type ExternalConfig struct {
-	MetricsAPIKey string                 `yaml:"-"`
-	Env           map[string]string      `yaml:"env"`
-	Secrets       map[string]string      `yaml:"secrets"`
-	Metadata      Metadata               `yaml:"metadata"`
-	Network       *ExternalNetworkConfig `yaml:"network"`
+	MetricsAPIKey     string                 `yaml:"-"`
+	DiagnosticsAPIKey string                 `yaml:"-"`
+	Env               map[string]string      `yaml:"env"`
+	Secrets           map[string]string      `yaml:"secrets"`
+	Metadata          Metadata               `yaml:"metadata"`
+	Network           *ExternalNetworkConfig `yaml:"network"`
 
 	// tinfoild preserves operator-owned top-level external data. Keep accepting
 	// those unrelated keys while KnownFields rejects unknown network fields.
@@ -83,6 +89,7 @@ func DecodeExternal(data []byte) (*ExternalConfig, error) {
 	}
 
 	config.MetricsAPIKey = config.GetSecret(SecretMetricsAPIKey)
+	config.DiagnosticsAPIKey = config.GetSecret(SecretDiagnosticsAPIKey)
 	return &config, nil
 }
 
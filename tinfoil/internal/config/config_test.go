@@ -1,7 +1,13 @@
 package config
 
 import (
+	"crypto/ed25519"
+	"crypto/tls"
+	"encoding/base64"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -72,6 +78,7 @@ network:
   gateway: 100.64.0.1
 secrets:
   METRICS_API_KEY: metrics-secret
+  DIAGNOSTICS_API_KEY: diagnostics-secret
 metadata:
   cpu: amd
   operator-label: retained
@@ -95,6 +102,9 @@ operator-extension:
 	if config.MetricsAPIKey != "metrics-secret" {
 		t.Fatalf("MetricsAPIKey = %q", config.MetricsAPIKey)
 	}
+	if config.DiagnosticsAPIKey != "diagnostics-secret" {
+		t.Fatalf("DiagnosticsAPIKey = %q", config.DiagnosticsAPIKey)
+	}
 	if _, ok := config.Extra["operator-extension"]; !ok {
 		t.Fatal("operator-owned top-level extension was not retained")
 	}
@@ -117,3 +127,235 @@ func TestDecodeExternalRejectsMultipleDocuments(t *testing.T) {
 		t.Fatal("DecodeExternal accepted multiple YAML documents")
 	}
 }
+
+func TestDecodeExtensions(t *testing.T) {
+	extensions, err := DecodeExtensions([]byte("anthropic-messages: true\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !extensions.AnthropicMessages {
+		t.Fatal("anthropic-messages not decoded")
+	}
+	if _, err := DecodeExtensions([]byte("typo: true\n")); err == nil {
+		t.Fatal("unknown extension accepted")
+	}
+	extensions, err = LoadExtensions(filepath.Join(t.TempDir(), "missing.yml"))
+	if err != nil || extensions.AnthropicMessages {
+		t.Fatalf("missing extensions file = %+v, %v; want no extensions", extensions, err)
+	}
+}
+
+func TestDecodeExtensionsValidatesRouteScopes(t *testing.T) {
+	for _, data := range []string{
+		"route-scopes:\n  - path: v1/embeddings\n    scope: inference:embeddings\n",
+		"route-scopes:\n  - path: /v1/embeddings\n    scope: \"\"\n",
+		"route-scopes:\n  - path: /v1/embeddings\n    scope: inference:a inference:b\n",
+	} {
+		if _, err := DecodeExtensions([]byte(data)); err == nil {
+			t.Errorf("DecodeExtensions(%q) accepted an invalid route scope", data)
+		}
+	}
+	extensions, err := DecodeExtensions([]byte("route-scopes:\n  - path: /v1/batches*\n    scope: inference:batch\n"))
+	if err != nil || len(extensions.RouteScopes) != 1 {
+		t.Fatalf("DecodeExtensions = %+v, %v", extensions, err)
+	}
+}
+
+func TestDecodeExtensionsJWTRevocation(t *testing.T) {
+	extensions, err := DecodeExtensions([]byte("jwt-revocation:\n  max-staleness: 1h\n  fail-closed: true\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revocation := extensions.JWTRevocation; revocation == nil || revocation.MaxStaleness != time.Hour || !revocation.FailClosed {
+		t.Fatalf("jwt-revocation = %+v", extensions.JWTRevocation)
+	}
+	for _, data := range []string{
+		"jwt-revocation:\n  url: http://control-plane/revocations\n",
+		"jwt-revocation:\n  fail-closed: true\n",
+	} {
+		if _, err := DecodeExtensions([]byte(data)); err == nil {
+			t.Errorf("DecodeExtensions(%q) accepted an invalid revocation feed", data)
+		}
+	}
+}
+
+func TestDecodeExtensionsDPoPRequiredPaths(t *testing.T) {
+	if _, err := DecodeExtensions([]byte("dpop-required-paths:\n  - v1/embeddings\n")); err == nil {
+		t.Fatal("relative dpop-required-paths entry accepted")
+	}
+	extensions, err := DecodeExtensions([]byte("dpop-required-paths:\n  - /v1/batches*\n"))
+	if err != nil || len(extensions.DPoPRequiredPaths) != 1 {
+		t.Fatalf("DecodeExtensions = %+v, %v", extensions, err)
+	}
+}
+
+func TestDecodeExtensionsTokenIntrospection(t *testing.T) {
+	extensions, err := DecodeExtensions([]byte("token-introspection:\n  url: https://auth.example.com/introspect\n  audience: inference\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if introspection := extensions.TokenIntrospection; introspection == nil || introspection.Audience != "inference" {
+		t.Fatalf("token-introspection = %+v", extensions.TokenIntrospection)
+	}
+	if _, err := DecodeExtensions([]byte("token-introspection:\n  url: http://auth.example.com/introspect\n")); err == nil {
+		t.Fatal("plain HTTP introspection endpoint accepted")
+	}
+}
+
+func TestDecodeExtensionsJWTKeys(t *testing.T) {
+	jwks := `{"keys":[{"kty":"OKP","crv":"Ed25519","kid":"k1","x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}]}`
+	extensions, err := DecodeExtensions([]byte("jwt-keys:\n  pinned-key-ids: [k1]\n  jwks: '" + jwks + "'\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := extensions.JWTKeys.KeySet()
+	if err != nil || set == nil || len(set.Keys) != 1 || set.Keys[0].KeyID != "k1" {
+		t.Fatalf("KeySet = %+v, %v", set, err)
+	}
+	for _, data := range []string{
+		"jwt-keys:\n  pinned-thumbprints: [not-a-thumbprint]\n",
+		"jwt-keys:\n  jwks: '{\"keys\":[]}'\n",
+		"jwt-keys:\n  jwks: '{\"keys\":[{\"kty\":\"OKP\",\"crv\":\"Ed25519\",\"x\":\"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo\"}]}'\n",
+	} {
+		if _, err := DecodeExtensions([]byte(data)); err == nil {
+			t.Errorf("DecodeExtensions(%q) accepted invalid jwt-keys", data)
+		}
+	}
+}
+
+func TestDecodeExtensionsEHBPRequiredPaths(t *testing.T) {
+	if _, err := DecodeExtensions([]byte("ehbp-required-paths:\n  - v1/chat/completions\n")); err == nil {
+		t.Fatal("relative ehbp-required-paths entry accepted")
+	}
+	extensions, err := DecodeExtensions([]byte("ehbp-required-paths:\n  - /v1/*\n"))
+	if err != nil || len(extensions.EHBPRequiredPaths) != 1 {
+		t.Fatalf("DecodeExtensions = %+v, %v", extensions, err)
+	}
+}
+
+func TestDecodeExtensionsL4Services(t *testing.T) {
+	invalid := map[string]string{
+		"shim port":     "l4-services:\n  - {name: db, port: 443, container: db, target-port: 5432}\n",
+		"tcp with sni":  "l4-services:\n  - {name: db, port: 5432, container: db, target-port: 5432, mode: tcp, sni: db.example.com}\n",
+		"shared tcp":    "l4-services:\n  - {name: a, port: 5432, container: a, target-port: 1, mode: tcp}\n  - {name: b, port: 5432, container: b, target-port: 1, mode: tcp}\n",
+		"duplicate sni": "l4-services:\n  - {name: a, port: 8443, container: a, target-port: 1, sni: x.example.com}\n  - {name: b, port: 8443, container: b, target-port: 1, sni: x.example.com}\n",
+		"unknown mode":  "l4-services:\n  - {name: a, port: 8443, container: a, target-port: 1, mode: udp}\n",
+	}
+	for name, doc := range invalid {
+		if _, err := DecodeExtensions([]byte(doc)); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+
+	extensions, err := DecodeExtensions([]byte("l4-services:\n  - {name: a, port: 8443, container: a, target-port: 1, sni: a.example.com, alpn: [h2]}\n  - {name: b, port: 8443, container: b, target-port: 1}\n  - {name: db, port: 5432, container: db, target-port: 5432, mode: tcp}\n"))
+	if err != nil {
+		t.Fatalf("DecodeExtensions: %v", err)
+	}
+	if ports := extensions.L4Ports(); len(ports) != 2 || ports[0] != 8443 || ports[1] != 5432 {
+		t.Fatalf("L4Ports = %v", ports)
+	}
+}
+
+func TestDecodeExtensionsHealthPort(t *testing.T) {
+	invalid := map[string]string{
+		"shim port": "health-port: 443\n",
+		"l4 port":   "health-port: 5432\nl4-services:\n  - {name: db, port: 5432, container: db, target-port: 5432, mode: tcp}\n",
+		"range":     "health-port: 70000\n",
+	}
+	for name, doc := range invalid {
+		if _, err := DecodeExtensions([]byte(doc)); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+
+	disabled, err := DecodeExtensions(nil)
+	if err != nil || len(disabled.InboundPorts()) != 0 {
+		t.Fatalf("default inbound ports = %v, %v; want none", disabled.InboundPorts(), err)
+	}
+	extensions, err := DecodeExtensions([]byte("health-port: 8080\n"))
+	if err != nil {
+		t.Fatalf("DecodeExtensions: %v", err)
+	}
+	if ports := extensions.InboundPorts(); len(ports) != 1 || ports[0] != 8080 {
+		t.Fatalf("InboundPorts = %v", ports)
+	}
+}
+
+func TestDecodeExtensionsPostQuantum(t *testing.T) {
+	if _, err := DecodeExtensions([]byte("post-quantum:\n  tls: always\n")); err == nil {
+		t.Fatal("unknown post-quantum tls policy accepted")
+	}
+	extensions, err := DecodeExtensions([]byte("post-quantum:\n  tls: require\n"))
+	if err != nil {
+		t.Fatalf("DecodeExtensions: %v", err)
+	}
+	var cfg tls.Config
+	extensions.PostQuantum.ApplyTLS(&cfg)
+	if len(cfg.CurvePreferences) != 1 || cfg.CurvePreferences[0] != tls.X25519MLKEM768 || cfg.MinVersion != tls.VersionTLS13 {
+		t.Fatalf("require policy = %v, min version %x", cfg.CurvePreferences, cfg.MinVersion)
+	}
+
+	var disabled *PostQuantum
+	cfg = tls.Config{}
+	disabled.ApplyTLS(&cfg)
+	if cfg.CurvePreferences != nil {
+		t.Fatal("nil post-quantum config changed the defaults")
+	}
+}
+
+func TestDecodeExtensionsDomainAliases(t *testing.T) {
+	invalid := map[string]string{
+		"uppercase":      "domain-aliases:\n  - {name: API.example.com}\n",
+		"single label":   "domain-aliases:\n  - {name: localhost}\n",
+		"port":           "domain-aliases:\n  - {name: \"api.example.com:443\"}\n",
+		"duplicate":      "domain-aliases:\n  - {name: api.example.com}\n  - {name: api.example.com, challenge-mode: http}\n",
+		"unknown mode":   "domain-aliases:\n  - {name: api.example.com, challenge-mode: email}\n",
+		"wildcard http":  "domain-aliases:\n  - {name: \"*.example.com\", challenge-mode: http}\n",
+		"inner wildcard": "domain-aliases:\n  - {name: \"api.*.example.com\", challenge-mode: dns}\n",
+	}
+	for name, doc := range invalid {
+		if _, err := DecodeExtensions([]byte(doc)); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+
+	extensions, err := DecodeExtensions([]byte("domain-aliases:\n  - {name: api.example.com, challenge-mode: http}\n  - {name: \"*.example.org\", challenge-mode: dns}\n  - {name: chat.example.net}\n"))
+	if err != nil {
+		t.Fatalf("DecodeExtensions: %v", err)
+	}
+	aliases := extensions.DomainAliases
+	if len(aliases) != 3 || aliases[0].Challenge("tls") != "http" || aliases[2].Challenge("tls") != "tls" {
+		t.Fatalf("DomainAliases = %+v", aliases)
+	}
+}
+
+func TestDecodeExtensionsSecureTime(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(make([]byte, ed25519.PublicKeySize))
+	servers := "  servers:\n  - {name: a, address: \"time-a.example.com:2002\", public-key: \"" + key + "\"}\n  - {name: b, address: \"time-b.example.com:2002\", public-key: \"" + key + "\"}\n  - {name: c, address: \"192.0.2.1:2002\", public-key: \"" + key + "\"}\n"
+	extensions, err := DecodeExtensions([]byte("secure-time:\n  max-skew: 2s\n  on-skew: warn\n" + servers))
+	if err != nil {
+		t.Fatalf("DecodeExtensions: %v", err)
+	}
+	secureTime := extensions.SecureTime
+	policy, err := secureTime.Policy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policy.Servers) != 3 || policy.Quorum != 2 || policy.MaxSkew != 2*time.Second || !secureTime.Warn() || secureTime.Interval() != time.Hour {
+		t.Fatalf("secure-time = %+v, policy = %+v", secureTime, policy)
+	}
+
+	invalid := map[string]string{
+		"no servers":    "secure-time: {servers: []}\n",
+		"short key":     "secure-time:\n  servers:\n  - {name: a, address: \"time.example.com:2002\", public-key: \"AAAA\"}\n",
+		"no port":       "secure-time:\n  servers:\n  - {name: a, address: time.example.com, public-key: \"" + key + "\"}\n",
+		"quorum":        "secure-time:\n  min-servers: 4\n" + servers,
+		"unknown mode":  "secure-time:\n  on-skew: ignore\n" + servers,
+		"negative skew": "secure-time:\n  max-skew: -1s\n" + servers,
+	}
+	for name, doc := range invalid {
+		if _, err := DecodeExtensions([]byte(doc)); err == nil || !strings.Contains(err.Error(), "secure-time") {
+			t.Errorf("%s: error = %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,540 @@
+package config
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	jose "github.com/go-jose/go-jose/v4"
+	"gopkg.in/yaml.v3"
+
+	"tinfoil/internal/boot"
+	"tinfoil/internal/roughtime"
+)
+
+// Extensions configures shim features that this image defines outside the
+// shared config schema. tinfoil-containers writes it from the measured
+// runtime config's extensions.shim section next to the shim config.
+type Extensions struct {
+	// AnthropicMessages serves /v1/messages by translating Anthropic
+	// Messages requests to the upstream's /v1/chat/completions.
+	AnthropicMessages bool `yaml:"anthropic-messages,omitempty"`
+
+	// Batches serves the OpenAI /v1/files and /v1/batches APIs from the
+	// shim, running each batch line against the upstream. Off by default,
+	// those routes go to the upstream like any other.
+	Batches bool `yaml:"batches,omitempty"`
+
+	// RouteScopes maps route patterns to the OAuth scope a token must carry
+	// to call them. The first matching rule applies; other routes require
+	// the default inference scope.
+	RouteScopes []RouteScope `yaml:"route-scopes,omitempty"`
+
+	// DPoPRequiredPaths lists route patterns that only accept RFC 9449
+	// sender-constrained tokens. Bound tokens need a valid proof on every
+	// route; unbound tokens keep working on the others.
+	DPoPRequiredPaths []string `yaml:"dpop-required-paths,omitempty"`
+
+	// EHBPRequiredPaths lists route patterns that reject plaintext request
+	// bodies, so clients relying on EHBP payload encryption cannot be
+	// silently downgraded. The list is advertised in v3 attestations.
+	EHBPRequiredPaths []string `yaml:"ehbp-required-paths,omitempty"`
+
+	// JWTRevocation enables the access-token revocation feed for locally
+	// verified JWTs.
+	JWTRevocation *JWTRevocation `yaml:"jwt-revocation,omitempty"`
+
+	// JWTKeys restricts or replaces the JWKS used to verify JWT access
+	// tokens locally.
+	JWTKeys *JWTKeys `yaml:"jwt-keys,omitempty"`
+
+	// L4Services exposes non-HTTP container services on their own inbound
+	// ports, optionally behind the enclave's TLS certificate.
+	L4Services []L4Service `yaml:"l4-services,omitempty"`
+
+	// HealthPort serves the load balancer health endpoint over plain HTTP
+	// on this inbound port. Zero, the default, serves no health listener.
+	HealthPort int `yaml:"health-port,omitempty"`
+
+	// PostQuantum enables hybrid X25519 + ML-KEM-768 TLS key exchange, so
+	// recorded traffic stays confidential if X25519 is broken later.
+	PostQuantum *PostQuantum `yaml:"post-quantum,omitempty"`
+
+	// TokenIntrospection validates opaque tokens against an external OAuth
+	// authorization server instead of the control plane.
+	TokenIntrospection *TokenIntrospection `yaml:"token-introspection,omitempty"`
+
+	// DomainAliases are further hostnames the enclave serves next to the
+	// node's DOMAIN. Each is added to the certificate with its own
+	// attestation-binding SANs, and requests for any other host are
+	// refused.
+	DomainAliases []DomainAlias `yaml:"domain-aliases,omitempty"`
+
+	// SecureTime checks the guest clock against Roughtime servers at boot
+	// and periodically while the shim runs, since the host controls the
+	// guest's time.
+	SecureTime *SecureTime `yaml:"secure-time,omitempty"`
+}
+
+// DomainAlias is a hostname served in addition to DOMAIN. Name may be a
+// "*." wildcard, which ACME only issues over DNS-01.
+type DomainAlias struct {
+	Name string `yaml:"name" json:"name"`
+	// ChallengeMode is the ACME challenge ("dns", "http" or "tls") that
+	// proves control of Name. Empty uses the shim's tls-challenge.
+	ChallengeMode string `yaml:"challenge-mode,omitempty" json:"challenge_mode,omitempty"`
+}
+
+// Challenge returns the alias's challenge mode, or defaultMode when it has
+// none.
+func (a DomainAlias) Challenge(defaultMode string) string {
+	if a.ChallengeMode == "" {
+		return defaultMode
+	}
+	return a.ChallengeMode
+}
+
+// JWTKeys pins the signing keys the shim accepts from the control plane's
+// JWKS, or embeds the JWKS itself so the trusted keys are covered by the
+// measurement.
+type JWTKeys struct {
+	// PinnedKeyIDs and PinnedThumbprints (RFC 7638 SHA-256, base64url)
+	// restrict which fetched keys are trusted. A key must match every
+	// non-empty list.
+	PinnedKeyIDs      []string `yaml:"pinned-key-ids,omitempty"`
+	PinnedThumbprints []string `yaml:"pinned-thumbprints,omitempty"`
+	// JWKS is a JSON Web Key Set document. When set, the shim trusts exactly
+	// these keys and never fetches the JWKS.
+	JWKS string `yaml:"jwks,omitempty"`
+}
+
+// KeySet parses the embedded JWKS, or returns nil when there is none.
+func (k *JWTKeys) KeySet() (*jose.JSONWebKeySet, error) {
+	if k.JWKS == "" {
+		return nil, nil
+	}
+	var set jose.JSONWebKeySet
+	if err := json.Unmarshal([]byte(k.JWKS), &set); err != nil {
+		return nil, fmt.Errorf("parsing jwks: %v", err)
+	}
+	if len(set.Keys) == 0 {
+		return nil, fmt.Errorf("jwks contains no keys")
+	}
+	for i, jwk := range set.Keys {
+		if jwk.KeyID == "" || !jwk.IsPublic() || !jwk.Valid() {
+			return nil, fmt.Errorf("jwks key %d must be a valid public key with a kid", i)
+		}
+	}
+	return &set, nil
+}
+
+// L4 service modes.
+const (
+	// L4ModeTLS terminates TLS with the enclave certificate and forwards the
+	// plaintext stream, so clients see the attested identity.
+	L4ModeTLS = "tls"
+	// L4ModeTCP forwards the raw TCP stream unchanged.
+	L4ModeTCP = "tcp"
+)
+
+// L4Service forwards connections on Port to TargetPort of Container. TLS
+// services may share a port when each has a distinct SNI; at most one
+// service per port may omit it and receives the remaining connections.
+type L4Service struct {
+	Name       string `yaml:"name"`
+	Port       int    `yaml:"port"`
+	Container  string `yaml:"container"`
+	TargetPort int    `yaml:"target-port"`
+	// Mode is L4ModeTLS (the default) or L4ModeTCP.
+	Mode string `yaml:"mode,omitempty"`
+	// SNI restricts a TLS service to connections for this server name.
+	SNI string `yaml:"sni,omitempty"`
+	// ALPN lists the protocols a TLS service negotiates, such as "h2" for
+	// gRPC.
+	ALPN []string `yaml:"alpn,omitempty"`
+}
+
+// TLS reports whether the service terminates TLS.
+func (s L4Service) TLS() bool {
+	return s.Mode != L4ModeTCP
+}
+
+// InboundPorts returns the ports the shim listens on besides its TLS port:
+// the L4 service ports and the health port, when enabled.
+func (e *Extensions) InboundPorts() []int {
+	ports := e.L4Ports()
+	if e.HealthPort != 0 {
+		ports = append(ports, e.HealthPort)
+	}
+	return ports
+}
+
+// L4Ports returns the distinct inbound ports of the L4 services.
+func (e *Extensions) L4Ports() []int {
+	var ports []int
+	for _, service := range e.L4Services {
+		if !slices.Contains(ports, service.Port) {
+			ports = append(ports, service.Port)
+		}
+	}
+	return ports
+}
+
+func validateL4Services(services []L4Service) error {
+	names := map[string]bool{}
+	portModes := map[int]string{}
+	portSNIs := map[int]map[string]bool{}
+	for i, service := range services {
+		if service.Name == "" || names[service.Name] {
+			return fmt.Errorf("l4-services[%d]: name must be non-empty and unique", i)
+		}
+		names[service.Name] = true
+		if service.Port < 1 || service.Port > 65535 || service.Port == boot.ShimListenPort {
+			return fmt.Errorf("l4-services[%d]: port must be 1-65535 and not the shim port %d", i, boot.ShimListenPort)
+		}
+		if service.TargetPort < 1 || service.TargetPort > 65535 {
+			return fmt.Errorf("l4-services[%d]: target-port must be 1-65535", i)
+		}
+		if service.Container == "" {
+			return fmt.Errorf("l4-services[%d]: container is required", i)
+		}
+		mode := service.Mode
+		if mode == "" {
+			mode = L4ModeTLS
+		}
+		if mode != L4ModeTLS && mode != L4ModeTCP {
+			return fmt.Errorf("l4-services[%d]: mode must be %q or %q", i, L4ModeTLS, L4ModeTCP)
+		}
+		if mode == L4ModeTCP && (service.SNI != "" || len(service.ALPN) > 0) {
+			return fmt.Errorf("l4-services[%d]: sni and alpn require mode %q", i, L4ModeTLS)
+		}
+		if previous, ok := portModes[service.Port]; ok && (previous != mode || mode == L4ModeTCP) {
+			return fmt.Errorf("l4-services[%d]: port %d is already used by another service", i, service.Port)
+		}
+		portModes[service.Port] = mode
+		if portSNIs[service.Port] == nil {
+			portSNIs[service.Port] = map[string]bool{}
+		}
+		sni := strings.ToLower(service.SNI)
+		if portSNIs[service.Port][sni] {
+			return fmt.Errorf("l4-services[%d]: port %d already has a service for sni %q", i, service.Port, service.SNI)
+		}
+		portSNIs[service.Port][sni] = true
+	}
+	return nil
+}
+
+var domainLabelPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+func validateDomainAliases(aliases []DomainAlias) error {
+	names := map[string]bool{}
+	for i, alias := range aliases {
+		name, wildcard := strings.CutPrefix(alias.Name, "*.")
+		labels := strings.Split(name, ".")
+		if len(alias.Name) > 253 || len(labels) < 2 || slices.ContainsFunc(labels, func(label string) bool { return !domainLabelPattern.MatchString(label) }) {
+			return fmt.Errorf("domain-aliases[%d]: name must be a lowercase DNS name", i)
+		}
+		if names[alias.Name] {
+			return fmt.Errorf("domain-aliases[%d]: %s is listed twice", i, alias.Name)
+		}
+		names[alias.Name] = true
+		switch alias.ChallengeMode {
+		case "", "dns", "http", "tls":
+		default:
+			return fmt.Errorf("domain-aliases[%d]: challenge-mode must be \"dns\", \"http\" or \"tls\"", i)
+		}
+		if wildcard && alias.ChallengeMode != "dns" {
+			return fmt.Errorf("domain-aliases[%d]: wildcard names require challenge-mode \"dns\"", i)
+		}
+	}
+	return nil
+}
+
+// Secure time policies for SecureTime.OnSkew.
+const (
+	// SecureTimeFail fails the boot stage when the clock cannot be
+	// confirmed.
+	SecureTimeFail = "fail"
+	// SecureTimeWarn records a warning and boots anyway.
+	SecureTimeWarn = "warn"
+)
+
+const (
+	defaultSecureTimeMaxSkew         = 10 * time.Second
+	defaultSecureTimeRecheckInterval = time.Hour
+)
+
+// SecureTime configures authenticated clock checks. The server keys are
+// measured, so the host cannot substitute servers that vouch for its clock.
+type SecureTime struct {
+	Servers []RoughtimeServer `yaml:"servers"`
+	// MinServers is how many servers must answer. Defaults to a majority.
+	MinServers int `yaml:"min-servers,omitempty"`
+	// MaxSkew is the largest tolerated clock offset, including the radius
+	// and round trip of the answers. Defaults to 10s.
+	MaxSkew time.Duration `yaml:"max-skew,omitempty"`
+	// OnSkew is SecureTimeFail (the default) or SecureTimeWarn. It also
+	// applies when too few servers answer.
+	OnSkew string `yaml:"on-skew,omitempty"`
+	// RecheckInterval is how often the shim checks again. Defaults to 1h.
+	RecheckInterval time.Duration `yaml:"recheck-interval,omitempty"`
+}
+
+// RoughtimeServer is a Roughtime server and its base64 Ed25519 long-term
+// public key.
+type RoughtimeServer struct {
+	Name      string `yaml:"name"`
+	Address   string `yaml:"address"`
+	PublicKey string `yaml:"public-key"`
+}
+
+// Warn reports whether a failed check only warns.
+func (s *SecureTime) Warn() bool {
+	return s.OnSkew == SecureTimeWarn
+}
+
+// Interval returns how often the shim re-checks the clock.
+func (s *SecureTime) Interval() time.Duration {
+	if s.RecheckInterval == 0 {
+		return defaultSecureTimeRecheckInterval
+	}
+	return s.RecheckInterval
+}
+
+// Policy returns the Roughtime servers, quorum and skew limit.
+func (s *SecureTime) Policy() (roughtime.Policy, error) {
+	policy := roughtime.Policy{Quorum: s.MinServers, MaxSkew: s.MaxSkew}
+	if policy.Quorum == 0 {
+		policy.Quorum = len(s.Servers)/2 + 1
+	}
+	if policy.MaxSkew == 0 {
+		policy.MaxSkew = defaultSecureTimeMaxSkew
+	}
+	for i, server := range s.Servers {
+		key, err := base64.StdEncoding.DecodeString(server.PublicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return roughtime.Policy{}, fmt.Errorf("servers[%d]: public-key must be a base64 Ed25519 public key", i)
+		}
+		policy.Servers = append(policy.Servers, roughtime.Server{Name: server.Name, Address: server.Address, PublicKey: key})
+	}
+	return policy, nil
+}
+
+func (s *SecureTime) validate() error {
+	if len(s.Servers) == 0 {
+		return fmt.Errorf("servers must not be empty")
+	}
+	names := map[string]bool{}
+	for i, server := range s.Servers {
+		if server.Name == "" || names[server.Name] {
+			return fmt.Errorf("servers[%d]: name must be non-empty and unique", i)
+		}
+		names[server.Name] = true
+		if _, _, err := net.SplitHostPort(server.Address); err != nil {
+			return fmt.Errorf("servers[%d]: address must be host:port", i)
+		}
+	}
+	if _, err := s.Policy(); err != nil {
+		return err
+	}
+	if s.MinServers < 0 || s.MinServers > len(s.Servers) {
+		return fmt.Errorf("min-servers must be between 1 and the number of servers")
+	}
+	if s.MaxSkew < 0 || s.RecheckInterval < 0 {
+		return fmt.Errorf("max-skew and recheck-interval must not be negative")
+	}
+	switch s.OnSkew {
+	case "", SecureTimeFail, SecureTimeWarn:
+	default:
+		return fmt.Errorf("on-skew must be %q or %q", SecureTimeFail, SecureTimeWarn)
+	}
+	return nil
+}
+
+// TokenIntrospection configures an RFC 7662 introspection endpoint. The
+// shim's client credentials are not measured; they come from the external
+// config secrets IntrospectionClientIDSecret and
+// IntrospectionClientSecretSecret.
+type TokenIntrospection struct {
+	URL string `yaml:"url"`
+	// Audience, when set, must appear in the introspected token's aud.
+	Audience string `yaml:"audience,omitempty"`
+}
+
+// TLS key exchange policies for PostQuantum.TLS.
+const (
+	// PostQuantumTLSPrefer negotiates X25519MLKEM768 with clients that
+	// support it and falls back to classical key exchange otherwise.
+	PostQuantumTLSPrefer = "prefer"
+	// PostQuantumTLSRequire refuses clients without X25519MLKEM768.
+	PostQuantumTLSRequire = "require"
+)
+
+// PostQuantum configures hybrid post-quantum key exchange.
+type PostQuantum struct {
+	// TLS is the shim's X25519MLKEM768 policy; empty keeps the Go defaults.
+	TLS string `yaml:"tls,omitempty"`
+}
+
+// ApplyTLS sets the key exchanges cfg offers according to the TLS policy.
+// X25519MLKEM768 only exists in TLS 1.3, so requiring it also requires
+// TLS 1.3.
+func (p *PostQuantum) ApplyTLS(cfg *tls.Config) {
+	if p == nil {
+		return
+	}
+	switch p.TLS {
+	case PostQuantumTLSPrefer:
+		cfg.CurvePreferences = []tls.CurveID{tls.X25519MLKEM768, tls.X25519, tls.CurveP256, tls.CurveP384}
+	case PostQuantumTLSRequire:
+		cfg.CurvePreferences = []tls.CurveID{tls.X25519MLKEM768}
+		cfg.MinVersion = tls.VersionTLS13
+	}
+}
+
+// External config secrets holding the introspection client credentials.
+const (
+	IntrospectionClientIDSecret     = "OAUTH_INTROSPECTION_CLIENT_ID"
+	IntrospectionClientSecretSecret = "OAUTH_INTROSPECTION_CLIENT_SECRET"
+)
+
+// JWTRevocation configures the control plane's access-token revocation feed.
+type JWTRevocation struct {
+	// URL of the feed. Defaults to /api/shim/revocations on the control
+	// plane.
+	URL string `yaml:"url,omitempty"`
+	// MaxStaleness is how long the shim keeps trusting its revocation list
+	// after the feed stops syncing. Zero means indefinitely.
+	MaxStaleness time.Duration `yaml:"max-staleness,omitempty"`
+	// FailClosed stops local JWT acceptance once the list is stale, leaving
+	// the decision to the control plane.
+	FailClosed bool `yaml:"fail-closed,omitempty"`
+}
+
+// RouteScope requires Scope for requests whose path matches Path. Path uses
+// the same patterns as the shim's paths list: an exact path, or a prefix
+// ending in "*".
+type RouteScope struct {
+	Path  string `yaml:"path"`
+	Scope string `yaml:"scope"`
+}
+
+// Validate checks the extension settings that the YAML schema cannot express.
+func (e *Extensions) Validate() error {
+	for i, rule := range e.RouteScopes {
+		if !strings.HasPrefix(rule.Path, "/") {
+			return fmt.Errorf("route-scopes[%d]: path must start with /", i)
+		}
+		if rule.Scope == "" || strings.ContainsFunc(rule.Scope, unicode.IsSpace) {
+			return fmt.Errorf("route-scopes[%d]: scope must be a single non-empty OAuth scope", i)
+		}
+	}
+	for i, path := range e.DPoPRequiredPaths {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("dpop-required-paths[%d]: path must start with /", i)
+		}
+	}
+	for i, path := range e.EHBPRequiredPaths {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("ehbp-required-paths[%d]: path must start with /", i)
+		}
+	}
+	if revocation := e.JWTRevocation; revocation != nil {
+		if revocation.URL != "" && !strings.HasPrefix(revocation.URL, "https://") {
+			return fmt.Errorf("jwt-revocation: url must use HTTPS")
+		}
+		if revocation.MaxStaleness < 0 {
+			return fmt.Errorf("jwt-revocation: max-staleness must not be negative")
+		}
+		if revocation.FailClosed && revocation.MaxStaleness == 0 {
+			return fmt.Errorf("jwt-revocation: fail-closed requires max-staleness")
+		}
+	}
+	if keys := e.JWTKeys; keys != nil {
+		for i, thumbprint := range keys.PinnedThumbprints {
+			if decoded, err := base64.RawURLEncoding.DecodeString(thumbprint); err != nil || len(decoded) != sha256.Size {
+				return fmt.Errorf("jwt-keys: pinned-thumbprints[%d] must be a base64url SHA-256 thumbprint", i)
+			}
+		}
+		if _, err := keys.KeySet(); err != nil {
+			return fmt.Errorf("jwt-keys: %v", err)
+		}
+	}
+	if pq := e.PostQuantum; pq != nil {
+		switch pq.TLS {
+		case "", PostQuantumTLSPrefer, PostQuantumTLSRequire:
+		default:
+			return fmt.Errorf("post-quantum: tls must be %q or %q", PostQuantumTLSPrefer, PostQuantumTLSRequire)
+		}
+	}
+	if err := validateL4Services(e.L4Services); err != nil {
+		return err
+	}
+	if e.HealthPort != 0 {
+		if e.HealthPort < 1 || e.HealthPort > 65535 || e.HealthPort == boot.ShimListenPort {
+			return fmt.Errorf("health-port must be 1-65535 and not the shim port %d", boot.ShimListenPort)
+		}
+		if slices.Contains(e.L4Ports(), e.HealthPort) {
+			return fmt.Errorf("health-port %d is also an l4-services port", e.HealthPort)
+		}
+	}
+	if err := validateDomainAliases(e.DomainAliases); err != nil {
+		return err
+	}
+	if secureTime := e.SecureTime; secureTime != nil {
+		if err := secureTime.validate(); err != nil {
+			return fmt.Errorf("secure-time: %v", err)
+		}
+	}
+	if introspection := e.TokenIntrospection; introspection != nil && !strings.HasPrefix(introspection.URL, "https://") {
+		return fmt.Errorf("token-introspection: url must use HTTPS")
+	}
+	return nil
+}
+
+// DecodeExtensions strictly decodes a shim extensions document. An empty
+// document enables nothing.
+func DecodeExtensions(data []byte) (*Extensions, error) {
+	var extensions Extensions
+	if len(bytes.TrimSpace(data)) == 0 {
+		return &extensions, nil
+	}
+	if _, err := decodeYAMLDocument(data); err != nil {
+		return nil, fmt.Errorf("failed to decode shim extensions: %v", err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&extensions); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to decode shim extensions: %v", err)
+	}
+	if err := extensions.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid shim extensions: %v", err)
+	}
+	return &extensions, nil
+}
+
+// LoadExtensions reads the shim extensions file. A missing file enables no
+// extensions, matching a runtime config without an extensions section.
+func LoadExtensions(path string) (*Extensions, error) {
+	data, err := readConfigFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &Extensions{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read shim extensions: %v", err)
+	}
+	return DecodeExtensions(data)
+}
@@ -634,6 +634,23 @@ func verifyPulledImageDigest(imageName string, repoDigests []string) error {
 	if !ok {
 		return fmt.Errorf("image reference %q does not contain a digest", imageName)
 	}
+	if pulledRepoDigest(imageName, repoDigests) == "" {
+		return fmt.Errorf("pulled image does not advertise requested digest %s", expected.Digest())
+	}
+	return nil
+}
+
+// pulledRepoDigest returns the entry of repoDigests that carries the digest
+// imageName pins, or "" if there is none.
+func pulledRepoDigest(imageName string, repoDigests []string) string {
+	named, err := reference.ParseNormalizedNamed(imageName)
+	if err != nil {
+		return ""
+	}
+	expected, ok := named.(reference.Digested)
+	if !ok {
+		return ""
+	}
 	for _, repoDigest := range repoDigests {
 		actualNamed, err := reference.ParseNormalizedNamed(repoDigest)
 		if err != nil {
@@ -641,10 +658,10 @@ func verifyPulledImageDigest(imageName string, repoDigests []string) error {
 		}
 		actual, ok := actualNamed.(reference.Digested)
 		if ok && actual.Digest() == expected.Digest() {
-			return nil
+			return repoDigest
 		}
 	}
-	return fmt.Errorf("pulled image does not advertise requested digest %s", expected.Digest())
+	return ""
 }
 
 func containerMemoryBytes(c *Container, cfg *Config) int64 {
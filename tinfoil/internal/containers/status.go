@@ -35,6 +35,7 @@ type declaredConfig struct {
 
 type containerStatusClient interface {
 	ContainerInspect(context.Context, string, client.ContainerInspectOptions) (client.ContainerInspectResult, error)
+	ImageInspect(context.Context, string, ...client.ImageInspectOption) (client.ImageInspectResult, error)
 }
 
 type containersResponse struct {
@@ -44,20 +45,27 @@ type containersResponse struct {
 }
 
 type containerStatus struct {
-	Name          string           `json:"name"`
-	ContainerID   string           `json:"container_id,omitempty"`
-	Image         string           `json:"image"`
-	Declared      bool             `json:"declared"`
-	Created       bool             `json:"created"`
-	Status        string           `json:"status,omitempty"`
-	RestartCount  int              `json:"restart_count"`
-	RestartPolicy string           `json:"restart_policy,omitempty"`
-	OOMKilled     bool             `json:"oom_killed"`
-	ExitCode      int              `json:"exit_code"`
-	Error         string           `json:"error,omitempty"`
-	StartedAt     string           `json:"started_at,omitempty"`
-	FinishedAt    string           `json:"finished_at,omitempty"`
-	Health        *containerHealth `json:"health,omitempty"`
+	Name        string `json:"name"`
+	ContainerID string `json:"container_id,omitempty"`
+	Image       string `json:"image"`
+	ImageID     string `json:"image_id,omitempty"`
+	// RepoDigest is the registry reference, repo@sha256:..., the image was
+	// pulled as. ImageID is only the local config ID.
+	RepoDigest string `json:"repo_digest,omitempty"`
+	// Addresses maps each attached network to the container's IPv4 address
+	// on it, so the shim can reach container services.
+	Addresses     map[string]string `json:"addresses,omitempty"`
+	Declared      bool              `json:"declared"`
+	Created       bool              `json:"created"`
+	Status        string            `json:"status,omitempty"`
+	RestartCount  int               `json:"restart_count"`
+	RestartPolicy string            `json:"restart_policy,omitempty"`
+	OOMKilled     bool              `json:"oom_killed"`
+	ExitCode      int               `json:"exit_code"`
+	Error         string            `json:"error,omitempty"`
+	StartedAt     string            `json:"started_at,omitempty"`
+	FinishedAt    string            `json:"finished_at,omitempty"`
+	Health        *containerHealth  `json:"health,omitempty"`
 }
 
 type containerHealth struct {
@@ -230,7 +238,15 @@ func inspectDeclaredContainers(ctx context.Context, cli containerStatusClient, d
 			}
 			return states, fmt.Errorf("inspecting %s: %w", c.Name, err)
 		}
-		states = append(states, containerStatusFromInspect(c, result.Container))
+		status := containerStatusFromInspect(c, result.Container)
+		if status.ImageID != "" {
+			image, err := cli.ImageInspect(ctx, status.ImageID)
+			if err != nil {
+				return states, fmt.Errorf("inspecting image of %s: %w", c.Name, err)
+			}
+			status.RepoDigest = pulledRepoDigest(status.Image, image.RepoDigests)
+		}
+		states = append(states, status)
 	}
 	return states, nil
 }
@@ -248,6 +264,8 @@ func containerStatusFromInspect(declared declaredContainer, inspect container.In
 	if inspect.Config != nil && inspect.Config.Image != "" {
 		status.Image = inspect.Config.Image
 	}
+	// The ID of the image the container actually runs, resolved by the pull.
+	status.ImageID = inspect.Image
 	if inspect.Name != "" {
 		status.Name = strings.TrimPrefix(inspect.Name, "/")
 	}
@@ -258,6 +276,16 @@ func containerStatusFromInspect(declared declaredContainer, inspect container.In
 		}
 	}
 	status.RestartCount = inspect.RestartCount
+	if inspect.NetworkSettings != nil {
+		for name, endpoint := range inspect.NetworkSettings.Networks {
+			if endpoint != nil && endpoint.IPAddress.IsValid() {
+				if status.Addresses == nil {
+					status.Addresses = map[string]string{}
+				}
+				status.Addresses[name] = endpoint.IPAddress.String()
+			}
+		}
+	}
 	if inspect.State == nil {
 		return status
 	}
@@ -16,8 +16,9 @@ import (
 )
 
 type fakeContainerClient struct {
-	inspect map[string]container.InspectResponse
-	errs    map[string]error
+	inspect     map[string]container.InspectResponse
+	errs        map[string]error
+	repoDigests map[string][]string
 }
 
 func (f fakeContainerClient) ContainerInspect(_ context.Context, name string, _ client.ContainerInspectOptions) (client.ContainerInspectResult, error) {
@@ -30,6 +31,13 @@ func (f fakeContainerClient) ContainerInspect(_ context.Context, name string, _
 	return client.ContainerInspectResult{}, errdefs.ErrNotFound
 }
 
+func (f fakeContainerClient) ImageInspect(_ context.Context, imageID string, _ ...client.ImageInspectOption) (client.ImageInspectResult, error) {
+	var result client.ImageInspectResult
+	result.ID = imageID
+	result.RepoDigests = f.repoDigests[imageID]
+	return result, nil
+}
+
 func TestInspectDeclaredContainers_MissingContainer(t *testing.T) {
 	states, err := inspectDeclaredContainers(context.Background(), fakeContainerClient{}, []declaredContainer{{
 		Name:    "model",
@@ -57,6 +65,7 @@ func TestInspectDeclaredContainers_MissingContainer(t *testing.T) {
 func TestContainerStatusFromInspect_RunningContainer(t *testing.T) {
 	got := containerStatusFromInspect(declaredContainer{Name: "model", Image: "declared:latest", Restart: "unless-stopped"}, container.InspectResponse{
 		Name:         "/model",
+		Image:        "sha256:0123",
 		RestartCount: 2,
 		State: &container.State{
 			Status:    "running",
@@ -67,8 +76,8 @@ func TestContainerStatusFromInspect_RunningContainer(t *testing.T) {
 		Config:     &container.Config{Image: "actual:latest"},
 	})
 
-	if got.Name != "model" || got.Image != "actual:latest" {
-		t.Fatalf("name/image = %q/%q", got.Name, got.Image)
+	if got.Name != "model" || got.Image != "actual:latest" || got.ImageID != "sha256:0123" {
+		t.Fatalf("name/image/image id = %q/%q/%q", got.Name, got.Image, got.ImageID)
 	}
 	if !got.Created || got.Status != "running" {
 		t.Fatalf("created/status = %v/%q", got.Created, got.Status)
@@ -151,6 +160,29 @@ func TestContainerStatusFromInspect_UnhealthyHealthcheck(t *testing.T) {
 	}
 }
 
+func TestInspectDeclaredContainers_RecordsPulledRepoDigest(t *testing.T) {
+	const digest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	const other = "sha256:fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210"
+	states, err := inspectDeclaredContainers(context.Background(), fakeContainerClient{
+		inspect: map[string]container.InspectResponse{
+			"model": {
+				Name:   "/model",
+				Image:  "sha256:bb",
+				Config: &container.Config{Image: "ghcr.io/tinfoilsh/model@" + digest},
+			},
+		},
+		repoDigests: map[string][]string{
+			"sha256:bb": {"ghcr.io/tinfoilsh/model@" + other, "ghcr.io/tinfoilsh/model@" + digest},
+		},
+	}, []declaredContainer{{Name: "model", Image: "ghcr.io/tinfoilsh/model@" + digest}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 1 || states[0].ImageID != "sha256:bb" || states[0].RepoDigest != "ghcr.io/tinfoilsh/model@"+digest {
+		t.Fatalf("states = %#v", states)
+	}
+}
+
 func TestInspectDeclaredContainers_UnexpectedError(t *testing.T) {
 	boom := errors.New("docker unavailable")
 	states, err := inspectDeclaredContainers(context.Background(), fakeContainerClient{
@@ -0,0 +1,49 @@
+package device
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Controller is one fixed disk controller of the guest topology and what
+// was found below it.
+type Controller struct {
+	Role       string `json:"role"`
+	PCIAddress string `json:"pci_address"`
+	Disk       string `json:"disk,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Inventory reports the disk found below each fixed controller without
+// waiting for devices to appear. Model slots are only listed when a PCI
+// device occupies them.
+func Inventory() []Controller {
+	controllers := []Controller{
+		inspectController("root", rootDiskPCIAddress, rootDiskSerial),
+		inspectController("config", configDiskPCIAddress, configDiskSerial),
+		inspectController("external-config", externalDiskPCIAddress, externalDiskSerial),
+	}
+	for index := range MaxModelDisks {
+		pciAddress, err := modelDiskPCIAddress(index)
+		if err != nil {
+			break
+		}
+		if _, err := os.Stat(filepath.Join(sysBusPCIDevices, pciAddress)); err != nil {
+			continue
+		}
+		controllers = append(controllers, inspectController(fmt.Sprintf("model%d", index+1), pciAddress, modelDiskSerial(index)))
+	}
+	return controllers
+}
+
+func inspectController(role, pciAddress, serial string) Controller {
+	controller := Controller{Role: role, PCIAddress: pciAddress}
+	disk, err := findDiskByPCIAddress(pciAddress, serial)
+	if err != nil {
+		controller.Error = err.Error()
+		return controller
+	}
+	controller.Disk = disk
+	return controller
+}
@@ -0,0 +1,32 @@
+package device
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInventoryReportsFixedAndPresentModelControllers(t *testing.T) {
+	fixture := withFixture(t)
+	addPCIDisk(t, fixture, rootDiskPCIAddress, "sda")
+	addPCIDisk(t, fixture, configDiskPCIAddress, "sdb")
+	model, err := modelDiskPCIAddress(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addPCIDisk(t, fixture, model, "sdc")
+
+	got := Inventory()
+	if len(got) != 4 {
+		t.Fatalf("Inventory() = %+v, want root, config, external-config and model2", got)
+	}
+	if got[0].Role != "root" || got[0].Disk != filepath.Join(fixture.dev, "sda") {
+		t.Fatalf("root controller = %+v", got[0])
+	}
+	if got[2].Role != "external-config" || got[2].Disk != "" || !strings.Contains(got[2].Error, externalDiskPCIAddress) {
+		t.Fatalf("missing external-config controller = %+v", got[2])
+	}
+	if got[3].Role != "model2" || got[3].PCIAddress != model || got[3].Disk != filepath.Join(fixture.dev, "sdc") {
+		t.Fatalf("model controller = %+v", got[3])
+	}
+}
@@ -58,6 +58,16 @@ var (
 	deviceWaitDelay   = 100 * time.Millisecond
 )
 
+// UseTree looks devices up below root instead of the live /sys and /dev,
+// without waiting for them to appear. It lets boot preflight checks run
+// against a prepared device tree.
+func UseTree(root string) {
+	sysBusPCIDevices = filepath.Join(root, "sys/bus/pci/devices")
+	sysBlockDir = filepath.Join(root, "sys/block")
+	devDir = filepath.Join(root, "dev")
+	deviceWaitTimeout = 0
+}
+
 // ConfigDisk returns the disk below the fixed config controller.
 func ConfigDisk() (string, error) {
 	return waitForDevice(func() (string, error) {
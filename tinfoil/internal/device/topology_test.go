@@ -6,6 +6,7 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 type deviceFixture struct {
@@ -123,6 +124,25 @@ func TestExternalConfigDiskUsesFixedController(t *testing.T) {
 	}
 }
 
+func TestUseTreeResolvesBelowRoot(t *testing.T) {
+	fixture := withFixture(t)
+	addPCIDisk(t, fixture, configDiskPCIAddress, "vdb")
+	root := filepath.Dir(filepath.Dir(fixture.sys))
+	deviceWaitTimeout = time.Hour
+	UseTree(root)
+
+	got, err := ConfigDisk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(root, "dev", "vdb"); got != want {
+		t.Fatalf("ConfigDisk() = %q, want %q", got, want)
+	}
+	if _, err := ExternalConfigDisk(); err == nil {
+		t.Fatal("found a disk missing from the tree")
+	}
+}
+
 func TestConfigDiskRejectsWrongOrAmbiguousTopology(t *testing.T) {
 	t.Run("wrong controller", func(t *testing.T) {
 		fixture := withFixture(t)
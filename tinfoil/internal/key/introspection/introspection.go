@@ -0,0 +1,153 @@
+// Package introspection validates opaque access tokens issued by a standard
+// OAuth 2.0 authorization server through its RFC 7662 introspection endpoint.
+package introspection
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"tinfoil/internal/key"
+)
+
+const (
+	introspectionTimeout = 10 * time.Second
+
+	// maxResponseBytes bounds an introspection response; real responses are
+	// a few hundred bytes.
+	maxResponseBytes = 1 << 20
+)
+
+// errUnavailable marks failures of the introspection endpoint itself. The
+// caller's token is not at fault, so the shim answers 503 and the wrapped
+// cause only reaches its log.
+var errUnavailable = &key.ValidationError{StatusCode: http.StatusServiceUnavailable}
+
+// Validator asks an introspection endpoint whether a token is active,
+// authenticating as a confidential client with client_secret_basic.
+type Validator struct {
+	endpoint     string
+	clientID     string
+	clientSecret string
+	audience     string
+	scope        string
+	client       *http.Client
+	now          func() time.Time
+}
+
+// NewValidator returns a Validator for the introspection endpoint. Tokens
+// must carry scope unless the request names a route scope, and must list
+// audience in aud when audience is non-empty.
+func NewValidator(endpoint, clientID, clientSecret, audience, scope string) (*Validator, error) {
+	if !strings.HasPrefix(endpoint, "https://") {
+		return nil, fmt.Errorf("introspection endpoint must use HTTPS: %s", endpoint)
+	}
+	if clientID == "" || clientSecret == "" {
+		return nil, fmt.Errorf("introspection client credentials are required")
+	}
+	return &Validator{
+		endpoint:     endpoint,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		audience:     audience,
+		scope:        scope,
+		client:       &http.Client{Timeout: introspectionTimeout},
+		now:          time.Now,
+	}, nil
+}
+
+// response is the subset of RFC 7662 section 2.2 the shim acts on.
+type response struct {
+	Active    bool     `json:"active"`
+	Scope     string   `json:"scope"`
+	ClientID  string   `json:"client_id"`
+	Subject   string   `json:"sub"`
+	Audience  audience `json:"aud"`
+	Expiry    int64    `json:"exp"`
+	TokenType string   `json:"token_type"`
+}
+
+// audience decodes aud, which RFC 7662 allows as a string or an array.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return err
+	}
+	*a = multiple
+	return nil
+}
+
+func (v *Validator) Validate(req key.Request) (*key.Claims, error) {
+	// Introspected tokens are not sender-constrained here, so a DPoP
+	// presentation cannot be honoured.
+	if req.DPoPScheme || req.RequireDPoP {
+		return nil, &key.ValidationError{StatusCode: http.StatusUnauthorized}
+	}
+
+	form := url.Values{"token": {req.APIKey}, "token_type_hint": {"access_token"}}
+	httpReq, err := http.NewRequest(http.MethodPost, v.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("building introspection request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	httpReq.Header.Set("Accept", "application/json")
+	// RFC 6749 section 2.3.1 form-encodes the credentials before Basic
+	// encoding.
+	httpReq.SetBasicAuth(url.QueryEscape(v.clientID), url.QueryEscape(v.clientSecret))
+
+	resp, err := v.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("%w: introspection request failed: %w", errUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	// Any other status is a problem with the shim's client registration or
+	// the authorization server, not with the caller's token.
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: introspection endpoint returned status %d", errUnavailable, resp.StatusCode)
+	}
+	var result response
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseBytes)).Decode(&result); err != nil {
+		return nil, fmt.Errorf("%w: decoding introspection response: %w", errUnavailable, err)
+	}
+
+	if !result.Active {
+		return nil, &key.ValidationError{StatusCode: http.StatusUnauthorized}
+	}
+	if result.Expiry != 0 && !v.now().Before(time.Unix(result.Expiry, 0)) {
+		return nil, &key.ValidationError{StatusCode: http.StatusUnauthorized}
+	}
+	if v.audience != "" && !slices.Contains(result.Audience, v.audience) {
+		return nil, &key.ValidationError{StatusCode: http.StatusUnauthorized}
+	}
+	if result.TokenType != "" && !strings.EqualFold(result.TokenType, "Bearer") {
+		return nil, &key.ValidationError{StatusCode: http.StatusUnauthorized}
+	}
+
+	requiredScope := req.Scope
+	if requiredScope == "" {
+		requiredScope = v.scope
+	}
+	scopes := strings.Fields(result.Scope)
+	if requiredScope != "" && !slices.Contains(scopes, requiredScope) {
+		return nil, &key.ValidationError{StatusCode: http.StatusForbidden}
+	}
+
+	return &key.Claims{
+		Subject:  result.Subject,
+		ClientID: result.ClientID,
+		Scopes:   scopes,
+	}, nil
+}
@@ -0,0 +1,148 @@
+package introspection
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"tinfoil/internal/key"
+)
+
+const (
+	testClientID     = "shim client"
+	testClientSecret = "s3cret:+"
+	testAudience     = "https://inference.example.com"
+	testScope        = "inference"
+)
+
+// introspectionServer answers every introspection with result and records
+// the token it was asked about.
+func introspectionServer(t *testing.T, status int, result map[string]interface{}) (*httptest.Server, *string) {
+	t.Helper()
+	var token string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, ok := r.BasicAuth()
+		if !ok || id != "shim+client" || secret != "s3cret%3A%2B" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err := r.ParseForm(); err != nil || r.PostForm.Get("token_type_hint") != "access_token" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		token = r.PostForm.Get("token")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(result)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &token
+}
+
+func newTestValidator(t *testing.T, srv *httptest.Server) *Validator {
+	t.Helper()
+	v, err := NewValidator(srv.URL, testClientID, testClientSecret, testAudience, testScope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.client = srv.Client()
+	return v
+}
+
+func expectStatus(t *testing.T, err error, want int) {
+	t.Helper()
+	var ve *key.ValidationError
+	if !errors.As(err, &ve) {
+		t.Fatalf("expected ValidationError, got %v", err)
+	}
+	if ve.StatusCode != want {
+		t.Fatalf("status = %d, want %d", ve.StatusCode, want)
+	}
+}
+
+func activeResult() map[string]interface{} {
+	return map[string]interface{}{
+		"active":     true,
+		"scope":      "inference inference:embeddings",
+		"client_id":  "app",
+		"sub":        "user_1",
+		"aud":        []string{"other", testAudience},
+		"exp":        time.Now().Add(time.Hour).Unix(),
+		"token_type": "Bearer",
+	}
+}
+
+func TestValidateAcceptsActiveToken(t *testing.T) {
+	srv, token := introspectionServer(t, http.StatusOK, activeResult())
+	v := newTestValidator(t, srv)
+
+	claims, err := v.Validate(key.Request{APIKey: "opaque-token"})
+	if err != nil {
+		t.Fatalf("active token rejected: %v", err)
+	}
+	if *token != "opaque-token" {
+		t.Fatalf("introspected token = %q", *token)
+	}
+	if claims.Subject != "user_1" || claims.ClientID != "app" || len(claims.Scopes) != 2 {
+		t.Fatalf("claims = %+v", claims)
+	}
+}
+
+func TestValidateMapsIntrospectionResults(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(map[string]interface{})
+		scope  string
+		want   int
+	}{
+		{name: "inactive", change: func(r map[string]interface{}) { r["active"] = false }, want: http.StatusUnauthorized},
+		{name: "expired", change: func(r map[string]interface{}) { r["exp"] = time.Now().Add(-time.Minute).Unix() }, want: http.StatusUnauthorized},
+		{name: "wrong audience", change: func(r map[string]interface{}) { r["aud"] = "https://other.example.com" }, want: http.StatusUnauthorized},
+		{name: "missing scope", change: func(r map[string]interface{}) { r["scope"] = "profile" }, want: http.StatusForbidden},
+		{name: "missing route scope", change: func(map[string]interface{}) {}, scope: "inference:batch", want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := activeResult()
+			tt.change(result)
+			srv, _ := introspectionServer(t, http.StatusOK, result)
+			_, err := newTestValidator(t, srv).Validate(key.Request{APIKey: "opaque-token", Scope: tt.scope})
+			expectStatus(t, err, tt.want)
+		})
+	}
+}
+
+func TestValidateEndpointFailureIsUnavailable(t *testing.T) {
+	srv, _ := introspectionServer(t, http.StatusInternalServerError, nil)
+	_, err := newTestValidator(t, srv).Validate(key.Request{APIKey: "opaque-token"})
+	expectStatus(t, err, http.StatusServiceUnavailable)
+
+	// An endpoint that cannot be reached is not the caller's fault either.
+	v := newTestValidator(t, srv)
+	srv.Close()
+	_, err = v.Validate(key.Request{APIKey: "opaque-token"})
+	expectStatus(t, err, http.StatusServiceUnavailable)
+}
+
+func TestValidateInChain(t *testing.T) {
+	srv, _ := introspectionServer(t, http.StatusOK, activeResult())
+	chain := key.NewChain(unsupported{}, newTestValidator(t, srv))
+	if _, err := chain.Validate(key.Request{APIKey: "opaque-token"}); err != nil {
+		t.Fatalf("chain did not reach the introspection validator: %v", err)
+	}
+}
+
+type unsupported struct{}
+
+func (unsupported) Validate(key.Request) (*key.Claims, error) { return nil, key.ErrUnsupportedToken }
+
+func TestNewValidatorRequiresHTTPSAndCredentials(t *testing.T) {
+	if _, err := NewValidator("http://auth.example.com/introspect", "id", "secret", "", testScope); err == nil {
+		t.Fatal("plain HTTP endpoint accepted")
+	}
+	if _, err := NewValidator("https://auth.example.com/introspect", "id", "", "", testScope); err == nil {
+		t.Fatal("missing client secret accepted")
+	}
+}
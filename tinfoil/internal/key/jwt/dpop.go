@@ -0,0 +1,158 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+	josejwt "github.com/go-jose/go-jose/v4/jwt"
+)
+
+const (
+	// dpopProofType is the RFC 9449 "typ" header of a DPoP proof JWT.
+	dpopProofType = "dpop+jwt"
+
+	// A proof is accepted for maxDPoPProofAge after its iat, plus a small
+	// allowance for client clocks running ahead. The replay cache only has
+	// to remember a jti for that long.
+	maxDPoPProofAge  = time.Minute
+	maxDPoPClockSkew = 5 * time.Second
+
+	// maxDPoPReplayEntries bounds the replay cache. When it is full of
+	// unexpired proofs, new proofs are refused rather than risking a replay.
+	maxDPoPReplayEntries = 1 << 18
+)
+
+// dpopAlgorithms are the asymmetric algorithms accepted for proofs. Unlike
+// access tokens, proofs are signed by client keys, so common client
+// algorithms are allowed.
+var dpopAlgorithms = []jose.SignatureAlgorithm{jose.EdDSA, jose.ES256, jose.ES384, jose.RS256, jose.PS256}
+
+var (
+	errDPoPInvalid  = errors.New("invalid DPoP proof")
+	errDPoPReplayed = errors.New("DPoP proof replayed")
+	errDPoPBusy     = errors.New("DPoP replay cache full")
+)
+
+type dpopProofClaims struct {
+	ID              string               `json:"jti"`
+	Method          string               `json:"htm"`
+	URI             string               `json:"htu"`
+	IssuedAt        *josejwt.NumericDate `json:"iat"`
+	AccessTokenHash string               `json:"ath"`
+}
+
+// dpopReplayCache remembers proof jtis until the proofs expire.
+type dpopReplayCache struct {
+	mu      sync.Mutex
+	entries map[string]time.Time
+	now     func() time.Time
+}
+
+func newDPoPReplayCache() *dpopReplayCache {
+	return &dpopReplayCache{entries: make(map[string]time.Time), now: time.Now}
+}
+
+// claim records id until expires. It fails if id was already used or the
+// cache has no room.
+func (c *dpopReplayCache) claim(id string, expires time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if expiry, ok := c.entries[id]; ok && now.Before(expiry) {
+		return errDPoPReplayed
+	}
+	if len(c.entries) >= maxDPoPReplayEntries {
+		for entry, expiry := range c.entries {
+			if !now.Before(expiry) {
+				delete(c.entries, entry)
+			}
+		}
+		if len(c.entries) >= maxDPoPReplayEntries {
+			return errDPoPBusy
+		}
+	}
+	c.entries[id] = expires
+	return nil
+}
+
+// verifyDPoP checks an RFC 9449 proof for a request with the given method and
+// target URI that presents accessToken, and returns the JWK SHA-256
+// thumbprint of the proof key for comparison with the token's cnf.jkt.
+func (v *Validator) verifyDPoP(proof, method, uri, accessToken string) (string, error) {
+	token, err := josejwt.ParseSigned(proof, dpopAlgorithms)
+	if err != nil || len(token.Headers) != 1 {
+		return "", errDPoPInvalid
+	}
+	header := token.Headers[0]
+	typ, _ := header.ExtraHeaders[jose.HeaderType].(string)
+	if normalizeType(typ) != dpopProofType || header.JSONWebKey == nil || !header.JSONWebKey.IsPublic() {
+		return "", errDPoPInvalid
+	}
+
+	var claims dpopProofClaims
+	if err := token.Claims(header.JSONWebKey, &claims); err != nil {
+		return "", errDPoPInvalid
+	}
+	if claims.ID == "" || claims.IssuedAt == nil || claims.Method != method || !sameHTU(claims.URI, uri) {
+		return "", errDPoPInvalid
+	}
+	tokenHash := sha256.Sum256([]byte(accessToken))
+	if claims.AccessTokenHash != base64.RawURLEncoding.EncodeToString(tokenHash[:]) {
+		return "", errDPoPInvalid
+	}
+	now := v.replay.now()
+	issuedAt := claims.IssuedAt.Time()
+	if issuedAt.After(now.Add(maxDPoPClockSkew)) || now.Sub(issuedAt) > maxDPoPProofAge {
+		return "", errDPoPInvalid
+	}
+
+	thumbprint, err := header.JSONWebKey.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", errDPoPInvalid
+	}
+	jkt := base64.RawURLEncoding.EncodeToString(thumbprint)
+	// jtis are only unique per client key, so the cache key includes it.
+	if err := v.replay.claim(jkt+"."+claims.ID, issuedAt.Add(maxDPoPProofAge+maxDPoPClockSkew)); err != nil {
+		return "", err
+	}
+	return jkt, nil
+}
+
+// sameHTU compares a proof's htu with the request URI as RFC 9449 requires:
+// without query and fragment, after scheme and host normalization.
+func sameHTU(htu, uri string) bool {
+	a, err := url.Parse(htu)
+	if err != nil {
+		return false
+	}
+	b, err := url.Parse(uri)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(a.Scheme, b.Scheme) &&
+		strings.EqualFold(canonicalHost(a), canonicalHost(b)) &&
+		canonicalPath(a) == canonicalPath(b)
+}
+
+func canonicalPath(u *url.URL) string {
+	if path := u.EscapedPath(); path != "" {
+		return path
+	}
+	return "/"
+}
+
+func canonicalHost(u *url.URL) string {
+	host, port := u.Hostname(), u.Port()
+	if port == "" || (port == "443" && strings.EqualFold(u.Scheme, "https")) || (port == "80" && strings.EqualFold(u.Scheme, "http")) {
+		return host
+	}
+	return host + ":" + port
+}
@@ -0,0 +1,185 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+	josejwt "github.com/go-jose/go-jose/v4/jwt"
+
+	"tinfoil/internal/key"
+)
+
+const testHTU = "https://inference.tinfoil.sh/v1/chat/completions"
+
+// dpopClient is a client key that mints proofs.
+type dpopClient struct {
+	priv *ecdsa.PrivateKey
+	jkt  string
+}
+
+func newDPoPClient(t *testing.T) *dpopClient {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	thumbprint, err := (&jose.JSONWebKey{Key: priv.Public()}).Thumbprint(crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &dpopClient{priv: priv, jkt: base64.RawURLEncoding.EncodeToString(thumbprint)}
+}
+
+func (c *dpopClient) proof(t *testing.T, jti, method, htu, accessToken string, iat time.Time) string {
+	t.Helper()
+	opts := (&jose.SignerOptions{EmbedJWK: true}).WithType(dpopProofType)
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: c.priv}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256([]byte(accessToken))
+	proof, err := josejwt.Signed(signer).Claims(map[string]interface{}{
+		"jti": jti,
+		"htm": method,
+		"htu": htu,
+		"iat": iat.Unix(),
+		"ath": base64.RawURLEncoding.EncodeToString(hash[:]),
+	}).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proof
+}
+
+func dpopRequest(token, proof string) key.Request {
+	req := chatRequest(token)
+	req.DPoPScheme = true
+	req.DPoPProof = proof
+	req.Method = http.MethodPost
+	req.URL = testHTU
+	return req
+}
+
+func mintBoundToken(t *testing.T, priv ed25519.PrivateKey, jkt string) string {
+	t.Helper()
+	return mintTokenWithClaims(t, priv, testKID, "at+jwt", validClaims(time.Now()), map[string]interface{}{
+		"scope":     RequiredScope,
+		"client_id": "tinfoil-chat",
+		"cnf":       map[string]string{"jkt": jkt},
+	})
+}
+
+func TestValidateAcceptsBoundTokenWithProof(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	srv := jwksServer(t, pub, testKID)
+	defer srv.Close()
+	v := newTestValidator(t, srv.URL)
+
+	client := newDPoPClient(t)
+	token := mintBoundToken(t, priv, client.jkt)
+	// The proof may name the default port and a differently cased host.
+	proof := client.proof(t, "p1", http.MethodPost, "https://Inference.tinfoil.sh:443/v1/chat/completions", token, time.Now())
+	claims, err := v.Validate(dpopRequest(token, proof))
+	if err != nil {
+		t.Fatalf("expected bound token with a valid proof, got %v", err)
+	}
+	if claims.DPoPKey != client.jkt {
+		t.Fatalf("DPoPKey = %q, want %q", claims.DPoPKey, client.jkt)
+	}
+}
+
+func TestValidateRejectsInvalidProofs(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	srv := jwksServer(t, pub, testKID)
+	defer srv.Close()
+	v := newTestValidator(t, srv.URL)
+
+	client := newDPoPClient(t)
+	token := mintBoundToken(t, priv, client.jkt)
+	now := time.Now()
+	tests := []struct {
+		name string
+		req  key.Request
+	}{
+		{name: "no proof", req: dpopRequest(token, "")},
+		{name: "bearer scheme", req: func() key.Request {
+			req := dpopRequest(token, client.proof(t, "a", http.MethodPost, testHTU, token, now))
+			req.DPoPScheme = false
+			return req
+		}()},
+		{name: "wrong method", req: dpopRequest(token, client.proof(t, "b", http.MethodGet, testHTU, token, now))},
+		{name: "wrong uri", req: dpopRequest(token, client.proof(t, "c", http.MethodPost, "https://inference.tinfoil.sh/v1/embeddings", token, now))},
+		{name: "wrong token hash", req: dpopRequest(token, client.proof(t, "d", http.MethodPost, testHTU, "other-token", now))},
+		{name: "expired proof", req: dpopRequest(token, client.proof(t, "e", http.MethodPost, testHTU, token, now.Add(-2*maxDPoPProofAge)))},
+		{name: "other key", req: dpopRequest(token, newDPoPClient(t).proof(t, "f", http.MethodPost, testHTU, token, now))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := v.Validate(tt.req)
+			expectStatus(t, err, http.StatusUnauthorized)
+		})
+	}
+}
+
+func TestValidateRejectsReplayedProof(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	srv := jwksServer(t, pub, testKID)
+	defer srv.Close()
+	v := newTestValidator(t, srv.URL)
+
+	client := newDPoPClient(t)
+	token := mintBoundToken(t, priv, client.jkt)
+	proof := client.proof(t, "once", http.MethodPost, testHTU, token, time.Now())
+	if _, err := v.Validate(dpopRequest(token, proof)); err != nil {
+		t.Fatalf("first use of proof rejected: %v", err)
+	}
+	_, err := v.Validate(dpopRequest(token, proof))
+	expectStatus(t, err, http.StatusUnauthorized)
+}
+
+func TestValidateUnboundTokenAndRequiredDPoP(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	srv := jwksServer(t, pub, testKID)
+	defer srv.Close()
+	v := newTestValidator(t, srv.URL)
+
+	token := mintToken(t, priv, testKID, "at+jwt", validClaims(time.Now()), RequiredScope)
+	claims, err := v.Validate(chatRequest(token))
+	if err != nil {
+		t.Fatalf("unbound bearer token rejected: %v", err)
+	}
+	if claims.DPoPKey != "" {
+		t.Fatalf("unbound token reported DPoP key %q", claims.DPoPKey)
+	}
+
+	req := chatRequest(token)
+	req.RequireDPoP = true
+	_, err = v.Validate(req)
+	expectStatus(t, err, http.StatusUnauthorized)
+}
+
+func TestDPoPReplayCacheIsBounded(t *testing.T) {
+	now := time.Now()
+	c := newDPoPReplayCache()
+	c.now = func() time.Time { return now }
+	for i := range maxDPoPReplayEntries {
+		c.entries[strconv.Itoa(i)] = now.Add(time.Minute)
+	}
+	if err := c.claim("new", now.Add(time.Minute)); err != errDPoPBusy {
+		t.Fatalf("claim on a full cache = %v, want errDPoPBusy", err)
+	}
+	now = now.Add(2 * time.Minute)
+	if err := c.claim("new", now.Add(time.Minute)); err != nil {
+		t.Fatalf("claim after entries expired = %v", err)
+	}
+}
@@ -1,13 +1,16 @@
 // Package jwt verifies OAuth 2.0 JWT access tokens (RFC 9068) locally inside
 // the enclave. It fetches the control plane's JWKS once at boot, refreshes it
 // periodically to follow signing-key rotation, and validates token signatures
-// and claims without a per-request call to the control plane.
+// and claims without a per-request call to the control plane. The trusted keys
+// can be pinned, or embedded in measured config instead of fetched.
 package jwt
 
 import (
 	"context"
+	"crypto"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -30,8 +33,8 @@ const (
 
 	// RequiredScope is the OAuth scope a token must carry to call the inference
 	// API. It is intentionally broad: it authorizes every inference endpoint
-	// rather than a single route, so access can be narrowed later by minting
-	// more specific scopes without re-issuing existing tokens.
+	// rather than a single route. Routes that need narrower access name their
+	// own scope in key.Request.Scope.
 	RequiredScope = "inference:api"
 
 	// accessTokenType is the RFC 9068 "typ" header that distinguishes an OAuth
@@ -50,16 +53,55 @@ const (
 	fetchTimeout = 10 * time.Second
 )
 
-// signingKeys caches a JWKS and refreshes it from the issuer.
+// signingKeys caches a JWKS and refreshes it from the issuer. A cache without
+// a url holds a fixed set from measured config and never fetches.
 type signingKeys struct {
 	url    string
 	client *http.Client
 
 	mu          sync.RWMutex
 	set         jose.JSONWebKeySet
+	pins        *keyPins
 	lastAttempt time.Time
 }
 
+// keyPins restricts which keys of a fetched JWKS are trusted, so a
+// compromised JWKS endpoint cannot introduce signing keys. A key must match
+// every non-empty list.
+type keyPins struct {
+	keyIDs      map[string]bool
+	thumbprints map[string]bool
+}
+
+func (p *keyPins) allows(k jose.JSONWebKey) bool {
+	if len(p.keyIDs) > 0 && !p.keyIDs[k.KeyID] {
+		return false
+	}
+	if len(p.thumbprints) > 0 {
+		thumbprint, err := k.Thumbprint(crypto.SHA256)
+		if err != nil || !p.thumbprints[base64.RawURLEncoding.EncodeToString(thumbprint)] {
+			return false
+		}
+	}
+	return true
+}
+
+// filter returns the keys of set that the pins allow, logging the others.
+func (p *keyPins) filter(set jose.JSONWebKeySet) jose.JSONWebKeySet {
+	if p == nil {
+		return set
+	}
+	var pinned jose.JSONWebKeySet
+	for _, k := range set.Keys {
+		if p.allows(k) {
+			pinned.Keys = append(pinned.Keys, k)
+		} else {
+			log.Printf("Warning: ignoring unpinned JWKS key %q", k.KeyID)
+		}
+	}
+	return pinned
+}
+
 // newSigningKeys builds a JWKS cache and makes a best-effort initial load so
 // the first request need not pay for an inline fetch. Failure is not fatal: the
 // cache starts empty and the on-demand and background refresh paths populate it
@@ -94,8 +136,12 @@ func (s *signingKeys) refresh(ctx context.Context) error {
 		return fmt.Errorf("jwks contains no keys")
 	}
 	s.mu.Lock()
+	defer s.mu.Unlock()
+	set = s.pins.filter(set)
+	if len(set.Keys) == 0 {
+		return fmt.Errorf("jwks contains no pinned keys")
+	}
 	s.set = set
-	s.mu.Unlock()
 	return nil
 }
 
@@ -116,6 +162,9 @@ func (s *signingKeys) lookup(kid string) (jose.JSONWebKey, bool) {
 // JWKS outage combined with unknown-kid traffic cannot fan out into unbounded
 // fetch attempts.
 func (s *signingKeys) refreshIfAllowed() {
+	if s.url == "" {
+		return
+	}
 	s.mu.Lock()
 	if time.Since(s.lastAttempt) < minRefreshInterval {
 		s.mu.Unlock()
@@ -145,15 +194,27 @@ func (s *signingKeys) startBackgroundRefresh() {
 // (non-JWT) credentials yield key.ErrUnsupportedToken so a Chain falls back to
 // the control-plane validator.
 type Validator struct {
-	keys     *signingKeys
-	issuer   string
-	audience string
-	scope    string
+	keys        *signingKeys
+	revocations *revocations
+	replay      *dpopReplayCache
+	issuer      string
+	audience    string
+	scope       string
 }
 
+// accessTokenClaims are the RFC 9068 claims the validator checks, plus the
+// optional caller attributes the control plane adds for per-tenant policy.
 type accessTokenClaims struct {
-	Scope    string `json:"scope"`
-	ClientID string `json:"client_id"`
+	Scope    string   `json:"scope"`
+	ClientID string   `json:"client_id"`
+	Tenant   string   `json:"tenant,omitempty"`
+	Tier     string   `json:"tier,omitempty"`
+	Models   []string `json:"models,omitempty"`
+
+	// Confirmation binds the token to a DPoP key (RFC 9449 section 6).
+	Confirmation *struct {
+		JWKThumbprint string `json:"jkt"`
+	} `json:"cnf,omitempty"`
 }
 
 // NewValidator builds a Validator over a best-effort JWKS cache and starts
@@ -163,22 +224,70 @@ type accessTokenClaims struct {
 func NewValidator(jwksURL, issuer, audience, requiredScope string) *Validator {
 	keys := newSigningKeys(jwksURL)
 	keys.startBackgroundRefresh()
+	return newValidator(keys, issuer, audience, requiredScope)
+}
+
+// NewOfflineValidator builds a Validator that trusts exactly the keys in set,
+// typically a JWKS embedded in measured config, and never fetches a JWKS.
+func NewOfflineValidator(set jose.JSONWebKeySet, issuer, audience, requiredScope string) (*Validator, error) {
+	for _, k := range set.Keys {
+		if !k.IsPublic() || !k.Valid() || k.KeyID == "" {
+			return nil, fmt.Errorf("jwks key %q must be a valid public key with a key id", k.KeyID)
+		}
+	}
+	if len(set.Keys) == 0 {
+		return nil, fmt.Errorf("jwks contains no keys")
+	}
+	return newValidator(&signingKeys{set: set}, issuer, audience, requiredScope), nil
+}
+
+func newValidator(keys *signingKeys, issuer, audience, requiredScope string) *Validator {
 	return &Validator{
 		keys:     keys,
+		replay:   newDPoPReplayCache(),
 		issuer:   strings.TrimRight(issuer, "/"),
 		audience: audience,
 		scope:    requiredScope,
 	}
 }
 
-func (v *Validator) Validate(req key.Request) error {
+// PinKeys restricts the trusted signing keys to those whose key id is in
+// keyIDs and whose RFC 7638 SHA-256 thumbprint (base64url) is in thumbprints;
+// an empty list does not restrict. Keys already cached are filtered too. It
+// must be called before the validator is in use.
+func (v *Validator) PinKeys(keyIDs, thumbprints []string) {
+	pins := &keyPins{keyIDs: make(map[string]bool), thumbprints: make(map[string]bool)}
+	for _, kid := range keyIDs {
+		pins.keyIDs[kid] = true
+	}
+	for _, thumbprint := range thumbprints {
+		pins.thumbprints[thumbprint] = true
+	}
+	v.keys.mu.Lock()
+	defer v.keys.mu.Unlock()
+	v.keys.pins = pins
+	v.keys.set = pins.filter(v.keys.set)
+}
+
+// UseRevocationFeed makes the validator reject tokens revoked through the
+// control plane's revocation feed at feedURL, which is followed on the JWKS
+// refresh cadence. If the feed has not synced within maxStaleness (zero
+// disables the limit) and failClosed is set, tokens are no longer accepted
+// locally: Validate reports key.ErrUnsupportedToken so a Chain defers to the
+// control plane. It must be called before the validator is in use.
+func (v *Validator) UseRevocationFeed(feedURL string, maxStaleness time.Duration, failClosed bool) {
+	v.revocations = newRevocations(feedURL, maxStaleness, failClosed)
+	v.revocations.startBackgroundRefresh()
+}
+
+func (v *Validator) Validate(req key.Request) (*key.Claims, error) {
 	if !isAccessTokenJWT(req.APIKey) {
-		return key.ErrUnsupportedToken
+		return nil, key.ErrUnsupportedToken
 	}
 
 	token, err := josejwt.ParseSigned(req.APIKey, []jose.SignatureAlgorithm{jose.EdDSA})
 	if err != nil || len(token.Headers) == 0 {
-		return &key.ValidationError{StatusCode: http.StatusUnauthorized}
+		return nil, &key.ValidationError{StatusCode: http.StatusUnauthorized}
 	}
 
 	// RFC 9068 registers the access-token type as "at+jwt"; RFC 7515 also
@@ -186,7 +295,7 @@ func (v *Validator) Validate(req key.Request) error {
 	// accept both forms case-insensitively.
 	typ, _ := token.Headers[0].ExtraHeaders[jose.HeaderType].(string)
 	if normalizeType(typ) != accessTokenType {
-		return &key.ValidationError{StatusCode: http.StatusUnauthorized}
+		return nil, &key.ValidationError{StatusCode: http.StatusUnauthorized}
 	}
 
 	signingKey, ok := v.keys.lookup(token.Headers[0].KeyID)
@@ -194,17 +303,17 @@ func (v *Validator) Validate(req key.Request) error {
 		v.keys.refreshIfAllowed()
 		signingKey, ok = v.keys.lookup(token.Headers[0].KeyID)
 		if !ok {
-			return &key.ValidationError{StatusCode: http.StatusUnauthorized}
+			return nil, &key.ValidationError{StatusCode: http.StatusUnauthorized}
 		}
 	}
 
 	var claims josejwt.Claims
 	var ext accessTokenClaims
 	if err := token.Claims(signingKey, &claims, &ext); err != nil {
-		return &key.ValidationError{StatusCode: http.StatusUnauthorized}
+		return nil, &key.ValidationError{StatusCode: http.StatusUnauthorized}
 	}
 	if claims.Subject == "" || claims.Expiry == nil || claims.IssuedAt == nil || claims.ID == "" || ext.ClientID == "" {
-		return &key.ValidationError{StatusCode: http.StatusUnauthorized}
+		return nil, &key.ValidationError{StatusCode: http.StatusUnauthorized}
 	}
 
 	if err := claims.Validate(josejwt.Expected{
@@ -212,14 +321,55 @@ func (v *Validator) Validate(req key.Request) error {
 		AnyAudience: josejwt.Audience{v.audience},
 		Time:        time.Now(),
 	}); err != nil {
-		return &key.ValidationError{StatusCode: http.StatusUnauthorized}
+		return nil, &key.ValidationError{StatusCode: http.StatusUnauthorized}
 	}
 
-	if !scopeContains(ext.Scope, v.scope) {
-		return &key.ValidationError{StatusCode: http.StatusForbidden}
+	if v.revocations != nil {
+		err := v.revocations.check(claims.Subject, claims.ID, claims.IssuedAt.Time())
+		if errors.Is(err, errTokenRevoked) {
+			return nil, &key.ValidationError{StatusCode: http.StatusUnauthorized}
+		}
+		if err != nil {
+			return nil, key.ErrUnsupportedToken
+		}
 	}
 
-	return nil
+	// A bound token is only valid with a matching proof and the DPoP
+	// scheme; an unbound token only where the route allows bearer use.
+	var dpopKey string
+	if ext.Confirmation != nil && ext.Confirmation.JWKThumbprint != "" {
+		if !req.DPoPScheme || req.DPoPProof == "" {
+			return nil, &key.ValidationError{StatusCode: http.StatusUnauthorized}
+		}
+		jkt, err := v.verifyDPoP(req.DPoPProof, req.Method, req.URL, req.APIKey)
+		if errors.Is(err, errDPoPBusy) {
+			return nil, &key.ValidationError{StatusCode: http.StatusServiceUnavailable}
+		}
+		if err != nil || jkt != ext.Confirmation.JWKThumbprint {
+			return nil, &key.ValidationError{StatusCode: http.StatusUnauthorized}
+		}
+		dpopKey = jkt
+	} else if req.RequireDPoP || req.DPoPScheme {
+		return nil, &key.ValidationError{StatusCode: http.StatusUnauthorized}
+	}
+
+	requiredScope := req.Scope
+	if requiredScope == "" {
+		requiredScope = v.scope
+	}
+	if !scopeContains(ext.Scope, requiredScope) {
+		return nil, &key.ValidationError{StatusCode: http.StatusForbidden}
+	}
+
+	return &key.Claims{
+		Subject:  claims.Subject,
+		ClientID: ext.ClientID,
+		Tenant:   ext.Tenant,
+		Tier:     ext.Tier,
+		Scopes:   strings.Fields(ext.Scope),
+		Models:   ext.Models,
+		DPoPKey:  dpopKey,
+	}, nil
 }
 
 // isAccessTokenJWT reports whether s is explicitly typed as an access-token
@@ -22,6 +22,11 @@ const (
 )
 
 func mintToken(t *testing.T, priv ed25519.PrivateKey, kid, typ string, claims josejwt.Claims, scope string) string {
+	t.Helper()
+	return mintTokenWithClaims(t, priv, kid, typ, claims, map[string]interface{}{"scope": scope, "client_id": "tinfoil-chat"})
+}
+
+func mintTokenWithClaims(t *testing.T, priv ed25519.PrivateKey, kid, typ string, claims josejwt.Claims, extra map[string]interface{}) string {
 	t.Helper()
 	signingKey := jose.JSONWebKey{Key: priv, KeyID: kid, Algorithm: string(jose.EdDSA)}
 	opts := &jose.SignerOptions{}
@@ -34,7 +39,7 @@ func mintToken(t *testing.T, priv ed25519.PrivateKey, kid, typ string, claims jo
 	}
 	token, err := josejwt.Signed(signer).
 		Claims(claims).
-		Claims(map[string]interface{}{"scope": scope, "client_id": "tinfoil-chat"}).
+		Claims(extra).
 		Serialize()
 	if err != nil {
 		t.Fatalf("serialize: %v", err)
@@ -98,7 +103,7 @@ func TestValidateAcceptsValidToken(t *testing.T) {
 	v := newTestValidator(t, srv.URL)
 
 	token := mintToken(t, priv, testKID, "at+jwt", validClaims(time.Now()), RequiredScope)
-	if err := v.Validate(chatRequest(token)); err != nil {
+	if _, err := v.Validate(chatRequest(token)); err != nil {
 		t.Fatalf("expected valid token, got %v", err)
 	}
 }
@@ -109,7 +114,7 @@ func TestValidateFallsThroughForOpaqueKey(t *testing.T) {
 	defer srv.Close()
 	v := newTestValidator(t, srv.URL)
 
-	err := v.Validate(key.Request{APIKey: "chat_abcdef"})
+	_, err := v.Validate(key.Request{APIKey: "chat_abcdef"})
 	if !errors.Is(err, key.ErrUnsupportedToken) {
 		t.Fatalf("expected ErrUnsupportedToken, got %v", err)
 	}
@@ -121,7 +126,7 @@ func TestValidateFallsThroughForDottedOpaqueKey(t *testing.T) {
 	defer srv.Close()
 	v := newTestValidator(t, srv.URL)
 
-	err := v.Validate(key.Request{APIKey: "opaque.with.dots"})
+	_, err := v.Validate(key.Request{APIKey: "opaque.with.dots"})
 	if !errors.Is(err, key.ErrUnsupportedToken) {
 		t.Fatalf("expected ErrUnsupportedToken, got %v", err)
 	}
@@ -136,7 +141,8 @@ func TestValidateRejectsWrongAudience(t *testing.T) {
 	claims := validClaims(time.Now())
 	claims.Audience = josejwt.Audience{"https://example.com"}
 	token := mintToken(t, priv, testKID, "at+jwt", claims, RequiredScope)
-	expectStatus(t, v.Validate(chatRequest(token)), http.StatusUnauthorized)
+	_, err := v.Validate(chatRequest(token))
+	expectStatus(t, err, http.StatusUnauthorized)
 }
 
 func TestValidateRejectsExpired(t *testing.T) {
@@ -146,7 +152,8 @@ func TestValidateRejectsExpired(t *testing.T) {
 	v := newTestValidator(t, srv.URL)
 
 	token := mintToken(t, priv, testKID, "at+jwt", validClaims(time.Now().Add(-time.Hour)), RequiredScope)
-	expectStatus(t, v.Validate(chatRequest(token)), http.StatusUnauthorized)
+	_, err := v.Validate(chatRequest(token))
+	expectStatus(t, err, http.StatusUnauthorized)
 }
 
 func TestValidateRejectsMissingExpiration(t *testing.T) {
@@ -158,7 +165,8 @@ func TestValidateRejectsMissingExpiration(t *testing.T) {
 	claims := validClaims(time.Now())
 	claims.Expiry = nil
 	token := mintToken(t, priv, testKID, "at+jwt", claims, RequiredScope)
-	expectStatus(t, v.Validate(chatRequest(token)), http.StatusUnauthorized)
+	_, err := v.Validate(chatRequest(token))
+	expectStatus(t, err, http.StatusUnauthorized)
 }
 
 func TestValidateRejectsMissingScope(t *testing.T) {
@@ -168,7 +176,8 @@ func TestValidateRejectsMissingScope(t *testing.T) {
 	v := newTestValidator(t, srv.URL)
 
 	token := mintToken(t, priv, testKID, "at+jwt", validClaims(time.Now()), "models:read")
-	expectStatus(t, v.Validate(chatRequest(token)), http.StatusForbidden)
+	_, err := v.Validate(chatRequest(token))
+	expectStatus(t, err, http.StatusForbidden)
 }
 
 func TestValidateRejectsWrongIssuer(t *testing.T) {
@@ -180,7 +189,8 @@ func TestValidateRejectsWrongIssuer(t *testing.T) {
 	claims := validClaims(time.Now())
 	claims.Issuer = "https://evil.example.com"
 	token := mintToken(t, priv, testKID, "at+jwt", claims, RequiredScope)
-	expectStatus(t, v.Validate(chatRequest(token)), http.StatusUnauthorized)
+	_, err := v.Validate(chatRequest(token))
+	expectStatus(t, err, http.StatusUnauthorized)
 }
 
 func TestValidateFallsThroughForWrongType(t *testing.T) {
@@ -190,7 +200,7 @@ func TestValidateFallsThroughForWrongType(t *testing.T) {
 	v := newTestValidator(t, srv.URL)
 
 	token := mintToken(t, priv, testKID, "JWT", validClaims(time.Now()), RequiredScope)
-	err := v.Validate(chatRequest(token))
+	_, err := v.Validate(chatRequest(token))
 	if !errors.Is(err, key.ErrUnsupportedToken) {
 		t.Fatalf("expected ErrUnsupportedToken, got %v", err)
 	}
@@ -206,7 +216,8 @@ func TestValidateRejectsForeignSignature(t *testing.T) {
 	// verification against the published key must fail.
 	_, foreignPriv, _ := ed25519.GenerateKey(nil)
 	token := mintToken(t, foreignPriv, testKID, "at+jwt", validClaims(time.Now()), RequiredScope)
-	expectStatus(t, v.Validate(chatRequest(token)), http.StatusUnauthorized)
+	_, err := v.Validate(chatRequest(token))
+	expectStatus(t, err, http.StatusUnauthorized)
 }
 
 func TestValidateAcceptsApplicationPrefixType(t *testing.T) {
@@ -217,7 +228,7 @@ func TestValidateAcceptsApplicationPrefixType(t *testing.T) {
 
 	// RFC 9068 / RFC 7515 permit the media type with an "application/" prefix.
 	token := mintToken(t, priv, testKID, "application/at+jwt", validClaims(time.Now()), RequiredScope)
-	if err := v.Validate(chatRequest(token)); err != nil {
+	if _, err := v.Validate(chatRequest(token)); err != nil {
 		t.Fatalf("expected application/at+jwt to be accepted, got %v", err)
 	}
 }
@@ -231,7 +242,7 @@ func TestValidateAcceptsNonChatPath(t *testing.T) {
 	// The inference:api scope authorizes every inference endpoint, not just
 	// chat completions, so a non-chat path must validate.
 	token := mintToken(t, priv, testKID, "at+jwt", validClaims(time.Now()), RequiredScope)
-	if err := v.Validate(key.Request{APIKey: token, Path: "/v1/embeddings"}); err != nil {
+	if _, err := v.Validate(key.Request{APIKey: token, Path: "/v1/embeddings"}); err != nil {
 		t.Fatalf("expected non-chat path to be accepted, got %v", err)
 	}
 }
@@ -310,7 +321,7 @@ func TestValidateRefreshesUnknownKidAfterRecentSuccess(t *testing.T) {
 	useSecond.Store(true)
 
 	token := mintToken(t, secondPriv, "test-key-2", "at+jwt", validClaims(time.Now()), RequiredScope)
-	if err := v.Validate(chatRequest(token)); err != nil {
+	if _, err := v.Validate(chatRequest(token)); err != nil {
 		t.Fatalf("expected unknown kid to refresh immediately, got %v", err)
 	}
 }
@@ -344,7 +355,7 @@ func TestNewValidatorRecoversWhenJWKSStartsUnavailable(t *testing.T) {
 	v := newTestValidator(t, srv.URL)
 
 	token := mintToken(t, priv, testKID, "at+jwt", validClaims(time.Now()), RequiredScope)
-	if err := v.Validate(chatRequest(token)); err == nil {
+	if _, err := v.Validate(chatRequest(token)); err == nil {
 		t.Fatal("expected rejection while no signing keys are cached")
 	}
 
@@ -355,7 +366,51 @@ func TestNewValidatorRecoversWhenJWKSStartsUnavailable(t *testing.T) {
 	v.keys.lastAttempt = time.Now().Add(-2 * minRefreshInterval)
 	v.keys.mu.Unlock()
 
-	if err := v.Validate(chatRequest(token)); err != nil {
+	if _, err := v.Validate(chatRequest(token)); err != nil {
 		t.Fatalf("expected token to validate after JWKS became available, got %v", err)
 	}
 }
+
+func TestValidateRequiresRouteScope(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	srv := jwksServer(t, pub, testKID)
+	defer srv.Close()
+	v := newTestValidator(t, srv.URL)
+
+	token := mintToken(t, priv, testKID, "at+jwt", validClaims(time.Now()), RequiredScope+" inference:batch")
+	if _, err := v.Validate(key.Request{APIKey: token, Path: "/v1/batches", Scope: "inference:batch"}); err != nil {
+		t.Fatalf("token with the route scope rejected: %v", err)
+	}
+	_, err := v.Validate(key.Request{APIKey: token, Path: "/v1/admin", Scope: "inference:admin"})
+	expectStatus(t, err, http.StatusForbidden)
+
+	// The default scope does not stand in for a route's own scope.
+	token = mintToken(t, priv, testKID, "at+jwt", validClaims(time.Now()), RequiredScope)
+	_, err = v.Validate(key.Request{APIKey: token, Path: "/v1/batches", Scope: "inference:batch"})
+	expectStatus(t, err, http.StatusForbidden)
+}
+
+func TestValidateReturnsClaims(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	srv := jwksServer(t, pub, testKID)
+	defer srv.Close()
+	v := newTestValidator(t, srv.URL)
+
+	token := mintTokenWithClaims(t, priv, testKID, "at+jwt", validClaims(time.Now()), map[string]interface{}{
+		"scope":     RequiredScope,
+		"client_id": "tinfoil-chat",
+		"tenant":    "org_1",
+		"tier":      "pro",
+		"models":    []string{"llama", "qwen"},
+	})
+	claims, err := v.Validate(chatRequest(token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "user_1" || claims.ClientID != "tinfoil-chat" || claims.Tenant != "org_1" || claims.Tier != "pro" {
+		t.Fatalf("claims = %+v", claims)
+	}
+	if len(claims.Models) != 2 || claims.Models[1] != "qwen" || len(claims.Scopes) != 1 || claims.Scopes[0] != RequiredScope {
+		t.Fatalf("claims = %+v", claims)
+	}
+}
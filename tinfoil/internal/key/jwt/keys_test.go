@@ -0,0 +1,81 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"encoding/base64"
+	"net/http"
+	"testing"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+)
+
+func thumbprint(t *testing.T, pub ed25519.PublicKey) string {
+	t.Helper()
+	sum, err := (&jose.JSONWebKey{Key: pub}).Thumbprint(crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(sum)
+}
+
+func TestPinKeysRejectsUnpinnedKeys(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	srv := jwksServer(t, pub, testKID)
+	defer srv.Close()
+	token := mintToken(t, priv, testKID, "at+jwt", validClaims(time.Now()), RequiredScope)
+
+	otherPub, _, _ := ed25519.GenerateKey(nil)
+	v := newTestValidator(t, srv.URL)
+	v.PinKeys(nil, []string{thumbprint(t, otherPub)})
+	_, err := v.Validate(chatRequest(token))
+	expectStatus(t, err, http.StatusUnauthorized)
+
+	v = newTestValidator(t, srv.URL)
+	v.PinKeys([]string{"other-kid"}, nil)
+	_, err = v.Validate(chatRequest(token))
+	expectStatus(t, err, http.StatusUnauthorized)
+
+	v = newTestValidator(t, srv.URL)
+	v.PinKeys([]string{testKID}, []string{thumbprint(t, pub)})
+	if _, err := v.Validate(chatRequest(token)); err != nil {
+		t.Fatalf("token signed by a pinned key rejected: %v", err)
+	}
+}
+
+func TestPinnedRefreshKeepsOnlyPinnedKeys(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(nil)
+	srv := jwksServer(t, pub, testKID)
+	defer srv.Close()
+
+	keys := &signingKeys{url: srv.URL, client: srv.Client(), pins: &keyPins{keyIDs: map[string]bool{"other-kid": true}}}
+	if err := keys.refresh(t.Context()); err == nil {
+		t.Fatal("refresh accepted a JWKS without pinned keys")
+	}
+	if _, ok := keys.lookup(testKID); ok {
+		t.Fatal("unpinned key cached")
+	}
+}
+
+func TestOfflineValidator(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	set := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: pub, KeyID: testKID, Algorithm: string(jose.EdDSA)}}}
+	v, err := NewOfflineValidator(set, testIssuer, AccessTokenAudience, RequiredScope)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := mintToken(t, priv, testKID, "at+jwt", validClaims(time.Now()), RequiredScope)
+	if _, err := v.Validate(chatRequest(token)); err != nil {
+		t.Fatalf("token signed by an embedded key rejected: %v", err)
+	}
+	// An unknown kid must not trigger a fetch; there is nowhere to fetch from.
+	_, err = v.Validate(chatRequest(mintToken(t, priv, "unknown", "at+jwt", validClaims(time.Now()), RequiredScope)))
+	expectStatus(t, err, http.StatusUnauthorized)
+
+	private := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: priv, KeyID: testKID}}}
+	if _, err := NewOfflineValidator(private, testIssuer, AccessTokenAudience, RequiredScope); err == nil {
+		t.Fatal("private key accepted as an embedded signing key")
+	}
+}
@@ -0,0 +1,223 @@
+package jwt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// maxRevocationResponseBytes bounds a single feed response, and the
+	// entry limits bound the in-memory list, so a misbehaving feed cannot
+	// exhaust enclave memory.
+	maxRevocationResponseBytes = 64 << 20
+	maxRevokedTokens           = 1 << 20
+	maxRevokedSubjects         = 1 << 17
+)
+
+var (
+	errTokenRevoked       = errors.New("access token revoked")
+	errRevocationStale    = errors.New("revocation feed is stale")
+	errRevocationFeedFull = errors.New("revocation feed exceeds entry limit")
+)
+
+// revocationFeed is one response of the control plane's revocation feed. A
+// request carries the cursor of the previous response as the "since" query
+// parameter and receives the revocations added after it; Reset replaces the
+// list instead, and is what the first request without a cursor receives.
+type revocationFeed struct {
+	Cursor   string              `json:"cursor"`
+	Reset    bool                `json:"reset"`
+	Tokens   []revokedToken      `json:"revoked_tokens"`
+	Subjects []revokedSubjectRef `json:"revoked_subjects"`
+}
+
+// revokedToken revokes one token by jti. Expiry is the token's exp, after
+// which the entry is dropped because the token is rejected anyway.
+type revokedToken struct {
+	ID     string `json:"jti"`
+	Expiry int64  `json:"exp"`
+}
+
+// revokedSubjectRef revokes every token of a subject issued before
+// RevokedBefore, for example after a password reset or account suspension.
+type revokedSubjectRef struct {
+	Subject       string `json:"sub"`
+	RevokedBefore int64  `json:"revoked_before"`
+}
+
+// revocations caches the revocation list and follows the feed incrementally.
+type revocations struct {
+	url          string
+	client       *http.Client
+	maxStaleness time.Duration
+	failClosed   bool
+	now          func() time.Time
+
+	mu       sync.RWMutex
+	cursor   string
+	tokens   map[string]time.Time
+	subjects map[string]time.Time
+	synced   time.Time
+	stale    bool
+}
+
+func newRevocations(feedURL string, maxStaleness time.Duration, failClosed bool) *revocations {
+	r := &revocations{
+		url:          feedURL,
+		client:       &http.Client{Timeout: fetchTimeout},
+		maxStaleness: maxStaleness,
+		failClosed:   failClosed,
+		now:          time.Now,
+		tokens:       make(map[string]time.Time),
+		subjects:     make(map[string]time.Time),
+	}
+	if err := r.refresh(context.Background()); err != nil {
+		log.Printf("Warning: initial revocation feed fetch failed: %v", err)
+	}
+	return r
+}
+
+func (r *revocations) refresh(ctx context.Context) error {
+	r.mu.RLock()
+	cursor := r.cursor
+	r.mu.RUnlock()
+
+	feedURL, err := url.Parse(r.url)
+	if err != nil {
+		return fmt.Errorf("parsing revocation feed url: %w", err)
+	}
+	if cursor != "" {
+		query := feedURL.Query()
+		query.Set("since", cursor)
+		feedURL.RawQuery = query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, feedURL.String(), nil)
+	if err != nil {
+		return fmt.Errorf("building revocation feed request: %w", err)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetching revocation feed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching revocation feed: unexpected status %d", resp.StatusCode)
+	}
+	var feed revocationFeed
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxRevocationResponseBytes)).Decode(&feed); err != nil {
+		return fmt.Errorf("decoding revocation feed: %w", err)
+	}
+	if feed.Cursor == "" {
+		return fmt.Errorf("decoding revocation feed: missing cursor")
+	}
+	if cursor == "" && !feed.Reset {
+		return fmt.Errorf("decoding revocation feed: first response is not a reset")
+	}
+	return r.apply(feed)
+}
+
+func (r *revocations) apply(feed revocationFeed) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	tokens, subjects := r.tokens, r.subjects
+	if feed.Reset {
+		tokens = make(map[string]time.Time, len(feed.Tokens))
+		subjects = make(map[string]time.Time, len(feed.Subjects))
+	} else {
+		tokens = cloneTimes(tokens)
+		subjects = cloneTimes(subjects)
+	}
+	for id, expiry := range tokens {
+		if now.After(expiry) {
+			delete(tokens, id)
+		}
+	}
+	for _, token := range feed.Tokens {
+		expiry := time.Unix(token.Expiry, 0)
+		if token.ID != "" && now.Before(expiry) {
+			tokens[token.ID] = expiry
+		}
+	}
+	for _, subject := range feed.Subjects {
+		before := time.Unix(subject.RevokedBefore, 0)
+		if subject.Subject != "" && before.After(subjects[subject.Subject]) {
+			subjects[subject.Subject] = before
+		}
+	}
+	if len(tokens) > maxRevokedTokens || len(subjects) > maxRevokedSubjects {
+		return errRevocationFeedFull
+	}
+
+	r.tokens, r.subjects = tokens, subjects
+	r.cursor = feed.Cursor
+	r.synced = now
+	if r.stale {
+		log.Printf("Revocation feed caught up")
+		r.stale = false
+	}
+	return nil
+}
+
+func cloneTimes(m map[string]time.Time) map[string]time.Time {
+	clone := make(map[string]time.Time, len(m))
+	for k, v := range m {
+		clone[k] = v
+	}
+	return clone
+}
+
+// check reports whether a token with the given claims may be accepted
+// locally. A revoked token yields errTokenRevoked. A list older than the
+// staleness limit yields errRevocationStale if the feed fails closed, and is
+// otherwise trusted with a warning.
+func (r *revocations) check(subject, id string, issuedAt time.Time) error {
+	r.mu.RLock()
+	_, revoked := r.tokens[id]
+	before, subjectRevoked := r.subjects[subject]
+	synced, stale := r.synced, r.stale
+	r.mu.RUnlock()
+
+	if revoked || (subjectRevoked && issuedAt.Before(before)) {
+		return errTokenRevoked
+	}
+	if r.maxStaleness > 0 && r.now().Sub(synced) > r.maxStaleness {
+		if !stale {
+			r.markStale()
+		}
+		if r.failClosed {
+			return errRevocationStale
+		}
+	}
+	return nil
+}
+
+func (r *revocations) markStale() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.stale {
+		r.stale = true
+		log.Printf("Warning: revocation feed has not synced since %v", r.synced)
+	}
+}
+
+func (r *revocations) startBackgroundRefresh() {
+	go func() {
+		ticker := time.NewTicker(refreshInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := r.refresh(context.Background()); err != nil {
+				log.Printf("Warning: periodic revocation feed refresh failed: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,119 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"tinfoil/internal/key"
+)
+
+// feedServer serves a scripted revocation feed: the response for each cursor
+// value ("" for the first request).
+type feedServer struct {
+	mu        sync.Mutex
+	responses map[string]revocationFeed
+	requests  []string
+}
+
+func (f *feedServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	since := r.URL.Query().Get("since")
+	f.requests = append(f.requests, since)
+	feed, ok := f.responses[since]
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(feed)
+}
+
+func TestValidateRejectsRevokedTokens(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	srv := jwksServer(t, pub, testKID)
+	defer srv.Close()
+
+	now := time.Now()
+	exp := now.Add(time.Hour).Unix()
+	feed := &feedServer{responses: map[string]revocationFeed{
+		"":   {Cursor: "c1", Reset: true, Tokens: []revokedToken{{ID: "jti-revoked", Expiry: exp}}},
+		"c1": {Cursor: "c2", Subjects: []revokedSubjectRef{{Subject: "user_2", RevokedBefore: now.Unix()}}},
+	}}
+	feedSrv := httptest.NewServer(feed)
+	defer feedSrv.Close()
+
+	v := newTestValidator(t, srv.URL)
+	v.revocations = newRevocations(feedSrv.URL, 0, false)
+
+	claims := validClaims(now)
+	claims.ID = "jti-revoked"
+	_, err := v.Validate(chatRequest(mintToken(t, priv, testKID, "at+jwt", claims, RequiredScope)))
+	expectStatus(t, err, http.StatusUnauthorized)
+
+	// The second fetch is incremental and adds a subject revocation without
+	// dropping the token revoked by the first.
+	if err := v.revocations.refresh(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if got := feed.requests; len(got) != 2 || got[1] != "c1" {
+		t.Fatalf("feed requests = %q, want the first cursor on the second request", got)
+	}
+	_, err = v.Validate(chatRequest(mintToken(t, priv, testKID, "at+jwt", claims, RequiredScope)))
+	expectStatus(t, err, http.StatusUnauthorized)
+
+	old := validClaims(now.Add(-time.Minute))
+	old.Subject = "user_2"
+	_, err = v.Validate(chatRequest(mintToken(t, priv, testKID, "at+jwt", old, RequiredScope)))
+	expectStatus(t, err, http.StatusUnauthorized)
+
+	fresh := validClaims(now.Add(time.Second))
+	fresh.Subject = "user_2"
+	if _, err := v.Validate(chatRequest(mintToken(t, priv, testKID, "at+jwt", fresh, RequiredScope))); err != nil {
+		t.Fatalf("token issued after the subject revocation rejected: %v", err)
+	}
+}
+
+func TestRevocationsDropExpiredTokens(t *testing.T) {
+	now := time.Now()
+	r := &revocations{now: func() time.Time { return now }, tokens: map[string]time.Time{}, subjects: map[string]time.Time{}}
+	if err := r.apply(revocationFeed{Cursor: "c1", Reset: true, Tokens: []revokedToken{
+		{ID: "live", Expiry: now.Add(time.Minute).Unix()},
+		{ID: "expired", Expiry: now.Add(-time.Minute).Unix()},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(2 * time.Minute)
+	if err := r.apply(revocationFeed{Cursor: "c2"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.tokens) != 0 {
+		t.Fatalf("revocation list still holds %d tokens past their expiry", len(r.tokens))
+	}
+}
+
+func TestValidateStaleRevocationFeed(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	srv := jwksServer(t, pub, testKID)
+	defer srv.Close()
+
+	for _, failClosed := range []bool{false, true} {
+		v := newTestValidator(t, srv.URL)
+		// The feed never answers, so the list never syncs.
+		v.revocations = newRevocations("http://127.0.0.1:1/revocations", time.Minute, failClosed)
+		token := mintToken(t, priv, testKID, "at+jwt", validClaims(time.Now()), RequiredScope)
+
+		_, err := v.Validate(chatRequest(token))
+		if failClosed && !errors.Is(err, key.ErrUnsupportedToken) {
+			t.Fatalf("fail-closed with a stale feed: err = %v, want ErrUnsupportedToken", err)
+		}
+		if !failClosed && err != nil {
+			t.Fatalf("fail-open with a stale feed: err = %v", err)
+		}
+	}
+}
@@ -1,21 +1,76 @@
 package key
 
 import (
+	"context"
 	"errors"
 	"net/http"
+	"slices"
 )
 
 // Request is the payload sent to the control plane for API key validation.
 // Domain, RequestedHost, and Path are optional policy inputs for the control plane.
+// Domain is the node's DOMAIN or the domain alias the requested host matched,
+// so one enclave can serve several tenants.
+// Scope is the OAuth scope the route requires; empty means the validator's
+// default.
 type Request struct {
 	APIKey        string `json:"api_key"`
 	Domain        string `json:"domain,omitempty"`
 	RequestedHost string `json:"requested_host,omitempty"`
 	Path          string `json:"path,omitempty"`
+	Scope         string `json:"scope,omitempty"`
+
+	// RFC 9449 DPoP inputs. DPoPScheme reports that the credential was sent
+	// with the DPoP authorization scheme rather than Bearer, DPoPProof is the
+	// DPoP header, and Method and URL are what the proof must be bound to.
+	// RequireDPoP rejects credentials that are not sender-constrained. They
+	// are checked locally and never sent to the control plane.
+	DPoPScheme  bool   `json:"-"`
+	DPoPProof   string `json:"-"`
+	Method      string `json:"-"`
+	URL         string `json:"-"`
+	RequireDPoP bool   `json:"-"`
+}
+
+// Claims describes the caller behind an accepted credential so that later
+// middleware can rate limit, restrict models and attribute usage per caller
+// rather than per raw API key.
+type Claims struct {
+	Subject  string
+	ClientID string
+	Tenant   string
+	Tier     string
+	Scopes   []string
+	// Models lists the models the caller may use; nil allows any model.
+	Models []string
+	// DPoPKey is the JWK thumbprint of the key the credential is bound to
+	// and was proven with, or "" for an unbound credential.
+	DPoPKey string
+}
+
+// HasScope reports whether the claims grant scope. Nil claims, as returned
+// for opaque keys, grant none.
+func (c *Claims) HasScope(scope string) bool {
+	return c != nil && slices.Contains(c.Scopes, scope)
 }
 
+// Validator accepts or rejects a credential. On success it returns the
+// caller's claims, or nil when the credential carries none (opaque keys).
 type Validator interface {
-	Validate(req Request) error
+	Validate(req Request) (*Claims, error)
+}
+
+type claimsKey struct{}
+
+// NewContext returns a copy of ctx carrying the validated claims.
+func NewContext(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+// FromContext returns the claims stored by NewContext, if any.
+func FromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(*Claims)
+	return claims, ok && claims != nil
 }
 
 // ErrUnsupportedToken signals that a Validator cannot handle the presented
@@ -44,13 +99,14 @@ func NewChain(validators ...Validator) *Chain {
 	return &Chain{validators: validators}
 }
 
-func (c *Chain) Validate(req Request) error {
+func (c *Chain) Validate(req Request) (*Claims, error) {
 	var err error
 	for _, v := range c.validators {
-		err = v.Validate(req)
+		var claims *Claims
+		claims, err = v.Validate(req)
 		if !errors.Is(err, ErrUnsupportedToken) {
-			return err
+			return claims, err
 		}
 	}
-	return err
+	return nil, err
 }
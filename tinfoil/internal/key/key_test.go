@@ -11,11 +11,11 @@ type stubValidator struct {
 	called *int
 }
 
-func (s stubValidator) Validate(Request) error {
+func (s stubValidator) Validate(Request) (*Claims, error) {
 	if s.called != nil {
 		*s.called++
 	}
-	return s.err
+	return nil, s.err
 }
 
 func TestChainFallsThroughOnUnsupported(t *testing.T) {
@@ -24,7 +24,7 @@ func TestChainFallsThroughOnUnsupported(t *testing.T) {
 		stubValidator{err: ErrUnsupportedToken, called: &firstCalls},
 		stubValidator{err: nil, called: &secondCalls},
 	)
-	if err := chain.Validate(Request{APIKey: "x"}); err != nil {
+	if _, err := chain.Validate(Request{APIKey: "x"}); err != nil {
 		t.Fatalf("expected success, got %v", err)
 	}
 	if firstCalls != 1 || secondCalls != 1 {
@@ -38,7 +38,7 @@ func TestChainReturnsValidationErrorImmediately(t *testing.T) {
 		stubValidator{err: &ValidationError{StatusCode: http.StatusUnauthorized}},
 		stubValidator{err: nil, called: &secondCalls},
 	)
-	err := chain.Validate(Request{APIKey: "x"})
+	_, err := chain.Validate(Request{APIKey: "x"})
 	var ve *ValidationError
 	if !errors.As(err, &ve) || ve.StatusCode != http.StatusUnauthorized {
 		t.Fatalf("expected 401 ValidationError, got %v", err)
@@ -54,7 +54,7 @@ func TestChainShortCircuitsOnSuccess(t *testing.T) {
 		stubValidator{err: nil},
 		stubValidator{err: ErrUnsupportedToken, called: &secondCalls},
 	)
-	if err := chain.Validate(Request{APIKey: "x"}); err != nil {
+	if _, err := chain.Validate(Request{APIKey: "x"}); err != nil {
 		t.Fatalf("expected success, got %v", err)
 	}
 	if secondCalls != 0 {
@@ -28,23 +28,23 @@ func NewValidator(server string) (*Validator, error) {
 	}, nil
 }
 
-func (v *Validator) Validate(req key.Request) error {
+func (v *Validator) Validate(req key.Request) (*key.Claims, error) {
 	body, err := json.Marshal(req)
 	if err != nil {
-		return fmt.Errorf("marshalling validation request: %w", err)
+		return nil, fmt.Errorf("marshalling validation request: %w", err)
 	}
 
 	resp, err := v.client.Post(v.server, "application/json", bytes.NewReader(body))
 	if err != nil {
-		return fmt.Errorf("validation request failed: %w", err)
+		return nil, fmt.Errorf("validation request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusOK {
-		return nil
+		return nil, nil
 	}
 
-	return &key.ValidationError{
+	return nil, &key.ValidationError{
 		StatusCode: resp.StatusCode,
 	}
 }
@@ -2,6 +2,7 @@ package metrics
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -59,8 +60,62 @@ var (
 		},
 		baseLabels,
 	)
+
+	ehbpDowngradeCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tfshim_ehbp_downgrade_attempts_total",
+			Help: "Plaintext requests rejected on routes that require EHBP",
+		},
+		[]string{"route"},
+	)
+
+	// The clock gauges are vectors without labels so they stay absent
+	// until the shim checks the time.
+	clockOffsetGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tfshim_clock_offset_seconds",
+			Help: "Roughtime time minus the local clock at the last measurement",
+		},
+		nil,
+	)
+
+	clockCheckOKGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tfshim_clock_check_ok",
+			Help: "Whether the last secure time check was within the skew limit (1) or not (0)",
+		},
+		nil,
+	)
+
+	clockCheckTimestampGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tfshim_clock_check_timestamp_seconds",
+			Help: "Unix time of the last secure time check",
+		},
+		nil,
+	)
 )
 
+// RecordEHBPDowngrade counts a plaintext request rejected on route, the
+// configured pattern it matched.
+func RecordEHBPDowngrade(route string) {
+	ehbpDowngradeCounter.WithLabelValues(route).Inc()
+}
+
+// RecordClockCheck publishes a secure time check. measured is false when
+// too few servers answered to measure an offset.
+func RecordClockCheck(offset time.Duration, measured, ok bool) {
+	if measured {
+		clockOffsetGauge.WithLabelValues().Set(offset.Seconds())
+	}
+	if ok {
+		clockCheckOKGauge.WithLabelValues().Set(1)
+	} else {
+		clockCheckOKGauge.WithLabelValues().Set(0)
+	}
+	clockCheckTimestampGauge.WithLabelValues().SetToCurrentTime()
+}
+
 // updatePrometheusMetrics updates all Prometheus metrics with the latest values
 func updatePrometheusMetrics(metrics *Metrics) {
 	// Reset all gauge vectors to remove stale label combinations
@@ -113,6 +168,10 @@ func HandlePrometheusMetrics(metadata *config.Metadata, metricsAPIKey string) ht
 		gpuMemUtilGauge,
 		cpuMemTotalGauge,
 		gpuMemTotalGauge,
+		ehbpDowngradeCounter,
+		clockOffsetGauge,
+		clockCheckOKGauge,
+		clockCheckTimestampGauge,
 	)
 	handler := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
 
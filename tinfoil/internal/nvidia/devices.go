@@ -60,25 +60,27 @@ var allowedCapabilityFiles = [...]string{
 }
 
 type devicePaths struct {
-	pciDevices   string
-	gpus         string
-	capabilities string
-	nvswitches   string
-	nvswitchMode string
-	nvlinkMode   string
-	procDevices  string
-	dev          string
+	pciDevices    string
+	gpus          string
+	capabilities  string
+	nvswitches    string
+	nvswitchMode  string
+	nvlinkMode    string
+	procDevices   string
+	dev           string
+	driverVersion string
 }
 
 var systemDevicePaths = devicePaths{
-	pciDevices:   "/sys/bus/pci/devices",
-	gpus:         "/proc/driver/nvidia/gpus",
-	capabilities: "/proc/driver/nvidia/capabilities",
-	nvswitches:   "/proc/driver/nvidia-nvswitch/devices",
-	nvswitchMode: "/proc/driver/nvidia-nvswitch/permissions",
-	nvlinkMode:   "/proc/driver/nvidia-nvlink/permissions",
-	procDevices:  "/proc/devices",
-	dev:          "/dev",
+	pciDevices:    "/sys/bus/pci/devices",
+	gpus:          "/proc/driver/nvidia/gpus",
+	capabilities:  "/proc/driver/nvidia/capabilities",
+	nvswitches:    "/proc/driver/nvidia-nvswitch/devices",
+	nvswitchMode:  "/proc/driver/nvidia-nvswitch/permissions",
+	nvlinkMode:    "/proc/driver/nvidia-nvlink/permissions",
+	procDevices:   "/proc/devices",
+	dev:           "/dev",
+	driverVersion: "/sys/module/nvidia/version",
 }
 
 type pciDevice struct {
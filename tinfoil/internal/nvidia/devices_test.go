@@ -17,14 +17,15 @@ func testDevicePaths(t *testing.T) devicePaths {
 	t.Helper()
 	root := t.TempDir()
 	paths := devicePaths{
-		pciDevices:   filepath.Join(root, "pci"),
-		gpus:         filepath.Join(root, "gpus"),
-		capabilities: filepath.Join(root, "capabilities"),
-		nvswitches:   filepath.Join(root, "nvswitches"),
-		nvswitchMode: filepath.Join(root, "nvswitch-permissions"),
-		nvlinkMode:   filepath.Join(root, "nvlink-permissions"),
-		procDevices:  filepath.Join(root, "devices"),
-		dev:          filepath.Join(root, "dev"),
+		pciDevices:    filepath.Join(root, "pci"),
+		gpus:          filepath.Join(root, "gpus"),
+		capabilities:  filepath.Join(root, "capabilities"),
+		nvswitches:    filepath.Join(root, "nvswitches"),
+		nvswitchMode:  filepath.Join(root, "nvswitch-permissions"),
+		nvlinkMode:    filepath.Join(root, "nvlink-permissions"),
+		procDevices:   filepath.Join(root, "devices"),
+		dev:           filepath.Join(root, "dev"),
+		driverVersion: filepath.Join(root, "nvidia-version"),
 	}
 	for _, path := range []string{paths.pciDevices, paths.gpus, paths.capabilities, paths.nvswitches, paths.dev} {
 		if err := os.MkdirAll(path, 0755); err != nil {
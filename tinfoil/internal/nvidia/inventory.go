@@ -0,0 +1,90 @@
+package nvidia
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// GPUInfo is what the driver reports about one GPU. Only PCIAddress is set
+// when the driver has not bound the GPU.
+type GPUInfo struct {
+	PCIAddress string `json:"pci_address"`
+	Model      string `json:"model,omitempty"`
+	UUID       string `json:"uuid,omitempty"`
+	VBIOS      string `json:"vbios,omitempty"`
+	Firmware   string `json:"firmware,omitempty"`
+}
+
+// Inventory lists the NVIDIA hardware in the guest and the loaded driver.
+type Inventory struct {
+	Driver     string    `json:"driver,omitempty"`
+	GPUs       []GPUInfo `json:"gpus"`
+	NVSwitches int       `json:"nvswitches"`
+}
+
+// ReadInventory reads the NVIDIA inventory from sysfs and the driver's
+// procfs, without NVML.
+func ReadInventory() (Inventory, error) {
+	return readInventory(systemDevicePaths)
+}
+
+func readInventory(paths devicePaths) (Inventory, error) {
+	devices, err := nvidiaPCIDevices(paths)
+	if err != nil {
+		return Inventory{}, err
+	}
+	inventory := Inventory{GPUs: []GPUInfo{}}
+	for _, device := range devices {
+		switch {
+		case device.class == pciClassNVSwitch:
+			inventory.NVSwitches++
+		case isGPUClass(device.class):
+			gpu, err := readGPUInfo(paths, device.name)
+			if err != nil {
+				return Inventory{}, err
+			}
+			inventory.GPUs = append(inventory.GPUs, gpu)
+		}
+	}
+	version, err := os.ReadFile(paths.driverVersion)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return Inventory{}, fmt.Errorf("read NVIDIA driver version: %w", err)
+	}
+	inventory.Driver = strings.TrimSpace(string(version))
+	return inventory, nil
+}
+
+func readGPUInfo(paths devicePaths, pciAddress string) (GPUInfo, error) {
+	gpu := GPUInfo{PCIAddress: pciAddress}
+	path := filepath.Join(paths.gpus, pciAddress, "information")
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return gpu, nil
+	}
+	if err != nil {
+		return GPUInfo{}, err
+	}
+	defer file.Close()
+
+	fields := map[string]*string{
+		"Model":        &gpu.Model,
+		"GPU UUID":     &gpu.UUID,
+		"Video BIOS":   &gpu.VBIOS,
+		"GPU Firmware": &gpu.Firmware,
+	}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if field, known := fields[strings.TrimSpace(key)]; ok && known {
+			*field = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return GPUInfo{}, fmt.Errorf("read %s: %w", path, err)
+	}
+	return gpu, nil
+}
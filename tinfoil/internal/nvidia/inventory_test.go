@@ -0,0 +1,34 @@
+package nvidia
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadInventoryUsesProcInformation(t *testing.T) {
+	paths := testDevicePaths(t)
+	addPCIFixture(t, paths, "0000:01:00.0", "0x10de", "0x030200", false)
+	addPCIFixture(t, paths, "0000:02:00.0", "0x10de", "0x030200", false)
+	addPCIFixture(t, paths, "0000:03:00.0", "0x10de", "0x068000", false)
+	addPCIFixture(t, paths, "0000:04:00.0", "0x1af4", "0x020000", false)
+	writeTestFile(t, filepath.Join(paths.gpus, "0000:01:00.0", "information"),
+		"Model: \t\t NVIDIA H100 80GB HBM3\nGPU UUID: \t GPU-0c1d2e3f\nVideo BIOS: \t 96.00.74.00.0d\nDevice Minor: \t 0\nGPU Firmware: \t 595.45.04\n")
+	writeTestFile(t, paths.driverVersion, "595.45.04\n")
+
+	got, err := readInventory(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Inventory{
+		Driver: "595.45.04",
+		GPUs: []GPUInfo{
+			{PCIAddress: "0000:01:00.0", Model: "NVIDIA H100 80GB HBM3", UUID: "GPU-0c1d2e3f", VBIOS: "96.00.74.00.0d", Firmware: "595.45.04"},
+			{PCIAddress: "0000:02:00.0"},
+		},
+		NVSwitches: 1,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("readInventory = %+v, want %+v", got, want)
+	}
+}
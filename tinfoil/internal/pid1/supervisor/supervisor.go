@@ -58,7 +58,7 @@ func (e Exit) Err() error {
 	case e.Status.Exited() && e.Status.ExitStatus() == 0:
 		return nil
 	case e.Status.Exited():
-		return fmt.Errorf("%s exited with status %d", identity, e.Status.ExitStatus())
+		return &ExitError{identity: identity, Code: e.Status.ExitStatus()}
 	case e.Status.Signaled():
 		return fmt.Errorf("%s killed by %s", identity, e.Status.Signal())
 	default:
@@ -66,6 +66,16 @@ func (e Exit) Err() error {
 	}
 }
 
+// ExitError is the error of a child that exited with a nonzero status.
+type ExitError struct {
+	identity string
+	Code     int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("%s exited with status %d", e.identity, e.Code)
+}
+
 type backendProcess interface {
 	pid() int
 	signal(syscall.Signal) error
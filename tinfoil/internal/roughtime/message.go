@@ -0,0 +1,123 @@
+package roughtime
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Message tags. A tag is four ASCII bytes read as a little-endian uint32.
+var (
+	tagSIG  = tag("SIG\x00")
+	tagNONC = tag("NONC")
+	tagPAD  = tag("PAD\xff")
+	tagPATH = tag("PATH")
+	tagSREP = tag("SREP")
+	tagCERT = tag("CERT")
+	tagINDX = tag("INDX")
+	tagROOT = tag("ROOT")
+	tagMIDP = tag("MIDP")
+	tagRADI = tag("RADI")
+	tagDELE = tag("DELE")
+	tagPUBK = tag("PUBK")
+	tagMINT = tag("MINT")
+	tagMAXT = tag("MAXT")
+)
+
+func tag(name string) uint32 {
+	return binary.LittleEndian.Uint32([]byte(name))
+}
+
+func tagName(t uint32) string {
+	return string(binary.LittleEndian.AppendUint32(nil, t))
+}
+
+// message is a Roughtime tag-value map. Values are multiples of four bytes
+// long.
+type message map[uint32][]byte
+
+// encode lays out the message as the tag count, the offset of every value
+// after the first, the tags in ascending order, and the values.
+func (m message) encode() []byte {
+	tags := make([]uint32, 0, len(m))
+	for t := range m {
+		tags = append(tags, t)
+	}
+	slices.Sort(tags)
+
+	out := binary.LittleEndian.AppendUint32(nil, uint32(len(tags)))
+	offset := 0
+	for _, t := range tags[:max(len(tags)-1, 0)] {
+		offset += len(m[t])
+		out = binary.LittleEndian.AppendUint32(out, uint32(offset))
+	}
+	for _, t := range tags {
+		out = binary.LittleEndian.AppendUint32(out, t)
+	}
+	for _, t := range tags {
+		out = append(out, m[t]...)
+	}
+	return out
+}
+
+func decode(data []byte) (message, error) {
+	if len(data) < 4 || len(data)%4 != 0 {
+		return nil, errors.New("message is not a multiple of four bytes")
+	}
+	count := int(binary.LittleEndian.Uint32(data))
+	if count == 0 {
+		return message{}, nil
+	}
+	// Bounds the header before it is sized, so a hostile count cannot
+	// overflow it.
+	if count > len(data)/8 {
+		return nil, fmt.Errorf("message claims %d tags in %d bytes", count, len(data))
+	}
+	header := 4 + 4*(count-1) + 4*count
+	values := data[header:]
+	offsets := make([]int, count+1)
+	for i := 1; i < count; i++ {
+		offsets[i] = int(binary.LittleEndian.Uint32(data[4*i:]))
+	}
+	offsets[count] = len(values)
+	m := make(message, count)
+	var previous uint32
+	for i := range count {
+		t := binary.LittleEndian.Uint32(data[4*count+4*i:])
+		if i > 0 && t <= previous {
+			return nil, errors.New("message tags are not in ascending order")
+		}
+		previous = t
+		start, end := offsets[i], offsets[i+1]
+		if start%4 != 0 || start > end || end > len(values) {
+			return nil, fmt.Errorf("message value %s has an invalid offset", tagName(t))
+		}
+		m[t] = values[start:end]
+	}
+	return m, nil
+}
+
+// fixed returns the value of t, which must be size bytes long.
+func (m message) fixed(t uint32, size int) ([]byte, error) {
+	value, ok := m[t]
+	if !ok {
+		return nil, fmt.Errorf("missing %s", tagName(t))
+	}
+	if size >= 0 && len(value) != size {
+		return nil, fmt.Errorf("%s is %d bytes, want %d", tagName(t), len(value), size)
+	}
+	return value, nil
+}
+
+func (m message) nested(t uint32) (message, error) {
+	value, err := m.fixed(t, -1)
+	if err != nil {
+		return nil, err
+	}
+	nested, err := decode(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", tagName(t), err)
+	}
+	return nested, nil
+}
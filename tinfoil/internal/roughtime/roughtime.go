@@ -0,0 +1,309 @@
+// Package roughtime fetches authenticated time from Roughtime servers. It
+// speaks the original Google Roughtime protocol: a server signs the time
+// together with the client's nonce, so a host relaying the UDP traffic can
+// delay answers but cannot forge or replay them. Servers that only speak
+// the IETF drafts do not answer it; roughenough-based servers such as
+// roughtime.int08h.com still serve the original protocol alongside them.
+package roughtime
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	nonceSize   = 64
+	requestSize = 1024
+	maxResponse = 4096
+
+	// QueryTimeout bounds a query whose context has no earlier deadline.
+	QueryTimeout = 5 * time.Second
+)
+
+var (
+	delegationContext = []byte("RoughTime v1 delegation signature--\x00")
+	responseContext   = []byte("RoughTime v1 response signature\x00")
+)
+
+// Server is a Roughtime server and its long-term Ed25519 public key.
+type Server struct {
+	Name      string
+	Address   string
+	PublicKey ed25519.PublicKey
+}
+
+// Sample is one server's verified answer. Offset is the server's time minus
+// the local clock at the midpoint of the round trip, so a positive offset
+// means the local clock is behind.
+type Sample struct {
+	Server   string
+	Midpoint time.Time
+	Radius   time.Duration
+	RTT      time.Duration
+	Offset   time.Duration
+}
+
+// Uncertainty bounds how far Offset may be from the true offset: the server
+// only vouches for Midpoint within Radius, and the answer may have been
+// produced anywhere within the round trip.
+func (s Sample) Uncertainty() time.Duration {
+	return s.RTT/2 + s.Radius
+}
+
+// Query asks server for the time and verifies its signed answer.
+func Query(ctx context.Context, server Server) (Sample, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, QueryTimeout)
+		defer cancel()
+	}
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return Sample{}, err
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", server.Address)
+	if err != nil {
+		return Sample{}, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	sent := time.Now()
+	if _, err := conn.Write(request(nonce)); err != nil {
+		return Sample{}, err
+	}
+	buf := make([]byte, maxResponse)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return Sample{}, err
+	}
+	rtt := time.Since(sent)
+
+	midpoint, radius, err := verify(buf[:n], nonce, server.PublicKey)
+	if err != nil {
+		return Sample{}, err
+	}
+	return Sample{
+		Server:   server.Name,
+		Midpoint: midpoint,
+		Radius:   radius,
+		RTT:      rtt,
+		Offset:   midpoint.Sub(sent.Add(rtt / 2)),
+	}, nil
+}
+
+func request(nonce []byte) []byte {
+	m := message{tagNONC: nonce}
+	// The request is padded so it is never smaller than the response,
+	// which keeps servers from being used as amplifiers.
+	padding := requestSize - len(message{tagNONC: nonce, tagPAD: nil}.encode())
+	m[tagPAD] = bytes.Repeat([]byte{0xff}, padding)
+	return m.encode()
+}
+
+// verify checks the delegation certificate against the server's key, the
+// response signature against the delegated key, and that the nonce is in
+// the signed Merkle tree. It returns the signed midpoint and radius.
+func verify(response, nonce []byte, publicKey ed25519.PublicKey) (time.Time, time.Duration, error) {
+	top, err := decode(response)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	cert, err := top.nested(tagCERT)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	deleBytes, err := cert.fixed(tagDELE, -1)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	certSig, err := cert.fixed(tagSIG, ed25519.SignatureSize)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	if !ed25519.Verify(publicKey, append(slices.Clip(delegationContext), deleBytes...), certSig) {
+		return time.Time{}, 0, errors.New("delegation signature does not verify with the server key")
+	}
+	dele, err := cert.nested(tagDELE)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	delegatedKey, err := dele.fixed(tagPUBK, ed25519.PublicKeySize)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+
+	srepBytes, err := top.fixed(tagSREP, -1)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	sig, err := top.fixed(tagSIG, ed25519.SignatureSize)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	if !ed25519.Verify(delegatedKey, append(slices.Clip(responseContext), srepBytes...), sig) {
+		return time.Time{}, 0, errors.New("response signature does not verify with the delegated key")
+	}
+	srep, err := top.nested(tagSREP)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+
+	root, err := srep.fixed(tagROOT, sha512.Size)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	index, err := top.fixed(tagINDX, 4)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	path, err := top.fixed(tagPATH, -1)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	if !bytes.Equal(merkleRoot(nonce, binary.LittleEndian.Uint32(index), path), root) {
+		return time.Time{}, 0, errors.New("nonce is not in the signed Merkle tree")
+	}
+
+	midp, err := srep.fixed(tagMIDP, 8)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	radi, err := srep.fixed(tagRADI, 4)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	mint, err := dele.fixed(tagMINT, 8)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	maxt, err := dele.fixed(tagMAXT, 8)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	midpoint := binary.LittleEndian.Uint64(midp)
+	if midpoint < binary.LittleEndian.Uint64(mint) || midpoint > binary.LittleEndian.Uint64(maxt) {
+		return time.Time{}, 0, errors.New("midpoint is outside the delegation's validity")
+	}
+	return time.UnixMicro(int64(midpoint)), time.Duration(binary.LittleEndian.Uint32(radi)) * time.Microsecond, nil
+}
+
+// merkleRoot hashes the nonce's leaf up the tree along path, a sequence of
+// sibling hashes from the leaf. Bit i of index is set when the node at
+// level i is a right child.
+func merkleRoot(nonce []byte, index uint32, path []byte) []byte {
+	hash := hashNode(0x00, nonce)
+	for sibling := range slices.Chunk(path, sha512.Size) {
+		if index&1 == 0 {
+			hash = hashNode(0x01, hash, sibling)
+		} else {
+			hash = hashNode(0x01, sibling, hash)
+		}
+		index >>= 1
+	}
+	return hash
+}
+
+func hashNode(prefix byte, parts ...[]byte) []byte {
+	h := sha512.New()
+	h.Write([]byte{prefix})
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+// Policy decides whether the local clock is trustworthy.
+type Policy struct {
+	Servers []Server
+	// Quorum is how many servers must answer.
+	Quorum int
+	// MaxSkew is the largest offset tolerated, uncertainty included.
+	// Samples too uncertain to fit within it are discarded.
+	MaxSkew time.Duration
+}
+
+// Measurement is the clock offset the answering servers agree on.
+type Measurement struct {
+	// Offset is the median of the samples' offsets, so a single lying or
+	// delayed server cannot move it past the honest ones.
+	Offset time.Duration
+	// Uncertainty is the median of the samples' uncertainties.
+	Uncertainty time.Duration
+	Samples     []Sample
+	// Failures lists the servers that did not answer with a valid response
+	// or whose answer was too uncertain to use.
+	Failures []string
+}
+
+// ErrSkew reports a clock offset beyond the policy's MaxSkew.
+var ErrSkew = errors.New("clock skew exceeds the limit")
+
+// Check queries every server concurrently. It fails when fewer than
+// Quorum answer usably, and returns the measurement with an ErrSkew error
+// when the offset plus its uncertainty exceeds MaxSkew.
+func Check(ctx context.Context, policy Policy) (*Measurement, error) {
+	samples := make([]Sample, len(policy.Servers))
+	errs := make([]error, len(policy.Servers))
+	var wg sync.WaitGroup
+	for i, server := range policy.Servers {
+		wg.Go(func() {
+			samples[i], errs[i] = Query(ctx, server)
+		})
+	}
+	wg.Wait()
+
+	m := &Measurement{}
+	for i, server := range policy.Servers {
+		if errs[i] != nil {
+			m.Failures = append(m.Failures, fmt.Sprintf("%s: %v", server.Name, errs[i]))
+			continue
+		}
+		if uncertainty := samples[i].Uncertainty(); uncertainty > policy.MaxSkew {
+			m.Failures = append(m.Failures, fmt.Sprintf("%s: uncertainty %s exceeds the limit", server.Name, uncertainty.Round(time.Millisecond)))
+			continue
+		}
+		m.Samples = append(m.Samples, samples[i])
+	}
+	if len(m.Samples) < max(policy.Quorum, 1) {
+		return nil, fmt.Errorf("%d of %d Roughtime servers answered, need %d: %s",
+			len(m.Samples), len(policy.Servers), policy.Quorum, strings.Join(m.Failures, "; "))
+	}
+	offsets := make([]time.Duration, len(m.Samples))
+	uncertainties := make([]time.Duration, len(m.Samples))
+	for i, sample := range m.Samples {
+		offsets[i] = sample.Offset
+		uncertainties[i] = sample.Uncertainty()
+	}
+	m.Offset = median(offsets)
+	m.Uncertainty = median(uncertainties)
+	if m.Offset.Abs()+m.Uncertainty > policy.MaxSkew {
+		return m, fmt.Errorf("%w: clock is off by %s ± %s, limit %s", ErrSkew,
+			m.Offset.Round(time.Millisecond), m.Uncertainty.Round(time.Millisecond), policy.MaxSkew)
+	}
+	return m, nil
+}
+
+func median(values []time.Duration) time.Duration {
+	slices.Sort(values)
+	mid := len(values) / 2
+	if len(values)%2 == 0 {
+		return (values[mid-1] + values[mid]) / 2
+	}
+	return values[mid]
+}
@@ -0,0 +1,201 @@
+package roughtime
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testServer answers Roughtime requests with now+offset. Each answer is
+// signed as the second leaf of a two-leaf Merkle tree, so verification has
+// to walk a path.
+type testServer struct {
+	key     ed25519.PrivateKey
+	offset  time.Duration
+	corrupt func(message)
+}
+
+func startTestServer(t *testing.T, name string, offset time.Duration) (Server, *testServer) {
+	t.Helper()
+	publicKey, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	s := &testServer{key: key, offset: offset}
+	go func() {
+		buf := make([]byte, maxResponse)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if response := s.respond(buf[:n]); response != nil {
+				conn.WriteTo(response, addr)
+			}
+		}
+	}()
+	return Server{Name: name, Address: conn.LocalAddr().String(), PublicKey: publicKey}, s
+}
+
+func (s *testServer) respond(req []byte) []byte {
+	if len(req) < requestSize {
+		return nil
+	}
+	parsed, err := decode(req)
+	if err != nil {
+		return nil
+	}
+	nonce, err := parsed.fixed(tagNONC, nonceSize)
+	if err != nil {
+		return nil
+	}
+	delegatedPublic, delegated, _ := ed25519.GenerateKey(rand.Reader)
+	now := uint64(time.Now().Add(s.offset).UnixMicro())
+	dele := message{
+		tagPUBK: delegatedPublic,
+		tagMINT: binary.LittleEndian.AppendUint64(nil, now-uint64(time.Hour.Microseconds())),
+		tagMAXT: binary.LittleEndian.AppendUint64(nil, now+uint64(time.Hour.Microseconds())),
+	}.encode()
+	cert := message{
+		tagDELE: dele,
+		tagSIG:  ed25519.Sign(s.key, append(append([]byte{}, delegationContext...), dele...)),
+	}
+
+	sibling := hashNode(0x00, make([]byte, nonceSize))
+	root := hashNode(0x01, sibling, hashNode(0x00, nonce))
+	srep := message{
+		tagROOT: root,
+		tagMIDP: binary.LittleEndian.AppendUint64(nil, now),
+		tagRADI: binary.LittleEndian.AppendUint32(nil, 1_000_000),
+	}.encode()
+	response := message{
+		tagSIG:  ed25519.Sign(delegated, append(append([]byte{}, responseContext...), srep...)),
+		tagSREP: srep,
+		tagCERT: cert.encode(),
+		tagINDX: binary.LittleEndian.AppendUint32(nil, 1),
+		tagPATH: sibling,
+	}
+	if s.corrupt != nil {
+		s.corrupt(response)
+	}
+	return response.encode()
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	m := message{tagNONC: make([]byte, 64), tagPAD: []byte{1, 2, 3, 4}, tagSIG: make([]byte, 8)}
+	decoded, err := decode(m.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 3 || string(decoded[tagPAD]) != "\x01\x02\x03\x04" || len(decoded[tagNONC]) != 64 {
+		t.Fatalf("decoded = %v", decoded)
+	}
+	if req := request(make([]byte, nonceSize)); len(req) != requestSize {
+		t.Fatalf("request is %d bytes, want %d", len(req), requestSize)
+	}
+	for _, bad := range [][]byte{{1, 0, 0}, {0xff, 0xff, 0xff, 0x7f, 0, 0, 0, 0}} {
+		if _, err := decode(bad); err == nil {
+			t.Fatalf("decode(%x) accepted", bad)
+		}
+	}
+}
+
+func TestQueryVerifiesResponse(t *testing.T) {
+	server, _ := startTestServer(t, "a", 3*time.Second)
+	sample, err := Query(context.Background(), server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sample.Server != "a" || sample.Radius != time.Second {
+		t.Fatalf("sample = %+v", sample)
+	}
+	if sample.Offset < 2*time.Second || sample.Offset > 4*time.Second {
+		t.Fatalf("offset = %s, want about 3s", sample.Offset)
+	}
+}
+
+func TestQueryRejectsForgedResponses(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		corrupt func(message)
+		want    string
+	}{
+		{"wrong server key", func(m message) {
+			cert, _ := decode(m[tagCERT])
+			cert[tagSIG] = make([]byte, ed25519.SignatureSize)
+			m[tagCERT] = cert.encode()
+		}, "delegation signature"},
+		{"altered time", func(m message) {
+			srep, _ := decode(m[tagSREP])
+			srep[tagMIDP] = binary.LittleEndian.AppendUint64(nil, 0)
+			m[tagSREP] = srep.encode()
+		}, "response signature"},
+		{"other nonce", func(m message) {
+			m[tagINDX] = binary.LittleEndian.AppendUint32(nil, 0)
+		}, "Merkle tree"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			server, s := startTestServer(t, "a", 0)
+			s.corrupt = test.corrupt
+			_, err := Query(context.Background(), server)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("Query error = %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckUsesMedianAndQuorum(t *testing.T) {
+	a, _ := startTestServer(t, "a", time.Second)
+	b, _ := startTestServer(t, "b", 2*time.Second)
+	liar, _ := startTestServer(t, "liar", 24*time.Hour)
+	liar.PublicKey = a.PublicKey
+
+	m, err := Check(context.Background(), Policy{Servers: []Server{a, b, liar}, Quorum: 2, MaxSkew: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Samples) != 2 || len(m.Failures) != 1 || !strings.HasPrefix(m.Failures[0], "liar: ") {
+		t.Fatalf("measurement = %+v", m)
+	}
+	if m.Offset < time.Second || m.Offset > 2*time.Second {
+		t.Fatalf("offset = %s, want between the two honest servers", m.Offset)
+	}
+
+	if _, err := Check(context.Background(), Policy{Servers: []Server{a, liar}, Quorum: 2, MaxSkew: 5 * time.Second}); err == nil || !strings.Contains(err.Error(), "1 of 2 Roughtime servers answered") {
+		t.Fatalf("Check without quorum error = %v", err)
+	}
+
+	m, err = Check(context.Background(), Policy{Servers: []Server{a, b}, Quorum: 2, MaxSkew: 2 * time.Second})
+	if !errors.Is(err, ErrSkew) || m == nil {
+		t.Fatalf("Check beyond max skew = %+v, %v", m, err)
+	}
+}
+
+func TestCheckAccountsForUncertainty(t *testing.T) {
+	// The test servers sign a one second radius.
+	a, _ := startTestServer(t, "a", 0)
+	b, _ := startTestServer(t, "b", 500*time.Millisecond)
+
+	m, err := Check(context.Background(), Policy{Servers: []Server{a}, Quorum: 1, MaxSkew: 1200 * time.Millisecond})
+	if err != nil || m.Uncertainty < time.Second {
+		t.Fatalf("Check within the radius = %+v, %v", m, err)
+	}
+	if _, err := Check(context.Background(), Policy{Servers: []Server{b}, Quorum: 1, MaxSkew: 1200 * time.Millisecond}); !errors.Is(err, ErrSkew) {
+		t.Fatalf("Check with offset plus radius beyond max skew error = %v, want ErrSkew", err)
+	}
+	if _, err := Check(context.Background(), Policy{Servers: []Server{a}, Quorum: 1, MaxSkew: 500 * time.Millisecond}); err == nil || !strings.Contains(err.Error(), "uncertainty") {
+		t.Fatalf("Check with a radius beyond max skew error = %v, want the sample discarded", err)
+	}
+}
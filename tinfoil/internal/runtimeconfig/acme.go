@@ -0,0 +1,46 @@
+package runtimeconfig
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/url"
+)
+
+// ACME points the ACME tls-mode at a CA other than Let's Encrypt. The
+// external account binding credentials such CAs often require are secrets
+// and come from the external config.
+type ACME struct {
+	// DirectoryURL is the CA's ACME directory. It replaces the Let's
+	// Encrypt directory tls-env would select.
+	DirectoryURL string `yaml:"directory-url"`
+	// CACertificates are PEM certificates trusted, in addition to the
+	// system roots, for the directory's own TLS certificate.
+	CACertificates string `yaml:"ca-certificates,omitempty"`
+}
+
+// RootCAs returns the system roots extended by CACertificates, or nil when
+// there are none to add.
+func (a *ACME) RootCAs() (*x509.CertPool, error) {
+	if a.CACertificates == "" {
+		return nil, nil
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM([]byte(a.CACertificates)) {
+		return nil, fmt.Errorf("ca-certificates contains no PEM certificates")
+	}
+	return pool, nil
+}
+
+func (a *ACME) validate() error {
+	directory, err := url.Parse(a.DirectoryURL)
+	if err != nil || directory.Scheme != "https" || directory.Host == "" {
+		return fmt.Errorf("directory-url must be an HTTPS URL")
+	}
+	if _, err := a.RootCAs(); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package runtimeconfig
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+
+	shimconfig "tinfoil/internal/config"
+)
+
+// ExtensionsKey names the top-level runtime config section for features this
+// image defines outside the shared config schema. The section is covered by
+// the config hash like the rest of the document and is removed before the
+// shared decoder sees it.
+const ExtensionsKey = "extensions"
+
+type Extensions struct {
+	Shim shimconfig.Extensions `yaml:"shim,omitempty"`
+	Boot BootExtensions        `yaml:"boot,omitempty"`
+}
+
+// DecodeExtensions strictly decodes the extensions section of a runtime
+// config. A config without the section enables no extensions.
+func DecodeExtensions(data []byte) (*Extensions, error) {
+	_, section, err := splitExtensions(data)
+	if err != nil {
+		return nil, err
+	}
+	return decodeExtensionsSection(section)
+}
+
+func decodeExtensionsSection(section *yaml.Node) (*Extensions, error) {
+	var extensions Extensions
+	if section == nil {
+		return &extensions, nil
+	}
+	raw, err := yaml.Marshal(section)
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", ExtensionsKey, err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(raw))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&extensions); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("decoding %s: %w", ExtensionsKey, err)
+	}
+	if err := extensions.Shim.Validate(); err != nil {
+		return nil, fmt.Errorf("decoding %s.shim: %w", ExtensionsKey, err)
+	}
+	if err := extensions.Boot.Validate(); err != nil {
+		return nil, fmt.Errorf("decoding %s.boot: %w", ExtensionsKey, err)
+	}
+	return &extensions, nil
+}
+
+// splitExtensions returns data without its extensions section, and the
+// section itself. Input that is not a single mapping document is returned
+// unchanged so the shared decoder reports the error.
+func splitExtensions(data []byte) ([]byte, *yaml.Node, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	var document yaml.Node
+	if err := decoder.Decode(&document); err != nil {
+		return data, nil, nil
+	}
+	var trailing yaml.Node
+	if err := decoder.Decode(&trailing); err != io.EOF {
+		return data, nil, nil
+	}
+	if document.Kind != yaml.DocumentNode || len(document.Content) != 1 || document.Content[0].Kind != yaml.MappingNode {
+		return data, nil, nil
+	}
+	root := document.Content[0]
+	for index := 0; index+1 < len(root.Content); index += 2 {
+		if root.Content[index].Value != ExtensionsKey {
+			continue
+		}
+		section := root.Content[index+1]
+		root.Content = slices.Delete(root.Content, index, index+2)
+		stripped, err := yaml.Marshal(&document)
+		if err != nil {
+			return nil, nil, fmt.Errorf("decoding %s: %w", ExtensionsKey, err)
+		}
+		return stripped, section, nil
+	}
+	return data, nil, nil
+}
@@ -0,0 +1,149 @@
+package runtimeconfig
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestDecodeExtensions(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		yaml    string
+		enabled bool
+		want    string
+	}{
+		{name: "absent", yaml: validConfig},
+		{name: "anthropic messages", yaml: validConfig + "extensions:\n  shim:\n    anthropic-messages: true\n", enabled: true},
+		{name: "unknown extension", yaml: validConfig + "extensions:\n  shim:\n    typo: true\n", want: "field typo not found"},
+		{name: "unknown section", yaml: validConfig + "extensions:\n  egress: {}\n", want: "field egress not found"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			extensions, err := DecodeExtensions([]byte(test.yaml))
+			if test.want != "" {
+				if err == nil || !strings.Contains(err.Error(), test.want) {
+					t.Fatalf("DecodeExtensions error = %v, want %q", err, test.want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if extensions.Shim.AnthropicMessages != test.enabled {
+				t.Fatalf("anthropic-messages = %v, want %v", extensions.Shim.AnthropicMessages, test.enabled)
+			}
+		})
+	}
+}
+
+func TestDecodeExtensionsMinimumTCB(t *testing.T) {
+	extensions, err := DecodeExtensions([]byte(validConfig + `extensions:
+  boot:
+    minimum-tcb:
+      sev-snp:
+        reported: {bootloader: 10, snp: 23, microcode: 213}
+        committed: {snp: 22}
+      tdx:
+        tee-tcb-svn: "0d010400000000000000000000000000"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	minimum := extensions.Boot.MinimumTCB
+	if minimum == nil || minimum.SEVSNP == nil || minimum.TDX == nil {
+		t.Fatalf("minimum-tcb = %+v", minimum)
+	}
+	if want := (SEVSNPTCBParts{Bootloader: 10, SNP: 23, Microcode: 213}); minimum.SEVSNP.Reported != want {
+		t.Fatalf("reported = %+v, want %+v", minimum.SEVSNP.Reported, want)
+	}
+	if svn, err := minimum.TDX.SVN(); err != nil || svn[0] != 0x0d || svn[2] != 0x04 {
+		t.Fatalf("SVN() = %x, %v", svn, err)
+	}
+
+	for _, test := range []struct{ name, yaml, want string }{
+		{"short tdx svn", "tdx: {tee-tcb-svn: \"0d01\"}", "tee-tcb-svn must be 32 hex characters"},
+		{"non-hex tdx svn", "tdx: {tee-tcb-svn: \"zz010400000000000000000000000000\"}", "tee-tcb-svn must be 32 hex characters"},
+		{"out of range part", "sev-snp: {reported: {snp: 256}}", "cannot unmarshal"},
+		{"unknown part", "sev-snp: {reported: {ucode: 1}}", "field ucode not found"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := DecodeExtensions([]byte(validConfig + "extensions:\n  boot:\n    minimum-tcb: {" + test.yaml + "}\n"))
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("DecodeExtensions error = %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestSplitExtensionsRemovesSection(t *testing.T) {
+	data := []byte(validConfig + "extensions:\n  shim:\n    anthropic-messages: true\n")
+	stripped, section, err := splitExtensions(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if section == nil {
+		t.Fatal("extensions section not returned")
+	}
+	var remaining map[string]any
+	if err := yaml.Unmarshal(stripped, &remaining); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := remaining[ExtensionsKey]; ok {
+		t.Fatalf("extensions left in the shared config: %s", stripped)
+	}
+	if _, ok := remaining["containers"]; !ok {
+		t.Fatalf("shared config lost its containers: %s", stripped)
+	}
+
+	multiple := []byte(validConfig + "---\n" + validConfig)
+	if stripped, section, err := splitExtensions(multiple); err != nil || section != nil || string(stripped) != string(multiple) {
+		t.Fatal("multiple documents were not passed through for the shared decoder to reject")
+	}
+}
+
+func TestDecodeExtensionsACME(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+	extensions, err := DecodeExtensions([]byte(validConfig + "extensions:\n  boot:\n    acme:\n      directory-url: https://acme.corp.example/directory\n      ca-certificates: |\n" + indent(string(caPEM), "        ")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	acme := extensions.Boot.ACME
+	if acme == nil || acme.DirectoryURL != "https://acme.corp.example/directory" {
+		t.Fatalf("acme = %+v", acme)
+	}
+	roots, err := acme.RootCAs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Certificate().Verify(x509.VerifyOptions{Roots: roots}); err != nil {
+		t.Fatalf("ca-certificates not trusted: %v", err)
+	}
+
+	for _, test := range []struct{ name, yaml, want string }{
+		{"http directory", "{directory-url: \"http://acme.corp.example/directory\"}", "directory-url must be an HTTPS URL"},
+		{"bad ca", "{directory-url: \"https://acme.corp.example/directory\", ca-certificates: \"not pem\"}", "ca-certificates contains no PEM certificates"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := DecodeExtensions([]byte(validConfig + "extensions:\n  boot:\n    acme: " + test.yaml + "\n"))
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("DecodeExtensions error = %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+func indent(text, prefix string) string {
+	var out strings.Builder
+	for line := range strings.Lines(text) {
+		out.WriteString(prefix + line)
+	}
+	return out.String()
+}
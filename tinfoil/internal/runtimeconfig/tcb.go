@@ -0,0 +1,75 @@
+package runtimeconfig
+
+import (
+	"encoding/hex"
+	"fmt"
+)
+
+// BootExtensions configures tinfoil-boot features that this image defines
+// outside the shared config schema.
+type BootExtensions struct {
+	// MinimumTCB fails the cpu-attestation stage on hosts whose attested
+	// firmware is older than policy, so outdated hosts never serve.
+	MinimumTCB *MinimumTCB `yaml:"minimum-tcb,omitempty"`
+
+	// ACME selects the CA the certificate stage orders from in the ACME
+	// tls-mode.
+	ACME *ACME `yaml:"acme,omitempty"`
+}
+
+// MinimumTCB holds the minimum TCB per platform. A platform without an
+// entry is not checked.
+type MinimumTCB struct {
+	SEVSNP *MinimumSEVSNPTCB `yaml:"sev-snp,omitempty"`
+	TDX    *MinimumTDXTCB    `yaml:"tdx,omitempty"`
+}
+
+// MinimumSEVSNPTCB bounds the TCB versions of a SEV-SNP report. Reported
+// is the TCB the report claims to verifiers; Committed is the version the
+// firmware can no longer be rolled back below.
+type MinimumSEVSNPTCB struct {
+	Reported  SEVSNPTCBParts `yaml:"reported,omitempty"`
+	Committed SEVSNPTCBParts `yaml:"committed,omitempty"`
+}
+
+// SEVSNPTCBParts are the security patch levels of a SEV-SNP TCB_VERSION.
+// FMC only exists on Turin and later. Zero requires nothing.
+type SEVSNPTCBParts struct {
+	FMC        uint8 `yaml:"fmc,omitempty"`
+	Bootloader uint8 `yaml:"bootloader,omitempty"`
+	TEE        uint8 `yaml:"tee,omitempty"`
+	SNP        uint8 `yaml:"snp,omitempty"`
+	Microcode  uint8 `yaml:"microcode,omitempty"`
+}
+
+// MinimumTDXTCB bounds the TEE_TCB_SVN of a TDX quote, given as the 32 hex
+// characters of its 16 components. Each component is compared on its own.
+type MinimumTDXTCB struct {
+	TEETCBSVN string `yaml:"tee-tcb-svn"`
+}
+
+// SVN decodes TEETCBSVN.
+func (t *MinimumTDXTCB) SVN() ([16]byte, error) {
+	var svn [16]byte
+	decoded, err := hex.DecodeString(t.TEETCBSVN)
+	if err != nil || len(decoded) != len(svn) {
+		return svn, fmt.Errorf("tee-tcb-svn must be %d hex characters", 2*len(svn))
+	}
+	copy(svn[:], decoded)
+	return svn, nil
+}
+
+// Validate checks the settings that the YAML schema cannot express.
+func (b *BootExtensions) Validate() error {
+	if minimum := b.MinimumTCB; minimum != nil && minimum.TDX != nil {
+		if _, err := minimum.TDX.SVN(); err != nil {
+			return fmt.Errorf("minimum-tcb.tdx: %v", err)
+		}
+	}
+	if b.ACME != nil {
+		if err := b.ACME.validate(); err != nil {
+			return fmt.Errorf("acme: %v", err)
+		}
+	}
+	return nil
+}
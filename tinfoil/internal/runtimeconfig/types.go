@@ -1,6 +1,14 @@
 package runtimeconfig
 
-import sharedconfig "github.com/tinfoilsh/tinfoil-config"
+import (
+	"fmt"
+	"slices"
+
+	sharedconfig "github.com/tinfoilsh/tinfoil-config"
+
+	"tinfoil/internal/boot"
+	shimconfig "tinfoil/internal/config"
+)
 
 const (
 	ReservedDebugContainerName = sharedconfig.ReservedDebugContainerName
@@ -23,7 +31,25 @@ func options(debug bool) sharedconfig.Options {
 }
 
 func Decode(data []byte, debug bool) (*Config, error) {
-	return sharedconfig.Decode(data, options(debug))
+	shared, section, err := splitExtensions(data)
+	if err != nil {
+		return nil, err
+	}
+	extensions, err := decodeExtensionsSection(section)
+	if err != nil {
+		return nil, err
+	}
+	config, err := sharedconfig.Decode(shared, options(debug))
+	if err != nil {
+		return nil, err
+	}
+	if err := validateInboundPorts(config, &extensions.Shim); err != nil {
+		return nil, err
+	}
+	if err := validateL4Services(config, &extensions.Shim); err != nil {
+		return nil, fmt.Errorf("decoding %s.shim: %w", ExtensionsKey, err)
+	}
+	return config, nil
 }
 
 func Validate(config *Config, debug bool) error {
@@ -41,3 +67,30 @@ func ShimUpstreamSet(config *Config) bool {
 func HasReservedDebugContainer(config *Config) bool {
 	return sharedconfig.HasReservedDebugContainer(config)
 }
+
+// validateInboundPorts keeps workloads off the ports tinfoil-shim listens
+// on, including the load balancer health port when it is enabled.
+func validateInboundPorts(config *Config, extensions *shimconfig.Extensions) error {
+	for _, port := range config.CVMNetwork.InboundPorts {
+		if port == boot.ShimListenPort || (extensions.HealthPort != 0 && port == extensions.HealthPort) {
+			return fmt.Errorf("cvm-network: inbound port %d is served by tinfoil-shim", port)
+		}
+	}
+	return nil
+}
+
+// validateL4Services checks the L4 services against the rest of the config:
+// each must target a declared container, and the shim listens on their
+// ports itself, so Docker must not publish them too.
+func validateL4Services(config *Config, extensions *shimconfig.Extensions) error {
+	for _, service := range extensions.L4Services {
+		declared := slices.ContainsFunc(config.Containers, func(c Container) bool { return c.Name == service.Container })
+		if !declared {
+			return fmt.Errorf("l4-services %q: container %q is not declared", service.Name, service.Container)
+		}
+		if slices.Contains(config.CVMNetwork.InboundPorts, service.Port) {
+			return fmt.Errorf("l4-services %q: port %d is also a cvm-network inbound port", service.Name, service.Port)
+		}
+	}
+	return nil
+}
@@ -62,6 +62,8 @@ func TestDecodeValidatesRuntimeConfig(t *testing.T) {
 		{name: "valid top-level gpu count", yaml: strings.Replace(validConfig, "cvm-version: 0.11.0", "cvm-version: 0.11.0\ngpus: 2", 1) + "\n", want: ""},
 		{name: "unsupported capability", yaml: strings.Replace(validConfig, "networks: [app]", "networks: [app]\n    cap_add: [SETUID]", 1), want: "capability"},
 		{name: "model key exposed to container", yaml: strings.Replace(validConfig, "networks: [app]", "networks: [app]\n    secrets: [MODEL_KEY]", 1) + "\nmodels:\n  - name: private\n    key-secret: MODEL_KEY\n", want: "exposes models[0].key-secret"},
+		{name: "inbound 8080 without a health port", yaml: validConfig + "cvm-network:\n  inbound-ports: [9000, 8080]\n", want: ""},
+		{name: "inbound health port", yaml: validConfig + "cvm-network:\n  inbound-ports: [9000, 8080]\nextensions:\n  shim:\n    health-port: 8080\n", want: "inbound port 8080 is served by tinfoil-shim"},
 		{name: "invalid allowlist", yaml: strings.Replace(validConfig, "egress: closed", "egress: allowlist\n    allow: ['*.example.com']", 1), want: "wildcards"},
 	} {
 		t.Run(test.name, func(t *testing.T) {
@@ -7,19 +7,26 @@ import (
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
+	"maps"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"time"
 
+	"github.com/go-acme/lego/v4/acme"
+	"github.com/go-acme/lego/v4/acme/api"
 	"github.com/go-acme/lego/v4/certcrypto"
 	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/challenge"
 	"github.com/go-acme/lego/v4/challenge/http01"
+	"github.com/go-acme/lego/v4/challenge/resolver"
 	"github.com/go-acme/lego/v4/challenge/tlsalpn01"
 	"github.com/go-acme/lego/v4/lego"
-	"github.com/go-acme/lego/v4/providers/dns/cloudflare"
 	"github.com/go-acme/lego/v4/registration"
 	"log"
 )
@@ -50,93 +57,249 @@ type ChallengeMode string
 
 type CertManager struct {
 	config         *lego.Config
-	client         *lego.Client
+	certifier      *certificate.Certifier
 	cacheDir       string
 	certSigningKey *ecdsa.PrivateKey
 	domains        []string
 }
 
-func NewCertManager(
-	domains []string,
-	email, cacheDir, caDir string,
-	challengeMode ChallengeMode,
-	port int,
-	privateKey *ecdsa.PrivateKey,
-	cloudflareAuthToken, cloudflareZoneToken string,
-) (*CertManager, error) {
+// ACMEConfig selects the ACME directory and how each domain proves
+// control.
+type ACMEConfig struct {
+	DirectoryURL string
+	Email        string
+	// RootCAs verifies the directory's certificate; nil uses the system
+	// roots.
+	RootCAs *x509.CertPool
+	// EABKeyID and EABHMAC (base64url) bind the new account to an existing
+	// account at CAs that require external account binding.
+	EABKeyID string
+	EABHMAC  string
+
+	// Each domain proves control with its entry in DomainModes, or with
+	// ChallengeMode when it has none.
+	ChallengeMode ChallengeMode
+	DomainModes   map[string]ChallengeMode
+	// Port serves the HTTP-01 and TLS-ALPN-01 challenges.
+	Port int
+	// DNSProvider publishes DNS-01 records; required when any domain uses
+	// the dns mode.
+	DNSProvider challenge.Provider
+}
+
+// NewCertManager returns a manager obtaining one certificate for domains
+// from the ACME directory in cfg.
+func NewCertManager(domains []string, cacheDir string, privateKey *ecdsa.PrivateKey, cfg ACMEConfig) (*CertManager, error) {
 	if err := os.MkdirAll(cacheDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create cache directory: %w", err)
 	}
 
-	acmeUserPrivateKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	user, err := loadACMEAccount(cacheDir, cfg.DirectoryURL)
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate private key: %v", err)
+		log.Printf("Warning: ignoring saved ACME account: %v", err)
+	}
+	if user == nil {
+		acmeUserPrivateKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate private key: %v", err)
+		}
+		user = &acmeUser{Email: cfg.Email, key: acmeUserPrivateKey}
 	}
 
-	user := &acmeUser{Email: email, key: acmeUserPrivateKey}
+	httpClient := http.DefaultClient
+	if cfg.RootCAs != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: cfg.RootCAs}
+		httpClient = &http.Client{Transport: transport}
+	}
 	config := &lego.Config{
-		CADirURL:   caDir,
+		CADirURL:   cfg.DirectoryURL,
 		User:       user,
-		HTTPClient: http.DefaultClient,
+		HTTPClient: httpClient,
 		Certificate: lego.CertificateConfig{
 			KeyType: certcrypto.EC384,
 			Timeout: 30 * time.Second,
 		},
 	}
-	client, err := lego.NewClient(config)
+	var accountURI string
+	if user.Registration != nil {
+		accountURI = user.Registration.URI
+	}
+	// lego.Client picks one challenge type for every authorization of an
+	// order, so the client is assembled here with a resolver per mode.
+	core, err := api.New(config.HTTPClient, config.UserAgent, config.CADirURL, accountURI, user.key)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create lego client: %w", err)
+		return nil, fmt.Errorf("failed to create ACME client: %w", err)
 	}
+	byDomain := &domainResolver{modes: cfg.DomainModes, defaultMode: cfg.ChallengeMode, probers: map[ChallengeMode]*resolver.Prober{}}
+	for _, domain := range domains {
+		mode := byDomain.mode(domain)
+		if byDomain.probers[mode] != nil {
+			continue
+		}
+		solvers := resolver.NewSolversManager(core)
+		if err := setChallengeProvider(solvers, mode, cfg.Port, cfg.DNSProvider); err != nil {
+			return nil, err
+		}
+		byDomain.probers[mode] = resolver.NewProber(solvers)
+	}
+	certifier := certificate.NewCertifier(core, byDomain, certificate.CertifierOptions{
+		KeyType: config.Certificate.KeyType,
+		Timeout: config.Certificate.Timeout,
+	})
+	registrar := registration.NewRegistrar(core, user)
 
-	switch challengeMode {
+	// Only register if certificate doesn't exist in cache and no earlier
+	// attempt registered already
+	certFile := filepath.Join(cacheDir, "cert.pem")
+	switch _, statErr := os.Stat(certFile); {
+	case !os.IsNotExist(statErr):
+		log.Println("Certificate exists in cache, skipping ACME registration")
+	case user.Registration != nil:
+		log.Printf("Reusing ACME account %s", user.Registration.URI)
+	default:
+		var reg *registration.Resource
+		if cfg.EABKeyID != "" {
+			log.Printf("Registering ACME account with external account binding %s", cfg.EABKeyID)
+			reg, err = registrar.RegisterWithExternalAccountBinding(registration.RegisterEABOptions{
+				TermsOfServiceAgreed: true,
+				Kid:                  cfg.EABKeyID,
+				HmacEncoded:          cfg.EABHMAC,
+			})
+		} else {
+			log.Println("Registering ACME account")
+			reg, err = registrar.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to register account: %w", err)
+		}
+		user.Registration = reg
+		if err := saveACMEAccount(cacheDir, cfg.DirectoryURL, user); err != nil {
+			log.Printf("Warning: failed to save ACME account: %v", err)
+		}
+	}
+
+	return &CertManager{
+		domains:        domains,
+		config:         config,
+		certifier:      certifier,
+		cacheDir:       cacheDir,
+		certSigningKey: privateKey,
+	}, nil
+}
+
+// acmeAccountFile holds the registered ACME account in the cache
+// directory, so a retried or resumed boot reuses it instead of registering
+// again, which would also spend a single-use external account binding.
+const acmeAccountFile = "acme-account.json"
+
+type acmeAccount struct {
+	DirectoryURL string                 `json:"directory_url"`
+	Email        string                 `json:"email,omitempty"`
+	Key          []byte                 `json:"key"`
+	Registration *registration.Resource `json:"registration"`
+}
+
+// loadACMEAccount returns the account saved for directoryURL, or nil when
+// there is none.
+func loadACMEAccount(cacheDir, directoryURL string) (*acmeUser, error) {
+	data, err := os.ReadFile(filepath.Join(cacheDir, acmeAccountFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var account acmeAccount
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, fmt.Errorf("parsing ACME account: %w", err)
+	}
+	if account.DirectoryURL != directoryURL || account.Registration == nil {
+		return nil, nil
+	}
+	key, err := x509.ParseECPrivateKey(account.Key)
+	if err != nil {
+		return nil, fmt.Errorf("parsing ACME account key: %w", err)
+	}
+	return &acmeUser{Email: account.Email, Registration: account.Registration, key: key}, nil
+}
+
+func saveACMEAccount(cacheDir, directoryURL string, user *acmeUser) error {
+	key, err := x509.MarshalECPrivateKey(user.key)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(acmeAccount{
+		DirectoryURL: directoryURL,
+		Email:        user.Email,
+		Key:          key,
+		Registration: user.Registration,
+	})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(cacheDir, acmeAccountFile), data, 0600)
+}
+
+func setChallengeProvider(solvers *resolver.SolverManager, mode ChallengeMode, port int, dnsProvider challenge.Provider) error {
+	switch mode {
 	case ChallengeModeTLSALPN01:
-		if err := client.Challenge.SetTLSALPN01Provider(
+		if err := solvers.SetTLSALPN01Provider(
 			tlsalpn01.NewProviderServer("", fmt.Sprintf("%d", port)),
 		); err != nil {
-			return nil, fmt.Errorf("failed to set TLS-ALPN-01 provider: %w", err)
+			return fmt.Errorf("failed to set TLS-ALPN-01 provider: %w", err)
 		}
 	case ChallengeModeHTTP01:
 		// HTTP-01 challenge server listens on the same port as the main HTTPS server.
-		if err := client.Challenge.SetHTTP01Provider(
+		if err := solvers.SetHTTP01Provider(
 			http01.NewProviderServer("", fmt.Sprintf("%d", port)),
 		); err != nil {
-			return nil, fmt.Errorf("failed to set HTTP-01 provider: %w", err)
+			return fmt.Errorf("failed to set HTTP-01 provider: %w", err)
 		}
 	case ChallengeModeDNS01:
-		dnsConfig := cloudflare.NewDefaultConfig()
-		dnsConfig.AuthToken = cloudflareAuthToken
-		dnsConfig.ZoneToken = cloudflareZoneToken
-		dnsProvider, err := cloudflare.NewDNSProviderConfig(dnsConfig)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create Cloudflare DNS provider: %w", err)
+		if dnsProvider == nil {
+			return fmt.Errorf("dns challenge mode requires a DNS provider")
 		}
-		if err := client.Challenge.SetDNS01Provider(dnsProvider); err != nil {
-			return nil, fmt.Errorf("failed to set DNS-01 provider: %w", err)
+		if err := solvers.SetDNS01Provider(dnsProvider); err != nil {
+			return fmt.Errorf("failed to set DNS-01 provider: %w", err)
 		}
 	default:
-		return nil, fmt.Errorf("invalid challenge mode: %s", challengeMode)
+		return fmt.Errorf("invalid challenge mode: %s", mode)
 	}
+	return nil
+}
 
-	// Only register if certificate doesn't exist in cache
-	certFile := filepath.Join(cacheDir, "cert.pem")
-	if _, err := os.Stat(certFile); os.IsNotExist(err) {
-		log.Println("Registering ACME account")
-		reg, err := client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
-		if err != nil {
-			return nil, fmt.Errorf("failed to register account: %w", err)
-		}
-		user.Registration = reg
-	} else {
-		log.Println("Certificate exists in cache, skipping ACME registration")
+// domainResolver solves each authorization with the prober for its
+// domain's challenge mode. The modes are solved one after another because
+// the HTTP-01 and TLS-ALPN-01 servers share a port.
+type domainResolver struct {
+	modes       map[string]ChallengeMode
+	defaultMode ChallengeMode
+	probers     map[ChallengeMode]*resolver.Prober
+}
+
+func (r *domainResolver) mode(domain string) ChallengeMode {
+	if mode, ok := r.modes[domain]; ok {
+		return mode
 	}
+	return r.defaultMode
+}
 
-	return &CertManager{
-		domains:        domains,
-		config:         config,
-		client:         client,
-		cacheDir:       cacheDir,
-		certSigningKey: privateKey,
-	}, nil
+func (r *domainResolver) Solve(authorizations []acme.Authorization) error {
+	byMode := map[ChallengeMode][]acme.Authorization{}
+	for _, authz := range authorizations {
+		mode := r.mode(challenge.GetTargetedDomain(authz))
+		if r.probers[mode] == nil {
+			return fmt.Errorf("no %s solver for %s", mode, challenge.GetTargetedDomain(authz))
+		}
+		byMode[mode] = append(byMode[mode], authz)
+	}
+	for _, mode := range slices.Sorted(maps.Keys(byMode)) {
+		if err := r.probers[mode].Solve(byMode[mode]); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (m *CertManager) Certificate() (*tls.Certificate, error) {
@@ -153,7 +316,7 @@ func (m *CertManager) Certificate() (*tls.Certificate, error) {
 	}
 
 	log.Printf("Requesting certificate for: %v", m.domains)
-	certResource, err := m.client.Certificate.Obtain(certificate.ObtainRequest{
+	certResource, err := m.certifier.Obtain(certificate.ObtainRequest{
 		Domains:    m.domains,
 		Bundle:     true,
 		PrivateKey: m.certSigningKey,
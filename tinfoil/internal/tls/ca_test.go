@@ -0,0 +1,184 @@
+package tls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// acmeTestServer is an ACME directory that only creates accounts.
+type acmeTestServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	accounts []map[string]json.RawMessage
+}
+
+func startACMETestServer(t *testing.T) *acmeTestServer {
+	t.Helper()
+	s := &acmeTestServer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/directory", func(w http.ResponseWriter, r *http.Request) {
+		base := s.URL
+		json.NewEncoder(w).Encode(map[string]any{
+			"newNonce":   base + "/new-nonce",
+			"newAccount": base + "/new-account",
+			"newOrder":   base + "/new-order",
+			"revokeCert": base + "/revoke-cert",
+			"keyChange":  base + "/key-change",
+			"meta":       map[string]any{"externalAccountRequired": true},
+		})
+	})
+	mux.HandleFunc("/new-nonce", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/new-account", func(w http.ResponseWriter, r *http.Request) {
+		var account map[string]json.RawMessage
+		if err := decodeJWSPayload(r, &account); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		s.accounts = append(s.accounts, account)
+		s.mu.Unlock()
+		w.Header().Set("Replay-Nonce", "nonce")
+		w.Header().Set("Location", s.URL+"/account/1")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]any{"status": "valid"})
+	})
+	s.Server = httptest.NewTLSServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func decodeJWSPayload(r *http.Request, v any) error {
+	var jws struct {
+		Payload string `json:"payload"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return err
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(payload, v)
+}
+
+func (s *acmeTestServer) rootCAs() *x509.CertPool {
+	roots := x509.NewCertPool()
+	roots.AddCert(s.Certificate())
+	return roots
+}
+
+func TestNewCertManagerRegistersWithExternalAccountBinding(t *testing.T) {
+	server := startACMETestServer(t)
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewCertManager([]string{"node.example.com"}, t.TempDir(), key, ACMEConfig{
+		DirectoryURL:  server.URL + "/directory",
+		Email:         "ops@example.com",
+		RootCAs:       server.rootCAs(),
+		EABKeyID:      "kid-1",
+		EABHMAC:       base64.RawURLEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef")),
+		ChallengeMode: ChallengeModeHTTP01,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(server.accounts) != 1 {
+		t.Fatalf("%d accounts created, want 1", len(server.accounts))
+	}
+	binding, ok := server.accounts[0]["externalAccountBinding"]
+	if !ok {
+		t.Fatalf("account request has no externalAccountBinding: %v", server.accounts[0])
+	}
+	var eab struct {
+		Protected string `json:"protected"`
+	}
+	if err := json.Unmarshal(binding, &eab); err != nil {
+		t.Fatal(err)
+	}
+	protected, err := base64.RawURLEncoding.DecodeString(eab.Protected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(protected), `"kid":"kid-1"`) {
+		t.Fatalf("binding header = %s, want kid-1", protected)
+	}
+}
+
+func TestNewCertManagerReusesSavedAccount(t *testing.T) {
+	server := startACMETestServer(t)
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheDir := t.TempDir()
+	cfg := ACMEConfig{
+		DirectoryURL:  server.URL + "/directory",
+		RootCAs:       server.rootCAs(),
+		EABKeyID:      "kid-1",
+		EABHMAC:       base64.RawURLEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef")),
+		ChallengeMode: ChallengeModeHTTP01,
+	}
+	// A retried certificate stage builds a new manager each attempt; the
+	// single-use binding must only be spent once.
+	for range 2 {
+		if _, err := NewCertManager([]string{"node.example.com"}, cacheDir, key, cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(server.accounts) != 1 {
+		t.Fatalf("%d accounts created, want 1", len(server.accounts))
+	}
+	user, err := loadACMEAccount(cacheDir, cfg.DirectoryURL)
+	if err != nil || user == nil || user.Registration.URI != server.URL+"/account/1" {
+		t.Fatalf("saved account = %+v, %v", user, err)
+	}
+	if user, err := loadACMEAccount(cacheDir, "https://other.example/directory"); err != nil || user != nil {
+		t.Fatalf("account for another directory = %+v, %v", user, err)
+	}
+}
+
+func TestNewCertManagerRequiresTrustedDirectory(t *testing.T) {
+	server := startACMETestServer(t)
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewCertManager([]string{"node.example.com"}, t.TempDir(), key, ACMEConfig{
+		DirectoryURL:  server.URL + "/directory",
+		ChallengeMode: ChallengeModeHTTP01,
+	})
+	if err == nil {
+		t.Fatal("directory with an untrusted certificate was accepted")
+	}
+}
+
+func TestNewCertManagerDNSModeRequiresProvider(t *testing.T) {
+	server := startACMETestServer(t)
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewCertManager([]string{"node.example.com"}, t.TempDir(), key, ACMEConfig{
+		DirectoryURL:  server.URL + "/directory",
+		RootCAs:       server.rootCAs(),
+		ChallengeMode: ChallengeModeDNS01,
+	})
+	if want := "requires a DNS provider"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Fatalf("NewCertManager error = %v, want %q", err, want)
+	}
+}
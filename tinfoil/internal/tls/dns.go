@@ -0,0 +1,159 @@
+package tls
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/go-acme/lego/v4/providers/dns/cloudflare"
+	"github.com/go-acme/lego/v4/providers/dns/httpreq"
+	"github.com/miekg/dns"
+)
+
+const (
+	rfc2136TTL     = 120
+	rfc2136Timeout = 10 * time.Second
+)
+
+// NewCloudflareDNSProvider solves DNS-01 challenges through the Cloudflare
+// API.
+func NewCloudflareDNSProvider(authToken, zoneToken string) (challenge.Provider, error) {
+	config := cloudflare.NewDefaultConfig()
+	config.AuthToken = authToken
+	config.ZoneToken = zoneToken
+	provider, err := cloudflare.NewDNSProviderConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Cloudflare DNS provider: %w", err)
+	}
+	return provider, nil
+}
+
+// NewWebhookDNSProvider solves DNS-01 challenges by posting the record to
+// endpoint's /present and /cleanup paths, authenticated with HTTP basic
+// auth when username is set.
+func NewWebhookDNSProvider(endpoint, username, password string) (challenge.Provider, error) {
+	parsed, err := url.Parse(endpoint)
+	if err != nil || parsed.Scheme != "https" || parsed.Host == "" {
+		return nil, fmt.Errorf("DNS webhook endpoint must be an HTTPS URL")
+	}
+	config := httpreq.NewDefaultConfig()
+	config.Endpoint = parsed
+	config.Username = username
+	config.Password = password
+	provider, err := httpreq.NewDNSProviderConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create webhook DNS provider: %w", err)
+	}
+	return provider, nil
+}
+
+// RFC2136Config configures DNS-01 through RFC 2136 dynamic updates.
+type RFC2136Config struct {
+	// Nameserver receives the updates, as host or host:port.
+	Nameserver string
+	// Zone is the zone updated; empty asks Nameserver for the zone of each
+	// challenge record.
+	Zone string
+	// TSIGKey, TSIGSecret (base64) and TSIGAlgorithm sign the updates
+	// (RFC 8945). The algorithm defaults to hmac-sha256.
+	TSIGKey       string
+	TSIGSecret    string
+	TSIGAlgorithm string
+}
+
+var tsigAlgorithms = []string{dns.HmacSHA1, dns.HmacSHA224, dns.HmacSHA256, dns.HmacSHA384, dns.HmacSHA512}
+
+// NewRFC2136DNSProvider solves DNS-01 challenges with dynamic updates to
+// an authoritative nameserver. Unlike Cloudflare and the webhook it does
+// not wrap lego's provider: lego's rfc2136 package imports
+// github.com/bodgit/tsig/gss unconditionally, which links a Kerberos client
+// (gokrb5) into the measured tinfoil-boot binary for GSS-TSIG, a mode this
+// image never offers. Plain TSIG is all it needs, and miekg/dns signs that.
+func NewRFC2136DNSProvider(config RFC2136Config) (challenge.Provider, error) {
+	if config.Nameserver == "" {
+		return nil, fmt.Errorf("RFC 2136 nameserver is required")
+	}
+	if _, _, err := net.SplitHostPort(config.Nameserver); err != nil {
+		config.Nameserver = net.JoinHostPort(config.Nameserver, "53")
+	}
+	if config.Zone != "" {
+		config.Zone = dns.Fqdn(config.Zone)
+	}
+	if (config.TSIGKey == "") != (config.TSIGSecret == "") {
+		return nil, fmt.Errorf("RFC 2136 TSIG key and secret must be set together")
+	}
+	if config.TSIGKey != "" {
+		config.TSIGKey = dns.Fqdn(config.TSIGKey)
+		config.TSIGAlgorithm = dns.Fqdn(strings.ToLower(config.TSIGAlgorithm))
+		if config.TSIGAlgorithm == "." {
+			config.TSIGAlgorithm = dns.HmacSHA256
+		}
+		valid := false
+		for _, algorithm := range tsigAlgorithms {
+			valid = valid || config.TSIGAlgorithm == algorithm
+		}
+		if !valid {
+			return nil, fmt.Errorf("unsupported TSIG algorithm %q", strings.TrimSuffix(config.TSIGAlgorithm, "."))
+		}
+	}
+	return &rfc2136Provider{config: config}, nil
+}
+
+type rfc2136Provider struct {
+	config RFC2136Config
+}
+
+func (p *rfc2136Provider) Present(domain, _, keyAuth string) error {
+	info := dns01.GetChallengeInfo(domain, keyAuth)
+	if err := p.update(info.EffectiveFQDN, info.Value, true); err != nil {
+		return fmt.Errorf("rfc2136: adding %s: %w", info.EffectiveFQDN, err)
+	}
+	return nil
+}
+
+func (p *rfc2136Provider) CleanUp(domain, _, keyAuth string) error {
+	info := dns01.GetChallengeInfo(domain, keyAuth)
+	if err := p.update(info.EffectiveFQDN, info.Value, false); err != nil {
+		return fmt.Errorf("rfc2136: removing %s: %w", info.EffectiveFQDN, err)
+	}
+	return nil
+}
+
+func (p *rfc2136Provider) update(fqdn, value string, insert bool) error {
+	zone := p.config.Zone
+	if zone == "" {
+		var err error
+		if zone, err = dns01.FindZoneByFqdnCustom(fqdn, []string{p.config.Nameserver}); err != nil {
+			return err
+		}
+	}
+	record := &dns.TXT{
+		Hdr: dns.RR_Header{Name: fqdn, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: rfc2136TTL},
+		Txt: []string{value},
+	}
+	message := new(dns.Msg)
+	message.SetUpdate(zone)
+	if insert {
+		message.Insert([]dns.RR{record})
+	} else {
+		message.Remove([]dns.RR{record})
+	}
+	client := &dns.Client{Net: "tcp", Timeout: rfc2136Timeout}
+	if p.config.TSIGKey != "" {
+		message.SetTsig(p.config.TSIGKey, p.config.TSIGAlgorithm, 300, time.Now().Unix())
+		client.TsigSecret = map[string]string{p.config.TSIGKey: p.config.TSIGSecret}
+	}
+	reply, _, err := client.Exchange(message, p.config.Nameserver)
+	if err != nil {
+		return err
+	}
+	if reply.Rcode != dns.RcodeSuccess {
+		return errors.New(dns.RcodeToString[reply.Rcode])
+	}
+	return nil
+}
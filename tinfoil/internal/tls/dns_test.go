@@ -0,0 +1,154 @@
+package tls
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/miekg/dns"
+)
+
+// updateServer is an authoritative nameserver for example.com that
+// applies TSIG-signed dynamic updates to a TXT record set.
+type updateServer struct {
+	mu      sync.Mutex
+	records map[string][]string
+}
+
+func startUpdateServer(t *testing.T, keyName, secret string) (*updateServer, string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &updateServer{records: map[string][]string{}}
+	server := &dns.Server{
+		Listener:   listener,
+		TsigSecret: map[string]string{keyName: secret},
+		Handler:    dns.HandlerFunc(u.serve),
+		// The default accept function answers updates with NOTIMP.
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+	}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+	return u, listener.Addr().String()
+}
+
+func (u *updateServer) serve(w dns.ResponseWriter, r *dns.Msg) {
+	reply := new(dns.Msg)
+	reply.SetReply(r)
+	switch {
+	case r.Opcode != dns.OpcodeUpdate:
+		reply.Rcode = dns.RcodeNotImplemented
+	case r.IsTsig() == nil || w.TsigStatus() != nil:
+		reply.Rcode = dns.RcodeNotAuth
+	case len(r.Question) != 1 || r.Question[0].Name != "example.com.":
+		reply.Rcode = dns.RcodeNotZone
+	default:
+		u.mu.Lock()
+		for _, rr := range r.Ns {
+			txt, ok := rr.(*dns.TXT)
+			if !ok {
+				continue
+			}
+			if rr.Header().Class == dns.ClassNONE {
+				u.records[txt.Hdr.Name] = nil
+			} else {
+				u.records[txt.Hdr.Name] = append(u.records[txt.Hdr.Name], txt.Txt...)
+			}
+		}
+		u.mu.Unlock()
+		tsig := r.IsTsig()
+		reply.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, int64(tsig.TimeSigned))
+	}
+	w.WriteMsg(reply)
+}
+
+func (u *updateServer) txt(name string) []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.records[name]
+}
+
+func TestRFC2136ProviderPresentsAndCleansUp(t *testing.T) {
+	const secret = "c2VjcmV0LXNlY3JldC1zZWNyZXQtc2VjcmV0LXNlY3JldA=="
+	server, address := startUpdateServer(t, "acme-update.", secret)
+	provider, err := NewRFC2136DNSProvider(RFC2136Config{
+		Nameserver: address,
+		Zone:       "example.com",
+		TSIGKey:    "acme-update",
+		TSIGSecret: secret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := dns01.GetChallengeInfo("node.example.com", "token.thumbprint")
+	if err := provider.Present("node.example.com", "token", "token.thumbprint"); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.txt(info.EffectiveFQDN); len(got) != 1 || got[0] != info.Value {
+		t.Fatalf("TXT %s = %q, want %q", info.EffectiveFQDN, got, info.Value)
+	}
+	if err := provider.CleanUp("node.example.com", "token", "token.thumbprint"); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.txt(info.EffectiveFQDN); len(got) != 0 {
+		t.Fatalf("TXT %s = %q after cleanup", info.EffectiveFQDN, got)
+	}
+}
+
+func TestRFC2136ProviderRejectsWrongKey(t *testing.T) {
+	_, address := startUpdateServer(t, "acme-update.", "c2VjcmV0LXNlY3JldC1zZWNyZXQtc2VjcmV0LXNlY3JldA==")
+	provider, err := NewRFC2136DNSProvider(RFC2136Config{
+		Nameserver: address,
+		Zone:       "example.com.",
+		TSIGKey:    "acme-update",
+		TSIGSecret: "d3Jvbmctd3Jvbmctd3Jvbmctd3Jvbmctd3Jvbmc=",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = provider.Present("node.example.com", "token", "token.thumbprint")
+	if err == nil || !strings.Contains(err.Error(), "NOTAUTH") {
+		t.Fatalf("Present error = %v, want NOTAUTH", err)
+	}
+}
+
+func TestNewRFC2136DNSProviderValidates(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		config RFC2136Config
+		want   string
+	}{
+		{"no nameserver", RFC2136Config{}, "nameserver is required"},
+		{"key without secret", RFC2136Config{Nameserver: "ns1.example.com", TSIGKey: "k"}, "must be set together"},
+		{"unknown algorithm", RFC2136Config{Nameserver: "ns1.example.com", TSIGKey: "k", TSIGSecret: "cw==", TSIGAlgorithm: "hmac-md4"}, "unsupported TSIG algorithm"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewRFC2136DNSProvider(test.config)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("NewRFC2136DNSProvider error = %v, want %q", err, test.want)
+			}
+		})
+	}
+	provider, err := NewRFC2136DNSProvider(RFC2136Config{Nameserver: "ns1.example.com", TSIGKey: "k", TSIGSecret: "cw==", TSIGAlgorithm: "HMAC-SHA512"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := provider.(*rfc2136Provider).config
+	if config.Nameserver != "ns1.example.com:53" || config.TSIGAlgorithm != dns.HmacSHA512 {
+		t.Fatalf("config = %+v", config)
+	}
+}
+
+func TestNewWebhookDNSProviderRequiresHTTPS(t *testing.T) {
+	if _, err := NewWebhookDNSProvider("http://dns.example.com/hook", "", ""); err == nil {
+		t.Fatal("plain HTTP webhook accepted")
+	}
+	if _, err := NewWebhookDNSProvider("https://dns.example.com/hook", "user", "pass"); err != nil {
+		t.Fatal(err)
+	}
+}